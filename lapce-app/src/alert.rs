@@ -37,6 +37,9 @@ pub struct AlertBoxData {
     pub title: RwSignal<String>,
     pub msg: RwSignal<String>,
     pub buttons: RwSignal<Vec<AlertButton>>,
+    /// Run when the alert is cancelled, hidden or replaced by another one
+    /// instead of picking one of the buttons.
+    pub on_cancel: RwSignal<Option<Rc<dyn Fn()>>>,
     pub config: ReadSignal<Arc<LapceConfig>>,
 }
 
@@ -47,9 +50,20 @@ pub fn new(cx: Scope, common: Rc<CommonData>) -> Self {
             title: cx.create_rw_signal("".to_string()),
             msg: cx.create_rw_signal("".to_string()),
             buttons: cx.create_rw_signal(Vec::new()),
+            on_cancel: cx.create_rw_signal(None),
             config: common.config,
         }
     }
+
+    /// Runs and clears the `on_cancel` of an alert that was closed without
+    /// picking one of its buttons.
+    pub fn cancel(&self) {
+        let on_cancel = self.on_cancel.get_untracked();
+        self.on_cancel.set(None);
+        if let Some(on_cancel) = on_cancel {
+            on_cancel();
+        }
+    }
 }
 
 pub fn alert_box(alert_data: AlertBoxData) -> impl View {
@@ -118,6 +132,7 @@ pub fn alert_box(alert_data: AlertBoxData) -> impl View {
                 label(|| "Cancel".to_string())
                     .on_click_stop(move |_| {
                         active.set(false);
+                        alert_data.cancel();
                     })
                     .style(move |s| {
                         let config = config.get();
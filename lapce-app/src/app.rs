@@ -62,6 +62,7 @@
         CommandKind, InternalCommand, LapceCommand, LapceWorkbenchCommand,
         WindowCommand,
     },
+    completion::CompletionStatus,
     config::{
         color::LapceColor, icon::LapceIcons, watcher::ConfigWatcher, LapceConfig,
     },
@@ -79,7 +80,7 @@
     keypress::keymap::KeyMap,
     listener::Listener,
     main_split::{SplitContent, SplitData, SplitDirection, SplitMoveDirection},
-    markdown::MarkdownContent,
+    markdown::{from_documentation, MarkdownContent},
     palette::{
         item::{PaletteItem, PaletteItemContent},
         PaletteStatus,
@@ -2045,11 +2046,11 @@ fn palette_item(
         }
         PaletteItemContent::WorkspaceSymbol {
             kind,
-            name,
+            breadcrumb,
             location,
             ..
         } => {
-            let text = name.to_string();
+            let text = breadcrumb.to_string();
             let kind = *kind;
 
             let path = location.path.clone();
@@ -2705,7 +2706,7 @@ fn completion(window_tab_data: Rc<WindowTabData>) -> impl View {
     let active = completion_data.with_untracked(|c| c.active);
     let request_id =
         move || completion_data.with_untracked(|c| (c.request_id, c.input_id));
-    scroll(
+    let list = scroll(
         virtual_stack(
             VirtualDirection::Vertical,
             VirtualItemSize::Fixed(Box::new(move || {
@@ -2750,6 +2751,9 @@ fn completion(window_tab_data: Rc<WindowTabData>) -> impl View {
                             .min_width(0.0)
                             .align_items(Some(AlignItems::Center))
                             .size_full()
+                            .apply_if(item.deprecated, |s| {
+                                s.color(config.color(LapceColor::EDITOR_DIM))
+                            })
                             .apply_if(active.get() == i, |s| {
                                 s.background(
                                     config.color(LapceColor::COMPLETION_CURRENT),
@@ -2780,24 +2784,114 @@ fn completion(window_tab_data: Rc<WindowTabData>) -> impl View {
                 active as f64 * config.editor.line_height() as f64,
             ))
     })
-    .on_resize(move |rect| {
-        completion_data.update(|c| {
-            c.layout_rect = rect;
-        });
+    .style(|s| s.width_full().min_height(0.0));
+
+    // Tells that only the best items are shown when there are more
+    let truncated = label(move || {
+        let max_items = config.get().editor.max_completion_items;
+        format!("Showing the first {max_items} items")
     })
+    .style(move |s| {
+        let config = config.get();
+        s.padding_horiz(5.0)
+            .width_full()
+            .color(config.color(LapceColor::EDITOR_DIM))
+            .apply_if(!completion_data.with(|c| c.truncated), |s| s.hide())
+    });
+
+    stack((list, truncated))
+        .on_resize(move |rect| {
+            completion_data.update(|c| {
+                c.layout_rect = rect;
+            });
+        })
+        .on_event_stop(EventListener::PointerMove, |_| {})
+        .style(move |s| {
+            let config = config.get();
+            let origin = window_tab_data.completion_origin();
+            s.position(Position::Absolute)
+                .flex_col()
+                .width(400.0)
+                .max_height(400.0)
+                .margin_left(origin.x as f32)
+                .margin_top(origin.y as f32)
+                .background(config.color(LapceColor::COMPLETION_BACKGROUND))
+                .font_family(config.editor.font_family.clone())
+                .font_size(config.editor.font_size() as f32)
+                .border_radius(6.0)
+        })
+}
+
+/// The documentation of the active completion item, next to the completion list.
+fn completion_documentation(window_tab_data: Rc<WindowTabData>) -> impl View {
+    let completion_data = window_tab_data.common.completion;
+    let config = window_tab_data.common.config;
+    let active = completion_data.with_untracked(|c| c.active);
+    let id = AtomicU64::new(0);
+    let documentation = move || {
+        if !config.with(|config| config.editor.completion_show_documentation) {
+            return None;
+        }
+        let active = active.get();
+        completion_data.with(|c| {
+            if c.status == CompletionStatus::Inactive {
+                return None;
+            }
+            c.filtered_items
+                .get(active)
+                .and_then(|item| item.item.documentation.clone())
+        })
+    };
+
+    scroll(
+        dyn_stack(
+            move || {
+                documentation()
+                    .map(|documentation| {
+                        from_documentation(&documentation, 1.5, &config.get())
+                    })
+                    .unwrap_or_default()
+            },
+            move |_| id.fetch_add(1, std::sync::atomic::Ordering::Relaxed),
+            move |content| match content {
+                MarkdownContent::Text(text_layout) => container_box(
+                    rich_text(move || text_layout.clone())
+                        .style(|s| s.max_width(400.0)),
+                )
+                .style(|s| s.max_width_full()),
+                MarkdownContent::Image { .. } => container_box(empty()),
+                MarkdownContent::Separator => {
+                    container_box(empty().style(move |s| {
+                        s.width_full()
+                            .margin_vert(5.0)
+                            .height(1.0)
+                            .background(config.get().color(LapceColor::LAPCE_BORDER))
+                    }))
+                }
+            },
+        )
+        .style(|s| s.flex_col().padding_horiz(10.0).padding_vert(5.0)),
+    )
     .on_event_stop(EventListener::PointerMove, |_| {})
     .style(move |s| {
+        if documentation().is_none() {
+            return s.hide();
+        }
         let config = config.get();
         let origin = window_tab_data.completion_origin();
-        s.position(Position::Absolute)
-            .width(400.0)
+        let width = window_tab_data
+            .common
+            .completion
+            .with(|c| c.layout_rect.width());
+        s.absolute()
+            .max_width(420.0)
             .max_height(400.0)
-            .margin_left(origin.x as f32)
+            .margin_left((origin.x + width) as f32 + 5.0)
             .margin_top(origin.y as f32)
-            .background(config.color(LapceColor::COMPLETION_BACKGROUND))
-            .font_family(config.editor.font_family.clone())
-            .font_size(config.editor.font_size() as f32)
+            .border(1.0)
             .border_radius(6.0)
+            .border_color(config.color(LapceColor::LAPCE_BORDER))
+            .background(config.color(LapceColor::COMPLETION_BACKGROUND))
     })
 }
 
@@ -2940,6 +3034,7 @@ fn window_tab(window_tab_data: Rc<WindowTabData>) -> impl View {
         })
         .style(|s| s.size_full().flex_col()),
         completion(window_tab_data.clone()),
+        completion_documentation(window_tab_data.clone()),
         hover(window_tab_data.clone()),
         code_action(window_tab_data.clone()),
         rename(window_tab_data.clone()),
@@ -166,7 +166,7 @@ pub fn previous_page(&self) {
 
     pub fn show(
         &mut self,
-        code_actions: Arc<(PluginId, Vec<CodeActionOrCommand>)>,
+        code_actions: Arc<Vec<(PluginId, CodeActionOrCommand)>>,
         offset: usize,
         mouse_click: bool,
     ) {
@@ -176,11 +176,10 @@ pub fn show(
         self.mouse_click = mouse_click;
         self.request_id += 1;
         self.items = code_actions
-            .1
             .iter()
-            .map(|code_action| ScoredCodeActionItem {
+            .map(|(plugin_id, code_action)| ScoredCodeActionItem {
                 item: code_action.clone(),
-                plugin_id: code_actions.0,
+                plugin_id: *plugin_id,
                 score: 0,
                 indices: Vec::new(),
             })
@@ -14,7 +14,7 @@
     proxy::ProxyStatus,
     terminal::{TermId, TerminalProfile},
 };
-use lsp_types::{CodeActionOrCommand, Position, WorkspaceEdit};
+use lsp_types::{CodeActionOrCommand, Position, ShowMessageParams, WorkspaceEdit};
 use serde_json::Value;
 use strum::{EnumMessage, IntoEnumIterator};
 use strum_macros::{Display, EnumIter, EnumMessage, EnumString, IntoStaticStr};
@@ -523,6 +523,70 @@ pub enum LapceWorkbenchCommand {
     #[strum(serialize = "previous_error")]
     PreviousError,
 
+    #[strum(message = "Quick Fix")]
+    #[strum(serialize = "quick_fix")]
+    QuickFix,
+
+    #[strum(message = "Go to Implementation")]
+    #[strum(serialize = "go_to_implementation")]
+    GoToImplementation,
+
+    #[strum(message = "Expand Selection")]
+    #[strum(serialize = "expand_selection")]
+    ExpandSelection,
+
+    #[strum(message = "Convert Color")]
+    #[strum(serialize = "convert_color")]
+    ConvertColor,
+
+    #[strum(message = "Go to Declaration")]
+    #[strum(serialize = "go_to_declaration")]
+    GoToDeclaration,
+
+    #[strum(message = "Go to Definition in Dependency")]
+    #[strum(serialize = "go_to_moniker")]
+    GoToMoniker,
+
+    #[strum(message = "Show Call Hierarchy")]
+    #[strum(serialize = "show_call_hierarchy")]
+    ShowCallHierarchy,
+
+    #[strum(message = "Show Incoming Calls")]
+    #[strum(serialize = "show_incoming_calls")]
+    ShowIncomingCalls,
+
+    #[strum(message = "Show Outgoing Calls")]
+    #[strum(serialize = "show_outgoing_calls")]
+    ShowOutgoingCalls,
+
+    #[strum(message = "Fix All Diagnostics Like This One")]
+    #[strum(serialize = "fix_all_diagnostics")]
+    FixAllDiagnostics,
+
+    #[strum(message = "Format Selection")]
+    #[strum(serialize = "format_selection")]
+    FormatSelection,
+
+    #[strum(message = "Show Hover")]
+    #[strum(serialize = "show_hover")]
+    ShowHover,
+
+    #[strum(message = "Show Signature Help")]
+    #[strum(serialize = "show_signature_help")]
+    ShowSignatureHelp,
+
+    #[strum(message = "Toggle Fold")]
+    #[strum(serialize = "toggle_fold")]
+    ToggleFold,
+
+    #[strum(message = "Unfold All")]
+    #[strum(serialize = "unfold_all")]
+    UnfoldAll,
+
+    #[strum(message = "Run Code Lens")]
+    #[strum(serialize = "run_code_lens")]
+    RunCodeLens,
+
     #[strum(message = "Diff Files")]
     #[strum(serialize = "diff_files")]
     DiffFiles,
@@ -605,7 +669,8 @@ pub enum InternalCommand {
     ShowCodeActions {
         offset: usize,
         mouse_click: bool,
-        code_actions: Arc<(PluginId, Vec<CodeActionOrCommand>)>,
+        /// The actions with the server that offered each
+        code_actions: Arc<Vec<(PluginId, CodeActionOrCommand)>>,
     },
     RunCodeAction {
         plugin_id: PluginId,
@@ -672,6 +737,10 @@ pub enum InternalCommand {
         buttons: Vec<AlertButton>,
     },
     HideAlert,
+    ShowMessage {
+        title: String,
+        message: ShowMessageParams,
+    },
     SaveScratchDoc {
         doc: Rc<Doc>,
     },
@@ -1,4 +1,6 @@
-use std::{borrow::Cow, path::PathBuf, str::FromStr, sync::Arc};
+use std::{
+    borrow::Cow, collections::HashSet, path::PathBuf, str::FromStr, sync::Arc,
+};
 
 use floem::{
     peniko::kurbo::Rect,
@@ -6,17 +8,22 @@
     views::editor::{id::EditorId, text::Document},
 };
 use lapce_core::{
-    buffer::rope_text::RopeText, movement::Movement, rope_text_pos::RopeTextPosition,
+    buffer::rope_text::RopeText, language::LapceLanguage, movement::Movement,
+    rope_text_pos::RopeTextPosition,
 };
 use lapce_rpc::{plugin::PluginId, proxy::ProxyRpcHandler};
 use lsp_types::{
-    CompletionItem, CompletionResponse, CompletionTextEdit, InsertTextFormat,
-    Position,
+    CompletionContext, CompletionItem, CompletionItemTag, CompletionResponse,
+    CompletionTextEdit, CompletionTriggerKind, InsertTextFormat, Position,
 };
 use nucleo::Utf32Str;
 
 use crate::{config::LapceConfig, editor::EditorData, snippet::Snippet};
 
+/// The score bonus of items whose text starts with the input, over items that
+/// only match it somewhere in the middle.
+pub const ANCHOR_MATCH_BONUS: u32 = 200;
+
 #[derive(Clone, Copy, PartialEq, Eq)]
 pub enum CompletionStatus {
     Inactive,
@@ -31,6 +38,12 @@ pub struct ScoredCompletionItem {
     pub score: u32,
     pub label_score: u32,
     pub indices: Vec<usize>,
+    /// Whether the item is marked as deprecated, by either its `deprecated`
+    /// flag or its tags.
+    pub deprecated: bool,
+    /// Whether the item was already resolved, so that its documentation and
+    /// additional edits are complete.
+    pub resolved: bool,
 }
 
 #[derive(Clone)]
@@ -50,10 +63,16 @@ pub struct CompletionData {
     pub active: RwSignal<usize>,
     /// The current input that the user has typed which is being sent for consideration by the LSP
     pub input: String,
+    /// The servers that said their last items are incomplete, so that further
+    /// typing should request completions again instead of filtering them.
+    pub incomplete: HashSet<PluginId>,
     /// `(Input, CompletionItems)`
     pub input_items: im::HashMap<String, im::Vector<ScoredCompletionItem>>,
     /// The filtered items that are being displayed to the user
     pub filtered_items: im::Vector<ScoredCompletionItem>,
+    /// Whether the filtered items were cut to the configured maximum, so that only
+    /// the best matches are displayed.
+    pub truncated: bool,
     /// The size of the completion element.  
     /// This is used for positioning the element.  
     /// As well, it is needed for some movement commands like page up/down that need to know the
@@ -77,8 +96,10 @@ pub fn new(cx: Scope, config: ReadSignal<Arc<LapceConfig>>) -> Self {
             offset: 0,
             active,
             input: "".to_string(),
+            incomplete: HashSet::new(),
             input_items: im::HashMap::new(),
             filtered_items: im::Vector::new(),
+            truncated: false,
             layout_rect: Rect::ZERO,
             matcher: cx
                 .create_rw_signal(nucleo::Matcher::new(nucleo::Config::DEFAULT)),
@@ -101,19 +122,32 @@ pub fn receive(
             return;
         }
 
-        let items = match resp {
-            CompletionResponse::Array(items) => items,
-            // TODO: Possibly handle the 'is_incomplete' field on List.
-            CompletionResponse::List(list) => &list.items,
+        let (items, is_incomplete) = match resp {
+            CompletionResponse::Array(items) => (items, false),
+            CompletionResponse::List(list) => (&list.items, list.is_incomplete),
         };
+        if is_incomplete {
+            self.incomplete.insert(plugin_id);
+        } else {
+            self.incomplete.remove(&plugin_id);
+        }
+        let language = LapceLanguage::from_path(&self.path);
+        let blacklist = self
+            .config
+            .get_untracked()
+            .editor
+            .completion_blacklist(language.name());
         let items: im::Vector<ScoredCompletionItem> = items
             .iter()
+            .filter(|i| !blacklist.iter().any(|glob| glob.is_match(&i.label)))
             .map(|i| ScoredCompletionItem {
                 item: i.to_owned(),
                 plugin_id,
                 score: 0,
                 label_score: 0,
                 indices: Vec::new(),
+                deprecated: is_deprecated(i),
+                resolved: false,
             })
             .collect();
         self.input_items.insert(input.to_string(), items);
@@ -128,10 +162,30 @@ pub fn request(
         path: PathBuf,
         input: String,
         position: Position,
+        context: CompletionContext,
     ) {
         self.latest_editor_id = Some(editor_id);
         self.input_items.insert(input.clone(), im::Vector::new());
-        proxy_rpc.completion(self.request_id, path, input, position);
+        proxy_rpc.completion(self.request_id, path, input, position, context);
+    }
+
+    /// The context of a request for the completions of a changed input, after the
+    /// completion was started.
+    pub fn input_context(&self) -> CompletionContext {
+        let trigger_kind = if self.is_incomplete() {
+            CompletionTriggerKind::TRIGGER_FOR_INCOMPLETE_COMPLETIONS
+        } else {
+            CompletionTriggerKind::INVOKED
+        };
+        CompletionContext {
+            trigger_kind,
+            trigger_character: None,
+        }
+    }
+
+    /// Whether any server's items are incomplete.
+    pub fn is_incomplete(&self) -> bool {
+        !self.incomplete.is_empty()
     }
 
     /// Close the completion, clearing all the data.
@@ -144,8 +198,10 @@ pub fn cancel(&mut self) {
         self.latest_editor_id = None;
         self.active.set(0);
         self.input.clear();
+        self.incomplete.clear();
         self.input_items.clear();
         self.filtered_items.clear();
+        self.truncated = false;
     }
 
     pub fn update_input(&mut self, input: String) {
@@ -174,7 +230,7 @@ fn all_items(&self) -> im::Vector<ScoredCompletionItem> {
     pub fn filter_items(&mut self) {
         self.input_id += 1;
         if self.input.is_empty() {
-            self.filtered_items = self.all_items();
+            self.set_filtered_items(self.all_items());
             return;
         }
 
@@ -191,6 +247,7 @@ pub fn filter_items(&mut self) {
                     .filter_map(|i| {
                         let filter_text =
                             i.item.filter_text.as_ref().unwrap_or(&i.item.label);
+                        let anchor_match = is_anchor_match(filter_text, &self.input);
                         let shift = i
                             .item
                             .label
@@ -210,6 +267,11 @@ pub fn filter_items(&mut self) {
                                     *idx += shift as u32;
                                 }
                             }
+                            let score = if anchor_match {
+                                score + ANCHOR_MATCH_BONUS
+                            } else {
+                                score
+                            };
                             let mut item = i.clone();
                             item.score = score;
                             item.label_score = score;
@@ -237,6 +299,16 @@ pub fn filter_items(&mut self) {
                 .then_with(|| b.label_score.cmp(&a.label_score))
                 .then_with(|| a.item.label.len().cmp(&b.item.label.len()))
         });
+        self.set_filtered_items(items);
+    }
+
+    /// Display the items, keeping at most the configured number of them.
+    fn set_filtered_items(&mut self, mut items: im::Vector<ScoredCompletionItem>) {
+        let max_items = self.config.get_untracked().editor.max_completion_items;
+        self.truncated = max_items > 0 && items.len() > max_items;
+        if self.truncated {
+            items.truncate(max_items);
+        }
         self.filtered_items = items;
     }
 
@@ -290,6 +362,27 @@ pub fn previous_page(&mut self) {
         self.active.set(new);
     }
 
+    /// Replace an item with its resolved version, in both the received and the
+    /// displayed items.
+    pub fn resolve_item(
+        &mut self,
+        plugin_id: PluginId,
+        item: &CompletionItem,
+        resolved: CompletionItem,
+    ) {
+        let items = self
+            .input_items
+            .iter_mut()
+            .flat_map(|(_, items)| items.iter_mut())
+            .chain(self.filtered_items.iter_mut());
+        for i in items {
+            if i.plugin_id == plugin_id && &i.item == item {
+                i.item = resolved.clone();
+                i.resolved = true;
+            }
+        }
+    }
+
     /// The currently selected/active item.
     pub fn current_item(&self) -> Option<&ScoredCompletionItem> {
         self.filtered_items.get(self.active.get_untracked())
@@ -414,3 +507,22 @@ fn completion_lens_text(
         Some(Some(item.to_string()))
     }
 }
+
+/// Whether the item is marked as deprecated, either by the old `deprecated`
+/// flag or by the `Deprecated` tag.
+fn is_deprecated(item: &CompletionItem) -> bool {
+    item.deprecated == Some(true)
+        || item
+            .tags
+            .as_ref()
+            .map(|tags| tags.contains(&CompletionItemTag::DEPRECATED))
+            .unwrap_or(false)
+}
+
+/// Whether the text starts with the word, ignoring case.
+pub fn is_anchor_match(text: &str, word: &str) -> bool {
+    let mut text = text.chars().flat_map(char::to_lowercase);
+    word.chars()
+        .flat_map(char::to_lowercase)
+        .all(|c| text.next() == Some(c))
+}
@@ -1,3 +1,5 @@
+use std::collections::HashMap;
+
 use serde::{Deserialize, Serialize};
 use structdesc::FieldNames;
 
@@ -14,4 +16,44 @@ pub struct CoreConfig {
         desc = "Enable customised titlebar and disable OS native one (Linux, BSD, Windows)"
     )]
     pub custom_titlebar: bool,
+    #[field_names(
+        desc = "The local port to serve language server metrics on in the Prometheus format. If it's taken, another free port is used, which is written to the log. If 0, they are not served."
+    )]
+    pub metrics_port: u16,
+    #[field_names(
+        desc = "The interval in seconds of pinging language servers, which are restarted if they stop answering. If 0, they are not pinged."
+    )]
+    pub lsp_heartbeat_interval: u64,
+    #[field_names(
+        desc = "Log every message exchanged with the language servers to a trace file in the logs folder. `lapce-proxy --replay-trace <file>` replays one against the server and prints the answers that changed."
+    )]
+    pub lsp_trace: bool,
+    #[field_names(
+        desc = "How many seconds the language servers of a language may take to start, by language. Servers of other languages may take 30 seconds."
+    )]
+    pub lsp_startup_timeout: HashMap<String, u64>,
+    #[field_names(
+        desc = "Turn language server features on or off by their LSP method, e.g. \"textDocument/inlayHint\" = false. Features that aren't listed are on."
+    )]
+    pub lsp_features: HashMap<String, bool>,
+    #[field_names(
+        desc = "The environment variable holding an authentication token that is passed to the language servers of a language as `authToken` in their initialization options, by language."
+    )]
+    pub lsp_auth_token_env: HashMap<String, String>,
+    #[field_names(
+        desc = "The settings the language servers of a language are given when they ask for their configuration, by language."
+    )]
+    pub lsp_configuration: HashMap<String, serde_json::Value>,
+    #[field_names(
+        desc = "The files that mark the root folder of a project, by language. The language servers of a language are started at the closest parent folder of the workspace that contains one of them, or else at the outermost one of the open files. Go, Python and Rust use go.work, pyproject.toml and Cargo.toml unless configured."
+    )]
+    pub lsp_root_markers: HashMap<String, Vec<String>>,
+    #[field_names(
+        desc = "The oldest version of the language servers of a language that's known to work, by language. A warning is shown when an older one starts."
+    )]
+    pub lsp_min_versions: HashMap<String, String>,
+    #[field_names(
+        desc = "The flag the language servers of a language print their version with, by language. It's used to check their version against the minimum when they don't report it on startup. Defaults to --version."
+    )]
+    pub lsp_version_flags: HashMap<String, String>,
 }
@@ -1,4 +1,9 @@
+use std::collections::HashMap;
+
 use floem::views::editor::text::RenderWhitespace;
+use globset::{Glob, GlobMatcher};
+use lapce_rpc::proxy::FoldMarker;
+use lsp_types::{InlayHintKind, SymbolKind};
 use serde::{Deserialize, Serialize};
 use structdesc::FieldNames;
 
@@ -97,6 +102,14 @@ pub struct EditorConfig {
         desc = "If the editor should show the documentation of the current completion item"
     )]
     pub completion_show_documentation: bool,
+    #[field_names(
+        desc = "The characters that start a completion before any word is typed"
+    )]
+    pub completion_trigger_characters: String,
+    #[field_names(
+        desc = "The maximum number of completion items to show. Set to 0 for no limit."
+    )]
+    pub max_completion_items: usize,
     #[field_names(
         desc = "If the editor should show the signature of the function as the parameters are being typed"
     )]
@@ -125,6 +138,14 @@ pub struct EditorConfig {
         desc = "Whether it should format the document on save (if there is an available formatter)"
     )]
     pub format_on_save: bool,
+    #[field_names(
+        desc = "Wrap comment and string literal lines longer than this when formatting the document. Set to 0 to disable"
+    )]
+    pub format_max_line_length: usize,
+    #[field_names(
+        desc = "Whether finding the references of a symbol also lists its declaration"
+    )]
+    pub references_include_declaration: bool,
 
     #[field_names(desc = "If matching brackets are highlighted")]
     pub highlight_matching_brackets: bool,
@@ -134,6 +155,10 @@ pub struct EditorConfig {
 
     #[field_names(desc = "If inlay hints should be displayed")]
     pub enable_inlay_hints: bool,
+    #[field_names(
+        desc = "Kinds of inlay hints to display (\"type\", \"parameter\"), by language name. Languages not listed display all inlay hints."
+    )]
+    pub inlay_hint_kinds: HashMap<String, Vec<String>>,
 
     #[field_names(
         desc = "Set the inlay hint font family. If empty, it uses the editor font family."
@@ -145,6 +170,10 @@ pub struct EditorConfig {
     pub inlay_hint_font_size: usize,
     #[field_names(desc = "If diagnostics should be displayed inline")]
     pub enable_error_lens: bool,
+    #[field_names(
+        desc = "Only update the diagnostics of a file when it's saved, to hide the errors of unfinished edits"
+    )]
+    pub diagnostics_on_save: bool,
     #[field_names(
         desc = "Whether error lens should go to the end of view line, or only to the end of the diagnostic"
     )]
@@ -225,6 +254,26 @@ pub struct EditorConfig {
         desc = "Glob patterns for excluding files and folders (in file explorer)"
     )]
     pub files_exclude: String,
+    #[field_names(
+        desc = "Comma separated symbol kinds (\"function\", \"method\", \"variable\", ...) in order of priority. Workspace symbols that match equally well are sorted by this."
+    )]
+    pub workspace_symbol_kind_priority: String,
+    #[field_names(
+        desc = "Glob patterns of files that renaming a symbol doesn't change, e.g. generated code. The files that are skipped are listed in a warning."
+    )]
+    pub rename_exclude_patterns: Vec<String>,
+    #[field_names(
+        desc = "Custom folding regions, as regexes of the lines that start and end them, e.g. { start = \"^\\\\s*// region\", end = \"^\\\\s*// endregion\" }. They are folded along with the ranges of the language server."
+    )]
+    pub fold_markers: Vec<FoldMarker>,
+    #[field_names(
+        desc = "Glob patterns of completion item labels to hide, by language name"
+    )]
+    pub completion_blacklist: HashMap<String, Vec<String>>,
+    #[field_names(
+        desc = "List the files renaming a symbol changes, and only change them once the rename is confirmed"
+    )]
+    pub rename_preview: bool,
 }
 
 impl EditorConfig {
@@ -253,6 +302,63 @@ pub fn inlay_hint_font_size(&self) -> usize {
         }
     }
 
+    /// The kinds of inlay hints to display, `None` if all of them should be.
+    /// The inlay hint kinds to display for the given language, or `None` to
+    /// display all of them.
+    pub fn inlay_hint_kinds(&self, language: &str) -> Option<Vec<InlayHintKind>> {
+        let kinds: Vec<InlayHintKind> = self
+            .inlay_hint_kinds
+            .iter()
+            .filter(|(name, _)| name.eq_ignore_ascii_case(language))
+            .flat_map(|(_, kinds)| kinds.iter())
+            .filter_map(|kind| match kind.trim() {
+                "type" => Some(InlayHintKind::TYPE),
+                "parameter" => Some(InlayHintKind::PARAMETER),
+                _ => None,
+            })
+            .collect();
+        if kinds.is_empty() {
+            None
+        } else {
+            Some(kinds)
+        }
+    }
+
+    /// The priority of a workspace symbol kind, higher is better. Kinds that are
+    /// not listed in `workspace-symbol-kind-priority` have the lowest priority.
+    pub fn workspace_symbol_kind_priority(&self, kind: SymbolKind) -> usize {
+        let kinds: Vec<&str> = self
+            .workspace_symbol_kind_priority
+            .split(',')
+            .map(|kind| kind.trim())
+            .collect();
+        kinds
+            .iter()
+            .position(|name| symbol_kind_from_name(name) == Some(kind))
+            .map(|i| kinds.len() - i)
+            .unwrap_or(0)
+    }
+
+    /// The patterns of the files that renaming a symbol doesn't change.
+    pub fn rename_exclude_patterns(&self) -> Vec<GlobMatcher> {
+        self.rename_exclude_patterns
+            .iter()
+            .filter_map(|pattern| Glob::new(pattern).ok())
+            .map(|glob| glob.compile_matcher())
+            .collect()
+    }
+
+    /// The completion label patterns to hide for the given language.
+    pub fn completion_blacklist(&self, language: &str) -> Vec<GlobMatcher> {
+        self.completion_blacklist
+            .iter()
+            .filter(|(name, _)| name.eq_ignore_ascii_case(language))
+            .flat_map(|(_, patterns)| patterns.iter())
+            .filter_map(|pattern| Glob::new(pattern).ok())
+            .map(|glob| glob.compile_matcher())
+            .collect()
+    }
+
     pub fn error_lens_font_size(&self) -> usize {
         if self.error_lens_font_size == 0 {
             self.inlay_hint_font_size()
@@ -285,3 +391,36 @@ pub fn blink_interval(&self) -> u64 {
         self.blink_interval.max(200)
     }
 }
+
+pub fn symbol_kind_from_name(name: &str) -> Option<SymbolKind> {
+    let kind = match name {
+        "file" => SymbolKind::FILE,
+        "module" => SymbolKind::MODULE,
+        "namespace" => SymbolKind::NAMESPACE,
+        "package" => SymbolKind::PACKAGE,
+        "class" => SymbolKind::CLASS,
+        "method" => SymbolKind::METHOD,
+        "property" => SymbolKind::PROPERTY,
+        "field" => SymbolKind::FIELD,
+        "constructor" => SymbolKind::CONSTRUCTOR,
+        "enum" => SymbolKind::ENUM,
+        "interface" => SymbolKind::INTERFACE,
+        "function" => SymbolKind::FUNCTION,
+        "variable" => SymbolKind::VARIABLE,
+        "constant" => SymbolKind::CONSTANT,
+        "string" => SymbolKind::STRING,
+        "number" => SymbolKind::NUMBER,
+        "boolean" => SymbolKind::BOOLEAN,
+        "array" => SymbolKind::ARRAY,
+        "object" => SymbolKind::OBJECT,
+        "key" => SymbolKind::KEY,
+        "null" => SymbolKind::NULL,
+        "enum-member" => SymbolKind::ENUM_MEMBER,
+        "struct" => SymbolKind::STRUCT,
+        "event" => SymbolKind::EVENT,
+        "operator" => SymbolKind::OPERATOR,
+        "type-parameter" => SymbolKind::TYPE_PARAMETER,
+        _ => return None,
+    };
+    Some(kind)
+}
@@ -83,11 +83,7 @@ pub fn get_default_profile(
         ) else {
             return None;
         };
-        let workdir = if let Some(workdir) = &profile.workdir {
-            url::Url::parse(&workdir.display().to_string()).ok()
-        } else {
-            None
-        };
+        let workdir = profile.workdir.as_deref().map(lapce_rpc::file::path_to_uri);
 
         let profile = profile.clone();
 
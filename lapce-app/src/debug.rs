@@ -19,6 +19,7 @@
     proxy::ProxyResponse,
     terminal::TermId,
 };
+use lsp_types::InlineValue;
 use serde::{Deserialize, Serialize};
 
 use crate::{
@@ -638,3 +639,113 @@ fn test_update_count() {
         assert_eq!(root.children_expanded_count, 11);
     }
 }
+
+/// The text shown at the end of each line for the inline values a language
+/// server found, with the variables of the frame the debugger stopped in looked
+/// up by name. `text_of` gives the text of a range, which is the name when the
+/// server leaves it out.
+pub fn inline_value_lines(
+    values: &[InlineValue],
+    variables: &[Variable],
+    text_of: impl Fn(lsp_types::Range) -> String,
+) -> Vec<(usize, String)> {
+    let lookup = |name: String, case_sensitive: bool| {
+        variables
+            .iter()
+            .find(|variable| {
+                if case_sensitive {
+                    variable.name == name
+                } else {
+                    variable.name.eq_ignore_ascii_case(&name)
+                }
+            })
+            .map(|variable| format!("{name} = {}", variable.value))
+    };
+
+    let mut lines: BTreeMap<usize, Vec<String>> = BTreeMap::new();
+    for value in values {
+        let (range, text) = match value {
+            InlineValue::Text(value) => (value.range, Some(value.text.clone())),
+            InlineValue::VariableLookup(value) => {
+                let name = value
+                    .variable_name
+                    .clone()
+                    .unwrap_or_else(|| text_of(value.range));
+                (value.range, lookup(name, value.case_sensitive_lookup))
+            }
+            // Expressions would have to be evaluated by the debugger, so only
+            // the ones that are a variable of the frame are shown
+            InlineValue::EvaluatableExpression(value) => {
+                let name = value
+                    .expression
+                    .clone()
+                    .unwrap_or_else(|| text_of(value.range));
+                (value.range, lookup(name, true))
+            }
+        };
+        if let Some(text) = text {
+            let texts = lines.entry(range.start.line as usize).or_default();
+            if !texts.contains(&text) {
+                texts.push(text);
+            }
+        }
+    }
+    lines
+        .into_iter()
+        .map(|(line, texts)| (line, texts.join(", ")))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use lapce_rpc::dap_types::Variable;
+    use lsp_types::{
+        InlineValue, InlineValueEvaluatableExpression, InlineValueText,
+        InlineValueVariableLookup, Position, Range,
+    };
+
+    use super::inline_value_lines;
+
+    #[test]
+    fn test_inline_value_lines() {
+        let range = |line, start, end| {
+            Range::new(Position::new(line, start), Position::new(line, end))
+        };
+        let variable = |name: &str, value: &str| Variable {
+            name: name.to_string(),
+            value: value.to_string(),
+            ..Default::default()
+        };
+        let variables = [variable("count", "3"), variable("Name", "\"a\"")];
+        let values = [
+            InlineValue::Text(InlineValueText {
+                range: range(0, 0, 4),
+                text: "ok".to_string(),
+            }),
+            // The name is the text of the range when it's left out
+            InlineValue::VariableLookup(InlineValueVariableLookup {
+                range: range(1, 4, 9),
+                variable_name: None,
+                case_sensitive_lookup: true,
+            }),
+            InlineValue::VariableLookup(InlineValueVariableLookup {
+                range: range(1, 12, 16),
+                variable_name: Some("name".to_string()),
+                case_sensitive_lookup: false,
+            }),
+            // An expression that isn't a variable isn't shown
+            InlineValue::EvaluatableExpression(InlineValueEvaluatableExpression {
+                range: range(2, 0, 9),
+                expression: Some("count + 1".to_string()),
+            }),
+        ];
+        let lines = inline_value_lines(&values, &variables, |_| "count".to_string());
+        assert_eq!(
+            lines,
+            vec![
+                (0, "ok".to_string()),
+                (1, "count = 3, name = \"a\"".to_string()),
+            ]
+        );
+    }
+}
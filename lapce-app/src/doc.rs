@@ -2,7 +2,7 @@
     borrow::Cow,
     cell::RefCell,
     collections::HashMap,
-    ops::Range,
+    ops::{Range, RangeInclusive},
     path::{Path, PathBuf},
     rc::Rc,
     sync::{atomic, Arc},
@@ -56,14 +56,15 @@
     buffer::BufferId,
     plugin::PluginId,
     proxy::ProxyResponse,
-    style::{LineStyle, LineStyles, Style},
+    style::{LineStyle, LineStyles, SemanticStyles, Style},
 };
 use lapce_xi_rope::{
     spans::{Spans, SpansBuilder},
     Interval, Rope, RopeDelta, Transformer,
 };
 use lsp_types::{
-    CodeActionResponse, Diagnostic, DiagnosticSeverity, InlayHint, InlayHintLabel,
+    CodeActionResponse, CodeLens, Diagnostic, DiagnosticSeverity, FoldingRange,
+    FoldingRangeKind, InlayHint, InlayHintLabel, Position,
 };
 use serde::{Deserialize, Serialize};
 use smallvec::SmallVec;
@@ -84,6 +85,12 @@
 pub struct DiagnosticData {
     pub expanded: RwSignal<bool>,
     pub diagnostics: RwSignal<im::Vector<EditorDiagnostic>>,
+    /// Diagnostics published while the document had unsaved changes, which
+    /// are held back until it's saved if `diagnostics-on-save` is set
+    pub pending: RwSignal<Option<im::Vector<EditorDiagnostic>>>,
+    /// Whether the diagnostics were restored from a previous session and the
+    /// server hasn't confirmed them yet, which are shown faded
+    pub stale: RwSignal<bool>,
 }
 
 #[derive(Clone, Debug, PartialEq, Eq)]
@@ -162,6 +169,24 @@ pub struct Doc {
     semantic_styles: RwSignal<Option<Spans<Style>>>,
     /// Inlay hints for the document
     pub inlay_hints: RwSignal<Option<Spans<InlayHint>>>,
+    /// The lines that the current inlay hints were requested for
+    inlay_hint_lines: RwSignal<Option<(usize, usize)>>,
+    /// The first and last lines of the document visible in each editor of it,
+    /// which inlay hints are requested around
+    visible_lines: RwSignal<HashMap<EditorId, (usize, usize)>>,
+    /// The folding ranges of the document, with their kind (comment, imports
+    /// or region) so that collapsed ranges can be shown differently
+    pub folding_ranges: RwSignal<Vec<FoldingRange>>,
+    /// The code lenses of the language server for the document
+    pub code_lenses: RwSignal<Vec<CodeLens>>,
+    /// The plugin the code lenses are from, which runs their commands
+    pub code_lens_plugin: RwSignal<Option<PluginId>>,
+    /// The folded regions of the document, as the offsets of the starts of
+    /// their first and last lines, in order. Their first line stays visible.
+    pub folded: RwSignal<Vec<(usize, usize)>>,
+    /// The values of the variables the debugger is stopped with, as the text
+    /// shown at the end of each line that has some
+    pub inline_values: RwSignal<Vec<(usize, String)>>,
     /// Current completion lens text, if any.
     /// This will be displayed even on views that are not focused.
     pub completion_lens: RwSignal<Option<String>>,
@@ -220,6 +245,13 @@ pub fn new(
             ))),
             semantic_styles: cx.create_rw_signal(None),
             inlay_hints: cx.create_rw_signal(None),
+            inlay_hint_lines: cx.create_rw_signal(None),
+            visible_lines: cx.create_rw_signal(HashMap::new()),
+            folding_ranges: cx.create_rw_signal(Vec::new()),
+            code_lenses: cx.create_rw_signal(Vec::new()),
+            code_lens_plugin: cx.create_rw_signal(None),
+            folded: cx.create_rw_signal(Vec::new()),
+            inline_values: cx.create_rw_signal(Vec::new()),
             diagnostics,
             completion_lens: cx.create_rw_signal(None),
             completion_pos: cx.create_rw_signal((0, 0)),
@@ -271,9 +303,18 @@ pub fn new_content(
             ))),
             semantic_styles: cx.create_rw_signal(None),
             inlay_hints: cx.create_rw_signal(None),
+            inlay_hint_lines: cx.create_rw_signal(None),
+            visible_lines: cx.create_rw_signal(HashMap::new()),
+            folding_ranges: cx.create_rw_signal(Vec::new()),
+            code_lenses: cx.create_rw_signal(Vec::new()),
+            code_lens_plugin: cx.create_rw_signal(None),
+            folded: cx.create_rw_signal(Vec::new()),
+            inline_values: cx.create_rw_signal(Vec::new()),
             diagnostics: DiagnosticData {
                 expanded: cx.create_rw_signal(true),
                 diagnostics: cx.create_rw_signal(im::Vector::new()),
+                pending: cx.create_rw_signal(None),
+                stale: cx.create_rw_signal(false),
             },
             completion_lens: cx.create_rw_signal(None),
             completion_pos: cx.create_rw_signal((0, 0)),
@@ -318,9 +359,18 @@ pub fn new_history(
             ))),
             semantic_styles: cx.create_rw_signal(None),
             inlay_hints: cx.create_rw_signal(None),
+            inlay_hint_lines: cx.create_rw_signal(None),
+            visible_lines: cx.create_rw_signal(HashMap::new()),
+            folding_ranges: cx.create_rw_signal(Vec::new()),
+            code_lenses: cx.create_rw_signal(Vec::new()),
+            code_lens_plugin: cx.create_rw_signal(None),
+            folded: cx.create_rw_signal(Vec::new()),
+            inline_values: cx.create_rw_signal(Vec::new()),
             diagnostics: DiagnosticData {
                 expanded: cx.create_rw_signal(true),
                 diagnostics: cx.create_rw_signal(im::Vector::new()),
+                pending: cx.create_rw_signal(None),
+                stale: cx.create_rw_signal(false),
             },
             completion_lens: cx.create_rw_signal(None),
             completion_pos: cx.create_rw_signal((0, 0)),
@@ -468,6 +518,7 @@ pub fn init_content(&self, content: Rope) {
             self.init_parser();
             self.init_diagnostics();
             self.retrieve_head();
+            self.get_code_lens();
         });
     }
 
@@ -612,9 +663,11 @@ pub fn do_edit(
     pub fn apply_deltas(&self, deltas: &[(Rope, RopeDelta, InvalLines)]) {
         let rev = self.rev() - deltas.len() as u64;
         batch(|| {
-            for (i, (_, delta, inval)) in deltas.iter().enumerate() {
+            for (i, (before_text, delta, inval)) in deltas.iter().enumerate() {
                 self.update_styles(delta);
                 self.update_inlay_hints(delta);
+                self.update_folded(delta);
+                self.update_code_lenses(before_text, delta);
                 self.update_diagnostics(delta);
                 self.update_completion_lens(delta);
                 self.update_find_result(delta);
@@ -660,6 +713,7 @@ pub fn rev(&self) -> u64 {
             self.check_auto_save();
             self.get_semantic_styles();
             self.get_inlay_hints();
+            self.get_folding_ranges();
             self.find_result.reset();
             self.do_bracket_colorization();
         });
@@ -739,6 +793,22 @@ fn update_inlay_hints(&self, delta: &RopeDelta) {
         });
     }
 
+    /// Update the folded regions so they fold the same lines after an edit.
+    /// Regions whose lines were joined into one are unfolded.
+    fn update_folded(&self, delta: &RopeDelta) {
+        if self.folded.with_untracked(|folded| folded.is_empty()) {
+            return;
+        }
+        let mut transformer = Transformer::new(delta);
+        self.folded.update(|folded| {
+            for (start, end) in folded.iter_mut() {
+                *start = transformer.transform(*start, false);
+                *end = transformer.transform(*end, false);
+            }
+            folded.retain(|(start, end)| start < end);
+        });
+    }
+
     pub fn trigger_syntax_change(&self, edits: Option<SmallVec<[SyntaxEdit; 3]>>) {
         let (rev, text) =
             self.buffer.with_untracked(|b| (b.rev(), b.text().clone()));
@@ -820,6 +890,30 @@ fn get_semantic_styles(&self) {
 
         let (rev, len) = self.buffer.with_untracked(|b| (b.rev(), b.len()));
 
+        // The tokens of the visible lines of a large document are asked for
+        // first, so that they show before the ones of the whole document
+        let last_line = self.buffer.with_untracked(|b| b.last_line());
+        if last_line >= SEMANTIC_TOKENS_RANGE_LINES {
+            let (start_line, end_line) = self.visible_lines();
+            let range = lsp_types::Range {
+                start: Position::new(start_line as u32, 0),
+                end: Position::new(end_line as u32 + 1, 0),
+            };
+            let doc = self.clone();
+            let send = create_ext_action(self.scope, move |styles| {
+                doc.add_partial_semantic_styles(&styles);
+            });
+            self.common.proxy.get_semantic_tokens_range(
+                path.clone(),
+                range,
+                move |result| {
+                    if let Ok(ProxyResponse::GetSemanticTokens { styles }) = result {
+                        send(styles);
+                    }
+                },
+            );
+        }
+
         let syntactic_styles =
             self.syntax.with_untracked(|syntax| syntax.styles.clone());
 
@@ -861,12 +955,112 @@ fn get_semantic_styles(&self) {
         });
     }
 
-    /// Request inlay hints for the buffer from the LSP through the proxy.
+    /// Show the styles of semantic tokens that the server reported before the full
+    /// response, over the styles that are currently shown.
+    pub fn add_partial_semantic_styles(&self, styles: &SemanticStyles) {
+        if self.buffer.with_untracked(|b| b.rev()) != styles.rev {
+            return;
+        }
+
+        let mut styles_span = SpansBuilder::new(styles.len);
+        for style in styles.styles.iter() {
+            styles_span.add_span(
+                Interval::new(style.start, style.end),
+                style.style.clone(),
+            );
+        }
+        let styles = styles_span.build();
+
+        let current = self
+            .semantic_styles
+            .get_untracked()
+            .or_else(|| self.syntax.with_untracked(|syntax| syntax.styles.clone()));
+        let styles = if let Some(current) = current {
+            current.merge(&styles, |a, b| {
+                if let Some(b) = b {
+                    return b.clone();
+                }
+                a.clone()
+            })
+        } else {
+            styles
+        };
+        self.semantic_styles.set(Some(styles));
+        self.clear_style_cache();
+    }
+
+    /// Update the lines visible in an editor, requesting the inlay hints around
+    /// the lines visible in all editors if they aren't within the lines the
+    /// current ones were requested for.
+    pub fn update_viewport(
+        &self,
+        editor_id: EditorId,
+        start_line: usize,
+        end_line: usize,
+    ) {
+        let lines = (start_line, end_line);
+        if self
+            .visible_lines
+            .with_untracked(|visible| visible.get(&editor_id) == Some(&lines))
+        {
+            return;
+        }
+        self.visible_lines.update(|visible| {
+            visible.insert(editor_id, lines);
+        });
+
+        let covered = self
+            .inlay_hint_lines
+            .get_untracked()
+            .is_some_and(|(start, end)| start <= start_line && end_line <= end);
+        if !covered {
+            self.get_inlay_hints();
+        }
+    }
+
+    /// Forget the lines visible in an editor that no longer shows the document.
+    pub fn remove_viewport(&self, editor_id: EditorId) {
+        self.visible_lines.update(|visible| {
+            visible.remove(&editor_id);
+        });
+    }
+
+    /// The lines from the first to the last one visible in any editor.
+    fn visible_lines(&self) -> (usize, usize) {
+        self.visible_lines.with_untracked(|visible| {
+            let start = visible.values().map(|(start, _)| *start).min();
+            let end = visible.values().map(|(_, end)| *end).max();
+            start.zip(end).unwrap_or((0, 0))
+        })
+    }
+
+    /// Request inlay hints once the buffer hasn't changed and the view hasn't
+    /// scrolled for a moment, so that typing or scrolling doesn't send a request
+    /// for every keystroke.
     fn get_inlay_hints(&self) {
         if !self.loaded() {
             return;
         }
 
+        let rev = self.rev();
+        let visible_lines = self.visible_lines();
+        let doc = self.clone();
+        exec_after(Duration::from_millis(INLAY_HINTS_DELAY), move |_| {
+            let current_rev = doc
+                .buffer
+                .try_with_untracked(|b| b.as_ref().map(|b| b.rev()));
+            if current_rev == Some(rev) && doc.visible_lines() == visible_lines {
+                doc.request_inlay_hints();
+            }
+        });
+    }
+
+    /// Request inlay hints for the buffer from the LSP through the proxy.
+    fn request_inlay_hints(&self) {
+        if !self.loaded() {
+            return;
+        }
+
         let path =
             if let DocContent::File { path, .. } = self.content.get_untracked() {
                 path
@@ -878,40 +1072,283 @@ fn get_inlay_hints(&self) {
             .buffer
             .with_untracked(|b| (b.clone(), b.rev(), b.len()));
 
+        // The lines around the visible ones are included, so that scrolling
+        // a little doesn't need new hints
+        let (start_line, end_line) = self.visible_lines();
+        let start_line = start_line.saturating_sub(INLAY_HINTS_MARGIN);
+        let end_line = end_line + INLAY_HINTS_MARGIN;
+        let range = lsp_types::Range {
+            start: Position::new(start_line as u32, 0),
+            end: buffer
+                .offset_to_position(buffer.offset_of_line(end_line + 1).min(len)),
+        };
+
+        let language = self.syntax.with_untracked(|s| s.language);
+        let kinds = self
+            .common
+            .config
+            .get_untracked()
+            .editor
+            .inlay_hint_kinds(language.name());
+
         let doc = self.clone();
         let send = create_ext_action(self.scope, move |hints| {
             if doc.buffer.with_untracked(|b| b.rev()) == rev {
                 doc.inlay_hints.set(Some(hints));
+                doc.inlay_hint_lines.set(Some((start_line, end_line)));
                 doc.clear_text_cache();
             }
         });
 
-        self.common.proxy.get_inlay_hints(path, move |result| {
-            if let Ok(ProxyResponse::GetInlayHints { mut hints }) = result {
-                // Sort the inlay hints by their position, as the LSP does not guarantee that it will
-                // provide them in the order that they are in within the file
-                // as well, Spans does not iterate in the order that they appear
-                hints.sort_by(|left, right| left.position.cmp(&right.position));
-
-                let mut hints_span = SpansBuilder::new(len);
-                for hint in hints {
-                    let offset = buffer.offset_of_position(&hint.position).min(len);
-                    hints_span.add_span(
-                        Interval::new(offset, (offset + 1).min(len)),
-                        hint,
-                    );
+        self.common
+            .proxy
+            .get_inlay_hints(path, Some(range), move |result| {
+                if let Ok(ProxyResponse::GetInlayHints { mut hints }) = result {
+                    if let Some(kinds) = &kinds {
+                        hints.retain(|hint| {
+                            hint.kind
+                                .as_ref()
+                                .is_some_and(|kind| kinds.contains(kind))
+                        });
+                    }
+
+                    // Sort the inlay hints by their position, as the LSP does not guarantee that it will
+                    // provide them in the order that they are in within the file
+                    // as well, Spans does not iterate in the order that they appear
+                    hints.sort_by(|left, right| left.position.cmp(&right.position));
+
+                    let mut hints_span = SpansBuilder::new(len);
+                    for hint in hints {
+                        let offset =
+                            buffer.offset_of_position(&hint.position).min(len);
+                        hints_span.add_span(
+                            Interval::new(offset, (offset + 1).min(len)),
+                            hint,
+                        );
+                    }
+                    let hints = hints_span.build();
+                    send(hints);
+                }
+            });
+    }
+
+    /// Request folding ranges once the buffer hasn't changed for a moment, as
+    /// they are not needed until the user goes to fold something.
+    fn get_folding_ranges(&self) {
+        if !self.loaded() {
+            return;
+        }
+
+        let rev = self.rev();
+        let doc = self.clone();
+        exec_after(Duration::from_millis(FOLDING_RANGES_DELAY), move |_| {
+            let current_rev = doc
+                .buffer
+                .try_with_untracked(|b| b.as_ref().map(|b| b.rev()));
+            if current_rev == Some(rev) {
+                doc.request_folding_ranges();
+            }
+        });
+    }
+
+    /// Request the folding ranges for the buffer from the LSP through the proxy.
+    fn request_folding_ranges(&self) {
+        let path =
+            if let DocContent::File { path, .. } = self.content.get_untracked() {
+                path
+            } else {
+                return;
+            };
+
+        let rev = self.rev();
+        let doc = self.clone();
+        let send = create_ext_action(self.scope, move |ranges| {
+            if doc.rev() == rev {
+                doc.folding_ranges.set(ranges);
+            }
+        });
+
+        let markers = self
+            .common
+            .config
+            .get_untracked()
+            .editor
+            .fold_markers
+            .clone();
+        self.common
+            .proxy
+            .get_folding_ranges(path, markers, move |result| {
+                if let Ok(ProxyResponse::GetFoldingRanges { ranges }) = result {
+                    send(ranges);
                 }
-                let hints = hints_span.build();
-                send(hints);
+            });
+    }
+
+    /// Request the code lenses for the buffer from the LSP through the proxy.
+    /// They're fetched again by the proxy whenever the document is saved.
+    pub fn get_code_lens(&self) {
+        let path =
+            if let DocContent::File { path, .. } = self.content.get_untracked() {
+                path
+            } else {
+                return;
+            };
+
+        let doc = self.clone();
+        let send = create_ext_action(self.scope, move |(plugin_id, lenses)| {
+            doc.set_code_lenses(plugin_id, lenses);
+        });
+
+        self.common.proxy.get_code_lens(path, move |result| {
+            if let Ok(ProxyResponse::GetCodeLens { plugin_id, lenses }) = result {
+                send((plugin_id, lenses));
             }
         });
     }
 
+    /// Show the code lenses at the end of the lines they're for.
+    pub fn set_code_lenses(&self, plugin_id: PluginId, lenses: Vec<CodeLens>) {
+        self.code_lens_plugin.set(Some(plugin_id));
+        self.code_lenses.set(lenses);
+        self.clear_text_cache();
+    }
+
+    /// Move the code lenses to the lines their lines moved to in an edit, until
+    /// they're fetched again when the document is saved.
+    fn update_code_lenses(&self, before_text: &Rope, delta: &RopeDelta) {
+        if self.code_lenses.with_untracked(|lenses| lenses.is_empty()) {
+            return;
+        }
+        let mut transformer = Transformer::new(delta);
+        self.code_lenses.update(|lenses| {
+            self.buffer.with_untracked(|buffer| {
+                for lens in lenses.iter_mut() {
+                    let line = lens.range.start.line as usize;
+                    if line > before_text.line_of_offset(before_text.len()) {
+                        continue;
+                    }
+                    let offset = transformer
+                        .transform(before_text.offset_of_line(line), false);
+                    let new_line = buffer.line_of_offset(offset) as u32;
+                    let shift = new_line as i64 - lens.range.start.line as i64;
+                    lens.range.start.line = new_line;
+                    lens.range.end.line =
+                        (lens.range.end.line as i64 + shift).max(0) as u32;
+                }
+            });
+        });
+    }
+
+    /// The lines hidden by the folded regions, which are all the lines of each
+    /// region but the first.
+    pub fn folded_lines(&self) -> Vec<RangeInclusive<usize>> {
+        self.folded.with(|folded| {
+            self.buffer.with_untracked(|buffer| {
+                folded
+                    .iter()
+                    .map(|(start, end)| {
+                        (buffer.line_of_offset(*start), buffer.line_of_offset(*end))
+                    })
+                    .filter(|(start, end)| start < end)
+                    .map(|(start, end)| start + 1..=end)
+                    .collect()
+            })
+        })
+    }
+
+    /// Unfold the region that starts at or hides the line, or else fold the
+    /// innermost folding range that starts at or contains it.
+    pub fn toggle_fold(&self, line: usize) {
+        let buffer = self.buffer.get_untracked();
+        let folded = self.folded.with_untracked(|folded| {
+            folded.iter().position(|(start, end)| {
+                let lines =
+                    buffer.line_of_offset(*start)..=buffer.line_of_offset(*end);
+                lines.contains(&line)
+            })
+        });
+        if let Some(i) = folded {
+            self.folded.update(|folded| {
+                folded.remove(i);
+            });
+            self.clear_text_cache();
+            return;
+        }
+
+        let range = self.folding_ranges.with_untracked(|ranges| {
+            ranges
+                .iter()
+                .filter(|range| {
+                    range.start_line < range.end_line
+                        && (range.start_line..=range.end_line)
+                            .contains(&(line as u32))
+                })
+                .min_by_key(|range| range.end_line - range.start_line)
+                .cloned()
+        });
+        let Some(range) = range else {
+            return;
+        };
+        if range.end_line as usize > buffer.last_line() {
+            return;
+        }
+        let start = buffer.offset_of_line(range.start_line as usize);
+        let end = buffer.offset_of_line(range.end_line as usize);
+        self.folded.update(|folded| {
+            // The regions inside it are unfolded with it
+            folded.retain(|(s, e)| *e < start || *s > end);
+            let i = folded.partition_point(|(s, _)| *s < start);
+            folded.insert(i, (start, end));
+        });
+        self.clear_text_cache();
+    }
+
+    /// Unfold the regions that hide the line, e.g. when the cursor moves onto
+    /// it.
+    pub fn unfold_line(&self, line: usize) {
+        let hidden = self
+            .folded_lines()
+            .iter()
+            .any(|lines| lines.contains(&line));
+        if !hidden {
+            return;
+        }
+        let buffer = self.buffer.get_untracked();
+        self.folded.update(|folded| {
+            folded.retain(|(start, end)| {
+                let lines =
+                    buffer.line_of_offset(*start) + 1..=buffer.line_of_offset(*end);
+                !lines.contains(&line)
+            });
+        });
+        self.clear_text_cache();
+    }
+
+    pub fn unfold_all(&self) {
+        if self.folded.with_untracked(|folded| !folded.is_empty()) {
+            self.folded.set(Vec::new());
+            self.clear_text_cache();
+        }
+    }
+
+    /// Show the values of variables at the end of their lines while the
+    /// debugger is stopped, or stop showing them with none.
+    pub fn set_inline_values(&self, values: Vec<(usize, String)>) {
+        if values.is_empty() && self.inline_values.with_untracked(Vec::is_empty) {
+            return;
+        }
+        self.inline_values.set(values);
+        self.clear_text_cache();
+    }
+
     pub fn diagnostics(&self) -> &DiagnosticData {
         &self.diagnostics
     }
 
     /// Update the diagnostics' positions after an edit so that they appear in the correct place.
+    /// Diagnostics that lie within the edited lines are dropped, since they are most likely
+    /// outdated and the language server can take a while to publish new ones. Ones that also
+    /// span other lines, like those of a whole function, are only shifted.
     fn update_diagnostics(&self, delta: &RopeDelta) {
         if self
             .diagnostics
@@ -920,6 +1357,13 @@ fn update_diagnostics(&self, delta: &RopeDelta) {
         {
             return;
         }
+        let (iv, new_len) = delta.summary();
+        let (edit_start_line, edit_end_line) = self.buffer.with_untracked(|b| {
+            (
+                b.line_of_offset(iv.start()),
+                b.line_of_offset(iv.start() + new_len),
+            )
+        });
         self.diagnostics.diagnostics.update(|diagnostics| {
             for diagnostic in diagnostics.iter_mut() {
                 let mut transformer = Transformer::new(delta);
@@ -941,9 +1385,29 @@ fn update_diagnostics(&self, delta: &RopeDelta) {
                 diagnostic.diagnostic.range.start = new_start_pos;
                 diagnostic.diagnostic.range.end = new_end_pos;
             }
+            diagnostics.retain(|diagnostic| {
+                let range = diagnostic.diagnostic.range;
+                (range.start.line as usize) < edit_start_line
+                    || range.end.line as usize > edit_end_line
+            });
         });
     }
 
+    /// Show the diagnostics that were held back while the document had unsaved
+    /// changes.
+    pub fn show_pending_diagnostics(&self) {
+        if let Some(diagnostics) = self
+            .diagnostics
+            .pending
+            .try_update(|pending| pending.take())
+            .flatten()
+        {
+            self.diagnostics.stale.set(false);
+            self.diagnostics.diagnostics.set(diagnostics);
+            self.init_diagnostics();
+        }
+    }
+
     /// init diagnostics offset ranges from lsp positions
     pub fn init_diagnostics(&self) {
         self.clear_text_cache();
@@ -1285,6 +1749,7 @@ pub fn save(&self, after_action: impl Fn() + 'static) {
         if let DocContent::File { path, .. } = content {
             let rev = self.rev();
             let buffer = self.buffer;
+            let doc = self.clone();
             let send = create_ext_action(self.scope, move |result| {
                 if let Ok(ProxyResponse::SaveResponse {}) = result {
                     let current_rev = buffer.with_untracked(|buffer| buffer.rev());
@@ -1292,6 +1757,8 @@ pub fn save(&self, after_action: impl Fn() + 'static) {
                         buffer.update(|buffer| {
                             buffer.set_pristine();
                         });
+                        doc.show_pending_diagnostics();
+                        doc.get_inlay_hints();
                         after_action();
                     }
                 }
@@ -1576,7 +2043,12 @@ fn phantom_text(&self, line: usize) -> PhantomTextLine {
                         LapceColor::ERROR_LENS_OTHER_FOREGROUND
                     };
 
-                    config.color(theme_prop)
+                    let color = config.color(theme_prop);
+                    if self.diagnostics.stale.get_untracked() {
+                        color.with_alpha_factor(STALE_DIAGNOSTIC_ALPHA)
+                    } else {
+                        color
+                    }
                 };
 
                 let text = if config.editor.error_lens_multiline {
@@ -1599,6 +2071,78 @@ fn phantom_text(&self, line: usize) -> PhantomTextLine {
 
         text.append(&mut diag_text);
 
+        // A folded region is marked at the end of its first line, with the kind
+        // of range it is
+        let folded = self.folded.with_untracked(|folded| {
+            self.buffer.with_untracked(|buffer| {
+                folded
+                    .iter()
+                    .any(|(start, _)| buffer.line_of_offset(*start) == line)
+            })
+        });
+        if folded {
+            let kind = self.folding_ranges.with_untracked(|ranges| {
+                ranges
+                    .iter()
+                    .find(|range| range.start_line as usize == line)
+                    .and_then(|range| range.kind.clone())
+            });
+            let label = match kind {
+                Some(FoldingRangeKind::Comment) => " ⋯ comment ",
+                Some(FoldingRangeKind::Imports) => " ⋯ imports ",
+                _ => " ⋯ ",
+            };
+            text.push(PhantomText {
+                kind: PhantomTextKind::InlayHint,
+                col: end_offset - start_offset,
+                text: label.to_string(),
+                fg: Some(config.color(LapceColor::INLAY_HINT_FOREGROUND)),
+                font_size: Some(config.editor.inlay_hint_font_size()),
+                bg: Some(config.color(LapceColor::INLAY_HINT_BACKGROUND)),
+                under_line: None,
+            });
+        }
+
+        // The titles of the code lenses of the line are shown after it
+        let titles = self.code_lenses.with_untracked(|lenses| {
+            lenses
+                .iter()
+                .filter(|lens| lens.range.start.line as usize == line)
+                .filter_map(|lens| lens.command.as_ref())
+                .map(|command| command.title.as_str())
+                .join(" | ")
+        });
+        if !titles.is_empty() {
+            text.push(PhantomText {
+                kind: PhantomTextKind::InlayHint,
+                col: end_offset - start_offset,
+                text: format!("    {titles}"),
+                fg: Some(config.color(LapceColor::EDITOR_DIM)),
+                font_size: Some(config.editor.inlay_hint_font_size()),
+                bg: None,
+                under_line: None,
+            });
+        }
+
+        // The values of the variables of the line while the debugger is stopped
+        let values = self.inline_values.with_untracked(|values| {
+            values
+                .iter()
+                .find(|(value_line, _)| *value_line == line)
+                .map(|(_, values)| values.clone())
+        });
+        if let Some(values) = values {
+            text.push(PhantomText {
+                kind: PhantomTextKind::InlayHint,
+                col: end_offset - start_offset,
+                text: format!("    {values}"),
+                fg: Some(config.color(LapceColor::INLAY_HINT_FOREGROUND)),
+                font_size: Some(config.editor.inlay_hint_font_size()),
+                bg: None,
+                under_line: None,
+            });
+        }
+
         let (completion_line, completion_col) = self.completion_pos.get_untracked();
         let completion_text = config
             .editor
@@ -1713,6 +2257,26 @@ fn do_edit(
 /// Minimum width that we'll allow the view to be wrapped at.
 const MIN_WRAPPED_WIDTH: f32 = 100.0;
 
+/// How opaque diagnostics restored from a previous session are drawn, until
+/// the server confirms them.
+const STALE_DIAGNOSTIC_ALPHA: f32 = 0.5;
+
+/// How many milliseconds the buffer has to stay unchanged before inlay hints
+/// are requested for it.
+const INLAY_HINTS_DELAY: u64 = 200;
+
+/// How many lines a document has to have for the semantic tokens of its visible
+/// lines to be requested before the ones of the whole document.
+const SEMANTIC_TOKENS_RANGE_LINES: usize = 5000;
+
+/// How many lines above and below the visible ones inlay hints are requested
+/// for.
+const INLAY_HINTS_MARGIN: usize = 10;
+
+/// How many milliseconds the buffer has to stay unchanged before folding
+/// ranges are requested for it.
+const FOLDING_RANGES_DELAY: u64 = 300;
+
 #[derive(Clone)]
 pub struct DocStyling {
     config: ReadSignal<Arc<LapceConfig>>,
@@ -1907,6 +2471,7 @@ fn apply_layout_styles(&self, line: usize, layout_line: &mut TextLayoutLine) {
             });
         }
 
+        let stale = doc.diagnostics.stale.get_untracked();
         doc.diagnostics.diagnostics.with_untracked(|diags| {
             doc.buffer.with_untracked(|buffer| {
                 for diag in diags {
@@ -1944,6 +2509,11 @@ fn apply_layout_styles(&self, line: usize, layout_line: &mut TextLayoutLine) {
                             _ => LapceColor::LAPCE_WARN,
                         };
                         let color = config.color(color_name);
+                        let color = if stale {
+                            color.with_alpha_factor(STALE_DIAGNOSTIC_ALPHA)
+                        } else {
+                            color
+                        };
 
                         let styles = extra_styles_for_range(
                             layout,
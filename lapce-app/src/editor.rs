@@ -1,9 +1,14 @@
 use std::{
     collections::{HashMap, HashSet},
+    ops::RangeInclusive,
+    path::PathBuf,
     rc::Rc,
     str::FromStr,
-    sync::Arc,
-    time::Duration,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc,
+    },
+    time::{Duration, Instant},
 };
 
 use floem::{
@@ -30,14 +35,15 @@
     buffer::{
         diff::DiffLines,
         rope_text::{RopeText, RopeTextVal},
-        InvalLines,
+        Buffer, InvalLines,
     },
     command::{
         EditCommand, FocusCommand, MotionModeCommand, MultiSelectionCommand,
         ScrollCommand,
     },
-    cursor::{Cursor, CursorMode},
+    cursor::{Cursor, CursorAffinity, CursorMode},
     editor::EditType,
+    indent::IndentStyle,
     mode::{Mode, MotionMode},
     rope_text_pos::RopeTextPosition,
     selection::{InsertDrift, SelRegion, Selection},
@@ -45,8 +51,11 @@
 use lapce_rpc::{buffer::BufferId, plugin::PluginId, proxy::ProxyResponse};
 use lapce_xi_rope::{Rope, RopeDelta, Transformer};
 use lsp_types::{
-    CompletionItem, CompletionTextEdit, GotoDefinitionResponse, HoverContents,
-    InlineCompletionTriggerKind, Location, MarkedString, MarkupKind, TextEdit,
+    CallHierarchyItem, CodeActionOrCommand, ColorPresentation, CompletionContext,
+    CompletionItem, CompletionTextEdit, CompletionTriggerKind, Diagnostic,
+    DocumentHighlightKind, GotoDefinitionResponse, HoverContents,
+    InlineCompletionTriggerKind, Location, MarkedString, MessageType, MonikerKind,
+    Position, ShowMessageParams, TextEdit,
 };
 use serde::{Deserialize, Serialize};
 
@@ -57,12 +66,14 @@
     db::LapceDb,
     doc::{Doc, DocContent},
     editor_tab::EditorTabChild,
+    hover::{HoverRateLimiter, SignatureRequest},
     id::{DiffEditorId, EditorTabId},
     inline_completion::{InlineCompletionItem, InlineCompletionStatus},
     keypress::{condition::Condition, KeyPressFocus},
     main_split::{MainSplitData, SplitDirection, SplitMoveDirection},
     markdown::{
-        from_marked_string, from_plaintext, parse_markdown, MarkdownContent,
+        from_documentation, from_marked_string, from_markup_content, parse_markdown,
+        MarkdownContent,
     },
     proxy::path_from_url,
     snippet::Snippet,
@@ -200,8 +211,32 @@ pub struct EditorData {
     pub editor: Rc<Editor>,
     pub kind: RwSignal<EditorViewKind>,
     pub sticky_header_height: RwSignal<f64>,
+    pub hover_limiter: RwSignal<HoverRateLimiter>,
+    /// The occurrences of the symbol at the cursor, as their start and end
+    /// offsets and whether they are read or written
+    pub document_highlights:
+        RwSignal<Vec<(usize, usize, Option<DocumentHighlightKind>)>>,
+    /// The timer of the pending document highlights request, which moving the
+    /// cursor again replaces
+    document_highlight_timer: RwSignal<TimerToken>,
+    /// The selection ranges around the cursor, prefetched so that expanding
+    /// the selection doesn't have to wait for the language server
+    selection_ranges: RwSignal<Option<SelectionRangeCache>>,
+    /// The timer of the pending selection range request
+    selection_range_timer: RwSignal<TimerToken>,
     pub common: Rc<CommonData>,
 }
+
+/// The selection ranges around an offset, from the innermost to the outermost
+#[derive(Clone)]
+struct SelectionRangeCache {
+    /// The buffer revision the ranges were requested for
+    rev: u64,
+    /// The caret offset the ranges were requested for
+    offset: usize,
+    levels: Vec<(usize, usize)>,
+}
+
 impl PartialEq for EditorData {
     fn eq(&self, other: &Self) -> bool {
         self.id() == other.id()
@@ -231,6 +266,11 @@ fn new(
             editor: Rc::new(editor),
             kind: cx.create_rw_signal(EditorViewKind::Normal),
             sticky_header_height: cx.create_rw_signal(0.0),
+            hover_limiter: cx.create_rw_signal(HoverRateLimiter::default()),
+            document_highlights: cx.create_rw_signal(Vec::new()),
+            document_highlight_timer: cx.create_rw_signal(TimerToken::INVALID),
+            selection_ranges: cx.create_rw_signal(None),
+            selection_range_timer: cx.create_rw_signal(TimerToken::INVALID),
             common,
         }
     }
@@ -877,21 +917,25 @@ pub fn run_focus_command(
                 self.common.completion.update(|c| {
                     c.next();
                 });
+                self.resolve_active_completion();
             }
             FocusCommand::ListPrevious => {
                 self.common.completion.update(|c| {
                     c.previous();
                 });
+                self.resolve_active_completion();
             }
             FocusCommand::ListNextPage => {
                 self.common.completion.update(|c| {
                     c.next_page();
                 });
+                self.resolve_active_completion();
             }
             FocusCommand::ListPreviousPage => {
                 self.common.completion.update(|c| {
                     c.previous_page();
                 });
+                self.resolve_active_completion();
             }
             FocusCommand::ListSelect => {
                 self.select_completion();
@@ -971,6 +1015,9 @@ pub fn run_focus_command(
             FocusCommand::GotoDefinition => {
                 self.go_to_definition();
             }
+            FocusCommand::GotoTypeDefinition => {
+                self.go_to_type_definition();
+            }
             FocusCommand::ShowCodeActions => {
                 self.show_code_actions(false);
             }
@@ -1150,6 +1197,10 @@ enum DefinitionOrReferece {
             }
         });
         let proxy = self.common.proxy.clone();
+        let include_declaration = self
+            .common
+            .config
+            .with_untracked(|config| config.editor.references_include_declaration);
         self.common.proxy.get_definition(
             offset,
             path.clone(),
@@ -1159,27 +1210,17 @@ enum DefinitionOrReferece {
                     definition, ..
                 }) = result
                 {
-                    if let Some(location) = match definition {
-                        GotoDefinitionResponse::Scalar(location) => Some(location),
-                        GotoDefinitionResponse::Array(locations) => {
-                            if !locations.is_empty() {
-                                Some(locations[0].clone())
-                            } else {
-                                None
-                            }
-                        }
-                        GotoDefinitionResponse::Link(location_links) => {
-                            let location_link = location_links[0].clone();
-                            Some(Location {
-                                uri: location_link.target_uri,
-                                range: location_link.target_selection_range,
-                            })
-                        }
-                    } {
+                    let locations = goto_response_locations(definition);
+                    // A symbol with several definitions, e.g. a method of a
+                    // trait, lists all of them
+                    if locations.len() > 1 {
+                        send(DefinitionOrReferece::References(locations));
+                    } else if let Some(location) = locations.into_iter().next() {
                         if location.range.start == start_position {
                             proxy.get_references(
                                 path.clone(),
                                 position,
+                                include_declaration,
                                 move |result| {
                                     if let Ok(
                                         ProxyResponse::GetReferencesResponse {
@@ -1233,6 +1274,376 @@ enum DefinitionOrReferece {
         );
     }
 
+    /// Jump to the implementation of the symbol at the cursor, or list them
+    /// when there are several.
+    pub fn go_to_implementation(&self) {
+        let Some((path, offset, position)) = self.cursor_position() else {
+            return;
+        };
+        let send = self.jump_to_locations_action(
+            offset,
+            "Go to Implementation",
+            "No implementation found",
+        );
+        self.common
+            .proxy
+            .get_implementation(path, position, move |result| {
+                if let Ok(ProxyResponse::GetImplementation { locations }) = result {
+                    send(locations);
+                }
+            });
+    }
+
+    /// Jump to the definition of the type of the symbol at the cursor, or list
+    /// them when there are several.
+    fn go_to_type_definition(&self) {
+        let Some((path, offset, position)) = self.cursor_position() else {
+            return;
+        };
+        let send = self.jump_to_locations_action(
+            offset,
+            "Go to Type Definition",
+            "No type definition found",
+        );
+        self.common.proxy.get_type_definition(
+            offset,
+            path,
+            position,
+            move |result| {
+                if let Ok(ProxyResponse::GetTypeDefinition { definition, .. }) =
+                    result
+                {
+                    send(goto_response_locations(definition));
+                }
+            },
+        );
+    }
+
+    /// Jump to the declaration of the symbol at the cursor, or list them when
+    /// there are several. The definition is used instead when the server has
+    /// no declaration, which the user is told about.
+    pub fn go_to_declaration(&self) {
+        let Some((path, offset, position)) = self.cursor_position() else {
+            return;
+        };
+        let send = self.jump_to_locations_action(
+            offset,
+            "Go to Declaration",
+            "No declaration found",
+        );
+        let internal_command = self.common.internal_command;
+        let send_fallback = create_ext_action(self.scope, move |_| {
+            internal_command.send(InternalCommand::ShowMessage {
+                title: "Go to Declaration".to_string(),
+                message: ShowMessageParams {
+                    typ: MessageType::INFO,
+                    message: "Definition (no declaration available)".to_string(),
+                },
+            });
+        });
+        self.common
+            .proxy
+            .get_declaration(offset, path, position, move |result| {
+                if let Ok(ProxyResponse::GetDeclaration {
+                    declaration,
+                    fallback,
+                    ..
+                }) = result
+                {
+                    let locations = goto_response_locations(declaration);
+                    if fallback && !locations.is_empty() {
+                        send_fallback(());
+                    }
+                    send(locations);
+                }
+            });
+    }
+
+    /// Jump to the function at the cursor that calls can be listed for, or list
+    /// them when there are several.
+    pub fn show_call_hierarchy(&self) {
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let send = self.jump_to_locations_action(
+            offset,
+            "Show Call Hierarchy",
+            "No call hierarchy at the cursor",
+        );
+        self.prepare_call_hierarchy(move |_, items| {
+            send(
+                items
+                    .into_iter()
+                    .map(|item| Location {
+                        uri: item.uri,
+                        range: item.selection_range,
+                    })
+                    .collect(),
+            );
+        });
+    }
+
+    /// List the calls of the function at the cursor: where it's called from
+    /// when `incoming`, and otherwise the functions it calls.
+    pub fn show_calls(&self, incoming: bool) {
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let send = if incoming {
+            self.jump_to_locations_action(
+                offset,
+                "Show Incoming Calls",
+                "No calls to the function",
+            )
+        } else {
+            self.jump_to_locations_action(
+                offset,
+                "Show Outgoing Calls",
+                "No calls in the function",
+            )
+        };
+        let proxy = self.common.proxy.clone();
+        // The function at the cursor is the first prepared item
+        self.prepare_call_hierarchy(move |path, _| {
+            if incoming {
+                proxy.call_hierarchy_incoming(path, 0, move |result| {
+                    if let Ok(ProxyResponse::CallHierarchyIncoming { calls }) =
+                        result
+                    {
+                        send(
+                            calls
+                                .into_iter()
+                                .flat_map(|call| {
+                                    let uri = call.from.uri;
+                                    call.from_ranges.into_iter().map(move |range| {
+                                        Location {
+                                            uri: uri.clone(),
+                                            range,
+                                        }
+                                    })
+                                })
+                                .collect(),
+                        );
+                    }
+                });
+            } else {
+                proxy.call_hierarchy_outgoing(path, 0, move |result| {
+                    if let Ok(ProxyResponse::CallHierarchyOutgoing { calls }) =
+                        result
+                    {
+                        send(
+                            calls
+                                .into_iter()
+                                .map(|call| Location {
+                                    uri: call.to.uri,
+                                    range: call.to.selection_range,
+                                })
+                                .collect(),
+                        );
+                    }
+                });
+            }
+        });
+    }
+
+    /// Prepare the call hierarchy of the function at the cursor, and run `f`
+    /// with the path of the file and the prepared items, or tell the user that
+    /// there is none. Nothing happens if the cursor moved away since.
+    fn prepare_call_hierarchy(
+        &self,
+        f: impl FnOnce(PathBuf, Vec<CallHierarchyItem>) + 'static,
+    ) {
+        let Some((path, offset, position)) = self.cursor_position() else {
+            return;
+        };
+        let internal_command = self.common.internal_command;
+        let cursor = self.cursor().read_only();
+        let file = path.clone();
+        let send = create_ext_action(self.scope, move |items| {
+            if cursor.with_untracked(|c| c.offset()) != offset {
+                return;
+            }
+            match items {
+                Some(items) => f(file, items),
+                None => {
+                    internal_command.send(InternalCommand::ShowMessage {
+                        title: "Call Hierarchy".to_string(),
+                        message: ShowMessageParams {
+                            typ: MessageType::INFO,
+                            message: "No call hierarchy at the cursor".to_string(),
+                        },
+                    });
+                }
+            }
+        });
+        self.common
+            .proxy
+            .prepare_call_hierarchy(path, position, move |result| {
+                if let Ok(ProxyResponse::PrepareCallHierarchy { items }) = result {
+                    send(Some(items));
+                } else {
+                    send(None);
+                }
+            });
+    }
+
+    /// Jump to the definition of the symbol at the cursor in the dependency it's
+    /// from, which is found by resolving the moniker of the symbol.
+    pub fn go_to_moniker(&self) {
+        let Some((path, offset, position)) = self.cursor_position() else {
+            return;
+        };
+        let send = self.jump_to_locations_action(
+            offset,
+            "Go to Definition in Dependency",
+            "No definition found in the dependencies",
+        );
+        let proxy = self.common.proxy.clone();
+        self.common
+            .proxy
+            .get_monikers(path, position, move |result| {
+                let moniker = match result {
+                    Ok(ProxyResponse::GetMonikers { monikers }) => monikers
+                        .into_iter()
+                        .find(|moniker| moniker.kind != Some(MonikerKind::Local)),
+                    _ => None,
+                };
+                let Some(moniker) = moniker else {
+                    send(Vec::new());
+                    return;
+                };
+                proxy.go_to_moniker(offset, moniker, move |result| {
+                    if let Ok(ProxyResponse::GetDefinitionResponse {
+                        definition,
+                        ..
+                    }) = result
+                    {
+                        send(goto_response_locations(definition));
+                    } else {
+                        send(Vec::new());
+                    }
+                });
+            });
+    }
+
+    /// Write the color at the cursor in the next of the notations the language
+    /// server offers for it, e.g. to go from hex to `rgba()`.
+    pub fn convert_color(&self) {
+        let Some((path, _, position)) = self.cursor_position() else {
+            return;
+        };
+        let rev = self.doc().rev();
+        let editor = self.clone();
+        let send = create_ext_action(
+            self.scope,
+            move |(range, presentations): (
+                lsp_types::Range,
+                Vec<ColorPresentation>,
+            )| {
+                let doc = editor.doc();
+                if doc.rev() != rev {
+                    return;
+                }
+                let current = doc.buffer.with_untracked(|buffer| {
+                    let start = buffer.offset_of_position(&range.start);
+                    let end = buffer.offset_of_position(&range.end);
+                    buffer.slice_to_cow(start..end).to_string()
+                });
+                if let Some(edits) =
+                    color_presentation_edits(&presentations, &current, range)
+                {
+                    editor.do_text_edit(&edits);
+                }
+            },
+        );
+        let proxy = self.common.proxy.clone();
+        self.common
+            .proxy
+            .get_document_colors(path.clone(), move |result| {
+                let Ok(ProxyResponse::GetDocumentColors { colors }) = result else {
+                    return;
+                };
+                let Some(info) = colors.into_iter().find(|info| {
+                    info.range.start <= position && position <= info.range.end
+                }) else {
+                    return;
+                };
+                proxy.get_color_presentations(
+                    path,
+                    info.color,
+                    info.range,
+                    move |result| {
+                        if let Ok(ProxyResponse::GetColorPresentations {
+                            presentations,
+                        }) = result
+                        {
+                            send((info.range, presentations));
+                        }
+                    },
+                );
+            });
+    }
+
+    /// The path of the file and the offset and position of the cursor in it.
+    fn cursor_position(&self) -> Option<(PathBuf, usize, Position)> {
+        let doc = self.doc();
+        if !doc.loaded() {
+            return None;
+        }
+        let path = doc.content.with_untracked(|c| c.path().cloned())?;
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let position = doc
+            .buffer
+            .with_untracked(|buffer| buffer.offset_to_position(offset));
+        Some((path, offset, position))
+    }
+
+    /// An action that jumps to the only location it is given, lists the
+    /// locations when there are several, or tells the user that there are
+    /// none. Nothing happens if the cursor moved away from the offset since.
+    fn jump_to_locations_action(
+        &self,
+        offset: usize,
+        title: &'static str,
+        empty_message: &'static str,
+    ) -> impl FnOnce(Vec<Location>) + 'static {
+        let internal_command = self.common.internal_command;
+        let cursor = self.cursor().read_only();
+        create_ext_action(self.scope, move |locations: Vec<Location>| {
+            if cursor.with_untracked(|c| c.offset()) != offset {
+                return;
+            }
+
+            let mut locations: Vec<EditorLocation> = locations
+                .into_iter()
+                .map(|l| EditorLocation {
+                    path: path_from_url(&l.uri),
+                    position: Some(EditorPosition::Position(l.range.start)),
+                    scroll_offset: None,
+                    ignore_unconfirmed: false,
+                    same_editor_tab: false,
+                })
+                .collect();
+            match locations.len() {
+                0 => {
+                    internal_command.send(InternalCommand::ShowMessage {
+                        title: title.to_string(),
+                        message: ShowMessageParams {
+                            typ: MessageType::INFO,
+                            message: empty_message.to_string(),
+                        },
+                    });
+                }
+                1 => {
+                    internal_command.send(InternalCommand::JumpToLocation {
+                        location: locations.remove(0),
+                    });
+                }
+                _ => {
+                    internal_command.send(InternalCommand::PaletteReferences {
+                        references: locations,
+                    });
+                }
+            }
+        })
+    }
+
     fn scroll(&self, down: bool, count: usize, mods: ModifiersState) {
         self.editor.scroll(
             self.sticky_header_height.get_untracked(),
@@ -1353,9 +1764,20 @@ fn update_inline_completion(&self, trigger_kind: InlineCompletionTriggerKind) {
         }
 
         let path2 = path.clone();
+        let rev = doc.rev();
         let send = create_ext_action(
             self.scope,
             move |items: Vec<lsp_types::InlineCompletionItem>| {
+                // The buffer was edited while the request was in flight, so the
+                // ranges of the items no longer line up with the text.
+                if doc.rev() != rev {
+                    inline_completion.update(|c| {
+                        c.cancel();
+                        c.update_doc(&doc, offset);
+                    });
+                    return;
+                }
+
                 let items = doc.buffer.with_untracked(|buffer| {
                     items
                         .into_iter()
@@ -1409,7 +1831,7 @@ fn select_completion(&self) {
         self.cancel_completion();
         let doc = self.doc();
         if let Some(item) = item {
-            if item.item.data.is_some() {
+            if item.item.data.is_some() && !item.resolved {
                 let editor = self.clone();
                 let rev = doc.buffer.with_untracked(|buffer| buffer.rev());
                 let path = doc.content.with_untracked(|c| c.path().cloned());
@@ -1451,6 +1873,52 @@ fn select_completion(&self) {
         }
     }
 
+    /// Resolve the active completion item if it has no documentation, as
+    /// servers may leave it out of the list and only send it for the item that
+    /// is looked at.
+    pub fn resolve_active_completion(&self) {
+        if !self
+            .common
+            .config
+            .with_untracked(|config| config.editor.completion_show_documentation)
+        {
+            return;
+        }
+        let (request_id, item) = self
+            .common
+            .completion
+            .with_untracked(|c| (c.request_id, c.current_item().cloned()));
+        let item = match item {
+            Some(item) => item,
+            None => return,
+        };
+        if item.resolved
+            || item.item.data.is_none()
+            || item.item.documentation.is_some()
+        {
+            return;
+        }
+
+        let completion = self.common.completion;
+        let plugin_id = item.plugin_id;
+        let original = item.item.clone();
+        let send = create_ext_action(self.scope, move |resolved: CompletionItem| {
+            completion.update(|c| {
+                if c.request_id == request_id {
+                    c.resolve_item(plugin_id, &original, resolved);
+                }
+            });
+        });
+        self.common
+            .proxy
+            .completion_resolve(plugin_id, item.item, move |result| {
+                if let Ok(ProxyResponse::CompletionResolveResponse { item }) = result
+                {
+                    send(*item);
+                }
+            });
+    }
+
     pub fn cancel_completion(&self) {
         if self.common.completion.with_untracked(|c| c.status)
             == CompletionStatus::Inactive
@@ -1496,11 +1964,27 @@ fn update_completion(&self, display_if_empty_input: bool) {
             };
             (start_offset, input, char)
         });
-        if !display_if_empty_input && input.is_empty() && char != "." && char != ":"
-        {
+        let is_trigger_character = !char.is_empty()
+            && self.common.config.with_untracked(|config| {
+                config.editor.completion_trigger_characters.contains(&char)
+            });
+        if !display_if_empty_input && input.is_empty() && !is_trigger_character {
             self.cancel_completion();
             return;
         }
+        // The completions at the start of the word are triggered by the character
+        // before it, if that is a trigger character
+        let start_context = if is_trigger_character {
+            CompletionContext {
+                trigger_kind: CompletionTriggerKind::TRIGGER_CHARACTER,
+                trigger_character: Some(char),
+            }
+        } else {
+            CompletionContext {
+                trigger_kind: CompletionTriggerKind::INVOKED,
+                trigger_character: None,
+            }
+        };
 
         if self.common.completion.with_untracked(|completion| {
             completion.status != CompletionStatus::Inactive
@@ -1520,19 +2004,26 @@ fn update_completion(&self, display_if_empty_input: bool) {
                         path.clone(),
                         "".to_string(),
                         start_pos,
+                        start_context,
                     );
                 }
 
-                if !completion.input_items.contains_key(&input) {
+                // Incomplete items have to be requested again for every input, as
+                // filtering them could miss what the server didn't send yet
+                if completion.is_incomplete()
+                    || !completion.input_items.contains_key(&input)
+                {
                     let position = doc
                         .buffer
                         .with_untracked(|buffer| buffer.offset_to_position(offset));
+                    let context = completion.input_context();
                     completion.request(
                         self.id(),
                         &self.common.proxy,
                         path,
                         input,
                         position,
+                        context,
                     );
                 }
             });
@@ -1551,6 +2042,7 @@ fn update_completion(&self, display_if_empty_input: bool) {
             completion.offset = start_offset;
             completion.input = input.clone();
             completion.status = CompletionStatus::Started;
+            completion.incomplete.clear();
             completion.input_items.clear();
             completion.request_id += 1;
             let start_pos = doc
@@ -1562,18 +2054,21 @@ fn update_completion(&self, display_if_empty_input: bool) {
                 path.clone(),
                 "".to_string(),
                 start_pos,
+                start_context,
             );
 
             if !input.is_empty() {
                 let position = doc
                     .buffer
                     .with_untracked(|buffer| buffer.offset_to_position(offset));
+                let context = completion.input_context();
                 completion.request(
                     self.id(),
                     &self.common.proxy,
                     path,
                     input,
                     position,
+                    context,
                 );
             }
         });
@@ -1655,6 +2150,17 @@ fn apply_completion_item(&self, item: &CompletionItem) -> anyhow::Result<()> {
         let end_offset = buffer.next_code_boundary(offset);
         let selection = Selection::region(start_offset, end_offset);
 
+        if let (Some(insert_text), lsp_types::InsertTextFormat::SNIPPET) =
+            (item.insert_text.as_deref(), text_format)
+        {
+            return self.completion_apply_snippet(
+                insert_text,
+                &selection,
+                additional_edit,
+                start_offset,
+            );
+        }
+
         self.do_edit(
             &selection,
             &[
@@ -1696,7 +2202,7 @@ pub fn completion_apply_snippet(
 
         let mut transformer = Transformer::new(&delta);
         let offset = transformer.transform(start_offset, false);
-        let snippet_tabs = snippet.tabs(offset);
+        let snippet_tabs = snippet.ordered_tabs(offset);
 
         let doc = self.doc();
         if snippet_tabs.is_empty() {
@@ -1934,20 +2440,16 @@ pub fn get_code_actions(&self) {
             let position = buffer.offset_to_position(offset);
             let rev = doc.rev();
 
-            // Get the diagnostics for the current line, which the LSP might use to inform
+            // Get the diagnostics under the cursor, which the LSP might use to inform
             // what code actions are available (such as fixes for the diagnostics).
-            let diagnostics = doc
-                .diagnostics()
-                .diagnostics
-                .get_untracked()
-                .iter()
-                .map(|x| &x.diagnostic)
-                .filter(|x| {
-                    x.range.start.line <= position.line
-                        && x.range.end.line >= position.line
-                })
-                .cloned()
-                .collect();
+            let diagnostics = diagnostics_at(
+                doc.diagnostics()
+                    .diagnostics
+                    .get_untracked()
+                    .iter()
+                    .map(|x| &x.diagnostic),
+                position,
+            );
 
             (position, rev, diagnostics)
         });
@@ -1976,36 +2478,181 @@ pub fn get_code_actions(&self) {
         );
     }
 
-    pub fn show_code_actions(&self, mouse_click: bool) {
-        let offset = self.cursor().with_untracked(|c| c.offset());
+    /// Request the quick fixes at the cursor, running it straight away if the
+    /// servers only offer one between them, otherwise letting the user pick from
+    /// the list.
+    pub fn quick_fix(&self) {
         let doc = self.doc();
-        let code_actions = doc
-            .code_actions()
-            .with_untracked(|c| c.get(&offset).cloned());
-        if let Some(code_actions) = code_actions {
-            if !code_actions.1.is_empty() {
-                self.common.internal_command.send(
-                    InternalCommand::ShowCodeActions {
-                        offset,
-                        mouse_click,
-                        code_actions,
-                    },
-                );
-            }
-        }
-    }
-
-    fn do_save(&self, after_action: impl Fn() + 'static) {
-        self.doc().save(after_action);
-    }
+        let path = match if doc.loaded() {
+            doc.content.with_untracked(|c| c.path().cloned())
+        } else {
+            None
+        } {
+            Some(path) => path,
+            None => return,
+        };
 
-    pub fn save(
-        &self,
-        allow_formatting: bool,
-        after_action: impl Fn() + 'static + Copy,
-    ) {
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let (position, rev, diagnostics) = doc.buffer.with_untracked(|buffer| {
+            let position = buffer.offset_to_position(offset);
+            let rev = doc.rev();
+            let diagnostics = diagnostics_at(
+                doc.diagnostics()
+                    .diagnostics
+                    .get_untracked()
+                    .iter()
+                    .map(|x| &x.diagnostic),
+                position,
+            );
+            (position, rev, diagnostics)
+        });
+
+        let internal_command = self.common.internal_command;
+        let send = create_ext_action(
+            self.scope,
+            move |mut actions: Vec<(PluginId, CodeActionOrCommand)>| {
+                if doc.rev() != rev {
+                    return;
+                }
+                match actions.len() {
+                    0 => {}
+                    1 => {
+                        let (plugin_id, action) = actions.remove(0);
+                        internal_command.send(InternalCommand::RunCodeAction {
+                            plugin_id,
+                            action,
+                        });
+                    }
+                    _ => {
+                        internal_command.send(InternalCommand::ShowCodeActions {
+                            offset,
+                            mouse_click: false,
+                            code_actions: Arc::new(actions),
+                        });
+                    }
+                }
+            },
+        );
+
+        self.common.proxy.get_quick_fixes(
+            path,
+            position,
+            diagnostics,
+            move |result| {
+                if let Ok(ProxyResponse::GetQuickFixesResponse { actions }) = result
+                {
+                    send(actions)
+                }
+            },
+        );
+    }
+
+    /// Fix all the diagnostics of the document with the source and code of the
+    /// one at the cursor at once, with the first fix all action the servers
+    /// offer for them.
+    pub fn fix_all_diagnostics(&self) {
+        let doc = self.doc();
+        let path = match if doc.loaded() {
+            doc.content.with_untracked(|c| c.path().cloned())
+        } else {
+            None
+        } {
+            Some(path) => path,
+            None => return,
+        };
+
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let (rev, diagnostics) = doc.buffer.with_untracked(|buffer| {
+            let position = buffer.offset_to_position(offset);
+            let all = doc.diagnostics().diagnostics.get_untracked();
+            let all = all.iter().map(|x| &x.diagnostic);
+            let diagnostics = diagnostics_at(all.clone(), position)
+                .into_iter()
+                .next()
+                .map(|at_cursor| {
+                    all.filter(|d| {
+                        d.source == at_cursor.source && d.code == at_cursor.code
+                    })
+                    .cloned()
+                    .collect::<Vec<_>>()
+                })
+                .unwrap_or_default();
+            (doc.rev(), diagnostics)
+        });
+        if diagnostics.is_empty() {
+            return;
+        }
+
+        let internal_command = self.common.internal_command;
+        let send = create_ext_action(
+            self.scope,
+            move |mut actions: Vec<(PluginId, CodeActionOrCommand)>| {
+                if doc.rev() != rev {
+                    return;
+                }
+                if actions.is_empty() {
+                    internal_command.send(InternalCommand::ShowMessage {
+                        title: "Fix All".to_string(),
+                        message: ShowMessageParams {
+                            typ: MessageType::INFO,
+                            message: "No language server can fix all of these \
+                                      diagnostics at once"
+                                .to_string(),
+                        },
+                    });
+                    return;
+                }
+                let (plugin_id, action) = actions.remove(0);
+                internal_command
+                    .send(InternalCommand::RunCodeAction { plugin_id, action });
+            },
+        );
+
+        self.common
+            .proxy
+            .get_fix_all_actions(path, diagnostics, move |result| {
+                if let Ok(ProxyResponse::GetQuickFixesResponse { actions }) = result
+                {
+                    send(actions)
+                }
+            });
+    }
+
+    pub fn show_code_actions(&self, mouse_click: bool) {
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let doc = self.doc();
+        let code_actions = doc
+            .code_actions()
+            .with_untracked(|c| c.get(&offset).cloned());
+        if let Some(code_actions) = code_actions {
+            if !code_actions.1.is_empty() {
+                let (plugin_id, actions) = &*code_actions;
+                self.common.internal_command.send(
+                    InternalCommand::ShowCodeActions {
+                        offset,
+                        mouse_click,
+                        code_actions: Arc::new(
+                            actions
+                                .iter()
+                                .map(|action| (*plugin_id, action.clone()))
+                                .collect(),
+                        ),
+                    },
+                );
+            }
+        }
+    }
+
+    fn do_save(&self, after_action: impl Fn() + 'static) {
+        self.doc().save(after_action);
+    }
+
+    pub fn save(
+        &self,
+        allow_formatting: bool,
+        after_action: impl Fn() + 'static + Copy,
+    ) {
         let doc = self.doc();
-        let rev = doc.rev();
         let is_pristine = doc.is_pristine();
         let content = doc.content.get_untracked();
 
@@ -2025,27 +2672,9 @@ pub fn save(
             let format_on_save = allow_formatting && config.editor.format_on_save;
             if format_on_save {
                 let editor = self.clone();
-                let send = create_ext_action(self.scope, move |result| {
-                    if let Ok(Ok(ProxyResponse::GetDocumentFormatting { edits })) =
-                        result
-                    {
-                        let current_rev = editor.doc().rev();
-                        if current_rev == rev {
-                            editor.do_text_edit(&edits);
-                        }
-                    }
+                self.request_formatting(path, FORMATTING_RETRIES, move || {
                     editor.do_save(after_action);
                 });
-
-                let (tx, rx) = crossbeam_channel::bounded(1);
-                let proxy = self.common.proxy.clone();
-                std::thread::spawn(move || {
-                    proxy.get_document_formatting(path, move |result| {
-                        let _ = tx.send(result);
-                    });
-                    let result = rx.recv_timeout(std::time::Duration::from_secs(1));
-                    send(result);
-                });
             } else {
                 self.do_save(after_action);
             }
@@ -2053,33 +2682,188 @@ pub fn save(
     }
 
     pub fn format(&self) {
+        let content = self.doc().content.get_untracked();
+        if let DocContent::File { path, .. } = content {
+            self.request_formatting(path, FORMATTING_RETRIES, || {});
+        }
+    }
+
+    /// Format the first selected range, or the whole document if nothing is
+    /// selected. The edits are dropped if the text has changed since.
+    pub fn format_selection(&self) {
         let doc = self.doc();
-        let rev = doc.rev();
-        let content = doc.content.get_untracked();
+        let Some(path) = doc
+            .content
+            .with_untracked(|content| content.path().cloned())
+        else {
+            return;
+        };
+        let (range, rev) = doc.buffer.with_untracked(|buffer| {
+            let region = self
+                .cursor()
+                .with_untracked(|c| c.edit_selection(buffer))
+                .first()
+                .cloned()
+                .filter(|region| !region.is_caret());
+            let range = region.map(|region| lsp_types::Range {
+                start: buffer.offset_to_position(region.min()),
+                end: buffer.offset_to_position(region.max()),
+            });
+            (range, buffer.rev())
+        });
+        let Some(range) = range else {
+            self.format();
+            return;
+        };
 
-        if let DocContent::File { path, .. } = content {
-            let editor = self.clone();
-            let send = create_ext_action(self.scope, move |result| {
-                if let Ok(Ok(ProxyResponse::GetDocumentFormatting { edits })) =
-                    result
-                {
-                    let current_rev = editor.doc().rev();
-                    if current_rev == rev {
-                        editor.do_text_edit(&edits);
-                    }
+        let editor = self.clone();
+        let send = create_ext_action(self.scope, move |result| {
+            if let Ok(ProxyResponse::GetDocumentFormatting { edits }) = result {
+                if editor.doc().rev() == rev {
+                    editor.do_text_edit(&edits);
                 }
-            });
+            }
+        });
+        let (tab_size, insert_spaces) = self.formatting_indent();
+        self.common.proxy.get_range_formatting(
+            path,
+            range,
+            tab_size,
+            insert_spaces,
+            |result| {
+                send(result);
+            },
+        );
+    }
+
+    /// Format the document and then run `after_action`. Edits computed for
+    /// text that has changed since, or that don't fit the current text, are
+    /// dropped and formatting is requested again for the current text, up to
+    /// `retries` times.
+    fn request_formatting(
+        &self,
+        path: PathBuf,
+        retries: usize,
+        after_action: impl FnOnce() + 'static,
+    ) {
+        let rev = self.doc().rev();
+        let editor = self.clone();
+        let retry_path = path.clone();
+        let send = create_ext_action(self.scope, move |result| {
+            if let Ok(Ok(ProxyResponse::GetDocumentFormatting { edits })) = result {
+                let doc = editor.doc();
+                let current = doc.rev() == rev
+                    && doc.buffer.with_untracked(|buffer| {
+                        edits.iter().all(|edit| {
+                            position_in_bounds(buffer, &edit.range.start)
+                                && position_in_bounds(buffer, &edit.range.end)
+                        })
+                    });
+                if current {
+                    editor.do_text_edit(&edits);
+                } else if retries > 0 {
+                    editor.request_formatting(retry_path, retries - 1, after_action);
+                    return;
+                }
+            }
+            after_action();
+        });
 
-            let (tx, rx) = crossbeam_channel::bounded(1);
-            let proxy = self.common.proxy.clone();
-            std::thread::spawn(move || {
-                proxy.get_document_formatting(path, move |result| {
+        let (tx, rx) = crossbeam_channel::bounded(1);
+        let proxy = self.common.proxy.clone();
+        let config = self.common.config.get_untracked();
+        let (tab_size, insert_spaces) = self.formatting_indent();
+        let max_line_length = config.editor.format_max_line_length;
+        std::thread::spawn(move || {
+            proxy.get_document_formatting(
+                path.clone(),
+                tab_size,
+                insert_spaces,
+                max_line_length,
+                move |result| {
+                    let _ = tx.send(result);
+                },
+            );
+            let mut result = rx.recv_timeout(std::time::Duration::from_secs(1));
+            // The edits are trimmed down to the text that they change, so that
+            // the cursors in the unchanged text stay where they are
+            if let Ok(Ok(ProxyResponse::GetDocumentFormatting { edits })) = &result {
+                let (tx, rx) = crossbeam_channel::bounded(1);
+                proxy.apply_text_edits(path, edits.clone(), move |result| {
                     let _ = tx.send(result);
                 });
-                let result = rx.recv_timeout(std::time::Duration::from_secs(1));
-                send(result);
-            });
+                if let Ok(Ok(ProxyResponse::ApplyTextEdits { edits, .. })) =
+                    rx.recv_timeout(std::time::Duration::from_secs(1))
+                {
+                    result = Ok(Ok(ProxyResponse::GetDocumentFormatting { edits }));
+                }
+            }
+            send(result);
+        });
+    }
+
+    /// The tab size and whether to indent with spaces, following the indentation
+    /// of the document, for formatting it.
+    fn formatting_indent(&self) -> (u32, bool) {
+        match self
+            .doc()
+            .buffer
+            .with_untracked(|buffer| buffer.indent_style())
+        {
+            IndentStyle::Spaces(size) => (size as u32, true),
+            IndentStyle::Tabs => {
+                let tab_width = self
+                    .common
+                    .config
+                    .with_untracked(|config| config.editor.tab_width);
+                (tab_width as u32, false)
+            }
+        }
+    }
+
+    /// Ask the language server to format the text around the cursor after `ch`
+    /// was typed. It's only sent to the servers that registered `ch` as a
+    /// trigger character, and the edits are dropped if the text has changed
+    /// since.
+    fn request_on_type_formatting(&self, ch: &str) {
+        if !self
+            .common
+            .on_type_formatting_triggers
+            .with_untracked(|triggers| triggers.contains(ch))
+        {
+            return;
         }
+        let doc = self.doc();
+        let Some(path) = doc
+            .content
+            .with_untracked(|content| content.path().cloned())
+        else {
+            return;
+        };
+        let offset = self.cursor().with_untracked(|cursor| cursor.offset());
+        let position = doc
+            .buffer
+            .with_untracked(|buffer| buffer.offset_to_position(offset));
+        let rev = doc.rev();
+        let editor = self.clone();
+        let send = create_ext_action(self.scope, move |result| {
+            if let Ok(ProxyResponse::GetOnTypeFormatting { edits }) = result {
+                if !edits.is_empty() && editor.doc().rev() == rev {
+                    editor.do_text_edit(&edits);
+                }
+            }
+        });
+        let (tab_size, insert_spaces) = self.formatting_indent();
+        self.common.proxy.get_on_type_formatting(
+            path,
+            position,
+            ch.to_string(),
+            tab_size,
+            insert_spaces,
+            |result| {
+                send(result);
+            },
+        );
     }
 
     fn search_whole_word_forward(&self, mods: ModifiersState) {
@@ -2221,12 +3005,24 @@ fn rename(&self) {
 
                 let (start, _end, position, placeholder) =
                     buffer.with_untracked(|buffer| match resp {
-                        lsp_types::PrepareRenameResponse::Range(range) => (
-                            buffer.offset_of_position(&range.start),
-                            buffer.offset_of_position(&range.end),
-                            range.start,
-                            None,
-                        ),
+                        lsp_types::PrepareRenameResponse::Range(range) => {
+                            let start = buffer.offset_of_position(&range.start);
+                            let end = buffer.offset_of_position(&range.end);
+                            let word = buffer.select_word(offset);
+                            let (start, end, position) =
+                                match shrink_rename_range((start, end), word) {
+                                    Some((start, end)) => {
+                                        tracing::warn!(
+                                            "prepare rename range {range:?} is not a word, using the word at {start}..{end}"
+                                        );
+                                        (start, end, buffer.offset_to_position(start))
+                                    }
+                                    None => (start, end, range.start),
+                                };
+                            let placeholder =
+                                buffer.slice_to_cow(start..end).to_string();
+                            (start, end, position, Some(placeholder))
+                        }
                         lsp_types::PrepareRenameResponse::RangeWithPlaceholder {
                             range,
                             placeholder,
@@ -2457,6 +3253,12 @@ fn right_click(&self, pointer_event: &PointerInputEvent) {
             vec![
                 Some(CommandKind::Focus(FocusCommand::GotoDefinition)),
                 Some(CommandKind::Focus(FocusCommand::GotoTypeDefinition)),
+                Some(CommandKind::Workbench(
+                    LapceWorkbenchCommand::GoToImplementation,
+                )),
+                Some(CommandKind::Workbench(
+                    LapceWorkbenchCommand::GoToDeclaration,
+                )),
                 None,
                 Some(CommandKind::Focus(FocusCommand::Rename)),
                 None,
@@ -2499,6 +3301,420 @@ fn right_click(&self, pointer_event: &PointerInputEvent) {
         show_context_menu(menu, None);
     }
 
+    /// Fold or unfold the folding range at the cursor. The cursor moves to the
+    /// first line of the range when it would be hidden.
+    pub fn toggle_fold(&self) {
+        let doc = self.doc();
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let line = doc.buffer.with_untracked(|b| b.line_of_offset(offset));
+        doc.toggle_fold(line);
+
+        let folded_into = doc
+            .folded_lines()
+            .into_iter()
+            .find(|lines| lines.contains(&line))
+            .map(|lines| lines.start() - 1);
+        if let Some(line) = folded_into {
+            let offset = doc.buffer.with_untracked(|b| b.offset_of_line(line));
+            self.cursor()
+                .update(|cursor| cursor.set_offset(offset, false, false));
+        }
+    }
+
+    /// Run the command of the first code lens of the cursor's line on the
+    /// server that sent it.
+    pub fn run_code_lens(&self) {
+        let doc = self.doc();
+        let Some(plugin_id) = doc.code_lens_plugin.get_untracked() else {
+            return;
+        };
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let line = doc.buffer.with_untracked(|b| b.line_of_offset(offset));
+        let command = doc.code_lenses.with_untracked(|lenses| {
+            lenses
+                .iter()
+                .filter(|lens| lens.range.start.line as usize == line)
+                .find_map(|lens| lens.command.clone())
+        });
+        if let Some(command) = command {
+            self.common
+                .proxy
+                .execute_command(command, plugin_id, move |result| {
+                    if let Err(err) = result {
+                        tracing::warn!(
+                            "failed to run code lens command: {}",
+                            err.message
+                        );
+                    }
+                });
+        }
+    }
+
+    /// The visual line of `vline` in the editor, which is further up than it
+    /// when folded regions above it hide lines.
+    pub fn visual_vline(&self, vline: VLine) -> VLine {
+        let doc = self.doc();
+        let folded = doc.folded_lines();
+        if folded.is_empty() {
+            return vline;
+        }
+        let last_line = doc.buffer.with_untracked(|b| b.last_line());
+        let hidden = hidden_vlines(
+            self.editor.lines(),
+            self.editor.text_prov(),
+            &folded,
+            last_line,
+        );
+        folded_vline(vline, &hidden)
+    }
+
+    /// The points above and below the offset, like
+    /// [`Editor::points_of_offset`], moved up by the lines that folded regions
+    /// above it hide.
+    pub fn points_of_offset(
+        &self,
+        offset: usize,
+        affinity: CursorAffinity,
+    ) -> (Point, Point) {
+        let (above, below) = self.editor.points_of_offset(offset, affinity);
+        let vline = self.editor.vline_of_offset(offset, affinity);
+        let hidden = vline.get() - self.visual_vline(vline).get();
+        let line_height =
+            self.common.config.get_untracked().editor.line_height() as f64;
+        let shift = Vec2::new(0.0, hidden as f64 * line_height);
+        (above - shift, below - shift)
+    }
+
+    /// Show the signature of the call the cursor is in, with the parameter the
+    /// cursor is at highlighted.
+    pub fn signature_help(&self) {
+        static REQUEST_ID: AtomicUsize = AtomicUsize::new(0);
+
+        let doc = self.doc();
+        let Some(path) = doc.content.with_untracked(|c| c.path().cloned()) else {
+            return;
+        };
+        let offset = self.cursor().with_untracked(|cursor| cursor.offset());
+        let position = doc
+            .buffer
+            .with_untracked(|buffer| buffer.offset_to_position(offset));
+        let id = REQUEST_ID.fetch_add(1, Ordering::Relaxed);
+        self.common.hover.signature.set(Some(SignatureRequest {
+            id,
+            editor_id: self.id(),
+            offset,
+        }));
+        self.common.proxy.signature_help(id, path, position);
+    }
+
+    /// Ask for the signature of the call the cursor is in after typing one of
+    /// the characters the servers trigger signature help on, or any character
+    /// while it's shown so that it follows the parameter the cursor is at.
+    fn update_signature_help(&self, c: &str) {
+        if self.common.hover.shows_signature(self.id())
+            || self
+                .common
+                .signature_help_triggers
+                .with_untracked(|triggers| triggers.contains(c))
+        {
+            self.signature_help();
+        }
+    }
+
+    /// Show the hover of the selection, or the hovers of all the cursors one
+    /// after another when there are several.
+    pub fn hover_selection(&self) {
+        let anchors: Vec<usize> = self.doc().buffer.with_untracked(|buffer| {
+            self.cursor()
+                .with_untracked(|c| c.edit_selection(buffer))
+                .regions()
+                .iter()
+                .map(|region| region.start)
+                .collect()
+        });
+        match anchors.as_slice() {
+            [] => {}
+            [anchor] => self.update_hover(*anchor),
+            [anchor, ..] => self.update_hover_multi(*anchor, &anchors),
+        }
+    }
+
+    /// Show the hovers of all the `offsets` in one popup at `anchor`, in the
+    /// order of the offsets.
+    fn update_hover_multi(&self, anchor: usize, offsets: &[usize]) {
+        let doc = self.doc();
+        let Some(path) = doc
+            .content
+            .with_untracked(|content| content.path().cloned())
+        else {
+            return;
+        };
+        let positions = doc.buffer.with_untracked(|buffer| {
+            offsets
+                .iter()
+                .map(|offset| buffer.offset_to_position(*offset))
+                .collect()
+        });
+        let config = self.common.config;
+        let hover_data = self.common.hover.clone();
+        let editor_id = self.id();
+        let rev = doc.rev();
+
+        let send = create_ext_action(self.scope, move |resp| {
+            if doc.rev() != rev {
+                hover_data.active.set(false);
+                return;
+            }
+            if let Ok(ProxyResponse::HoverMultiResponse { results, .. }) = resp {
+                if results.is_empty() {
+                    return;
+                }
+                let config = config.get_untracked();
+                let content = itertools::Itertools::intersperse(
+                    results
+                        .into_iter()
+                        .map(|result| parse_hover_resp(result.hover, &config)),
+                    vec![MarkdownContent::Separator],
+                )
+                .flatten()
+                .collect();
+                hover_data.signature.set(None);
+                hover_data.content.set(content);
+                hover_data.offset.set(anchor);
+                hover_data.editor_id.set(editor_id);
+                hover_data.active.set(true);
+            }
+        });
+        self.common
+            .proxy
+            .get_hover_multi(0, path, positions, move |resp| {
+                send(resp);
+            });
+    }
+
+    /// Request the occurrences of the symbol at the cursor once the cursor has
+    /// rested for a moment. Moving it again cancels the pending request, and
+    /// moving it off the occurrences clears them right away.
+    pub fn get_document_highlights(&self) {
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let on_highlight = self.document_highlights.with_untracked(|highlights| {
+            highlights
+                .iter()
+                .any(|(start, end, _)| *start <= offset && offset <= *end)
+        });
+        if !on_highlight {
+            self.clear_document_highlights();
+        }
+
+        let editor = self.clone();
+        let timer = self.document_highlight_timer;
+        let timer_token = exec_after(
+            Duration::from_millis(DOCUMENT_HIGHLIGHTS_DELAY),
+            move |token| {
+                if timer.try_get_untracked() == Some(token) {
+                    editor.request_document_highlights(token);
+                }
+            },
+        );
+        timer.set(timer_token);
+    }
+
+    pub fn clear_document_highlights(&self) {
+        if self
+            .document_highlights
+            .with_untracked(|highlights| !highlights.is_empty())
+        {
+            self.document_highlights.set(Vec::new());
+        }
+    }
+
+    fn request_document_highlights(&self, token: TimerToken) {
+        let doc = self.doc();
+        let path = if doc.loaded() {
+            doc.content.with_untracked(|c| c.path().cloned())
+        } else {
+            None
+        };
+        let Some(path) = path else {
+            self.document_highlights.set(Vec::new());
+            return;
+        };
+
+        let offset = self.cursor().with_untracked(|c| c.offset());
+        let (position, rev) = doc.buffer.with_untracked(|buffer| {
+            (buffer.offset_to_position(offset), buffer.rev())
+        });
+
+        let timer = self.document_highlight_timer;
+        let document_highlights = self.document_highlights;
+        let send = create_ext_action(
+            self.scope,
+            move |highlights: Vec<lsp_types::DocumentHighlight>| {
+                // The cursor moved again or the text changed meanwhile
+                if timer.get_untracked() != token || doc.rev() != rev {
+                    return;
+                }
+                let highlights = doc.buffer.with_untracked(|buffer| {
+                    highlights
+                        .into_iter()
+                        .map(|highlight| {
+                            (
+                                buffer.offset_of_position(&highlight.range.start),
+                                buffer.offset_of_position(&highlight.range.end),
+                                highlight.kind,
+                            )
+                        })
+                        .collect()
+                });
+                document_highlights.set(highlights);
+            },
+        );
+
+        self.common
+            .proxy
+            .get_document_highlights(path, position, move |result| {
+                if let Ok(ProxyResponse::GetDocumentHighlights { highlights }) =
+                    result
+                {
+                    send(highlights);
+                }
+            });
+    }
+
+    /// Prefetch the selection ranges around the cursor once it has rested for
+    /// a moment, unless the cached ones still cover it.
+    pub fn prefetch_selection_range(&self) {
+        if self.cached_selection_range().is_some() {
+            return;
+        }
+        let editor = self.clone();
+        let timer = self.selection_range_timer;
+        let timer_token = exec_after(
+            Duration::from_millis(SELECTION_RANGE_PREFETCH_DELAY),
+            move |token| {
+                if timer.try_get_untracked() == Some(token) {
+                    editor.request_selection_range(token, false);
+                }
+            },
+        );
+        timer.set(timer_token);
+    }
+
+    /// Expand the selection to the next enclosing syntactic range, using the
+    /// prefetched ranges when they are still valid.
+    pub fn expand_selection(&self) {
+        if let Some((start, end)) = self.cached_selection_range() {
+            self.select_range(start, end);
+            return;
+        }
+        let token = TimerToken::next();
+        self.selection_range_timer.set(token);
+        self.request_selection_range(token, true);
+    }
+
+    /// The range the selection expands to next, if the cached selection ranges
+    /// are for the current text and contain the current selection.
+    fn cached_selection_range(&self) -> Option<(usize, usize)> {
+        let doc = self.doc();
+        let rev = doc.rev();
+        let (start, end) = self.selected_range();
+        self.selection_ranges.with_untracked(|cache| {
+            let cache = cache.as_ref()?;
+            if cache.rev != rev {
+                return None;
+            }
+            // The selection is either still the caret the ranges were
+            // requested for, or one of the ranges it has been expanded to
+            let covered = (start == end && start == cache.offset)
+                || cache.levels.contains(&(start, end));
+            if !covered {
+                return None;
+            }
+            next_selection_level(&cache.levels, start, end)
+        })
+    }
+
+    fn selected_range(&self) -> (usize, usize) {
+        self.doc().buffer.with_untracked(|buffer| {
+            let selection =
+                self.cursor().with_untracked(|c| c.edit_selection(buffer));
+            selection
+                .first()
+                .map(|region| (region.min(), region.max()))
+                .unwrap_or((0, 0))
+        })
+    }
+
+    fn select_range(&self, start: usize, end: usize) {
+        self.cursor().update(|cursor| {
+            cursor.set_insert(Selection::region(start, end));
+        });
+    }
+
+    fn request_selection_range(&self, token: TimerToken, expand: bool) {
+        let doc = self.doc();
+        let path = if doc.loaded() {
+            doc.content.with_untracked(|c| c.path().cloned())
+        } else {
+            None
+        };
+        let Some(path) = path else {
+            return;
+        };
+
+        let (start, end) = self.selected_range();
+        let (position, rev) = doc.buffer.with_untracked(|buffer| {
+            (buffer.offset_to_position(start), buffer.rev())
+        });
+
+        let editor = self.clone();
+        let send =
+            create_ext_action(self.scope, move |levels: Vec<lsp_types::Range>| {
+                // The cursor moved again or the text changed meanwhile
+                if editor.selection_range_timer.get_untracked() != token
+                    || editor.doc().rev() != rev
+                    || editor.selected_range() != (start, end)
+                {
+                    return;
+                }
+                let levels: Vec<(usize, usize)> =
+                    editor.doc().buffer.with_untracked(|buffer| {
+                        levels
+                            .iter()
+                            .map(|range| {
+                                (
+                                    buffer.offset_of_position(&range.start),
+                                    buffer.offset_of_position(&range.end),
+                                )
+                            })
+                            .collect()
+                    });
+                let next = next_selection_level(&levels, start, end);
+                editor.selection_ranges.set(Some(SelectionRangeCache {
+                    rev,
+                    offset: start,
+                    levels,
+                }));
+                if expand {
+                    if let Some((start, end)) = next {
+                        editor.select_range(start, end);
+                    }
+                }
+            });
+
+        self.common
+            .proxy
+            .get_selection_range(path, vec![position], move |result| {
+                if let Ok(ProxyResponse::GetSelectionRange { mut levels, .. }) =
+                    result
+                {
+                    if !levels.is_empty() {
+                        send(levels.swap_remove(0));
+                    }
+                }
+            });
+    }
+
     fn update_hover(&self, offset: usize) {
         let doc = self.doc();
         let path = doc
@@ -2514,9 +3730,42 @@ fn update_hover(&self, offset: usize) {
         let config = self.common.config;
         let hover_data = self.common.hover.clone();
         let editor_id = self.id();
+        let hover_limiter = self.hover_limiter;
+        let rev = doc.rev();
+
+        // Held back requests show the last hover, if it was of the same word
+        if !hover_limiter
+            .try_update(|limiter| limiter.try_acquire(Instant::now()))
+            .unwrap_or(false)
+        {
+            let cached = hover_limiter
+                .with_untracked(|limiter| limiter.cached.clone())
+                .filter(|(cached_rev, cached_offset, _)| {
+                    *cached_rev == rev && *cached_offset == offset
+                });
+            if let Some((_, _, content)) = cached {
+                hover_data.signature.set(None);
+                hover_data.content.set(content);
+                hover_data.offset.set(offset);
+                hover_data.editor_id.set(editor_id);
+                hover_data.active.set(true);
+            }
+            return;
+        }
+
         let send = create_ext_action(self.scope, move |resp| {
+            // The text under the offset may have changed since the request was
+            // sent, so rather than showing a stale hover we hide it
+            if doc.rev() != rev {
+                hover_data.active.set(false);
+                return;
+            }
             if let Ok(ProxyResponse::HoverResponse { hover, .. }) = resp {
                 let content = parse_hover_resp(hover, &config.get_untracked());
+                hover_limiter.update(|limiter| {
+                    limiter.cached = Some((rev, offset, content.clone()));
+                });
+                hover_data.signature.set(None);
                 hover_data.content.set(content);
                 hover_data.offset.set(offset);
                 hover_data.editor_id.set(editor_id);
@@ -2702,6 +3951,8 @@ fn receive_char(&self, c: &str) {
                 );
 
                 self.apply_deltas(&deltas);
+                self.request_on_type_formatting(c);
+                self.update_signature_help(c);
             } else if let Some(direction) = self.inline_find.get_untracked() {
                 self.inline_find(direction.clone(), c);
                 self.last_inline_find.set(Some((direction, c.to_string())));
@@ -2802,6 +4053,52 @@ fn show_inline_completion(cmd: &EditCommand) -> bool {
     )
 }
 
+/// The vlines hidden by the folded `lines`, as the first vline of each folded
+/// region and how many vlines it hides.
+fn hidden_vlines(
+    lines: &Lines,
+    text_prov: impl TextLayoutProvider + Clone,
+    folded: &[RangeInclusive<usize>],
+    last_line: usize,
+) -> Vec<(VLine, usize)> {
+    folded
+        .iter()
+        .map(|folded| {
+            let start = lines.vline_of_line(&text_prov, *folded.start());
+            let end = if *folded.end() < last_line {
+                lines.vline_of_line(&text_prov, folded.end() + 1).get()
+            } else {
+                lines.vline_of_line(&text_prov, *folded.end()).get() + 1
+            };
+            (start, end - start.get())
+        })
+        .collect()
+}
+
+/// The vline shown at the visual line `vline` of an editor, which is further
+/// down the document than it when folded regions above it hide vlines.
+fn unfolded_vline(vline: VLine, hidden: &[(VLine, usize)]) -> VLine {
+    let mut vline = vline.get();
+    for (start, count) in hidden {
+        if start.get() > vline {
+            break;
+        }
+        vline += count;
+    }
+    VLine(vline)
+}
+
+/// The visual line `vline` is shown at in an editor, which is further up than
+/// it when folded regions above it hide vlines.
+fn folded_vline(vline: VLine, hidden: &[(VLine, usize)]) -> VLine {
+    let hidden_above: usize = hidden
+        .iter()
+        .filter(|(start, _)| *start < vline)
+        .map(|(start, count)| (*count).min(vline.get() - start.get()))
+        .sum();
+    VLine(vline.get() - hidden_above)
+}
+
 // TODO(minor): Should we just put this on view, since it only requires those values?
 pub(crate) fn compute_screen_lines(
     config: ReadSignal<Arc<LapceConfig>>,
@@ -2846,7 +4143,23 @@ pub(crate) fn compute_screen_lines(
             let mut rvlines = Vec::new();
             let mut info = HashMap::new();
 
-            let Some(min_info) = *min_info else {
+            let folded = doc.folded_lines();
+            let last_line = doc.buffer.with_untracked(|buffer| buffer.last_line());
+            let hidden = hidden_vlines(lines, &text_prov, &folded, last_line);
+            // The line at the top of the viewport is further down the document
+            // when folded regions above it hide lines
+            let min_info = if hidden.is_empty() {
+                *min_info
+            } else {
+                lines
+                    .iter_vlines(
+                        text_prov.clone(),
+                        false,
+                        unfolded_vline(min_vline, &hidden),
+                    )
+                    .next()
+            };
+            let Some(min_info) = min_info else {
                 return ScreenLines {
                     lines: Rc::new(rvlines),
                     info: Rc::new(info),
@@ -2857,34 +4170,50 @@ pub(crate) fn compute_screen_lines(
 
             // TODO: the original was min_line..max_line + 1, are we iterating too little now?
             // the iterator is from min_vline..max_vline
-            let count = max_vline.get() - min_vline.get();
-            let iter = lines
-                .iter_rvlines_init(
-                    text_prov,
+            let mut y_idx = min_vline.get();
+            let mut start = Some(min_info.rvline);
+            'lines: while let Some(rvline) = start.take() {
+                let iter = lines.iter_rvlines_init(
+                    text_prov.clone(),
                     cache_rev,
                     config.id,
-                    min_info.rvline,
+                    rvline,
                     false,
-                )
-                .take(count);
-
-            for (i, vline_info) in iter.enumerate() {
-                rvlines.push(vline_info.rvline);
-
-                let y_idx = min_vline.get() + i;
-                let vline_y = y_idx * line_height;
-                let line_y = vline_y - vline_info.rvline.line_index * line_height;
-
-                // Add the information to make it cheap to get in the future.
-                // This y positions are shifted by the baseline y0
-                info.insert(
-                    vline_info.rvline,
-                    LineInfo {
-                        y: line_y as f64 - y0,
-                        vline_y: vline_y as f64 - y0,
-                        vline_info,
-                    },
                 );
+                for vline_info in iter {
+                    if y_idx >= max_vline.get() {
+                        break 'lines;
+                    }
+
+                    // Continue after the folded lines, without laying them out
+                    let line = vline_info.rvline.line;
+                    if let Some(hidden) = folded.iter().find(|l| l.contains(&line)) {
+                        if *hidden.end() < last_line {
+                            start = Some(
+                                lines.rvline_of_line(&text_prov, hidden.end() + 1),
+                            );
+                        }
+                        continue 'lines;
+                    }
+
+                    rvlines.push(vline_info.rvline);
+
+                    let vline_y = y_idx * line_height;
+                    let line_y =
+                        vline_y - vline_info.rvline.line_index * line_height;
+
+                    // Add the information to make it cheap to get in the future.
+                    // This y positions are shifted by the baseline y0
+                    info.insert(
+                        vline_info.rvline,
+                        LineInfo {
+                            y: line_y as f64 - y0,
+                            vline_y: vline_y as f64 - y0,
+                            vline_info,
+                        },
+                    );
+                    y_idx += 1;
+                }
             }
 
             ScreenLines {
@@ -3140,9 +4469,312 @@ fn parse_hover_resp(
             .flatten()
             .collect()
         }
-        HoverContents::Markup(content) => match content.kind {
-            MarkupKind::PlainText => from_plaintext(&content.value, 1.5, config),
-            MarkupKind::Markdown => parse_markdown(&content.value, 1.5, config),
-        },
+        HoverContents::Markup(content) => from_markup_content(&content, 1.5, config),
+    }
+}
+
+/// The diagnostics whose range contains the position, as only those are the
+/// ones that the code actions at the position can be about.
+fn diagnostics_at<'a>(
+    diagnostics: impl Iterator<Item = &'a Diagnostic>,
+    position: Position,
+) -> Vec<Diagnostic> {
+    diagnostics
+        .filter(|d| d.range.start <= position && position <= d.range.end)
+        .cloned()
+        .collect()
+}
+
+/// The content of the hover that shows signature help: the active signature
+/// with its active parameter in bold, then its documentation. There is none
+/// if there is no signature.
+pub fn signature_help_content(
+    help: &lsp_types::SignatureHelp,
+    config: &LapceConfig,
+) -> Option<Vec<MarkdownContent>> {
+    let (label, signature) = signature_label_markdown(help)?;
+    let mut content = parse_markdown(&label, 1.5, config);
+    if let Some(documentation) = signature.documentation.as_ref() {
+        content.push(MarkdownContent::Separator);
+        content.extend(from_documentation(documentation, 1.5, config));
+    }
+    Some(content)
+}
+
+/// The label of the active signature as markdown with the active parameter in
+/// bold, along with the signature.
+fn signature_label_markdown(
+    help: &lsp_types::SignatureHelp,
+) -> Option<(String, &lsp_types::SignatureInformation)> {
+    let index = help.active_signature.unwrap_or(0) as usize;
+    let signature = help
+        .signatures
+        .get(index)
+        .or_else(|| help.signatures.first())?;
+    let label = &signature.label;
+
+    let parameter = signature
+        .active_parameter
+        .or(help.active_parameter)
+        .and_then(|i| signature.parameters.as_ref()?.get(i as usize));
+    let range = parameter.and_then(|parameter| match &parameter.label {
+        lsp_types::ParameterLabel::Simple(name) => {
+            let start = label.find(name.as_str())?;
+            Some(start..start + name.len())
+        }
+        // The offsets count UTF-16 code units
+        lsp_types::ParameterLabel::LabelOffsets([start, end]) => {
+            let offset = |utf16: u32| {
+                let mut count = 0;
+                label
+                    .char_indices()
+                    .find(|(_, c)| {
+                        let found = count >= utf16 as usize;
+                        count += c.len_utf16();
+                        found
+                    })
+                    .map(|(i, _)| i)
+                    .unwrap_or(label.len())
+            };
+            Some(offset(*start)..offset(*end))
+        }
+    });
+
+    // The label is code, so none of it is read as markdown
+    let escape = |text: &str| {
+        text.chars().fold(String::new(), |mut escaped, c| {
+            if c.is_ascii_punctuation() {
+                escaped.push('\\');
+            }
+            escaped.push(c);
+            escaped
+        })
+    };
+    let markdown = match range {
+        Some(range) if !range.is_empty() => format!(
+            "{}**{}**{}",
+            escape(&label[..range.start]),
+            escape(&label[range.clone()]),
+            escape(&label[range.end..])
+        ),
+        _ => escape(label),
+    };
+    Some((markdown, signature))
+}
+
+/// Servers sometimes answer a prepare rename with a range that reaches past the
+/// word under the cursor, e.g. into the surrounding punctuation. Returns the
+/// range shrunk to the word boundaries, or `None` if it's within them already.
+fn shrink_rename_range(
+    (start, end): (usize, usize),
+    (word_start, word_end): (usize, usize),
+) -> Option<(usize, usize)> {
+    if start >= word_start && end <= word_end {
+        return None;
+    }
+    let shrunk = (start.max(word_start), end.min(word_end));
+    if shrunk.0 < shrunk.1 {
+        Some(shrunk)
+    } else {
+        // The range doesn't overlap the word at all
+        Some((word_start, word_end))
+    }
+}
+
+/// Whether the position is on a line of the buffer, and at most at its end.
+fn position_in_bounds(buffer: &Buffer, position: &Position) -> bool {
+    let line = position.line as usize;
+    if line > buffer.last_line() {
+        return false;
+    }
+    let content = buffer.line_content(line);
+    let len = content
+        .trim_end_matches(['\n', '\r'])
+        .encode_utf16()
+        .count();
+    position.character as usize <= len
+}
+
+/// The innermost of `levels` that strictly contains the range from `start` to
+/// `end`. The levels are ordered from the innermost to the outermost.
+fn next_selection_level(
+    levels: &[(usize, usize)],
+    start: usize,
+    end: usize,
+) -> Option<(usize, usize)> {
+    levels
+        .iter()
+        .find(|(s, e)| *s <= start && end <= *e && (*s, *e) != (start, end))
+        .copied()
+}
+
+/// How many milliseconds the cursor has to rest before the occurrences of the
+/// symbol under it are requested.
+const DOCUMENT_HIGHLIGHTS_DELAY: u64 = 250;
+
+/// How many times formatting is requested again when the edits the server
+/// returned no longer fit the document.
+const FORMATTING_RETRIES: usize = 2;
+
+/// How many milliseconds the cursor has to rest before the selection ranges
+/// around it are prefetched.
+const SELECTION_RANGE_PREFETCH_DELAY: u64 = 500;
+
+/// The locations of a definition response, with links pointing at their target
+/// selection.
+fn goto_response_locations(response: GotoDefinitionResponse) -> Vec<Location> {
+    match response {
+        GotoDefinitionResponse::Scalar(location) => vec![location],
+        GotoDefinitionResponse::Array(locations) => locations,
+        GotoDefinitionResponse::Link(location_links) => location_links
+            .into_iter()
+            .map(|location_link| Location {
+                uri: location_link.target_uri,
+                range: location_link.target_selection_range,
+            })
+            .collect(),
+    }
+}
+
+/// The edits that write the color at `range`, which reads `current`, in the
+/// presentation after the one it's written in, or in the first one when it's
+/// in none of them.
+fn color_presentation_edits(
+    presentations: &[ColorPresentation],
+    current: &str,
+    range: lsp_types::Range,
+) -> Option<Vec<TextEdit>> {
+    let text = |presentation: &ColorPresentation| {
+        presentation
+            .text_edit
+            .as_ref()
+            .map(|edit| edit.new_text.clone())
+            .unwrap_or_else(|| presentation.label.clone())
+    };
+    let next = presentations
+        .iter()
+        .position(|presentation| text(presentation) == current)
+        .map(|i| (i + 1) % presentations.len())
+        .unwrap_or(0);
+    let presentation = presentations.get(next)?;
+    if text(presentation) == current {
+        return None;
+    }
+
+    let mut edits = vec![presentation
+        .text_edit
+        .clone()
+        .unwrap_or_else(|| TextEdit::new(range, presentation.label.clone()))];
+    edits.extend(presentation.additional_text_edits.iter().flatten().cloned());
+    Some(edits)
+}
+
+#[cfg(test)]
+mod tests {
+    use floem::views::editor::visual_line::VLine;
+    use lsp_types::{ColorPresentation, Position, Range, TextEdit};
+
+    use super::{
+        color_presentation_edits, folded_vline, next_selection_level,
+        signature_label_markdown, unfolded_vline,
+    };
+
+    #[test]
+    fn test_signature_label_markdown() {
+        let parameter = |label| lsp_types::ParameterInformation {
+            label,
+            documentation: None,
+        };
+        let mut help = lsp_types::SignatureHelp {
+            signatures: vec![lsp_types::SignatureInformation {
+                label: "fn add(a: &u8, b: &u8)".to_string(),
+                documentation: None,
+                parameters: Some(vec![
+                    parameter(lsp_types::ParameterLabel::Simple(
+                        "a: &u8".to_string(),
+                    )),
+                    parameter(lsp_types::ParameterLabel::LabelOffsets([15, 21])),
+                ]),
+                active_parameter: None,
+            }],
+            active_signature: None,
+            active_parameter: Some(1),
+        };
+        assert_eq!(
+            signature_label_markdown(&help).unwrap().0,
+            r"fn add\(a: \&u8, **b: \&u8**\)"
+        );
+        // The parameter of the signature wins over the one of the help
+        help.signatures[0].active_parameter = Some(0);
+        assert_eq!(
+            signature_label_markdown(&help).unwrap().0,
+            r"fn add\(**a: \&u8**, b: \&u8\)"
+        );
+        help.signatures.clear();
+        assert!(signature_label_markdown(&help).is_none());
+    }
+
+    #[test]
+    fn test_color_presentation_edits() {
+        let range = Range::new(Position::new(0, 4), Position::new(0, 11));
+        let presentation = |label: &str| ColorPresentation {
+            label: label.to_string(),
+            text_edit: None,
+            additional_text_edits: None,
+        };
+        let presentations =
+            [presentation("#ff0000"), presentation("rgba(255, 0, 0, 1)")];
+        let edit = |text: &str| Some(vec![TextEdit::new(range, text.to_string())]);
+        // The next presentation is picked, wrapping around
+        assert_eq!(
+            color_presentation_edits(&presentations, "#ff0000", range),
+            edit("rgba(255, 0, 0, 1)")
+        );
+        assert_eq!(
+            color_presentation_edits(&presentations, "rgba(255, 0, 0, 1)", range),
+            edit("#ff0000")
+        );
+        assert_eq!(
+            color_presentation_edits(&presentations, "red", range),
+            edit("#ff0000")
+        );
+        // A single presentation that's already used changes nothing
+        assert_eq!(
+            color_presentation_edits(&presentations[..1], "#ff0000", range),
+            None
+        );
+        assert_eq!(color_presentation_edits(&[], "red", range), None);
+    }
+
+    #[test]
+    fn test_next_selection_level() {
+        let levels = [(4, 7), (2, 10), (0, 20)];
+        // The innermost level around a caret
+        assert_eq!(next_selection_level(&levels, 5, 5), Some((4, 7)));
+        // A level equal to the selection is skipped
+        assert_eq!(next_selection_level(&levels, 4, 7), Some((2, 10)));
+        assert_eq!(next_selection_level(&levels, 3, 8), Some((2, 10)));
+        // Nothing is larger than the outermost level
+        assert_eq!(next_selection_level(&levels, 0, 20), None);
+        assert_eq!(next_selection_level(&[], 5, 5), None);
+    }
+
+    #[test]
+    fn test_folded_vlines() {
+        // Vlines 3 to 5 and 10 to 11 are hidden
+        let hidden = [(VLine(3), 3), (VLine(10), 2)];
+        assert_eq!(unfolded_vline(VLine(2), &hidden), VLine(2));
+        assert_eq!(unfolded_vline(VLine(3), &hidden), VLine(6));
+        assert_eq!(unfolded_vline(VLine(6), &hidden), VLine(9));
+        assert_eq!(unfolded_vline(VLine(7), &hidden), VLine(12));
+
+        assert_eq!(folded_vline(VLine(2), &hidden), VLine(2));
+        assert_eq!(folded_vline(VLine(6), &hidden), VLine(3));
+        assert_eq!(folded_vline(VLine(9), &hidden), VLine(6));
+        assert_eq!(folded_vline(VLine(12), &hidden), VLine(7));
+        for vline in [0, 1, 2, 6, 7, 8, 9, 12, 20] {
+            let visual = folded_vline(VLine(vline), &hidden);
+            assert_eq!(unfolded_vline(visual, &hidden), VLine(vline));
+        }
     }
 }
@@ -48,7 +48,7 @@ fn paint_head_changes(
         let changes = e_data.doc().head_changes().get_untracked();
         let line_height = config.editor.line_height() as f64;
 
-        let changes = changes_colors_screen(config, &e_data.editor, changes);
+        let changes = changes_colors_screen(config, e_data, changes);
         for (y, height, removed, color) in changes {
             let height = if removed {
                 10.0
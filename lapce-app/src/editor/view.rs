@@ -11,7 +11,8 @@
         Color,
     },
     reactive::{
-        create_effect, create_memo, create_rw_signal, Memo, ReadSignal, RwSignal,
+        create_effect, create_memo, create_rw_signal, untrack, Memo, ReadSignal,
+        RwSignal,
     },
     style::{CursorStyle, Style},
     taffy::prelude::Node,
@@ -37,6 +38,7 @@
 };
 use lapce_rpc::dap_types::{DapId, SourceBreakpoint};
 use lapce_xi_rope::find::CaseMatching;
+use lsp_types::DocumentHighlightKind;
 
 use super::{gutter::editor_gutter_view, EditorData};
 use crate::{
@@ -44,7 +46,7 @@
     command::InternalCommand,
     config::{color::LapceColor, icon::LapceIcons, LapceConfig},
     debug::LapceBreakpoint,
-    doc::DocContent,
+    doc::{Doc, DocContent},
     text_input::text_input,
     window_tab::{Focus, WindowTabData},
     workspace::LapceWorkspace,
@@ -85,6 +87,49 @@ pub fn editor_view(
         id.request_layout();
     });
 
+    let document_highlights = e_data.document_highlights;
+    create_effect(move |_| {
+        document_highlights.track();
+        id.request_paint();
+    });
+
+    // The occurrences are offsets into the text they were found in, so they
+    // are cleared when it's edited
+    let editor = e_data.clone();
+    create_effect(move |last_rev| {
+        let rev = doc.with(|doc| doc.buffer.with(|buffer| buffer.rev()));
+        if last_rev.is_some_and(|last_rev| last_rev != rev) {
+            editor.clear_document_highlights();
+        }
+        rev
+    });
+
+    // The occurrences of the symbol and the selection ranges around it are
+    // requested once the cursor rests on it
+    let cursor = e_data.cursor();
+    let editor = e_data.clone();
+    create_effect(move |last_offset| {
+        let offset = cursor.with(|cursor| cursor.offset());
+        if last_offset != Some(offset) {
+            editor.get_document_highlights();
+            editor.prefetch_selection_range();
+        }
+        offset
+    });
+
+    // The region the cursor moved into is unfolded
+    let cursor = e_data.cursor();
+    let editor = e_data.clone();
+    create_effect(move |last_offset| {
+        let offset = cursor.with(|cursor| cursor.offset());
+        if last_offset != Some(offset) {
+            let doc = editor.doc();
+            let line = doc.buffer.with_untracked(|b| b.line_of_offset(offset));
+            untrack(|| doc.unfold_line(line));
+        }
+        offset
+    });
+
     let hide_cursor = e_data.common.window_common.hide_cursor;
     create_effect(move |_| {
         hide_cursor.track();
@@ -96,13 +141,37 @@ pub fn editor_view(
     create_effect(move |last_rev| {
         let buffer = doc.with(|doc| doc.buffer);
         let rev = buffer.with(|buffer| buffer.rev());
-        if last_rev == Some(rev) {
+        let folded = doc.with(|doc| doc.folded_lines());
+        let rev = (rev, folded);
+        if last_rev.as_ref() == Some(&rev) {
             return rev;
         }
         id.request_layout();
         rev
     });
 
+    // Inlay hints are only requested around the lines that are visible, in
+    // this and the other editors of the document
+    let editor_id = e_data.id();
+    create_effect(move |last_doc: Option<Rc<Doc>>| {
+        let doc = doc.get();
+        if let Some(last_doc) = last_doc.filter(|last| !Rc::ptr_eq(last, &doc)) {
+            last_doc.remove_viewport(editor_id);
+        }
+        let lines = screen_lines.with(|screen_lines| {
+            let min_vline = *screen_lines.lines.first()?;
+            let max_vline = *screen_lines.lines.last()?;
+            Some((
+                screen_lines.info(min_vline)?.vline_info.rvline.line,
+                screen_lines.info(max_vline)?.vline_info.rvline.line,
+            ))
+        });
+        if let Some((start_line, end_line)) = lines {
+            doc.update_viewport(editor_id, start_line, end_line);
+        }
+        doc
+    });
+
     let config = e_data.common.config;
     let sticky_header_height_signal = e_data.sticky_header_height;
     let editor2 = e_data.clone();
@@ -140,6 +209,7 @@ pub fn editor_view(
         rev
     });
 
+    let editor1 = e_data.clone();
     let ed1 = e_data.editor.clone();
     let ed2 = ed1.clone();
     let ed3 = ed1.clone();
@@ -164,7 +234,7 @@ pub fn editor_view(
                     set_ime_allowed(true);
                 }
                 let (offset, affinity) = cursor.with(|c| (c.offset(), c.affinity));
-                let (_, point_below) = ed1.points_of_offset(offset, affinity);
+                let (_, point_below) = editor1.points_of_offset(offset, affinity);
                 let window_origin = editor_window_origin.get();
                 let viewport = editor_viewport.get();
                 let pos = window_origin
@@ -440,62 +510,13 @@ fn paint_find(&self, cx: &mut PaintCx, screen_lines: &ScreenLines) {
         for region in occurrences.with_untracked(|selection| {
             selection.regions_in_range(start, end).to_vec()
         }) {
-            let start = region.min();
-            let end = region.max();
-
-            // TODO(minor): the proper affinity here should probably be tracked by selregion
-            let (start_rvline, start_col) =
-                ed.rvline_col_of_offset(start, CursorAffinity::Forward);
-            let (end_rvline, end_col) =
-                ed.rvline_col_of_offset(end, CursorAffinity::Backward);
-
-            for line_info in screen_lines.iter_line_info() {
-                let rvline_info = line_info.vline_info;
-                let rvline = rvline_info.rvline;
-                let line = rvline.line;
-
-                if rvline < start_rvline {
-                    continue;
-                }
-
-                if rvline > end_rvline {
-                    break;
-                }
-
-                let phantom_text = ed.phantom_text(line);
-
-                let left_col = if rvline == start_rvline { start_col } else { 0 };
-                let (right_col, _vline_end) = if rvline == end_rvline {
-                    let max_col = ed.last_col(rvline_info, true);
-                    (end_col.min(max_col), false)
-                } else {
-                    (ed.last_col(rvline_info, true), true)
-                };
-
-                // Shift it by the phantom text
-                let left_col = phantom_text.col_after(left_col, false);
-                let right_col = phantom_text.col_after(right_col, false);
-
-                // TODO(minor): sel region should have the affinity of the start/end
-                let x0 = ed
-                    .line_point_of_line_col(line, left_col, CursorAffinity::Forward)
-                    .x;
-                let x1 = ed
-                    .line_point_of_line_col(
-                        line,
-                        right_col,
-                        CursorAffinity::Backward,
-                    )
-                    .x;
-
-                if !rvline_info.is_empty() && start != end && left_col != right_col {
-                    rects.push(
-                        Size::new(x1 - x0, line_height)
-                            .to_rect()
-                            .with_origin(Point::new(x0, line_info.vline_y)),
-                    );
-                }
-            }
+            rects.extend(offset_range_rects(
+                ed,
+                screen_lines,
+                line_height,
+                region.min(),
+                region.max(),
+            ));
         }
 
         let color = config.color(LapceColor::EDITOR_FOREGROUND);
@@ -504,6 +525,51 @@ fn paint_find(&self, cx: &mut PaintCx, screen_lines: &ScreenLines) {
         }
     }
 
+    /// Paint the occurrences of the symbol at the cursor, outlining the ones
+    /// where it's written to.
+    fn paint_document_highlights(
+        &self,
+        cx: &mut PaintCx,
+        screen_lines: &ScreenLines,
+    ) {
+        let e_data = &self.editor;
+        let ed = &e_data.editor;
+        let highlights = e_data.document_highlights.get_untracked();
+        if highlights.is_empty() {
+            return;
+        }
+        let Some((min, max)) = screen_lines.rvline_range() else {
+            return;
+        };
+
+        let config = e_data.common.config.get_untracked();
+        let line_height = config.editor.line_height() as f64;
+        let start = ed.offset_of_line(min.line);
+        let end = ed.offset_of_line(max.line + 1);
+
+        let fill = config
+            .color(LapceColor::EDITOR_SELECTION)
+            .with_alpha_factor(0.5);
+        let outline = config.color(LapceColor::EDITOR_FOREGROUND);
+        for (highlight_start, highlight_end, kind) in highlights {
+            if highlight_end < start || highlight_start > end {
+                continue;
+            }
+            for rect in offset_range_rects(
+                ed,
+                screen_lines,
+                line_height,
+                highlight_start,
+                highlight_end,
+            ) {
+                cx.fill(&rect, fill, 0.0);
+                if kind == Some(DocumentHighlightKind::WRITE) {
+                    cx.stroke(&rect, outline, 1.0);
+                }
+            }
+        }
+    }
+
     fn paint_sticky_headers(
         &self,
         cx: &mut PaintCx,
@@ -962,7 +1028,8 @@ fn layout(
             let line_height = config.editor.line_height() as f64;
 
             let width = e_data.editor.max_line_width() + 20.0;
-            let height = line_height * e_data.editor.last_vline().get() as f64;
+            let height = line_height
+                * e_data.visual_vline(e_data.editor.last_vline()).get() as f64;
 
             let style = Style::new().width(width).height(height).to_taffy_style();
             cx.set_style(inner_node, style);
@@ -1003,6 +1070,8 @@ fn paint(&mut self, cx: &mut PaintCx) {
         let screen_lines = ed.screen_lines.get_untracked();
         self.paint_diff_sections(cx, viewport, &screen_lines, &config);
         let screen_lines = ed.screen_lines.get_untracked();
+        self.paint_document_highlights(cx, &screen_lines);
+        let screen_lines = ed.screen_lines.get_untracked();
         self.paint_find(cx, &screen_lines);
         let screen_lines = ed.screen_lines.get_untracked();
         self.paint_bracket_highlights_scope_lines(cx, viewport, &screen_lines);
@@ -1203,6 +1272,7 @@ pub fn editor_container_view(
         }
         let editor = editor.get_untracked();
         let doc = editor.doc();
+        doc.remove_viewport(editor.id());
         editor.scope.dispose();
 
         let scratch_doc_name =
@@ -1258,7 +1328,7 @@ fn editor_gutter(
                 .with(|c| c.get(&offset).map(|c| !c.1.is_empty()).unwrap_or(false));
             if has_code_actions {
                 let vline = ed.vline_of_offset(offset, affinity);
-                Some(vline)
+                Some(e_data.with_untracked(|e| e.visual_vline(vline)))
             } else {
                 None
             }
@@ -1724,7 +1794,7 @@ fn editor_content(
         let config = config.get_untracked();
         let line_height = config.editor.line_height();
         // TODO: is there a good way to avoid the calculation of the vline here?
-        let vline = e_data.editor.vline_of_rvline(rvline);
+        let vline = e_data.visual_vline(e_data.editor.vline_of_rvline(rvline));
         let rect = Rect::from_origin_size(
             (x, (vline.get() * line_height) as f64),
             (width, line_height as f64),
@@ -2091,15 +2161,80 @@ fn changes_color_iter<'a>(
     })
 }
 
+/// The rects covering the text between the offsets `start` and `end` on the
+/// screen lines, one for each visual line it spans.
+fn offset_range_rects(
+    ed: &Editor,
+    screen_lines: &ScreenLines,
+    line_height: f64,
+    start: usize,
+    end: usize,
+) -> Vec<Rect> {
+    let mut rects = Vec::new();
+
+    // TODO(minor): the proper affinity here should probably be tracked by selregion
+    let (start_rvline, start_col) =
+        ed.rvline_col_of_offset(start, CursorAffinity::Forward);
+    let (end_rvline, end_col) =
+        ed.rvline_col_of_offset(end, CursorAffinity::Backward);
+
+    for line_info in screen_lines.iter_line_info() {
+        let rvline_info = line_info.vline_info;
+        let rvline = rvline_info.rvline;
+        let line = rvline.line;
+
+        if rvline < start_rvline {
+            continue;
+        }
+
+        if rvline > end_rvline {
+            break;
+        }
+
+        let phantom_text = ed.phantom_text(line);
+
+        let left_col = if rvline == start_rvline { start_col } else { 0 };
+        let (right_col, _vline_end) = if rvline == end_rvline {
+            let max_col = ed.last_col(rvline_info, true);
+            (end_col.min(max_col), false)
+        } else {
+            (ed.last_col(rvline_info, true), true)
+        };
+
+        // Shift it by the phantom text
+        let left_col = phantom_text.col_after(left_col, false);
+        let right_col = phantom_text.col_after(right_col, false);
+
+        // TODO(minor): sel region should have the affinity of the start/end
+        let x0 = ed
+            .line_point_of_line_col(line, left_col, CursorAffinity::Forward)
+            .x;
+        let x1 = ed
+            .line_point_of_line_col(line, right_col, CursorAffinity::Backward)
+            .x;
+
+        if !rvline_info.is_empty() && start != end && left_col != right_col {
+            rects.push(
+                Size::new(x1 - x0, line_height)
+                    .to_rect()
+                    .with_origin(Point::new(x0, line_info.vline_y)),
+            );
+        }
+    }
+
+    rects
+}
+
 // TODO: both of the changes color functions could easily return iterators
 
 /// Get the position and coloring information for over the entire current [`ScreenLines`]
 /// Returns `(y, height_idx, removed, color)`
 pub fn changes_colors_screen(
     config: &LapceConfig,
-    editor: &Editor,
+    e_data: &EditorData,
     changes: im::Vector<DiffLines>,
 ) -> Vec<(f64, usize, bool, Color)> {
+    let editor = &e_data.editor;
     let screen_lines = editor.screen_lines.get_untracked();
 
     let Some((min, max)) = screen_lines.rvline_range() else {
@@ -2124,7 +2259,7 @@ pub fn changes_colors_screen(
             }
 
             let rvline = editor.rvline_of_line(pre_line);
-            let vline = editor.vline_of_line(pre_line);
+            let vline = e_data.visual_vline(editor.vline_of_line(pre_line));
             let y = (vline.0 * line_height) as f64;
             let height = {
                 // Accumulate the number of line indices each potentially wrapped line spans
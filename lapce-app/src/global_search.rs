@@ -10,6 +10,7 @@
 use lapce_core::{mode::Mode, selection::Selection};
 use lapce_rpc::proxy::{ProxyResponse, SearchMatch};
 use lapce_xi_rope::Rope;
+use lsp_types::SymbolInformation;
 
 use crate::{
     command::{CommandExecuted, CommandKind},
@@ -42,6 +43,8 @@ pub fn height(&self) -> f64 {
 pub struct GlobalSearchData {
     pub editor: EditorData,
     pub search_result: RwSignal<IndexMap<PathBuf, SearchMatchData>>,
+    /// Whether the workspace symbols are searched rather than the text
+    pub search_symbols: RwSignal<bool>,
     pub main_split: MainSplitData,
     pub common: Rc<CommonData>,
 }
@@ -109,10 +112,12 @@ pub fn new(cx: Scope, main_split: MainSplitData) -> Self {
         let common = main_split.common.clone();
         let editor = EditorData::new_local(cx, main_split.editors, common.clone());
         let search_result = cx.create_rw_signal(IndexMap::new());
+        let search_symbols = cx.create_rw_signal(false);
 
         let global_search = Self {
             editor,
             search_result,
+            search_symbols,
             main_split,
             common,
         };
@@ -126,6 +131,10 @@ pub fn new(cx: Scope, main_split: MainSplitData) -> Self {
                     global_search.search_result.update(|r| r.clear());
                     return;
                 }
+                if global_search.search_symbols.get() {
+                    global_search.search_workspace_symbols(pattern);
+                    return;
+                }
                 let case_sensitive = global_search.common.find.case_sensitive(true);
                 let whole_word = global_search.common.find.whole_words.get();
                 let is_regex = global_search.common.find.is_regex.get();
@@ -190,6 +199,27 @@ fn update_matches(&self, matches: IndexMap<PathBuf, Vec<SearchMatch>>) {
         );
     }
 
+    /// List the workspace symbols matching the query under the file that each
+    /// is in.
+    fn search_workspace_symbols(&self, query: String) {
+        let global_search = self.clone();
+        let send = create_ext_action(self.common.scope, move |result| {
+            // The search was switched back to text meanwhile
+            if !global_search.search_symbols.get_untracked() {
+                return;
+            }
+            if let Ok(ProxyResponse::GetWorkspaceSymbolsGrouped { symbols }) = result
+            {
+                global_search.update_matches(symbol_matches(symbols));
+            }
+        });
+        self.common
+            .proxy
+            .get_workspace_symbols_grouped(query, move |result| {
+                send(result);
+            });
+    }
+
     pub fn set_pattern(&self, pattern: String) {
         let pattern_len = pattern.len();
         self.editor.doc().reload(Rope::from(pattern), true);
@@ -198,3 +228,25 @@ pub fn set_pattern(&self, pattern: String) {
             .update(|cursor| cursor.set_insert(Selection::region(0, pattern_len)));
     }
 }
+
+/// The symbols of each file as search matches, which list the name of each
+/// symbol at its line.
+fn symbol_matches(
+    symbols: IndexMap<PathBuf, Vec<SymbolInformation>>,
+) -> IndexMap<PathBuf, Vec<SearchMatch>> {
+    symbols
+        .into_iter()
+        .map(|(path, symbols)| {
+            let matches = symbols
+                .into_iter()
+                .map(|symbol| SearchMatch {
+                    line: symbol.location.range.start.line as usize + 1,
+                    start: 0,
+                    end: symbol.name.len(),
+                    line_content: symbol.name,
+                })
+                .collect();
+            (path, matches)
+        })
+        .collect()
+}
@@ -1,3 +1,5 @@
+use std::time::Instant;
+
 use floem::{
     peniko::kurbo::Rect,
     reactive::{RwSignal, Scope},
@@ -13,6 +15,9 @@ pub struct HoverData {
     pub editor_id: RwSignal<EditorId>,
     pub content: RwSignal<Vec<MarkdownContent>>,
     pub layout_rect: RwSignal<Rect>,
+    /// The last signature help request, which the hover shows the answer of
+    /// until the cursor leaves the call
+    pub signature: RwSignal<Option<SignatureRequest>>,
 }
 
 impl HoverData {
@@ -23,6 +28,97 @@ pub fn new(cx: Scope) -> Self {
             content: cx.create_rw_signal(Vec::new()),
             editor_id: cx.create_rw_signal(EditorId::next()),
             layout_rect: cx.create_rw_signal(Rect::ZERO),
+            signature: cx.create_rw_signal(None),
         }
     }
+
+    /// Whether the hover shows the signature of a call in the editor.
+    pub fn shows_signature(&self, editor_id: EditorId) -> bool {
+        self.active.get_untracked()
+            && self.editor_id.get_untracked() == editor_id
+            && self.signature.with_untracked(Option::is_some)
+    }
+}
+
+/// A signature help request of an editor.
+#[derive(Clone, Copy, PartialEq)]
+pub struct SignatureRequest {
+    pub id: usize,
+    pub editor_id: EditorId,
+    /// The offset of the cursor it was asked for at
+    pub offset: usize,
+}
+
+/// How many hover requests an editor may send per second once it used up its
+/// burst.
+const HOVER_REQUESTS_PER_SECOND: f64 = 1.0;
+/// How many hover requests an editor may send in quick succession.
+const HOVER_REQUEST_BURST: f64 = 3.0;
+
+/// Limits how often an editor asks the servers for hovers, so that e.g. moving
+/// the mouse across many words doesn't flood them with requests. Also keeps
+/// the last hover of the editor, to show instead of one that was held back.
+#[derive(Clone)]
+pub struct HoverRateLimiter {
+    tokens: f64,
+    last: Instant,
+    /// The document revision, offset and content of the last hover received
+    pub cached: Option<(u64, usize, Vec<MarkdownContent>)>,
+}
+
+impl Default for HoverRateLimiter {
+    fn default() -> Self {
+        Self {
+            tokens: HOVER_REQUEST_BURST,
+            last: Instant::now(),
+            cached: None,
+        }
+    }
+}
+
+impl HoverRateLimiter {
+    /// Whether a request may be sent at the time, using up one of the requests
+    /// that were allowed since the last one.
+    pub fn try_acquire(&mut self, now: Instant) -> bool {
+        let elapsed = now.saturating_duration_since(self.last).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * HOVER_REQUESTS_PER_SECOND)
+            .min(HOVER_REQUEST_BURST);
+        self.last = now;
+        if self.tokens >= 1.0 {
+            self.tokens -= 1.0;
+            true
+        } else {
+            false
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{Duration, Instant};
+
+    use super::HoverRateLimiter;
+
+    #[test]
+    fn test_hover_rate_limiter() {
+        let mut limiter = HoverRateLimiter::default();
+        let now = Instant::now();
+        assert!(limiter.try_acquire(now));
+        assert!(limiter.try_acquire(now));
+        assert!(limiter.try_acquire(now));
+        assert!(!limiter.try_acquire(now));
+
+        let now = now + Duration::from_millis(500);
+        assert!(!limiter.try_acquire(now));
+        let now = now + Duration::from_millis(500);
+        assert!(limiter.try_acquire(now));
+        assert!(!limiter.try_acquire(now));
+
+        // The burst is refilled, but not beyond it
+        let now = now + Duration::from_secs(10);
+        assert!(limiter.try_acquire(now));
+        assert!(limiter.try_acquire(now));
+        assert!(limiter.try_acquire(now));
+        assert!(!limiter.try_acquire(now));
+    }
 }
@@ -25,8 +25,9 @@
 };
 use lapce_xi_rope::Rope;
 use lsp_types::{
-    CodeAction, CodeActionOrCommand, DiagnosticSeverity, DocumentChangeOperation,
-    DocumentChanges, OneOf, Position, TextEdit, Url, WorkspaceEdit,
+    CodeAction, CodeActionOrCommand, Command, DiagnosticSeverity,
+    DocumentChangeOperation, DocumentChanges, OneOf, Position, TextEdit, Url,
+    WorkspaceEdit,
 };
 use serde::{Deserialize, Serialize};
 use tracing::warn;
@@ -1960,69 +1961,173 @@ pub fn editor_tab_update_layout(
 
     pub fn run_code_action(&self, plugin_id: PluginId, action: CodeActionOrCommand) {
         match action {
-            CodeActionOrCommand::Command(_) => {}
+            CodeActionOrCommand::Command(command) => {
+                self.execute_command(plugin_id, command);
+            }
             CodeActionOrCommand::CodeAction(action) => {
-                if let Some(edit) = action.edit.as_ref() {
-                    self.apply_workspace_edit(edit);
-                } else {
+                // The server left out the details of the action, to be resolved
+                // when it's picked
+                if action.edit.is_none()
+                    && action.command.is_none()
+                    && action.data.is_some()
+                {
                     self.resolve_code_action(plugin_id, action);
+                } else {
+                    self.apply_code_action(plugin_id, action);
                 }
             }
         }
     }
 
-    /// Resolve a code action and apply its held workspace edit
+    /// Resolve a code action and then apply it
     fn resolve_code_action(&self, plugin_id: PluginId, action: CodeAction) {
         let main_split = self.clone();
-        let send = create_ext_action(self.scope, move |edit| {
-            main_split.apply_workspace_edit(&edit);
+        let send = create_ext_action(self.scope, move |action| {
+            main_split.apply_code_action(plugin_id, action);
         });
         self.common
             .proxy
             .code_action_resolve(action, plugin_id, move |result| {
                 if let Ok(ProxyResponse::CodeActionResolveResponse { item }) = result
                 {
-                    if let Some(edit) = item.edit {
-                        send(edit);
-                    }
+                    send(*item);
+                }
+            });
+    }
+
+    /// Apply the workspace edit of a code action, and then run its command
+    fn apply_code_action(&self, plugin_id: PluginId, action: CodeAction) {
+        if let Some(edit) = action.edit.as_ref() {
+            self.apply_workspace_edit(edit);
+        }
+        if let Some(command) = action.command {
+            self.execute_command(plugin_id, command);
+        }
+    }
+
+    /// Run a command on the server that offered it
+    fn execute_command(&self, plugin_id: PluginId, command: Command) {
+        self.common
+            .proxy
+            .execute_command(command, plugin_id, move |result| {
+                if let Err(err) = result {
+                    warn!("failed to execute command: {}", err.message);
                 }
             });
     }
 
     /// Perform a workspace edit, which are from the LSP (such as code actions, or symbol renaming)
-    pub fn apply_workspace_edit(&self, edit: &WorkspaceEdit) {
-        if let Some(DocumentChanges::Operations(_op)) =
+    /// Returns false if some of its text edits can't be applied, because they
+    /// aren't for a file or lie past the end of an open document.
+    pub fn apply_workspace_edit(&self, edit: &WorkspaceEdit) -> bool {
+        if let Some(DocumentChanges::Operations(ops)) =
             edit.document_changes.as_ref()
         {
-            // TODO
+            if ops
+                .iter()
+                .any(|op| matches!(op, DocumentChangeOperation::Op(_)))
+            {
+                self.apply_resource_operations(edit.clone());
+                return true;
+            }
         }
 
+        let mut applied = true;
         if let Some(edits) = workspace_edits(edit) {
             for (url, edits) in edits {
-                if let Ok(path) = url.to_file_path() {
-                    let active_path = self
-                        .active_editor
-                        .get_untracked()
-                        .map(|editor| editor.doc())
-                        .map(|doc| doc.content.get_untracked())
-                        .and_then(|content| content.path().cloned());
-                    let position = if active_path.as_ref() == Some(&path) {
-                        None
-                    } else {
-                        edits
-                            .first()
-                            .map(|edit| EditorPosition::Position(edit.range.start))
-                    };
-                    let location = EditorLocation {
-                        path,
-                        position,
-                        scroll_offset: None,
-                        ignore_unconfirmed: true,
-                        same_editor_tab: false,
-                    };
-                    self.jump_to_location(location, Some(edits));
+                let Ok(path) = url.to_file_path() else {
+                    applied = false;
+                    continue;
+                };
+                let doc = self.docs.with_untracked(|docs| docs.get(&path).cloned());
+                if let Some(doc) = doc.filter(|doc| doc.loaded()) {
+                    let last_line =
+                        doc.buffer.with_untracked(|buffer| buffer.last_line());
+                    if edits
+                        .iter()
+                        .any(|edit| edit.range.end.line as usize > last_line)
+                    {
+                        applied = false;
+                        continue;
+                    }
                 }
+                let active_path = self
+                    .active_editor
+                    .get_untracked()
+                    .map(|editor| editor.doc())
+                    .map(|doc| doc.content.get_untracked())
+                    .and_then(|content| content.path().cloned());
+                let position = if active_path.as_ref() == Some(&path) {
+                    None
+                } else {
+                    edits
+                        .first()
+                        .map(|edit| EditorPosition::Position(edit.range.start))
+                };
+                let location = EditorLocation {
+                    path,
+                    position,
+                    scroll_offset: None,
+                    ignore_unconfirmed: true,
+                    same_editor_tab: false,
+                };
+                self.jump_to_location(location, Some(edits));
+            }
+        }
+        applied
+    }
+
+    /// Let the proxy create, rename and delete the files of the workspace edit,
+    /// and then apply its text edits.
+    fn apply_resource_operations(&self, edit: WorkspaceEdit) {
+        let main_split = self.clone();
+        let send = create_ext_action(self.scope, move |result| {
+            if let Ok(ProxyResponse::ApplyResourceOperations {
+                edit,
+                renamed,
+                failure_reason,
+                ..
+            }) = result
+            {
+                for (from, to) in &renamed {
+                    main_split.rename_open_paths(from, to);
+                }
+                if let Some(reason) = failure_reason {
+                    warn!("failed to apply the workspace edit: {reason}");
+                }
+                main_split.apply_workspace_edit(&edit);
             }
+        });
+        self.common
+            .proxy
+            .apply_resource_operations(edit, move |result| send(result));
+    }
+
+    /// Update the editors in which the renamed file, or a file in the renamed
+    /// directory, is open to use its new path.
+    pub fn rename_open_paths(&self, from: &Path, to: &Path) {
+        let renamed_editors_content: Vec<_> =
+            self.editors.with_untracked(|editors| {
+                editors
+                    .values()
+                    .map(|editor| editor.doc().content)
+                    .filter(|content| {
+                        content.with_untracked(|content| match content {
+                            DocContent::File { path, .. } => path.starts_with(from),
+                            _ => false,
+                        })
+                    })
+                    .collect()
+            });
+
+        for content in renamed_editors_content {
+            content.update(|content| {
+                if let DocContent::File { path, .. } = content {
+                    if let Ok(suffix) = path.strip_prefix(from) {
+                        *path = to.join(suffix);
+                    }
+                }
+            });
         }
     }
 
@@ -2094,6 +2199,8 @@ pub fn get_diagnostic_data(&self, path: &Path) -> DiagnosticData {
             let diagnostic_data = DiagnosticData {
                 expanded: self.scope.create_rw_signal(true),
                 diagnostics: self.scope.create_rw_signal(im::Vector::new()),
+                pending: self.scope.create_rw_signal(None),
+                stale: self.scope.create_rw_signal(false),
             };
             self.diagnostics.update(|d| {
                 d.insert(path.to_path_buf(), diagnostic_data.clone());
@@ -2655,11 +2762,11 @@ pub fn export_theme(&self) {
 }
 
 fn workspace_edits(edit: &WorkspaceEdit) -> Option<HashMap<Url, Vec<TextEdit>>> {
-    if let Some(changes) = edit.changes.as_ref() {
-        return Some(changes.clone());
-    }
-
-    let changes = edit.document_changes.as_ref()?;
+    // The document changes are preferred over the changes, which servers may
+    // still send for clients that don't support them
+    let Some(changes) = edit.document_changes.as_ref() else {
+        return edit.changes.clone();
+    };
     let edits = match changes {
         DocumentChanges::Edits(edits) => edits
             .iter()
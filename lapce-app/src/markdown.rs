@@ -3,7 +3,7 @@
 };
 use lapce_core::{language::LapceLanguage, syntax::Syntax};
 use lapce_xi_rope::Rope;
-use lsp_types::MarkedString;
+use lsp_types::{Documentation, MarkedString, MarkupContent, MarkupKind};
 use pulldown_cmark::{CodeBlockKind, CowStr, Event, Options, Parser, Tag};
 use smallvec::SmallVec;
 
@@ -306,6 +306,32 @@ pub fn from_marked_string(
     }
 }
 
+pub fn from_markup_content(
+    content: &MarkupContent,
+    line_height: f64,
+    config: &LapceConfig,
+) -> Vec<MarkdownContent> {
+    match content.kind {
+        MarkupKind::PlainText => from_plaintext(&content.value, line_height, config),
+        MarkupKind::Markdown => parse_markdown(&content.value, line_height, config),
+    }
+}
+
+/// The documentation of e.g. a completion item, which is plain text unless the
+/// server marked it as markdown.
+pub fn from_documentation(
+    documentation: &Documentation,
+    line_height: f64,
+    config: &LapceConfig,
+) -> Vec<MarkdownContent> {
+    match documentation {
+        Documentation::String(text) => from_plaintext(text, line_height, config),
+        Documentation::MarkupContent(content) => {
+            from_markup_content(content, line_height, config)
+        }
+    }
+}
+
 pub fn from_plaintext(
     text: &str,
     line_height: f64,
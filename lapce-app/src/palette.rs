@@ -22,12 +22,13 @@
     buffer::rope_text::RopeText, command::FocusCommand, language::LapceLanguage,
     mode::Mode, movement::Movement, selection::Selection, syntax::Syntax,
 };
-use lapce_rpc::proxy::ProxyResponse;
+use lapce_rpc::{file::path_to_uri, proxy::ProxyResponse};
 use lapce_xi_rope::Rope;
-use lsp_types::DocumentSymbolResponse;
+use lsp_types::{
+    DocumentSymbol, DocumentSymbolResponse, SymbolInformation, SymbolKind,
+};
 use nucleo::Utf32Str;
 use strum::{EnumMessage, IntoEnumIterator};
-use tracing::error;
 
 use self::{
     item::{PaletteItem, PaletteItemContent},
@@ -37,6 +38,8 @@
     command::{
         CommandExecuted, CommandKind, InternalCommand, LapceCommand, WindowCommand,
     },
+    completion::{is_anchor_match, ANCHOR_MATCH_BONUS},
+    config::{editor::symbol_kind_from_name, LapceConfig},
     db::LapceDb,
     debug::{RunDebugConfigs, RunDebugMode},
     editor::{
@@ -56,6 +59,10 @@
 
 const DEFAULT_RUN_TOML: &str = include_str!("../../defaults/run.toml");
 
+/// How many symbols of a workspace symbol query the palette lists at first,
+/// and loads at a time when the end of the list is reached
+const WORKSPACE_SYMBOL_PAGE_SIZE: usize = 500;
+
 #[derive(Clone, PartialEq, Eq)]
 pub enum PaletteStatus {
     Inactive,
@@ -75,6 +82,50 @@ pub fn update_input(&mut self, input: String, kind: PaletteKind) {
         self.kind = kind.get_palette_kind(&input);
         self.input = self.kind.get_input(&input).to_string();
     }
+
+    /// The input that the items are filtered with, which leaves out the
+    /// filters of a workspace symbol query.
+    fn filter_input(&self) -> String {
+        match self.kind {
+            PaletteKind::WorkspaceSymbol => {
+                WorkspaceSymbolQuery::parse(&self.input).query
+            }
+            _ => self.input.clone(),
+        }
+    }
+}
+
+/// A workspace symbol query of the palette with the filters typed in it, like
+/// `#new in:src/editor` for the symbols named `new` under `src/editor`, or
+/// `#new kind:function,method` for the functions and methods named `new`.
+#[derive(Debug, Default, PartialEq)]
+struct WorkspaceSymbolQuery {
+    query: String,
+    /// The folder the symbols have to be in, relative to the workspace
+    folder: Option<PathBuf>,
+    /// The kinds the symbols have to be of, any if empty
+    kinds: Vec<SymbolKind>,
+}
+
+impl WorkspaceSymbolQuery {
+    fn parse(input: &str) -> Self {
+        let mut filter = WorkspaceSymbolQuery::default();
+        let mut query = Vec::new();
+        for word in input.split_whitespace() {
+            if let Some(folder) = word.strip_prefix("in:") {
+                filter.folder = (!folder.is_empty()).then(|| PathBuf::from(folder));
+            } else if let Some(kinds) = word.strip_prefix("kind:") {
+                filter.kinds = kinds
+                    .split(',')
+                    .filter_map(|kind| symbol_kind_from_name(kind.trim()))
+                    .collect();
+            } else {
+                query.push(word);
+            }
+        }
+        filter.query = query.join(" ");
+        filter
+    }
 }
 
 #[derive(Clone)]
@@ -102,6 +153,9 @@ pub struct PaletteData {
     pub source_control: SourceControlData,
     pub common: Rc<CommonData>,
     left_diff_path: RwSignal<Option<PathBuf>>,
+    /// How many of the symbols of the last workspace symbol query were loaded,
+    /// and how many it found
+    workspace_symbol_pages: RwSignal<(usize, usize)>,
 }
 
 impl PaletteData {
@@ -147,7 +201,12 @@ pub fn new(
                     let run_id = run_id.get_untracked();
                     let preselect_index =
                         preselect_index.try_update(|i| i.take()).unwrap();
-                    let _ = tx.send((run_id, input.input, items, preselect_index));
+                    let _ = tx.send((
+                        run_id,
+                        input.filter_input(),
+                        items,
+                        preselect_index,
+                    ));
                 });
             }
             // this effect only monitors input change
@@ -159,7 +218,7 @@ pub fn new(
                 }
                 let items = items.get_untracked();
                 let run_id = run_id.get_untracked();
-                let _ = tx.send((run_id, input.input, items, None));
+                let _ = tx.send((run_id, input.filter_input(), items, None));
                 kind
             });
         }
@@ -185,7 +244,7 @@ pub fn new(
                 )) = resp.get()
                 {
                     if run_id.get_untracked() == filter_run_id
-                        && input.get_untracked().input == filter_input
+                        && input.get_untracked().filter_input() == filter_input
                     {
                         set_filtered_items.set(new_items);
                         let i = preselect_index.unwrap_or(0);
@@ -197,6 +256,7 @@ pub fn new(
 
         let clicked_index = cx.create_rw_signal(Option::<usize>::None);
         let left_diff_path = cx.create_rw_signal(None);
+        let workspace_symbol_pages = cx.create_rw_signal((0, 0));
 
         let palette = Self {
             run_id_counter,
@@ -221,6 +281,7 @@ pub fn new(
             source_control,
             common,
             left_diff_path,
+            workspace_symbol_pages,
         };
 
         {
@@ -632,8 +693,15 @@ fn get_document_symbols(&self) {
             }
         };
 
+        // The symbol positions are only meaningful for the revision they were
+        // requested at, so a reply for an older revision is dropped.
+        let rev = doc.rev();
         let set_items = self.items.write_only();
         let send = create_ext_action(self.common.scope, move |result| {
+            if doc.rev() != rev {
+                set_items.update(|items| items.clear());
+                return;
+            }
             if let Ok(ProxyResponse::GetDocumentSymbols { resp }) = result {
                 let items: im::Vector<PaletteItem> = match resp {
                     DocumentSymbolResponse::Flat(symbols) => symbols
@@ -656,20 +724,11 @@ fn get_document_symbols(&self) {
                             }
                         })
                         .collect(),
-                    DocumentSymbolResponse::Nested(symbols) => symbols
-                        .iter()
-                        .map(|s| PaletteItem {
-                            content: PaletteItemContent::DocumentSymbol {
-                                kind: s.kind,
-                                name: s.name.clone(),
-                                range: s.range,
-                                container_name: None,
-                            },
-                            filter_text: s.name.clone(),
-                            score: 0,
-                            indices: Vec::new(),
-                        })
-                        .collect(),
+                    DocumentSymbolResponse::Nested(symbols) => {
+                        let mut items = im::Vector::new();
+                        nested_symbol_items(&symbols, None, &mut items);
+                        items
+                    }
                 };
                 set_items.set(items);
             } else {
@@ -684,50 +743,110 @@ fn get_document_symbols(&self) {
 
     fn get_workspace_symbols(&self) {
         let input = self.input.get_untracked().input;
+        let filter = WorkspaceSymbolQuery::parse(&input);
+        let kinds = filter.kinds.clone();
 
         let set_items = self.items.write_only();
+        let pages = self.workspace_symbol_pages;
+        let config = self.common.config;
+        let current_input = self.input;
+        let query = input.clone();
         let send = create_ext_action(self.common.scope, move |result| {
+            // The query changed meanwhile, so a newer one will answer
+            if current_input.with_untracked(|i| i.input != query) {
+                return;
+            }
             if let Ok(ProxyResponse::GetWorkspaceSymbols { symbols }) = result {
-                let items: im::Vector<PaletteItem> = symbols
+                // Only the first page is listed, as there can be thousands
+                let loaded = symbols.len().min(WORKSPACE_SYMBOL_PAGE_SIZE);
+                pages.set((loaded, symbols.len()));
+                let config = config.get_untracked();
+                let items: im::Vector<PaletteItem> = symbols[..loaded]
                     .iter()
-                    .map(|s| {
-                        // TODO: Should we be using filter text?
-                        let mut filter_text = s.name.clone();
-                        if let Some(container_name) = s.container_name.as_ref() {
-                            filter_text += container_name;
-                        }
-                        PaletteItem {
-                            content: PaletteItemContent::WorkspaceSymbol {
-                                kind: s.kind,
-                                name: s.name.clone(),
-                                location: EditorLocation {
-                                    path: path_from_url(&s.location.uri),
-                                    position: Some(EditorPosition::Position(
-                                        s.location.range.start,
-                                    )),
-                                    scroll_offset: None,
-                                    ignore_unconfirmed: false,
-                                    same_editor_tab: false,
-                                },
-                                container_name: s.container_name.clone(),
-                            },
-                            filter_text,
-                            score: 0,
-                            indices: Vec::new(),
-                        }
-                    })
+                    // The servers can only filter by the folder or by the
+                    // kind at once, so the kinds are filtered here when both
+                    // are asked for
+                    .filter(|s| kinds.is_empty() || kinds.contains(&s.kind))
+                    .map(|s| workspace_symbol_item(s, &config))
                     .collect();
                 set_items.set(items);
             } else {
+                pages.set((0, 0));
                 set_items.update(|items| items.clear());
             }
         });
 
-        self.common
-            .proxy
-            .get_workspace_symbols(input, move |result| {
+        let proxy = &self.common.proxy;
+        let cb = move |result| {
+            send(result);
+        };
+        match filter.folder {
+            Some(folder) => {
+                let path = match self.workspace.path.as_ref() {
+                    Some(workspace) => workspace.join(folder),
+                    None => folder,
+                };
+                proxy.get_workspace_symbols_in_path(filter.query, path, cb);
+            }
+            None if !filter.kinds.is_empty() => {
+                proxy.get_workspace_symbols_by_kind(filter.query, filter.kinds, cb);
+            }
+            None => proxy.get_workspace_symbols(filter.query, cb),
+        }
+    }
+
+    /// List the next page of the symbols of the last workspace symbol query,
+    /// if the palette doesn't list all of them yet.
+    fn load_workspace_symbol_page(&self) {
+        if self
+            .input
+            .with_untracked(|i| i.kind != PaletteKind::WorkspaceSymbol)
+        {
+            return;
+        }
+        let (offset, total) = self.workspace_symbol_pages.get_untracked();
+        if offset >= total {
+            return;
+        }
+        // Marked as loaded already, so that it's only asked for once
+        let loaded = (offset + WORKSPACE_SYMBOL_PAGE_SIZE).min(total);
+        self.workspace_symbol_pages.set((loaded, total));
+
+        let input = self.input.get_untracked().input;
+        let kinds = WorkspaceSymbolQuery::parse(&input).kinds;
+        let items = self.items;
+        let index = self.index;
+        let preselect_index = self.preselect_index;
+        let config = self.common.config;
+        let current_input = self.input;
+        let send = create_ext_action(self.common.scope, move |result| {
+            if current_input.with_untracked(|i| i.input != input) {
+                return;
+            }
+            if let Ok(ProxyResponse::GetWorkspaceSymbolsPage { symbols, .. }) =
+                result
+            {
+                let config = config.get_untracked();
+                // Stay on the entry that was reached rather than going back to
+                // the first one when the list is filtered again
+                preselect_index.set(Some(index.get_untracked()));
+                items.update(|items| {
+                    items.extend(
+                        symbols
+                            .iter()
+                            .filter(|s| kinds.is_empty() || kinds.contains(&s.kind))
+                            .map(|s| workspace_symbol_item(s, &config)),
+                    );
+                });
+            }
+        });
+        self.common.proxy.get_workspace_symbols_page(
+            offset,
+            WORKSPACE_SYMBOL_PAGE_SIZE,
+            move |result| {
                 send(result);
-            });
+            },
+        );
     }
 
     fn get_ssh_hosts(&self) {
@@ -994,16 +1113,7 @@ fn get_terminal_profiles(&self) {
         let mut items: im::Vector<PaletteItem> = im::Vector::new();
 
         for (name, profile) in profiles.into_iter() {
-            let uri = match lsp_types::Url::parse(&format!(
-                "file://{}",
-                profile.workdir.unwrap_or_default().display()
-            )) {
-                Ok(v) => Some(v),
-                Err(e) => {
-                    error!("Failed to parse uri: {e}");
-                    None
-                }
-            };
+            let uri = profile.workdir.as_deref().map(path_to_uri);
 
             items.push_back(PaletteItem {
                 content: PaletteItemContent::TerminalProfile {
@@ -1169,10 +1279,36 @@ fn select(&self) {
                         },
                     );
                 }
-                PaletteItemContent::WorkspaceSymbol { location, .. } => {
-                    self.common.internal_command.send(
-                        InternalCommand::JumpToLocation {
-                            location: location.clone(),
+                PaletteItemContent::WorkspaceSymbol {
+                    kind,
+                    name,
+                    location,
+                    ..
+                } => {
+                    // Servers may leave out the range of the symbol until it's
+                    // picked
+                    let internal_command = self.common.internal_command;
+                    let location = location.clone();
+                    let path = location.path.clone();
+                    let send = create_ext_action(self.common.scope, move |result| {
+                        let mut location = location;
+                        if let Ok(ProxyResponse::ResolveWorkspaceSymbol {
+                            location: Some(resolved),
+                        }) = result
+                        {
+                            location.path = path_from_url(&resolved.uri);
+                            location.position =
+                                Some(EditorPosition::Position(resolved.range.start));
+                        }
+                        internal_command
+                            .send(InternalCommand::JumpToLocation { location });
+                    });
+                    self.common.proxy.resolve_workspace_symbol(
+                        name.clone(),
+                        *kind,
+                        path,
+                        move |result| {
+                            send(result);
                         },
                     );
                 }
@@ -1403,6 +1539,9 @@ fn next(&self) {
         let len = self.filtered_items.with_untracked(|i| i.len());
         let new_index = Movement::Down.update_index(index, len, 1, true);
         self.index.set(new_index);
+        if new_index + 1 == len {
+            self.load_workspace_symbol_page();
+        }
     }
 
     /// Move to the previous entry in the palette list, wrapping around if needed.
@@ -1475,8 +1614,15 @@ fn filter_items(
             let mut indices = Vec::new();
             let mut filter_text_buf = Vec::new();
             let filter_text = Utf32Str::new(&i.filter_text, &mut filter_text_buf);
-            if let Some(score) = pattern.indices(filter_text, matcher, &mut indices)
+            if let Some(mut score) =
+                pattern.indices(filter_text, matcher, &mut indices)
             {
+                if let PaletteItemContent::WorkspaceSymbol { name, .. } = &i.content
+                {
+                    if is_anchor_match(name, input) {
+                        score += ANCHOR_MATCH_BONUS;
+                    }
+                }
                 let mut item = i.clone();
                 item.score = score;
                 item.indices = indices.into_iter().map(|i| i as usize).collect();
@@ -1485,11 +1631,12 @@ fn filter_items(
         }
 
         filtered_items.sort_by(|a, b| {
-            let order = b.score.cmp(&a.score);
-            match order {
-                std::cmp::Ordering::Equal => a.filter_text.cmp(&b.filter_text),
-                _ => order,
-            }
+            b.score
+                .cmp(&a.score)
+                .then_with(|| {
+                    b.content.kind_priority().cmp(&a.content.kind_priority())
+                })
+                .then_with(|| a.filter_text.cmp(&b.filter_text))
         });
 
         if run_id.load(std::sync::atomic::Ordering::Acquire) != current_run_id {
@@ -1596,3 +1743,108 @@ fn receive_char(&self, c: &str) {
         self.input_editor.receive_char(c);
     }
 }
+
+/// The name of a symbol qualified by its container, as `container > name`.
+fn symbol_breadcrumb(container_name: Option<&str>, name: &str) -> String {
+    match container_name {
+        Some(container_name) if !container_name.is_empty() => {
+            format!("{container_name} > {name}")
+        }
+        _ => name.to_string(),
+    }
+}
+
+/// The palette item of a symbol found by a workspace symbol query.
+fn workspace_symbol_item(
+    s: &SymbolInformation,
+    config: &LapceConfig,
+) -> PaletteItem {
+    let breadcrumb = symbol_breadcrumb(s.container_name.as_deref(), &s.name);
+    PaletteItem {
+        content: PaletteItemContent::WorkspaceSymbol {
+            kind: s.kind,
+            name: s.name.clone(),
+            breadcrumb: breadcrumb.clone(),
+            location: EditorLocation {
+                path: path_from_url(&s.location.uri),
+                position: Some(EditorPosition::Position(s.location.range.start)),
+                scroll_offset: None,
+                ignore_unconfirmed: false,
+                same_editor_tab: false,
+            },
+            container_name: s.container_name.clone(),
+            kind_priority: config.editor.workspace_symbol_kind_priority(s.kind),
+        },
+        filter_text: breadcrumb,
+        score: 0,
+        indices: Vec::new(),
+    }
+}
+
+/// The palette items of nested document symbols and all their children, with
+/// the breadcrumb of the parent of each as its container name.
+fn nested_symbol_items(
+    symbols: &[DocumentSymbol],
+    container_name: Option<&str>,
+    items: &mut im::Vector<PaletteItem>,
+) {
+    for s in symbols {
+        let mut filter_text = s.name.clone();
+        if let Some(container_name) = container_name {
+            filter_text += container_name;
+        }
+        items.push_back(PaletteItem {
+            content: PaletteItemContent::DocumentSymbol {
+                kind: s.kind,
+                name: s.name.clone(),
+                range: s.range,
+                container_name: container_name.map(|name| name.to_string()),
+            },
+            filter_text,
+            score: 0,
+            indices: Vec::new(),
+        });
+        if let Some(children) = s.children.as_ref() {
+            let breadcrumb = symbol_breadcrumb(container_name, &s.name);
+            nested_symbol_items(children, Some(&breadcrumb), items);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::PathBuf;
+
+    use lsp_types::SymbolKind;
+
+    use super::WorkspaceSymbolQuery;
+
+    #[test]
+    fn test_workspace_symbol_query() {
+        assert_eq!(
+            WorkspaceSymbolQuery::parse("new in:src/editor data"),
+            WorkspaceSymbolQuery {
+                query: "new data".to_string(),
+                folder: Some(PathBuf::from("src/editor")),
+                kinds: Vec::new(),
+            }
+        );
+        assert_eq!(
+            WorkspaceSymbolQuery::parse("new kind:function,struct,nothing"),
+            WorkspaceSymbolQuery {
+                query: "new".to_string(),
+                folder: None,
+                kinds: vec![SymbolKind::FUNCTION, SymbolKind::STRUCT],
+            }
+        );
+        // A filter that's still being typed filters nothing yet
+        assert_eq!(
+            WorkspaceSymbolQuery::parse("new in: kind:"),
+            WorkspaceSymbolQuery {
+                query: "new".to_string(),
+                folder: None,
+                kinds: Vec::new(),
+            }
+        );
+    }
+}
@@ -51,7 +51,11 @@ pub enum PaletteItemContent {
         kind: SymbolKind,
         name: String,
         container_name: Option<String>,
+        /// The name qualified by its container, as `container > name`
+        breadcrumb: String,
         location: EditorLocation,
+        /// Breaks ties between symbols that match the input equally well
+        kind_priority: usize,
     },
     SshHost {
         host: SshHost,
@@ -81,3 +85,15 @@ pub enum PaletteItemContent {
         profile: lapce_rpc::terminal::TerminalProfile,
     },
 }
+
+impl PaletteItemContent {
+    /// The priority of the symbol kind for workspace symbols, `0` otherwise.
+    pub fn kind_priority(&self) -> usize {
+        match self {
+            PaletteItemContent::WorkspaceSymbol { kind_priority, .. } => {
+                *kind_priority
+            }
+            _ => 0,
+        }
+    }
+}
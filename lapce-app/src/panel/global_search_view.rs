@@ -38,6 +38,7 @@ pub fn global_search_panel(
     let case_matching = global_search.common.find.case_matching;
     let whole_word = global_search.common.find.whole_words;
     let is_regex = global_search.common.find.is_regex;
+    let search_symbols = global_search.search_symbols;
 
     let focus = global_search.common.focus;
     let is_focused = move || focus.get() == Focus::Panel(PanelKind::Search);
@@ -84,6 +85,18 @@ pub fn global_search_panel(
                     config,
                 )
                 .style(|s| s.padding_left(6.0)),
+                clickable_icon(
+                    || LapceIcons::SYMBOL_KIND_FUNCTION,
+                    move || {
+                        search_symbols.update(|search_symbols| {
+                            *search_symbols = !*search_symbols;
+                        });
+                    },
+                    move || search_symbols.get(),
+                    || false,
+                    config,
+                )
+                .style(|s| s.padding_left(6.0)),
             ))
             .on_event_cont(EventListener::PointerDown, move |_| {
                 focus.set(Focus::Panel(PanelKind::Search));
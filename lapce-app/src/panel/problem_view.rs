@@ -7,7 +7,9 @@
     view::View,
     views::{container, dyn_stack, label, scroll, stack, svg, Decorators},
 };
-use lsp_types::{DiagnosticRelatedInformation, DiagnosticSeverity};
+use lsp_types::{
+    Diagnostic, DiagnosticRelatedInformation, DiagnosticSeverity, NumberOrString,
+};
 
 use super::{position::PanelPosition, view::panel_header};
 use crate::{
@@ -17,6 +19,7 @@
     editor::location::{EditorLocation, EditorPosition},
     listener::Listener,
     proxy::path_from_url,
+    web_link::web_link,
     window_tab::WindowTabData,
     workspace::LapceWorkspace,
 };
@@ -238,6 +241,7 @@ fn item_view(
     internal_command: Listener<InternalCommand>,
     config: ReadSignal<Arc<LapceConfig>>,
 ) -> impl View {
+    let code_link = code_link_view(&d.diagnostic, internal_command, config);
     let related = d.diagnostic.related_information.unwrap_or_default();
     let location = EditorLocation {
         path,
@@ -285,11 +289,43 @@ fn item_view(
             });
         })
         .style(|s| s.width_pct(100.0).min_width_pct(0.0)),
+        code_link,
         related_view(related, internal_command, config),
     ))
     .style(|s| s.width_pct(100.0).min_width_pct(0.0).flex_col())
 }
 
+/// The code of the diagnostic, linked to the page explaining it when the server
+/// gave one.
+fn code_link_view(
+    diagnostic: &Diagnostic,
+    internal_command: Listener<InternalCommand>,
+    config: ReadSignal<Arc<LapceConfig>>,
+) -> impl View {
+    let href = diagnostic
+        .code_description
+        .as_ref()
+        .map(|description| description.href.to_string());
+    let is_empty = href.is_none();
+    let href = href.unwrap_or_default();
+    let text = match &diagnostic.code {
+        Some(NumberOrString::String(code)) => code.clone(),
+        Some(NumberOrString::Number(code)) => code.to_string(),
+        None => href.clone(),
+    };
+    container(web_link(
+        move || text.clone(),
+        move || href.clone(),
+        move || config.get().color(LapceColor::EDITOR_LINK),
+        internal_command,
+    ))
+    .style(move |s| {
+        s.padding_left(10.0 + (config.get().ui.icon_size() as f32 + 6.0) * 3.0)
+            .padding_right(10.0)
+            .apply_if(is_empty, |s| s.hide())
+    })
+}
+
 fn related_view(
     related: Vec<DiagnosticRelatedInformation>,
     internal_command: Listener<InternalCommand>,
@@ -14,6 +14,7 @@
 
 use self::{remote::start_remote, ssh::SshRemote};
 use crate::{
+    id::WindowTabId,
     terminal::event::TermEvent,
     workspace::{LapceWorkspace, LapceWorkspaceType},
 };
@@ -42,10 +43,22 @@ pub fn shutdown(&self) {
     }
 }
 
+#[allow(clippy::too_many_arguments)]
 pub fn new_proxy(
+    window_tab_id: WindowTabId,
     workspace: Arc<LapceWorkspace>,
     disabled_volts: Vec<VoltID>,
     plugin_configurations: HashMap<String, HashMap<String, serde_json::Value>>,
+    metrics_port: u16,
+    lsp_heartbeat_interval: u64,
+    lsp_trace: bool,
+    lsp_startup_timeouts: HashMap<String, u64>,
+    lsp_features: HashMap<String, bool>,
+    lsp_auth_token_envs: HashMap<String, String>,
+    lsp_configurations: HashMap<String, serde_json::Value>,
+    lsp_root_markers: HashMap<String, Vec<String>>,
+    lsp_min_versions: HashMap<String, String>,
+    lsp_version_flags: HashMap<String, String>,
     term_tx: Sender<(TermId, TermEvent)>,
 ) -> ProxyData {
     let proxy_rpc = ProxyRpcHandler::new();
@@ -63,7 +76,17 @@ pub fn new_proxy(
                 disabled_volts,
                 plugin_configurations,
                 1,
-                1,
+                window_tab_id.to_raw() as usize,
+                metrics_port,
+                lsp_heartbeat_interval,
+                lsp_trace,
+                lsp_startup_timeouts,
+                lsp_features,
+                lsp_auth_token_envs,
+                lsp_configurations,
+                lsp_root_markers,
+                lsp_min_versions,
+                lsp_version_flags,
             );
 
             match &workspace.kind {
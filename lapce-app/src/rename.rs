@@ -7,15 +7,22 @@
     reactive::{RwSignal, Scope},
     views::editor::id::EditorId,
 };
+use globset::GlobMatcher;
 use lapce_core::{command::FocusCommand, mode::Mode, selection::Selection};
 use lapce_rpc::proxy::ProxyResponse;
 use lapce_xi_rope::Rope;
-use lsp_types::Position;
+use lsp_types::{
+    DocumentChangeOperation, DocumentChanges, MessageType, Position, ResourceOp,
+    ShowMessageParams, Url, WorkspaceEdit,
+};
 
 use crate::{
+    alert::AlertButton,
     command::{CommandExecuted, CommandKind, InternalCommand, LapceCommand},
     editor::EditorData,
     keypress::{condition::Condition, KeyPressFocus},
+    listener::Listener,
+    proxy::path_from_url,
     window_tab::{CommonData, Focus},
 };
 
@@ -134,14 +141,23 @@ fn confirm(&self) {
             .buffer
             .with_untracked(|buffer| buffer.to_string());
         let new_name = new_name.trim();
-        if !new_name.is_empty() {
+        let rename_preview = self
+            .common
+            .config
+            .with_untracked(|config| config.editor.rename_preview);
+        if !new_name.is_empty() && rename_preview {
+            self.preview(new_name.to_string());
+        } else if !new_name.is_empty() {
             let path = self.path.get_untracked();
             let position = self.position.get_untracked();
             let internal_command = self.common.internal_command;
+            let exclude_patterns = self
+                .common
+                .config
+                .with_untracked(|config| config.editor.rename_exclude_patterns());
             let send = create_ext_action(self.common.scope, move |result| {
                 if let Ok(ProxyResponse::Rename { edit }) = result {
-                    internal_command
-                        .send(InternalCommand::ApplyWorkspaceEdit { edit });
+                    apply_rename(edit, &exclude_patterns, internal_command);
                 }
             });
             self.common.proxy.rename(
@@ -155,4 +171,247 @@ fn confirm(&self) {
         }
         self.cancel();
     }
+
+    /// Ask the server for the edit of the rename, and list the files it
+    /// changes. The edit is only applied once the rename is confirmed.
+    fn preview(&self, new_name: String) {
+        let path = self.path.get_untracked();
+        let position = self.position.get_untracked();
+        let scope = self.common.scope;
+        let internal_command = self.common.internal_command;
+        let proxy = self.common.proxy.clone();
+        let exclude_patterns = self
+            .common
+            .config
+            .with_untracked(|config| config.editor.rename_exclude_patterns());
+        let title = format!("Rename to {new_name}?");
+        let send = create_ext_action(self.common.scope, move |result| {
+            let Ok(ProxyResponse::RenamePreview { preview_id, edit }) = result
+            else {
+                return;
+            };
+            let confirm = Rc::new(move || {
+                internal_command.send(InternalCommand::HideAlert);
+                let exclude_patterns = exclude_patterns.clone();
+                let send = create_ext_action(scope, move |result| {
+                    if let Ok(ProxyResponse::Rename { edit }) = result {
+                        apply_rename(edit, &exclude_patterns, internal_command);
+                    }
+                });
+                proxy.confirm_rename(preview_id, move |result| {
+                    send(result);
+                });
+            });
+            internal_command.send(InternalCommand::ShowAlert {
+                title,
+                msg: rename_summary(&edit),
+                buttons: vec![AlertButton {
+                    text: "Rename".to_string(),
+                    action: confirm,
+                }],
+            });
+        });
+        self.common
+            .proxy
+            .rename_preview(path, position, new_name, move |result| {
+                send(result);
+            });
+    }
+}
+
+/// Apply the edit of a rename, leaving out the files that match one of the
+/// exclude `patterns`, which are listed in a warning.
+fn apply_rename(
+    mut edit: WorkspaceEdit,
+    patterns: &[GlobMatcher],
+    internal_command: Listener<InternalCommand>,
+) {
+    let excluded = exclude_files(&mut edit, patterns);
+    if !excluded.is_empty() {
+        let files = excluded
+            .iter()
+            .map(|path| path.to_string_lossy())
+            .collect::<Vec<_>>()
+            .join(", ");
+        internal_command.send(InternalCommand::ShowMessage {
+            title: "Rename".to_string(),
+            message: ShowMessageParams {
+                typ: MessageType::WARNING,
+                message: format!("The excluded files weren't changed: {files}"),
+            },
+        });
+    }
+    internal_command.send(InternalCommand::ApplyWorkspaceEdit { edit });
+}
+
+/// The files the rename `edit` changes, a line each with how many edits it
+/// makes in the file.
+fn rename_summary(edit: &WorkspaceEdit) -> String {
+    let mut files: Vec<(PathBuf, usize)> = Vec::new();
+    let mut add = |uri: &Url, count: usize| {
+        let path = path_from_url(uri);
+        match files.iter_mut().find(|(file, _)| *file == path) {
+            Some((_, total)) => *total += count,
+            None => files.push((path, count)),
+        }
+    };
+
+    if let Some(changes) = edit.changes.as_ref() {
+        for (uri, edits) in changes {
+            add(uri, edits.len());
+        }
+    }
+    match edit.document_changes.as_ref() {
+        Some(DocumentChanges::Edits(edits)) => {
+            for edit in edits {
+                add(&edit.text_document.uri, edit.edits.len());
+            }
+        }
+        Some(DocumentChanges::Operations(ops)) => {
+            for op in ops {
+                if let DocumentChangeOperation::Edit(edit) = op {
+                    add(&edit.text_document.uri, edit.edits.len());
+                }
+            }
+        }
+        None => {}
+    }
+
+    files.sort();
+    files
+        .iter()
+        .map(|(path, count)| {
+            let edits = if *count == 1 { "edit" } else { "edits" };
+            format!("{}: {count} {edits}", path.to_string_lossy())
+        })
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+/// Drop the changes of the rename `edit` to the files that match one of the
+/// `patterns`, returning those files.
+fn exclude_files(
+    edit: &mut WorkspaceEdit,
+    patterns: &[GlobMatcher],
+) -> Vec<PathBuf> {
+    if patterns.is_empty() {
+        return Vec::new();
+    }
+
+    let mut excluded = Vec::new();
+    let mut keep = |uri: &Url| {
+        let path = path_from_url(uri);
+        if !patterns.iter().any(|pattern| pattern.is_match(&path)) {
+            return true;
+        }
+        if !excluded.contains(&path) {
+            excluded.push(path);
+        }
+        false
+    };
+
+    if let Some(changes) = edit.changes.as_mut() {
+        changes.retain(|uri, _| keep(uri));
+    }
+    match edit.document_changes.as_mut() {
+        Some(DocumentChanges::Edits(edits)) => {
+            edits.retain(|edit| keep(&edit.text_document.uri));
+        }
+        Some(DocumentChanges::Operations(ops)) => {
+            ops.retain(|op| match op {
+                DocumentChangeOperation::Edit(edit) => keep(&edit.text_document.uri),
+                DocumentChangeOperation::Op(ResourceOp::Create(create)) => {
+                    keep(&create.uri)
+                }
+                DocumentChangeOperation::Op(ResourceOp::Rename(rename)) => {
+                    keep(&rename.old_uri) & keep(&rename.new_uri)
+                }
+                DocumentChangeOperation::Op(ResourceOp::Delete(delete)) => {
+                    keep(&delete.uri)
+                }
+            });
+        }
+        None => {}
+    }
+
+    excluded.sort();
+    excluded
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{collections::HashMap, path::PathBuf};
+
+    use globset::Glob;
+    use lsp_types::{
+        DocumentChanges, OptionalVersionedTextDocumentIdentifier, Range,
+        TextDocumentEdit, TextEdit, Url, WorkspaceEdit,
+    };
+
+    use super::{exclude_files, rename_summary};
+
+    #[test]
+    fn test_exclude_files() {
+        let uri = |path: &str| Url::parse(&format!("file://{path}")).unwrap();
+        let patterns = [Glob::new("**/*.pb.go").unwrap().compile_matcher()];
+
+        let mut edit = WorkspaceEdit {
+            changes: Some(HashMap::from([
+                (uri("/src/main.go"), Vec::new()),
+                (uri("/src/api.pb.go"), Vec::new()),
+            ])),
+            ..Default::default()
+        };
+        assert_eq!(
+            exclude_files(&mut edit, &patterns),
+            vec![PathBuf::from("/src/api.pb.go")]
+        );
+        let changes = edit.changes.unwrap();
+        assert!(changes.contains_key(&uri("/src/main.go")));
+        assert_eq!(changes.len(), 1);
+
+        let document_edit = |path: &str| TextDocumentEdit {
+            text_document: OptionalVersionedTextDocumentIdentifier {
+                uri: uri(path),
+                version: None,
+            },
+            edits: Vec::new(),
+        };
+        let mut edit = WorkspaceEdit {
+            document_changes: Some(DocumentChanges::Edits(vec![
+                document_edit("/src/api.pb.go"),
+                document_edit("/src/main.go"),
+            ])),
+            ..Default::default()
+        };
+        assert_eq!(
+            exclude_files(&mut edit, &patterns),
+            vec![PathBuf::from("/src/api.pb.go")]
+        );
+        let Some(DocumentChanges::Edits(edits)) = edit.document_changes else {
+            panic!("the document changes should still be edits");
+        };
+        assert_eq!(edits, vec![document_edit("/src/main.go")]);
+    }
+
+    #[test]
+    fn test_rename_summary() {
+        let uri = |path: &str| Url::parse(&format!("file://{path}")).unwrap();
+        let text_edit = TextEdit {
+            range: Range::default(),
+            new_text: "name".to_string(),
+        };
+        let edit = WorkspaceEdit {
+            changes: Some(HashMap::from([
+                (uri("/src/b.go"), vec![text_edit.clone()]),
+                (uri("/src/a.go"), vec![text_edit.clone(), text_edit]),
+            ])),
+            ..Default::default()
+        };
+        assert_eq!(
+            rename_summary(&edit),
+            "/src/a.go: 2 edits\n/src/b.go: 1 edit"
+        );
+        assert_eq!(rename_summary(&WorkspaceEdit::default()), "");
+    }
 }
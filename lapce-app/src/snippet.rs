@@ -253,6 +253,14 @@ pub fn tabs(&self, pos: usize) -> Vec<(usize, (usize, usize))> {
         Self::elements_tabs(&self.elements, pos)
     }
 
+    /// The tabs in the order they are visited, by their number with the final
+    /// `$0` tab last.
+    pub fn ordered_tabs(&self, pos: usize) -> Vec<(usize, (usize, usize))> {
+        let mut tabs = self.tabs(pos);
+        tabs.sort_by_key(|(tab, _)| if *tab == 0 { usize::MAX } else { *tab });
+        tabs
+    }
+
     pub fn elements_tabs(
         elements: &[SnippetElement],
         start: usize,
@@ -414,6 +422,21 @@ fn test_snippet() {
         );
     }
 
+    #[test]
+    fn test_ordered_tabs() {
+        let parsed = Snippet::from_str("$0 ${2:second ${1:first}} $3").unwrap();
+        assert_eq!(
+            vec![(1, (8, 13)), (2, (1, 13)), (3, (14, 14)), (0, (0, 0))],
+            parsed.ordered_tabs(0)
+        );
+
+        let parsed = Snippet::from_str("fn ${1:name}($2) {\n\t$0\n}").unwrap();
+        assert_eq!(
+            vec![(1, (3, 7)), (2, (8, 8)), (0, (13, 13))],
+            parsed.ordered_tabs(0)
+        );
+    }
+
     #[test]
     fn test_extract_tabstop() {
         fn vec_of_tab_elms(s: &str) -> Vec<(usize, usize)> {
@@ -1,5 +1,5 @@
 use std::{
-    collections::{BTreeMap, HashSet},
+    collections::{BTreeMap, HashMap, HashSet},
     env,
     path::{Path, PathBuf},
     rc::Rc,
@@ -21,19 +21,23 @@
 use indexmap::IndexMap;
 use itertools::Itertools;
 use lapce_core::{
-    command::FocusCommand, cursor::CursorAffinity, directory::Directory, meta,
-    mode::Mode, register::Register,
+    buffer::rope_text::RopeText, command::FocusCommand, cursor::CursorAffinity,
+    directory::Directory, meta, mode::Mode, register::Register,
+    rope_text_pos::RopeTextPosition,
 };
 use lapce_rpc::{
     core::CoreNotification,
-    dap_types::RunDebugConfig,
+    dap_types::{self, RunDebugConfig, StackFrame, Stopped, ThreadId, Variable},
     file::{PathObject, RenameState},
     proxy::{ProxyResponse, ProxyRpcHandler, ProxyStatus},
     source_control::FileDiff,
     terminal::TermId,
     RpcError,
 };
-use lsp_types::{ProgressParams, ProgressToken, ShowMessageParams};
+use lsp_types::{
+    InlineValueContext, Position, ProgressParams, ProgressToken, ShowMessageParams,
+    ShowMessageRequestParams, SignatureHelp,
+};
 use serde_json::Value;
 use tracing::{debug, error};
 
@@ -48,9 +52,14 @@
     completion::{CompletionData, CompletionStatus},
     config::LapceConfig,
     db::LapceDb,
-    debug::{DapData, LapceBreakpoint, RunDebugMode, RunDebugProcess},
+    debug::{
+        inline_value_lines, DapData, LapceBreakpoint, RunDebugMode, RunDebugProcess,
+    },
     doc::{DocContent, EditorDiagnostic},
-    editor::location::{EditorLocation, EditorPosition},
+    editor::{
+        location::{EditorLocation, EditorPosition},
+        signature_help_content,
+    },
     editor_tab::EditorTabChild,
     file_explorer::data::FileExplorerData,
     find::Find,
@@ -138,6 +147,10 @@ pub struct CommonData {
     // the current focused view which will receive keyboard events
     pub keyboard_focus: RwSignal<Option<floem::id::Id>>,
     pub window_common: Rc<WindowCommonData>,
+    /// The characters that trigger on type formatting on any of the servers
+    pub on_type_formatting_triggers: RwSignal<HashSet<String>>,
+    /// The characters that trigger signature help on any of the servers
+    pub signature_help_triggers: RwSignal<HashSet<String>>,
 }
 
 #[derive(Clone)]
@@ -288,10 +301,22 @@ pub fn new(
             });
         }
 
+        let window_tab_id = WindowTabId::next();
         let proxy = new_proxy(
+            window_tab_id,
             workspace.clone(),
             all_disabled_volts,
             config.plugins.clone(),
+            config.core.metrics_port,
+            config.core.lsp_heartbeat_interval,
+            config.core.lsp_trace,
+            config.core.lsp_startup_timeout.clone(),
+            config.core.lsp_features.clone(),
+            config.core.lsp_auth_token_env.clone(),
+            config.core.lsp_configuration.clone(),
+            config.core.lsp_root_markers.clone(),
+            config.core.lsp_min_versions.clone(),
+            config.core.lsp_version_flags.clone(),
             term_tx.clone(),
         );
         let (config, set_config) = cx.create_signal(Arc::new(config));
@@ -347,6 +372,8 @@ pub fn new(
             breakpoints: cx.create_rw_signal(BTreeMap::new()),
             keyboard_focus: cx.create_rw_signal(None),
             window_common: window_common.clone(),
+            on_type_formatting_triggers: cx.create_rw_signal(HashSet::new()),
+            signature_help_triggers: cx.create_rw_signal(HashSet::new()),
         });
 
         let main_split = MainSplitData::new(cx, common.clone());
@@ -485,7 +512,7 @@ pub fn new(
 
         let window_tab_data = Self {
             scope: cx,
-            window_tab_id: WindowTabId::next(),
+            window_tab_id,
             workspace,
             palette,
             main_split,
@@ -577,6 +604,16 @@ pub fn reload_config(&self) {
         self.common.keypress.update(|keypress| {
             keypress.update_keymaps(&config);
         });
+        // Let the language servers pick up their changed settings without a restart
+        if self
+            .common
+            .config
+            .with_untracked(|c| c.plugins != config.plugins)
+        {
+            self.common
+                .proxy
+                .update_plugin_configs(config.plugins.clone());
+        }
         self.set_config.set(Arc::new(config));
     }
 
@@ -1254,6 +1291,86 @@ pub fn run_workbench_command(
                 self.main_split.next_error();
             }
             PreviousError => {}
+            QuickFix => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.quick_fix();
+                }
+            }
+            GoToImplementation => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.go_to_implementation();
+                }
+            }
+            ExpandSelection => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.expand_selection();
+                }
+            }
+            ConvertColor => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.convert_color();
+                }
+            }
+            GoToDeclaration => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.go_to_declaration();
+                }
+            }
+            GoToMoniker => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.go_to_moniker();
+                }
+            }
+            ShowCallHierarchy => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.show_call_hierarchy();
+                }
+            }
+            ShowIncomingCalls => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.show_calls(true);
+                }
+            }
+            ShowOutgoingCalls => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.show_calls(false);
+                }
+            }
+            FixAllDiagnostics => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.fix_all_diagnostics();
+                }
+            }
+            FormatSelection => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.format_selection();
+                }
+            }
+            ShowHover => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.hover_selection();
+                }
+            }
+            ShowSignatureHelp => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.signature_help();
+                }
+            }
+            ToggleFold => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.toggle_fold();
+                }
+            }
+            UnfoldAll => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.doc().unfold_all();
+                }
+            }
+            RunCodeLens => {
+                if let Some(editor) = self.main_split.active_editor.get_untracked() {
+                    editor.run_code_lens();
+                }
+            }
             Quit => {
                 floem::quit_app();
             }
@@ -1334,7 +1451,7 @@ pub fn run_internal_command(&self, cmd: InternalCommand) {
                 let send_current_path = current_path.clone();
                 let send_new_path = new_path.clone();
                 let file_explorer = self.file_explorer.clone();
-                let editors = self.main_split.editors;
+                let main_split = self.main_split.clone();
 
                 let send = create_ext_action(
                     self.scope,
@@ -1350,43 +1467,8 @@ pub fn run_internal_command(&self, cmd: InternalCommand) {
                                     send_new_path
                                 };
 
-                            // If the renamed item is a file, update any editors the file is open
-                            // in to use the new path.
-                            // If the renamed item is a directory, update any editors in which a
-                            // file the renamed directory is an ancestor of is open to use the
-                            // file's new path.
-                            let renamed_editors_content: Vec<_> = editors
-                                .with_untracked(|editors| {
-                                    editors
-                                        .values()
-                                        .map(|editor| editor.doc().content)
-                                        .filter(|content| {
-                                            content.with_untracked(|content| {
-                                                match content {
-                                                    DocContent::File {
-                                                        path,
-                                                        ..
-                                                    } => path.starts_with(
-                                                        &send_current_path,
-                                                    ),
-                                                    _ => false,
-                                                }
-                                            })
-                                        })
-                                        .collect()
-                                });
-
-                            for content in renamed_editors_content {
-                                content.update(|content| {
-                                    if let DocContent::File { path, .. } = content {
-                                        if let Ok(suffix) =
-                                            path.strip_prefix(&send_current_path)
-                                        {
-                                            *path = new_path.join(suffix);
-                                        }
-                                    }
-                                });
-                            }
+                            main_split
+                                .rename_open_paths(&send_current_path, &new_path);
 
                             file_explorer.reload();
                             file_explorer.rename_state.set(RenameState::NotRenaming);
@@ -1576,8 +1658,12 @@ pub fn run_internal_command(&self, cmd: InternalCommand) {
             } => {
                 self.show_alert(title, msg, buttons);
             }
+            InternalCommand::ShowMessage { title, message } => {
+                self.show_message(&title, &message);
+            }
             InternalCommand::HideAlert => {
                 self.alert_data.active.set(false);
+                self.alert_data.cancel();
             }
             InternalCommand::SaveScratchDoc { doc } => {
                 self.main_split.save_scratch_doc(doc);
@@ -1662,9 +1748,10 @@ fn handle_core_notification(&self, rpc: &CoreNotification) {
                         editor_data.cursor().with_untracked(|c| c.offset());
                     completion
                         .update_document_completion(&editor_data, cursor_offset);
+                    editor_data.resolve_active_completion();
                 }
             }
-            CoreNotification::PublishDiagnostics { diagnostics } => {
+            CoreNotification::PublishDiagnostics { diagnostics, stale } => {
                 let path = path_from_url(&diagnostics.uri);
                 let diagnostics: im::Vector<EditorDiagnostic> = diagnostics
                     .diagnostics
@@ -1676,17 +1763,25 @@ fn handle_core_notification(&self, rpc: &CoreNotification) {
                     .sorted_by_key(|d| d.diagnostic.range.start)
                     .collect();
 
-                self.main_split
-                    .get_diagnostic_data(&path)
-                    .diagnostics
-                    .set(diagnostics);
-
-                // inform the document about the diagnostics
-                if let Some(doc) = self
+                let diagnostic_data = self.main_split.get_diagnostic_data(&path);
+                let doc = self
                     .main_split
                     .docs
-                    .with_untracked(|docs| docs.get(&path).cloned())
-                {
+                    .with_untracked(|docs| docs.get(&path).cloned());
+                let on_save = self
+                    .common
+                    .config
+                    .with_untracked(|config| config.editor.diagnostics_on_save);
+                if on_save && doc.as_ref().is_some_and(|doc| !doc.is_pristine()) {
+                    diagnostic_data.pending.set(Some(diagnostics));
+                    return;
+                }
+                diagnostic_data.pending.set(None);
+                diagnostic_data.stale.set(*stale);
+                diagnostic_data.diagnostics.set(diagnostics);
+
+                // inform the document about the diagnostics
+                if let Some(doc) = doc {
                     doc.init_diagnostics();
                 }
             }
@@ -1727,12 +1822,14 @@ fn handle_core_notification(&self, rpc: &CoreNotification) {
             } => {
                 self.terminal
                     .dap_stopped(dap_id, stopped, stack_frames, variables);
+                self.get_inline_values(stopped, stack_frames, variables);
             }
             CoreNotification::OpenPaths { paths } => {
                 self.open_paths(paths);
             }
             CoreNotification::DapContinued { dap_id } => {
                 self.terminal.dap_continued(dap_id);
+                self.clear_inline_values();
             }
             CoreNotification::DapBreakpointsResp {
                 path, breakpoints, ..
@@ -1783,28 +1880,121 @@ fn handle_core_notification(&self, rpc: &CoreNotification) {
             CoreNotification::WorkDoneProgress { progress } => {
                 self.update_progress(progress);
             }
+            CoreNotification::PartialSemanticStyles { styles } => {
+                if let Some(doc) = self
+                    .main_split
+                    .docs
+                    .with_untracked(|docs| docs.get(&styles.path).cloned())
+                {
+                    doc.add_partial_semantic_styles(styles);
+                }
+            }
             CoreNotification::ShowMessage { title, message } => {
                 self.show_message(title, message);
             }
+            CoreNotification::ShowMessageRequest {
+                title,
+                request_id,
+                message,
+            } => {
+                self.show_message_request(
+                    title.clone(),
+                    *request_id,
+                    message.clone(),
+                );
+            }
+            CoreNotification::CodeLens {
+                path,
+                plugin_id,
+                lenses,
+            } => {
+                let doc = self
+                    .main_split
+                    .docs
+                    .with_untracked(|docs| docs.get(path).cloned());
+                if let Some(doc) = doc {
+                    doc.set_code_lenses(*plugin_id, lenses.clone());
+                }
+            }
+            CoreNotification::CodeLensRefresh => {
+                let docs = self.main_split.docs.get_untracked();
+                for doc in docs.values() {
+                    if doc.loaded() {
+                        doc.get_code_lens();
+                    }
+                }
+            }
+            CoreNotification::ShowDocument { params } => {
+                if params.external == Some(true) || params.uri.scheme() != "file" {
+                    self.common
+                        .internal_command
+                        .send(InternalCommand::OpenWebUri {
+                            uri: params.uri.to_string(),
+                        });
+                } else {
+                    self.main_split.jump_to_location(
+                        EditorLocation {
+                            path: path_from_url(&params.uri),
+                            position: params.selection.map(|selection| {
+                                EditorPosition::Position(selection.start)
+                            }),
+                            scroll_offset: None,
+                            ignore_unconfirmed: false,
+                            same_editor_tab: false,
+                        },
+                        None,
+                    );
+                }
+            }
+            CoreNotification::ApplyWorkspaceEdit {
+                request_id,
+                edit,
+                renamed,
+            } => {
+                for (from, to) in renamed {
+                    self.main_split.rename_open_paths(from, to);
+                }
+                let applied = self.main_split.apply_workspace_edit(edit);
+                self.common
+                    .proxy
+                    .apply_workspace_edit_response(*request_id, applied);
+            }
+            CoreNotification::OnTypeFormattingTriggers { triggers } => {
+                self.common
+                    .on_type_formatting_triggers
+                    .set(triggers.iter().cloned().collect());
+            }
+            CoreNotification::SignatureHelpTriggers { triggers } => {
+                self.common
+                    .signature_help_triggers
+                    .set(triggers.iter().cloned().collect());
+            }
+            CoreNotification::SignatureHelpResponse {
+                request_id, resp, ..
+            } => {
+                self.show_signature_help(*request_id, resp);
+            }
             CoreNotification::Log { level, message } => {
+                // Every window tab has its own proxy, so tell their logs apart
+                let window_tab = self.window_tab_id.to_raw();
                 match level.as_str() {
                     "TRACE" => {
-                        tracing::trace!(message);
+                        tracing::trace!(window_tab, message);
                     }
                     "DEBUG" => {
-                        tracing::debug!(message);
+                        tracing::debug!(window_tab, message);
                     }
                     "INFO" => {
-                        tracing::info!(message);
+                        tracing::info!(window_tab, message);
                     }
                     "WARN" => {
-                        tracing::warn!(message);
+                        tracing::warn!(window_tab, message);
                     }
                     "ERROR" => {
-                        tracing::error!(message);
+                        tracing::error!(window_tab, message);
                     }
                     _ => {
-                        tracing::debug!(message);
+                        tracing::debug!(window_tab, message);
                     }
                 };
             }
@@ -1892,7 +2082,7 @@ pub fn hover_origin(&self) -> Option<Point> {
         let (window_origin, viewport, editor) = (
             editor_data.window_origin(),
             editor_data.viewport(),
-            &editor_data.editor,
+            &editor_data,
         );
 
         // TODO(minor): affinity should be gotten from where the hover was started at.
@@ -1941,7 +2131,7 @@ pub fn completion_origin(&self) -> Point {
         let (window_origin, viewport, editor) = (
             editor_data.window_origin(),
             editor_data.viewport(),
-            &editor_data.editor,
+            &editor_data,
         );
 
         // TODO(minor): What affinity should we use for this? Probably just use the cursor's
@@ -1997,7 +2187,7 @@ pub fn code_action_origin(&self) -> Point {
         let (window_origin, viewport, editor) = (
             editor_data.window_origin(),
             editor_data.viewport(),
-            &editor_data.editor,
+            &editor_data,
         );
 
         // TODO(minor): What affinity should we use for this?
@@ -2052,7 +2242,7 @@ pub fn rename_origin(&self) -> Point {
         let (window_origin, viewport, editor) = (
             editor_data.window_origin(),
             editor_data.viewport(),
-            &editor_data.editor,
+            &editor_data,
         );
 
         // TODO(minor): What affinity should we use for this?
@@ -2276,6 +2466,107 @@ fn run_in_terminal(
         }
     }
 
+    /// Show the signature of the call at the cursor in the hover if it answers
+    /// the last request, or hide it once the cursor left the call.
+    fn show_signature_help(&self, request_id: usize, resp: &SignatureHelp) {
+        let hover = &self.common.hover;
+        let Some(request) = hover
+            .signature
+            .get_untracked()
+            .filter(|request| request.id == request_id)
+        else {
+            return;
+        };
+        let config = self.common.config.get_untracked();
+        match signature_help_content(resp, &config) {
+            Some(content) => {
+                hover.content.set(content);
+                hover.offset.set(request.offset);
+                hover.editor_id.set(request.editor_id);
+                hover.active.set(true);
+            }
+            None => {
+                if hover.shows_signature(request.editor_id) {
+                    hover.active.set(false);
+                }
+                hover.signature.set(None);
+            }
+        }
+    }
+
+    /// Ask the language server for the values to show at the end of the lines
+    /// of the frame the debugger stopped in, looking them up in the variables
+    /// of the frame.
+    fn get_inline_values(
+        &self,
+        stopped: &Stopped,
+        stack_frames: &HashMap<ThreadId, Vec<StackFrame>>,
+        variables: &[(dap_types::Scope, Vec<Variable>)],
+    ) {
+        self.clear_inline_values();
+
+        let thread_id = stopped.thread_id.unwrap_or_default();
+        let Some(frame) = stack_frames
+            .get(&thread_id)
+            .and_then(|frames| frames.first())
+        else {
+            return;
+        };
+        let Some(path) = frame.source.as_ref().and_then(|s| s.path.clone()) else {
+            return;
+        };
+        let line = frame.line.saturating_sub(1) as u32;
+        let column = frame.column.saturating_sub(1) as u32;
+        let context = InlineValueContext {
+            frame_id: frame.id as i32,
+            stopped_location: lsp_types::Range::new(
+                Position::new(line, column),
+                Position::new(line, column),
+            ),
+        };
+        // The values are shown for the lines up to the one stopped on
+        let range =
+            lsp_types::Range::new(Position::new(0, 0), Position::new(line + 1, 0));
+        let variables: Vec<Variable> = variables
+            .iter()
+            .flat_map(|(_, variables)| variables.iter().cloned())
+            .collect();
+
+        let docs = self.main_split.docs;
+        let doc_path = path.clone();
+        let send = create_ext_action(self.scope, move |values| {
+            let Some(doc) = docs.with_untracked(|docs| docs.get(&doc_path).cloned())
+            else {
+                return;
+            };
+            let lines = doc.buffer.with_untracked(|buffer| {
+                inline_value_lines(&values, &variables, |range| {
+                    let start = buffer.offset_of_position(&range.start);
+                    let end = buffer.offset_of_position(&range.end);
+                    buffer.slice_to_cow(start..end).to_string()
+                })
+            });
+            doc.set_inline_values(lines);
+        });
+        self.common
+            .proxy
+            .get_inline_values(path, range, context, move |result| {
+                if let Ok(ProxyResponse::GetInlineValues { values }) = result {
+                    send(values);
+                }
+            });
+    }
+
+    /// Stop showing the values of variables of the frame the debugger was
+    /// stopped in.
+    fn clear_inline_values(&self) {
+        self.main_split.docs.with_untracked(|docs| {
+            for doc in docs.values() {
+                doc.set_inline_values(Vec::new());
+            }
+        });
+    }
+
     pub fn open_paths(&self, paths: &[PathObject]) {
         let (folders, files): (Vec<&PathObject>, Vec<&PathObject>) =
             paths.iter().partition(|p| p.is_dir);
@@ -2321,9 +2612,48 @@ pub fn show_alert(&self, title: String, msg: String, buttons: Vec<AlertButton>)
         self.alert_data.title.set(title);
         self.alert_data.msg.set(msg);
         self.alert_data.buttons.set(buttons);
+        // The alert that's replaced is cancelled
+        self.alert_data.cancel();
         self.alert_data.active.set(true);
     }
 
+    /// Asks the user to pick one of the actions of a message a server showed,
+    /// and sends the picked action back to it, or `None` if it was cancelled,
+    /// hidden or replaced by another alert.
+    fn show_message_request(
+        &self,
+        title: String,
+        request_id: u64,
+        message: ShowMessageRequestParams,
+    ) {
+        let internal_command = self.common.internal_command;
+        let on_cancel = self.alert_data.on_cancel;
+        let proxy = self.common.proxy.clone();
+        let buttons = message
+            .actions
+            .unwrap_or_default()
+            .into_iter()
+            .map(|action| {
+                let proxy = proxy.clone();
+                AlertButton {
+                    text: action.title.clone(),
+                    action: Rc::new(move || {
+                        on_cancel.set(None);
+                        internal_command.send(InternalCommand::HideAlert);
+                        proxy.show_message_request_response(
+                            request_id,
+                            Some(action.clone()),
+                        );
+                    }),
+                }
+            })
+            .collect();
+        self.show_alert(title, message.message, buttons);
+        self.alert_data.on_cancel.set(Some(Rc::new(move || {
+            proxy.show_message_request_response(request_id, None);
+        })));
+    }
+
     fn update_progress(&self, progress: &ProgressParams) {
         let token = progress.token.clone();
         match &progress.value {
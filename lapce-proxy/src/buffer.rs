@@ -10,9 +10,9 @@
 
 use anyhow::{anyhow, Result};
 use floem_editor_core::buffer::rope_text::CharIndicesJoin;
-use lapce_core::encoding::offset_utf8_to_utf16;
+use lapce_core::encoding::{offset_utf16_to_utf8, offset_utf8_to_utf16};
 use lapce_rpc::buffer::BufferId;
-use lapce_xi_rope::{interval::IntervalBounds, rope::Rope, RopeDelta};
+use lapce_xi_rope::{interval::IntervalBounds, rope::Rope, DeltaBuilder, RopeDelta};
 use lsp_types::*;
 
 #[derive(Clone)]
@@ -41,9 +41,9 @@ pub fn new(id: BufferId, path: PathBuf) -> Buffer {
                 None => ("Not Supported".to_string(), true),
             },
         };
+        let language_id = language_id_from_path_and_content(&path, &s).unwrap_or("");
         let rope = Rope::from(s);
         let rev = u64::from(!rope.is_empty());
-        let language_id = language_id_from_path(&path).unwrap_or("");
         let mod_time = get_mod_time(&path);
         Buffer {
             id,
@@ -159,6 +159,85 @@ pub fn offset_to_position(&self, offset: usize) -> Position {
         }
     }
 
+    /// Converts a UTF16 LSP position to a UTF8 offset
+    pub fn offset_of_position(&self, position: &Position) -> usize {
+        let line = (position.line as usize).min(self.line_of_offset(self.len()));
+        let line_offset = self.offset_of_line(line);
+        let col = offset_utf16_to_utf8(
+            self.char_indices_iter(line_offset..),
+            position.character as usize,
+        );
+        (line_offset + col).min(self.len())
+    }
+
+    /// Applies the text edits to the buffer content, and returns the delta of the
+    /// changes. Every edit is trimmed down to the text that it actually changes,
+    /// so that e.g. formatting doesn't replace whole lines that stay the same.
+    pub fn text_edits_delta(&self, edits: &[TextEdit]) -> RopeDelta {
+        let mut builder = DeltaBuilder::new(self.len());
+        for (start, end, new_text) in self.trimmed_text_edits(edits) {
+            builder.replace(start..end, Rope::from(new_text));
+        }
+        builder.build()
+    }
+
+    /// The text edits trimmed down to the text that they actually change, so
+    /// that applying them in the editor leaves the rest of the text, and the
+    /// cursors in it, alone.
+    pub fn minimal_text_edits(&self, edits: &[TextEdit]) -> Vec<TextEdit> {
+        self.trimmed_text_edits(edits)
+            .into_iter()
+            .map(|(start, end, new_text)| {
+                TextEdit::new(
+                    Range::new(
+                        self.offset_to_position(start),
+                        self.offset_to_position(end),
+                    ),
+                    new_text.to_string(),
+                )
+            })
+            .collect()
+    }
+
+    /// The offsets of the text that each of the text edits actually changes,
+    /// and its new text, in order. Overlapping edits are left out.
+    fn trimmed_text_edits<'a>(
+        &self,
+        edits: &'a [TextEdit],
+    ) -> Vec<(usize, usize, &'a str)> {
+        let mut edits: Vec<(usize, usize, &str)> = edits
+            .iter()
+            .map(|edit| {
+                (
+                    self.offset_of_position(&edit.range.start),
+                    self.offset_of_position(&edit.range.end),
+                    edit.new_text.as_str(),
+                )
+            })
+            .collect();
+        edits.sort_by_key(|(start, end, _)| (*start, *end));
+
+        let mut trimmed = Vec::new();
+        let mut last_end = 0;
+        for (start, end, new_text) in edits {
+            // Overlapping edits are invalid
+            if start < last_end {
+                continue;
+            }
+            last_end = end;
+
+            let old_text = self.slice_to_cow(start..end);
+            let prefix = common_prefix_len(&old_text, new_text);
+            let suffix = common_suffix_len(&old_text[prefix..], &new_text[prefix..]);
+            let new_text = &new_text[prefix..new_text.len() - suffix];
+            let (start, end) = (start + prefix, end - suffix);
+            if start < end || !new_text.is_empty() {
+                trimmed.push((start, end, new_text));
+            }
+        }
+        trimmed
+    }
+
     pub fn slice_to_cow<T: IntervalBounds>(&self, range: T) -> Cow<str> {
         self.rope.slice_to_cow(range)
     }
@@ -289,6 +368,50 @@ pub fn language_id_from_path(path: &Path) -> Option<&'static str> {
     })
 }
 
+/// Get the language id of a file from its path, or from the shebang on its first
+/// line for scripts that have no extension or a generic `.sh` one.
+pub fn language_id_from_path_and_content(
+    path: &Path,
+    content: &str,
+) -> Option<&'static str> {
+    let language_id = language_id_from_path(path);
+    match path.extension() {
+        Some(ext) if ext != "sh" => language_id,
+        _ => content
+            .lines()
+            .next()
+            .and_then(language_id_from_shebang)
+            .or(language_id),
+    }
+}
+
+/// Get the language id from a shebang line like `#!/usr/bin/env python3`.
+fn language_id_from_shebang(line: &str) -> Option<&'static str> {
+    let mut args = line.strip_prefix("#!")?.split_whitespace();
+    let mut program = args.next()?;
+    if program.ends_with("/env") {
+        // Skip the flags of env, e.g. `#!/usr/bin/env -S node --flag`
+        program = args.find(|arg| !arg.starts_with('-'))?;
+    }
+    let program = program.rsplit('/').next()?;
+    // Ignore the version of the interpreter, e.g. `python3.11`
+    let program = program.trim_end_matches(|c: char| c.is_ascii_digit() || c == '.');
+    Some(match program {
+        "python" => "python",
+        "node" | "nodejs" | "deno" | "bun" => "javascript",
+        "sh" | "bash" | "zsh" | "dash" | "ksh" => "shellscript",
+        "ruby" => "ruby",
+        "perl" => "perl",
+        "php" => "php",
+        "lua" | "luajit" => "lua",
+        "pwsh" => "powershell",
+        "Rscript" => "r",
+        "julia" => "julia",
+        "elixir" => "elixir",
+        _ => return None,
+    })
+}
+
 fn get_document_content_changes(
     delta: &RopeDelta,
     buffer: &Buffer,
@@ -328,6 +451,25 @@ fn get_document_content_changes(
     }
 }
 
+/// The length in bytes of the common prefix of the texts.
+fn common_prefix_len(a: &str, b: &str) -> usize {
+    a.char_indices()
+        .zip(b.chars())
+        .find(|((_, a), b)| a != b)
+        .map(|((i, _), _)| i)
+        .unwrap_or_else(|| a.len().min(b.len()))
+}
+
+/// The length in bytes of the common suffix of the texts.
+fn common_suffix_len(a: &str, b: &str) -> usize {
+    a.chars()
+        .rev()
+        .zip(b.chars().rev())
+        .take_while(|(a, b)| a == b)
+        .map(|(c, _)| c.len_utf8())
+        .sum()
+}
+
 /// Returns the modification timestamp for the file at a given path,
 /// if present.
 pub fn get_mod_time<P: AsRef<Path>>(path: P) -> Option<SystemTime> {
@@ -336,3 +478,76 @@ pub fn get_mod_time<P: AsRef<Path>>(path: P) -> Option<SystemTime> {
         .and_then(|meta| meta.modified())
         .ok()
 }
+
+#[cfg(test)]
+mod tests {
+    use std::path::PathBuf;
+
+    use lapce_rpc::buffer::BufferId;
+    use lapce_xi_rope::Rope;
+    use lsp_types::{Position, Range, TextEdit};
+
+    use super::Buffer;
+
+    fn buffer(text: &str) -> Buffer {
+        Buffer {
+            language_id: "",
+            read_only: false,
+            id: BufferId::next(),
+            rope: Rope::from(text),
+            path: PathBuf::new(),
+            rev: 0,
+            mod_time: None,
+        }
+    }
+
+    fn edit(start: (u32, u32), end: (u32, u32), new_text: &str) -> TextEdit {
+        TextEdit::new(
+            Range::new(Position::new(start.0, start.1), Position::new(end.0, end.1)),
+            new_text.to_string(),
+        )
+    }
+
+    #[test]
+    fn test_text_edits_delta() {
+        let buffer = buffer("fn main(){\n  let a=1;\n}\n");
+        let edits = [
+            edit((0, 0), (1, 10), "fn main() {\n    let a = 1;"),
+            edit((2, 1), (2, 1), "// end"),
+        ];
+        let delta = buffer.text_edits_delta(&edits);
+        assert_eq!(
+            delta.apply(&buffer.rope).to_string(),
+            "fn main() {\n    let a = 1;\n}// end\n"
+        );
+
+        // The unchanged `fn main()` isn't part of the delta
+        let (interval, _) = delta.summary();
+        assert_eq!(interval.start(), 9);
+    }
+
+    #[test]
+    fn test_text_edits_delta_unchanged() {
+        let buffer = buffer("let a = 1;\n");
+        let delta = buffer.text_edits_delta(&[edit((0, 0), (1, 0), "let a = 1;\n")]);
+        assert!(delta.is_identity());
+    }
+
+    #[test]
+    fn test_minimal_text_edits() {
+        let buffer = buffer("fn main(){\n  let a=1;\n}\n");
+        let edits = [
+            edit((2, 1), (2, 1), "// end"),
+            edit((0, 0), (1, 10), "fn main() {\n    let a = 1;"),
+            // Edits that change nothing are left out
+            edit((2, 0), (2, 1), "}"),
+        ];
+        assert_eq!(
+            buffer.minimal_text_edits(&edits),
+            vec![
+                edit((0, 9), (1, 8), " {\n    let a = "),
+                edit((2, 1), (2, 1), "// end"),
+            ]
+        );
+    }
+}
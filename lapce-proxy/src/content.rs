@@ -0,0 +1,102 @@
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+use anyhow::{anyhow, Context, Result};
+use git2::Repository;
+use lapce_core::directory::Directory;
+use lapce_rpc::file::uri_to_path;
+use lsp_types::Url;
+
+use crate::plugin::TextDocumentContentProvider;
+
+/// Provides the content of files at a git revision, for uris like
+/// `git:/path/to/file?HEAD~1`. The revision defaults to `HEAD`.
+pub struct GitContentProvider;
+
+impl TextDocumentContentProvider for GitContentProvider {
+    fn provide_content(&self, uri: &Url) -> Result<String> {
+        let path = uri_to_path(&Url::parse(&format!("file://{}", uri.path()))?)?;
+        let revision = uri.query().filter(|q| !q.is_empty()).unwrap_or("HEAD");
+
+        let repo = Repository::discover(&path)?;
+        let workdir = repo
+            .workdir()
+            .ok_or_else(|| anyhow!("repository of {path:?} has no workdir"))?;
+        let tree = repo.revparse_single(revision)?.peel_to_tree()?;
+        let tree_entry = tree.get_path(path.strip_prefix(workdir)?)?;
+        let blob = repo.find_blob(tree_entry.id())?;
+        let content = std::str::from_utf8(blob.content())
+            .with_context(|| "content bytes to string")?
+            .to_string();
+        Ok(content)
+    }
+}
+
+/// Provides the content of the logs in the logs folder, for uris like
+/// `output:lapce`, which is the latest log whose file name starts with
+/// `lapce.`.
+pub struct OutputContentProvider;
+
+impl TextDocumentContentProvider for OutputContentProvider {
+    fn provide_content(&self, uri: &Url) -> Result<String> {
+        let dir = Directory::logs_directory()
+            .ok_or_else(|| anyhow!("can't find the logs folder"))?;
+        let name = uri.path().trim_start_matches('/');
+        let path = latest_output(&dir, name)
+            .ok_or_else(|| anyhow!("no output named {name}"))?;
+        Ok(fs::read_to_string(path)?)
+    }
+}
+
+/// The latest of the files in `dir` named `<name>.<suffix>`. Logs rotate
+/// daily with the date in their suffix, so the latest is the last by name.
+fn latest_output(dir: &Path, name: &str) -> Option<PathBuf> {
+    let prefix = format!("{name}.");
+    fs::read_dir(dir)
+        .ok()?
+        .flatten()
+        .map(|entry| entry.path())
+        .filter(|path| {
+            path.is_file()
+                && path
+                    .file_name()
+                    .and_then(|n| n.to_str())
+                    .is_some_and(|n| n.starts_with(&prefix))
+        })
+        .max()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+
+    use super::latest_output;
+
+    #[test]
+    fn test_latest_output() {
+        let dir = std::env::temp_dir()
+            .join(format!("lapce-output-test-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        for name in [
+            "lapce.2024-01-01.log",
+            "lapce.2024-01-02.log",
+            "lapce-proxy.2024-01-03.log",
+        ] {
+            fs::write(dir.join(name), name).unwrap();
+        }
+
+        assert_eq!(
+            latest_output(&dir, "lapce"),
+            Some(dir.join("lapce.2024-01-02.log"))
+        );
+        assert_eq!(
+            latest_output(&dir, "lapce-proxy"),
+            Some(dir.join("lapce-proxy.2024-01-03.log"))
+        );
+        assert_eq!(latest_output(&dir, "plugin"), None);
+
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -1,13 +1,14 @@
 use std::{
     collections::{HashMap, HashSet},
     fs, io,
-    path::{Path, PathBuf},
+    ops::RangeInclusive,
+    path::{Component, Path, PathBuf},
     sync::{
         atomic::{AtomicU64, Ordering},
         Arc,
     },
     thread,
-    time::Duration,
+    time::{Duration, Instant},
 };
 
 use alacritty_terminal::{event::WindowSize, event_loop::Msg};
@@ -21,10 +22,11 @@
 use indexmap::IndexMap;
 use lapce_rpc::{
     core::{CoreNotification, CoreRpcHandler},
-    file::FileNodeItem,
+    file::{path_to_uri, uri_to_path, FileNodeItem},
+    plugin::PluginId,
     proxy::{
-        ProxyHandler, ProxyNotification, ProxyRequest, ProxyResponse,
-        ProxyRpcHandler, SearchMatch,
+        FoldMarker, HoverResult, ProxyHandler, ProxyNotification, ProxyRequest,
+        ProxyResponse, ProxyRpcHandler, RenamePreviewId, SearchMatch,
     },
     source_control::{DiffInfo, FileDiff},
     style::{LineStyle, SemanticStyles},
@@ -33,12 +35,20 @@
 };
 use lapce_xi_rope::Rope;
 use lsp_types::{
-    MessageType, Position, Range, ShowMessageParams, TextDocumentItem, Url,
+    CallHierarchyItem, Color, ColorPresentation, DocumentChangeOperation,
+    DocumentChanges, FoldingRange, FoldingRangeKind, GotoDefinitionResponse,
+    InlineValue, Location, MessageType, Position, Range, ResourceOp, SelectionRange,
+    SemanticToken, SemanticTokens, ShowMessageParams, SymbolInformation,
+    TextDocumentEdit, TextDocumentItem, TextEdit, Url, WorkspaceEdit,
 };
 use parking_lot::Mutex;
+use regex::Regex;
 
 use crate::{
     buffer::{get_mod_time, load_file, Buffer},
+    content::{GitContentProvider, OutputContentProvider},
+    metrics,
+    moniker::MonikerResolvers,
     plugin::{catalog::PluginCatalog, PluginCatalogRpcHandler},
     terminal::{Terminal, TerminalSender},
     watcher::{FileWatcher, Notify, WatchToken},
@@ -46,6 +56,8 @@
 
 const OPEN_FILE_EVENT_TOKEN: WatchToken = WatchToken(1);
 const WORKSPACE_EVENT_TOKEN: WatchToken = WatchToken(2);
+/// The least time between refreshing the code lenses of a document on save.
+const CODE_LENS_REFRESH_INTERVAL: Duration = Duration::from_secs(2);
 
 pub struct Dispatcher {
     workspace: Option<PathBuf>,
@@ -57,8 +69,27 @@ pub struct Dispatcher {
     file_watcher: FileWatcher,
     window_id: usize,
     tab_id: usize,
+    /// The edit of the last rename preview, waiting for the user to confirm it.
+    rename_preview: Arc<Mutex<Option<(RenamePreviewId, WorkspaceEdit)>>>,
+    moniker_resolvers: Arc<MonikerResolvers>,
+    inline_values: Arc<Mutex<InlineValueCache>>,
+    /// The symbols found by the last workspace symbol query, to be paged
+    /// through.
+    workspace_symbols: Arc<Mutex<Vec<SymbolInformation>>>,
+    /// The call hierarchy items last prepared for each document, with the
+    /// plugin that prepared each of them, which incoming and outgoing calls
+    /// are asked about.
+    call_hierarchy_items: Arc<Mutex<HashMap<PathBuf, CallHierarchyItems>>>,
+    /// When the code lenses of each document were last refreshed after a save.
+    code_lens_refreshes: HashMap<PathBuf, Instant>,
 }
 
+type CallHierarchyItems = Vec<(PluginId, CallHierarchyItem)>;
+
+/// The inline values of documents by the line that the debugger stopped on,
+/// with the revision of the document and the range they were requested for.
+type InlineValueCache = HashMap<(PathBuf, u32), (u64, Range, Vec<InlineValue>)>;
+
 impl ProxyHandler for Dispatcher {
     fn handle_notification(&mut self, rpc: ProxyNotification) {
         use ProxyNotification::*;
@@ -69,9 +100,50 @@ fn handle_notification(&mut self, rpc: ProxyNotification) {
                 plugin_configurations,
                 window_id,
                 tab_id,
+                metrics_port,
+                lsp_heartbeat_interval,
+                lsp_trace,
+                lsp_startup_timeouts,
+                lsp_features,
+                lsp_auth_token_envs,
+                lsp_configurations,
+                lsp_root_markers,
+                lsp_min_versions,
+                lsp_version_flags,
             } => {
                 self.window_id = window_id;
                 self.tab_id = tab_id;
+                self.catalog_rpc
+                    .set_heartbeat_interval(lsp_heartbeat_interval);
+                self.catalog_rpc.set_lsp_trace(lsp_trace);
+                self.catalog_rpc.set_startup_timeouts(lsp_startup_timeouts);
+                metrics::set_features(&lsp_features);
+                self.catalog_rpc.set_lsp_features(lsp_features);
+                self.catalog_rpc.set_auth_token_envs(lsp_auth_token_envs);
+                self.catalog_rpc.set_configurations(lsp_configurations);
+                self.catalog_rpc.set_min_versions(lsp_min_versions);
+                self.catalog_rpc.set_version_flags(lsp_version_flags);
+                if metrics_port > 0 {
+                    match metrics::serve(metrics_port) {
+                        Ok(port) => {
+                            self.core_rpc.log(
+                                tracing::Level::INFO,
+                                format!(
+                                    "serving metrics on http://127.0.0.1:{port}/metrics"
+                                ),
+                            );
+                        }
+                        Err(e) => {
+                            self.core_rpc.log(
+                                tracing::Level::ERROR,
+                                format!(
+                                    "can't serve metrics on port {metrics_port}: {e}"
+                                ),
+                            );
+                        }
+                    }
+                }
+                self.catalog_rpc.set_root_markers(lsp_root_markers);
                 self.workspace = workspace;
                 self.file_watcher.notify(FileWatchNotifier::new(
                     self.workspace.clone(),
@@ -124,16 +196,39 @@ fn handle_notification(&mut self, rpc: ProxyNotification) {
                 path,
                 input,
                 position,
+                context,
             } => {
                 self.catalog_rpc
-                    .completion(request_id, &path, input, position);
+                    .completion(request_id, &path, input, position, context);
             }
             SignatureHelp {
                 request_id,
                 path,
                 position,
             } => {
-                self.catalog_rpc.signature_help(request_id, &path, position);
+                let (trigger_character, active_parameter) =
+                    match self.buffers.get(&path) {
+                        Some(buffer) => {
+                            let offset = buffer.offset_of_position(&position);
+                            let line = buffer.line_of_offset(offset);
+                            let start = buffer.offset_of_line(
+                                line.saturating_sub(SIGNATURE_SCAN_LINES),
+                            );
+                            let before = buffer.slice_to_cow(start..offset);
+                            (
+                                before.chars().last().map(|c| c.to_string()),
+                                call_argument_index(&before),
+                            )
+                        }
+                        None => (None, None),
+                    };
+                self.catalog_rpc.signature_help(
+                    request_id,
+                    &path,
+                    position,
+                    trigger_character,
+                    active_parameter,
+                );
             }
             Shutdown {} => {
                 self.catalog_rpc.shutdown();
@@ -154,6 +249,17 @@ fn handle_notification(&mut self, rpc: ProxyNotification) {
                     buffer.rope.clone(),
                 );
             }
+            ShowMessageRequestResponse { request_id, action } => {
+                self.catalog_rpc
+                    .message_request_response(request_id, action);
+            }
+            ApplyWorkspaceEditResponse {
+                request_id,
+                applied,
+            } => {
+                self.catalog_rpc
+                    .workspace_edit_response(request_id, applied);
+            }
             UpdatePluginConfigs { configs } => {
                 let _ = self.catalog_rpc.update_plugin_configs(configs);
             }
@@ -449,12 +555,70 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     proxy_rpc.handle_response(id, result);
                 });
             }
+            GetHoverMulti {
+                request_id,
+                path,
+                positions,
+            } => {
+                if positions.is_empty() {
+                    self.proxy_rpc.handle_response(
+                        id,
+                        Ok(ProxyResponse::HoverMultiResponse {
+                            request_id,
+                            results: Vec::new(),
+                        }),
+                    );
+                    return;
+                }
+
+                // Every position is queried concurrently, and the response is
+                // only sent once all of them have answered. A position counts
+                // as answered by its first reply, however many servers reply
+                // to it. Positions the servers failed to hover are left out of
+                // the results.
+                let answers = Arc::new(Mutex::new((
+                    vec![None; positions.len()],
+                    positions.len(),
+                )));
+                for (i, position) in positions.into_iter().enumerate() {
+                    let proxy_rpc = self.proxy_rpc.clone();
+                    let answers = answers.clone();
+                    self.catalog_rpc.hover(&path, position, move |_, result| {
+                        let mut answers = answers.lock();
+                        let (results, remaining) = &mut *answers;
+                        if *remaining == 0 || results[i].is_some() {
+                            return;
+                        }
+                        results[i] = Some(
+                            result.ok().map(|hover| HoverResult { position, hover }),
+                        );
+                        *remaining -= 1;
+                        if *remaining == 0 {
+                            let results: Vec<HoverResult> =
+                                results.drain(..).flatten().flatten().collect();
+                            drop(answers);
+                            proxy_rpc.handle_response(
+                                id,
+                                Ok(ProxyResponse::HoverMultiResponse {
+                                    request_id,
+                                    results,
+                                }),
+                            );
+                        }
+                    });
+                }
+            }
             GetSignature { .. } => {}
-            GetReferences { path, position } => {
+            GetReferences {
+                path,
+                position,
+                include_declaration,
+            } => {
                 let proxy_rpc = self.proxy_rpc.clone();
                 self.catalog_rpc.get_references(
                     &path,
                     position,
+                    include_declaration,
                     move |_, result| {
                         let result = result.map(|references| {
                             ProxyResponse::GetReferencesResponse { references }
@@ -514,13 +678,112 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     },
                 );
             }
-            GetInlayHints { path } => {
+            GetDocumentHighlights { path, position } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.get_document_highlights(
+                    &path,
+                    position,
+                    move |_, result| {
+                        let result = result.map(|highlights| {
+                            ProxyResponse::GetDocumentHighlights {
+                                highlights: highlights.unwrap_or_default(),
+                            }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    },
+                );
+            }
+            GetImplementation { path, position } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.get_implementation(
+                    &path,
+                    position,
+                    move |_, result| {
+                        let locations = match result {
+                            Ok(GotoDefinitionResponse::Scalar(location)) => {
+                                vec![location]
+                            }
+                            Ok(GotoDefinitionResponse::Array(locations)) => {
+                                locations
+                            }
+                            Ok(GotoDefinitionResponse::Link(links)) => links
+                                .into_iter()
+                                .map(|link| Location {
+                                    uri: link.target_uri,
+                                    range: link.target_selection_range,
+                                })
+                                .collect(),
+                            // Servers without implementations to offer answer with
+                            // none, so the editor can tell the user
+                            Err(_) => Vec::new(),
+                        };
+                        proxy_rpc.handle_response(
+                            id,
+                            Ok(ProxyResponse::GetImplementation { locations }),
+                        );
+                    },
+                );
+            }
+            GetDeclaration {
+                request_id,
+                path,
+                position,
+            } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                let catalog_rpc = self.catalog_rpc.clone();
+                let definition_path = path.clone();
+                self.catalog_rpc.get_declaration(
+                    &path,
+                    position,
+                    move |_, result| {
+                        let declaration =
+                            result.ok().filter(|declaration| match declaration {
+                                GotoDefinitionResponse::Scalar(_) => true,
+                                GotoDefinitionResponse::Array(locations) => {
+                                    !locations.is_empty()
+                                }
+                                GotoDefinitionResponse::Link(links) => {
+                                    !links.is_empty()
+                                }
+                            });
+                        if let Some(declaration) = declaration {
+                            proxy_rpc.handle_response(
+                                id,
+                                Ok(ProxyResponse::GetDeclaration {
+                                    request_id,
+                                    declaration,
+                                    fallback: false,
+                                }),
+                            );
+                            return;
+                        }
+
+                        // Not every server distinguishes declarations from
+                        // definitions, so fall back to the definition.
+                        catalog_rpc.get_definition(
+                            &definition_path,
+                            position,
+                            move |_, result| {
+                                let result = result.map(|declaration| {
+                                    ProxyResponse::GetDeclaration {
+                                        request_id,
+                                        declaration,
+                                        fallback: true,
+                                    }
+                                });
+                                proxy_rpc.handle_response(id, result);
+                            },
+                        );
+                    },
+                );
+            }
+            GetInlayHints { path, range } => {
                 let proxy_rpc = self.proxy_rpc.clone();
                 let buffer = self.buffers.get(&path).unwrap();
-                let range = Range {
+                let range = range.unwrap_or_else(|| Range {
                     start: Position::new(0, 0),
                     end: buffer.offset_to_position(buffer.len()),
-                };
+                });
                 self.catalog_rpc
                     .get_inlay_hints(&path, range, move |_, result| {
                         let result = result
@@ -528,6 +791,49 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                         proxy_rpc.handle_response(id, result);
                     });
             }
+            GetInlineValues {
+                path,
+                range,
+                context,
+            } => {
+                // The values only change with the text, so stopping on the same
+                // line again doesn't ask the servers again
+                let rev = self.buffers.get(&path).map(|buffer| buffer.rev);
+                let key = (path.clone(), context.stopped_location.start.line);
+                let cached = self
+                    .inline_values
+                    .lock()
+                    .get(&key)
+                    .filter(|(cached_rev, cached_range, _)| {
+                        Some(*cached_rev) == rev && *cached_range == range
+                    })
+                    .map(|(_, _, values)| values.clone());
+                if let Some(values) = cached {
+                    self.respond_rpc(
+                        id,
+                        Ok(ProxyResponse::GetInlineValues { values }),
+                    );
+                } else {
+                    let proxy_rpc = self.proxy_rpc.clone();
+                    let inline_values = self.inline_values.clone();
+                    self.catalog_rpc.get_inline_values(
+                        &path,
+                        range,
+                        context,
+                        move |_, result| {
+                            if let (Ok(values), Some(rev)) = (result.as_ref(), rev) {
+                                inline_values
+                                    .lock()
+                                    .insert(key, (rev, range, values.clone()));
+                            }
+                            let result = result.map(|values| {
+                                ProxyResponse::GetInlineValues { values }
+                            });
+                            proxy_rpc.handle_response(id, result);
+                        },
+                    );
+                }
+            }
             GetInlineCompletions {
                 path,
                 position,
@@ -575,11 +881,62 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                         }
                     };
 
+                let partial_tokens =
+                    Arc::new(Mutex::new(PartialSemanticTokens::default()));
+                let partial = {
+                    let partial_tokens = partial_tokens.clone();
+                    let catalog_rpc = self.catalog_rpc.clone();
+                    let core_rpc = self.core_rpc.clone();
+                    let text = text.clone();
+                    let path = path.clone();
+                    move |plugin_id, tokens| {
+                        let Some(data) =
+                            partial_tokens.lock().add_batch(plugin_id, tokens)
+                        else {
+                            return;
+                        };
+                        let core_rpc = core_rpc.clone();
+                        let path = path.clone();
+                        catalog_rpc.format_semantic_tokens(
+                            plugin_id,
+                            SemanticTokens {
+                                result_id: None,
+                                data,
+                            },
+                            text.clone(),
+                            Box::new(
+                                move |result: Result<Vec<LineStyle>, RpcError>| {
+                                    if let Ok(styles) = result {
+                                        core_rpc.partial_semantic_styles(
+                                            SemanticStyles {
+                                                rev,
+                                                path,
+                                                styles,
+                                                len,
+                                            },
+                                        );
+                                    }
+                                },
+                            ),
+                        );
+                    }
+                };
+
                 let proxy_rpc = self.proxy_rpc.clone();
                 self.catalog_rpc.get_semantic_tokens(
                     &path,
-                    move |plugin_id, result| match result {
-                        Ok(result) => {
+                    partial,
+                    move |result| match result {
+                        Ok((plugin_id, mut result)) => {
+                            // The response only has the tokens that weren't
+                            // reported as partial results already
+                            let mut partial_tokens = partial_tokens.lock();
+                            if partial_tokens.plugin_id == Some(plugin_id) {
+                                let mut data =
+                                    std::mem::take(&mut partial_tokens.tokens);
+                                data.append(&mut result.data);
+                                result.data = data;
+                            }
                             catalog_rpc.format_semantic_tokens(
                                 plugin_id,
                                 result,
@@ -593,6 +950,49 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     },
                 );
             }
+            GetSemanticTokensRange { path, range } => {
+                let buffer = self.buffers.get(&path).unwrap();
+                let text = buffer.rope.clone();
+                let rev = buffer.rev;
+                let len = buffer.len();
+                let local_path = path.clone();
+                let proxy_rpc = self.proxy_rpc.clone();
+                let catalog_rpc = self.catalog_rpc.clone();
+
+                let handle_tokens = {
+                    let proxy_rpc = proxy_rpc.clone();
+                    move |result: Result<Vec<LineStyle>, RpcError>| {
+                        let result =
+                            result.map(|styles| ProxyResponse::GetSemanticTokens {
+                                styles: SemanticStyles {
+                                    rev,
+                                    path: local_path,
+                                    styles,
+                                    len,
+                                },
+                            });
+                        proxy_rpc.handle_response(id, result);
+                    }
+                };
+
+                self.catalog_rpc.get_semantic_tokens_range(
+                    &path,
+                    range,
+                    move |plugin_id, result| match result {
+                        Ok(tokens) => {
+                            catalog_rpc.format_semantic_tokens(
+                                plugin_id,
+                                tokens,
+                                text,
+                                Box::new(handle_tokens),
+                            );
+                        }
+                        Err(e) => {
+                            proxy_rpc.handle_response(id, Err(e));
+                        }
+                    },
+                );
+            }
             GetCodeActions {
                 path,
                 position,
@@ -603,6 +1003,7 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     &path,
                     position,
                     diagnostics,
+                    None,
                     move |plugin_id, result| {
                         let result = result.map(|resp| {
                             ProxyResponse::GetCodeActionsResponse { plugin_id, resp }
@@ -611,6 +1012,51 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     },
                 );
             }
+            GetQuickFixes {
+                path,
+                position,
+                diagnostics,
+            } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.get_quick_fixes(
+                    &path,
+                    position,
+                    diagnostics,
+                    move |responses| {
+                        let actions = responses
+                            .into_iter()
+                            .flat_map(|(plugin_id, resp)| {
+                                resp.into_iter()
+                                    .map(move |action| (plugin_id, action))
+                            })
+                            .collect();
+                        proxy_rpc.handle_response(
+                            id,
+                            Ok(ProxyResponse::GetQuickFixesResponse { actions }),
+                        );
+                    },
+                );
+            }
+            GetFixAllActions { path, diagnostics } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.get_fix_all_actions(
+                    &path,
+                    diagnostics,
+                    move |responses| {
+                        let actions = responses
+                            .into_iter()
+                            .flat_map(|(plugin_id, resp)| {
+                                resp.into_iter()
+                                    .map(move |action| (plugin_id, action))
+                            })
+                            .collect();
+                        proxy_rpc.handle_response(
+                            id,
+                            Ok(ProxyResponse::GetQuickFixesResponse { actions }),
+                        );
+                    },
+                );
+            }
             GetDocumentSymbols { path } => {
                 let proxy_rpc = self.proxy_rpc.clone();
                 self.catalog_rpc
@@ -622,23 +1068,184 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
             }
             GetWorkspaceSymbols { query } => {
                 let proxy_rpc = self.proxy_rpc.clone();
+                let workspace_symbols = self.workspace_symbols.clone();
                 self.catalog_rpc
-                    .get_workspace_symbols(query, move |_, result| {
+                    .get_workspace_symbols(query, move |result| {
                         let result = result.map(|symbols| {
+                            *workspace_symbols.lock() = symbols.clone();
                             ProxyResponse::GetWorkspaceSymbols { symbols }
                         });
                         proxy_rpc.handle_response(id, result);
                     });
             }
-            GetDocumentFormatting { path } => {
+            GetWorkspaceSymbolsInPath { query, path } => {
                 let proxy_rpc = self.proxy_rpc.clone();
+                let workspace_symbols = self.workspace_symbols.clone();
+                let path = normalize_path(&path);
                 self.catalog_rpc
-                    .get_document_formatting(&path, move |_, result| {
+                    .get_workspace_symbols(query, move |result| {
+                        let result = result.map(|symbols| {
+                            let symbols: Vec<_> = symbols
+                                .into_iter()
+                                .filter(|symbol| {
+                                    uri_to_path(&symbol.location.uri)
+                                        .map(|p| {
+                                            normalize_path(&p).starts_with(&path)
+                                        })
+                                        .unwrap_or(false)
+                                })
+                                .collect();
+                            *workspace_symbols.lock() = symbols.clone();
+                            ProxyResponse::GetWorkspaceSymbols { symbols }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    });
+            }
+            GetWorkspaceSymbolsByKind { query, kinds } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                let workspace_symbols = self.workspace_symbols.clone();
+                self.catalog_rpc
+                    .get_workspace_symbols(query, move |result| {
+                        let result = result.map(|mut symbols| {
+                            symbols.retain(|symbol| kinds.contains(&symbol.kind));
+                            *workspace_symbols.lock() = symbols.clone();
+                            ProxyResponse::GetWorkspaceSymbols { symbols }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    });
+            }
+            GetWorkspaceSymbolsGrouped { query } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                let workspace_symbols = self.workspace_symbols.clone();
+                self.catalog_rpc
+                    .get_workspace_symbols(query, move |result| {
+                        let result = result.map(|symbols| {
+                            *workspace_symbols.lock() = symbols.clone();
+                            let symbols = group_symbols_by_file(symbols);
+                            ProxyResponse::GetWorkspaceSymbolsGrouped { symbols }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    });
+            }
+            GetWorkspaceSymbolsPage { offset, limit } => {
+                let (symbols, total) = {
+                    let workspace_symbols = self.workspace_symbols.lock();
+                    let symbols = workspace_symbols
+                        .iter()
+                        .skip(offset)
+                        .take(limit)
+                        .cloned()
+                        .collect();
+                    (symbols, workspace_symbols.len())
+                };
+                self.respond_rpc(
+                    id,
+                    Ok(ProxyResponse::GetWorkspaceSymbolsPage { symbols, total }),
+                );
+            }
+            ResolveWorkspaceSymbol { name, kind, path } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.resolve_workspace_symbol(
+                    &name,
+                    kind,
+                    &path,
+                    move |location| {
+                        proxy_rpc.handle_response(
+                            id,
+                            Ok(ProxyResponse::ResolveWorkspaceSymbol { location }),
+                        );
+                    },
+                );
+            }
+            ApplyTextEdits { path, edits } => {
+                let result = self
+                    .buffers
+                    .get(&path)
+                    .map(|buffer| ProxyResponse::ApplyTextEdits {
+                        rev: buffer.rev,
+                        edits: buffer.minimal_text_edits(&edits),
+                    })
+                    .ok_or_else(|| RpcError {
+                        code: 0,
+                        message: "buffer not found".to_string(),
+                    });
+                self.respond_rpc(id, result);
+            }
+            GetDocumentFormatting {
+                path,
+                tab_size,
+                insert_spaces,
+                max_line_length,
+            } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                // The lines are wrapped in the document as it was when the
+                // formatting was requested, which is what the edits apply to
+                let buffer = if max_line_length > 0 {
+                    self.buffers.get(&path).cloned()
+                } else {
+                    None
+                };
+                self.catalog_rpc.get_document_formatting(
+                    &path,
+                    tab_size,
+                    insert_spaces,
+                    move |_, result| {
                         let result = result.map(|edits| {
+                            let edits = match buffer.as_ref() {
+                                Some(buffer) => wrap_formatted_lines(
+                                    buffer,
+                                    edits,
+                                    max_line_length,
+                                ),
+                                None => edits,
+                            };
                             ProxyResponse::GetDocumentFormatting { edits }
                         });
                         proxy_rpc.handle_response(id, result);
-                    });
+                    },
+                );
+            }
+            GetRangeFormatting {
+                path,
+                range,
+                tab_size,
+                insert_spaces,
+            } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.get_range_formatting(
+                    &path,
+                    range,
+                    tab_size,
+                    insert_spaces,
+                    move |_, result| {
+                        let result = result.map(|edits| {
+                            ProxyResponse::GetDocumentFormatting { edits }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    },
+                );
+            }
+            GetOnTypeFormatting {
+                path,
+                position,
+                ch,
+                tab_size,
+                insert_spaces,
+            } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.get_on_type_formatting(
+                    &path,
+                    position,
+                    ch,
+                    tab_size,
+                    insert_spaces,
+                    move |result| {
+                        let result = result.map(|edits| {
+                            ProxyResponse::GetOnTypeFormatting { edits }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    },
+                );
             }
             PrepareRename { path, position } => {
                 let proxy_rpc = self.proxy_rpc.clone();
@@ -669,6 +1276,240 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     },
                 );
             }
+            RenamePreview {
+                path,
+                position,
+                new_name,
+            } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                let rename_preview = self.rename_preview.clone();
+                self.catalog_rpc.rename(
+                    &path,
+                    position,
+                    new_name,
+                    move |_, result| {
+                        let result = result.map(|edit| {
+                            let preview_id = RenamePreviewId::next();
+                            *rename_preview.lock() =
+                                Some((preview_id, edit.clone()));
+                            ProxyResponse::RenamePreview { preview_id, edit }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    },
+                );
+            }
+            ConfirmRename { preview_id } => {
+                let edit = {
+                    let mut rename_preview = self.rename_preview.lock();
+                    match rename_preview.as_ref() {
+                        Some((current, _)) if *current == preview_id => {
+                            rename_preview.take().map(|(_, edit)| edit)
+                        }
+                        _ => None,
+                    }
+                };
+                let result = edit
+                    .map(|edit| ProxyResponse::Rename { edit })
+                    .ok_or_else(|| RpcError {
+                        code: 0,
+                        message: "rename preview is outdated".to_string(),
+                    });
+                self.respond_rpc(id, result);
+            }
+            PrepareCallHierarchy { path, position } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                let catalog_rpc = self.catalog_rpc.clone();
+                let call_hierarchy_items = self.call_hierarchy_items.clone();
+                call_hierarchy_items.lock().remove(&path);
+                let respond = move |path: PathBuf, items: CallHierarchyItems| {
+                    let result = if items.is_empty() {
+                        Err(RpcError {
+                            code: 0,
+                            message: "call hierarchy unavailable".to_string(),
+                        })
+                    } else {
+                        let response = ProxyResponse::PrepareCallHierarchy {
+                            items: items
+                                .iter()
+                                .map(|(_, item)| item.clone())
+                                .collect(),
+                        };
+                        call_hierarchy_items.lock().insert(path, items);
+                        Ok(response)
+                    };
+                    proxy_rpc.handle_response(id, result);
+                };
+                self.catalog_rpc.prepare_call_hierarchy(
+                    &path.clone(),
+                    position,
+                    move |items| {
+                        if !items.is_empty() {
+                            respond(path, items);
+                            return;
+                        }
+
+                        // Some servers only find anonymous functions from their
+                        // keyword, so try again one character to the right.
+                        let position =
+                            Position::new(position.line, position.character + 1);
+                        catalog_rpc.prepare_call_hierarchy(
+                            &path.clone(),
+                            position,
+                            move |items| respond(path, items),
+                        );
+                    },
+                );
+            }
+            CallHierarchyIncoming { path, index } => {
+                let Some((plugin_id, item)) = self.call_hierarchy_item(&path, index)
+                else {
+                    self.respond_rpc(id, Err(call_hierarchy_item_missing()));
+                    return;
+                };
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.call_hierarchy_incoming(
+                    plugin_id,
+                    item,
+                    move |result| {
+                        let result = result.map(|calls| {
+                            ProxyResponse::CallHierarchyIncoming { calls }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    },
+                );
+            }
+            CallHierarchyOutgoing { path, index } => {
+                let Some((plugin_id, item)) = self.call_hierarchy_item(&path, index)
+                else {
+                    self.respond_rpc(id, Err(call_hierarchy_item_missing()));
+                    return;
+                };
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.call_hierarchy_outgoing(
+                    plugin_id,
+                    item,
+                    move |result| {
+                        let result = result.map(|calls| {
+                            ProxyResponse::CallHierarchyOutgoing { calls }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    },
+                );
+            }
+            GetMonikers { path, position } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc
+                    .get_monikers(&path, position, move |_, result| {
+                        let result =
+                            result.map(|monikers| ProxyResponse::GetMonikers {
+                                monikers: monikers.unwrap_or_default(),
+                            });
+                        proxy_rpc.handle_response(id, result);
+                    });
+            }
+            GetDocumentColors { path } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc
+                    .get_document_colors(&path, move |_, result| {
+                        let result = result.map(|colors| {
+                            ProxyResponse::GetDocumentColors { colors }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    });
+            }
+            GetColorPresentations { path, color, range } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.get_color_presentations(
+                    &path,
+                    color,
+                    range,
+                    move |_, result| {
+                        // Servers without presentations still get the css
+                        // notation, which keeps the alpha of the color
+                        let presentations = match result {
+                            Ok(presentations) if !presentations.is_empty() => {
+                                presentations
+                            }
+                            _ => vec![ColorPresentation {
+                                label: color_to_css(&color),
+                                text_edit: None,
+                                additional_text_edits: None,
+                            }],
+                        };
+                        proxy_rpc.handle_response(
+                            id,
+                            Ok(ProxyResponse::GetColorPresentations {
+                                presentations,
+                            }),
+                        );
+                    },
+                );
+            }
+            GetFoldingRanges { path, markers } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                let marker_ranges = self
+                    .buffers
+                    .get(&path)
+                    .map(|buffer| {
+                        marker_folding_ranges(&buffer.rope.to_string(), &markers)
+                    })
+                    .unwrap_or_default();
+                self.catalog_rpc
+                    .get_folding_ranges(&path, move |_, result| {
+                        // The markers still work without a server
+                        let mut ranges = match result {
+                            Ok(ranges) => ranges.unwrap_or_default(),
+                            Err(_) if !marker_ranges.is_empty() => Vec::new(),
+                            Err(err) => {
+                                proxy_rpc.handle_response(id, Err(err));
+                                return;
+                            }
+                        };
+                        for range in marker_ranges {
+                            if !ranges.iter().any(|r| {
+                                r.start_line == range.start_line
+                                    && r.end_line == range.end_line
+                            }) {
+                                ranges.push(range);
+                            }
+                        }
+                        ranges.sort_by_key(|r| (r.start_line, r.end_line));
+                        proxy_rpc.handle_response(
+                            id,
+                            Ok(ProxyResponse::GetFoldingRanges { ranges }),
+                        );
+                    });
+            }
+            GetCodeLens { path } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc
+                    .get_resolved_code_lens(&path, move |result| {
+                        let result = result.map(|(plugin_id, lenses)| {
+                            ProxyResponse::GetCodeLens { plugin_id, lenses }
+                        });
+                        proxy_rpc.handle_response(id, result);
+                    });
+            }
+            GoToMoniker {
+                request_id,
+                moniker,
+            } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                let moniker_resolvers = self.moniker_resolvers.clone();
+                thread::spawn(move || {
+                    let result = moniker_resolvers
+                        .resolve(&moniker)
+                        .map(|location| ProxyResponse::GetDefinitionResponse {
+                            request_id,
+                            definition: GotoDefinitionResponse::Scalar(location),
+                        })
+                        .map_err(|e| RpcError {
+                            code: 0,
+                            message: e.to_string(),
+                        });
+                    proxy_rpc.handle_response(id, result);
+                });
+            }
             GetFiles { .. } => {
                 let workspace = self.workspace.clone();
                 let proxy_rpc = self.proxy_rpc.clone();
@@ -714,7 +1555,7 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     .buffers
                     .iter()
                     .map(|(path, buffer)| TextDocumentItem {
-                        uri: Url::from_file_path(path).unwrap(),
+                        uri: path_to_uri(path),
                         language_id: buffer.language_id.to_string(),
                         version: buffer.rev as i32,
                         text: buffer.get_document(),
@@ -772,7 +1613,11 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                         code: 0,
                         message: e.to_string(),
                     });
+                let saved = result.is_ok();
                 self.respond_rpc(id, result);
+                if saved {
+                    self.refresh_code_lens(path);
+                }
             }
             SaveBufferAs {
                 buffer_id,
@@ -891,47 +1736,7 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
 
                 let result = result
                     .map(|_| {
-                        let to = to.canonicalize().unwrap_or(to);
-
-                        let (is_dir, is_file) = to
-                            .metadata()
-                            .map(|metadata| (metadata.is_dir(), metadata.is_file()))
-                            .unwrap_or((false, false));
-
-                        if is_dir {
-                            // Update all buffers in which a file the renamed directory is an
-                            // ancestor of is open to use the file's new path.
-                            // This could be written more nicely if `HashMap::extract_if` were
-                            // stable.
-                            let child_buffers: Vec<_> = self
-                                .buffers
-                                .keys()
-                                .filter_map(|path| {
-                                    path.strip_prefix(&from).ok().map(|suffix| {
-                                        (path.clone(), suffix.to_owned())
-                                    })
-                                })
-                                .collect();
-
-                            for (path, suffix) in child_buffers {
-                                if let Some(mut buffer) = self.buffers.remove(&path)
-                                {
-                                    let new_path = to.join(suffix);
-                                    buffer.path = new_path;
-
-                                    self.buffers.insert(buffer.path.clone(), buffer);
-                                }
-                            }
-                        } else if is_file {
-                            // If the renamed file is open in a buffer, update it to use the new
-                            // path.
-                            let buffer = self.buffers.remove(&from);
-
-                            if let Some(mut buffer) = buffer {
-                                buffer.path = to.clone();
-                                self.buffers.insert(to.clone(), buffer);
-                            }
-                        }
+                        let to = self.rename_buffers(&from, to);
 
                         ProxyResponse::CreatePathResponse { path: to }
                     })
@@ -939,6 +1744,10 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
 
                 self.respond_rpc(id, result);
             }
+            ApplyResourceOperations { edit } => {
+                let response = self.apply_resource_operations(edit);
+                self.respond_rpc(id, Ok(response));
+            }
             TestCreateAtPath { path } => {
                 // This performs a best effort test to see if an attempt to create an item at
                 // `path` or rename an item to `path` will succeed.
@@ -978,7 +1787,9 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     positions,
                     move |_, result| {
                         let result = result.map(|ranges| {
-                            ProxyResponse::GetSelectionRange { ranges }
+                            let levels =
+                                ranges.iter().map(selection_range_levels).collect();
+                            ProxyResponse::GetSelectionRange { ranges, levels }
                         });
                         proxy_rpc.handle_response(id, result);
                     },
@@ -1002,6 +1813,17 @@ fn handle_request(&mut self, id: RequestId, rpc: ProxyRequest) {
                     },
                 );
             }
+            ExecuteCommand { plugin_id, command } => {
+                let proxy_rpc = self.proxy_rpc.clone();
+                self.catalog_rpc.execute_command(
+                    command,
+                    plugin_id,
+                    move |result| {
+                        let result = result.map(|_| ProxyResponse::Success {});
+                        proxy_rpc.handle_response(id, result);
+                    },
+                );
+            }
             DapVariable { dap_id, reference } => {
                 let proxy_rpc = self.proxy_rpc.clone();
                 self.catalog_rpc
@@ -1034,6 +1856,14 @@ impl Dispatcher {
     pub fn new(core_rpc: CoreRpcHandler, proxy_rpc: ProxyRpcHandler) -> Self {
         let plugin_rpc =
             PluginCatalogRpcHandler::new(core_rpc.clone(), proxy_rpc.clone());
+        plugin_rpc.register_text_document_content_provider(
+            "git",
+            Arc::new(GitContentProvider),
+        );
+        plugin_rpc.register_text_document_content_provider(
+            "output",
+            Arc::new(OutputContentProvider),
+        );
 
         let file_watcher = FileWatcher::new();
 
@@ -1047,12 +1877,228 @@ pub fn new(core_rpc: CoreRpcHandler, proxy_rpc: ProxyRpcHandler) -> Self {
             file_watcher,
             window_id: 1,
             tab_id: 1,
+            rename_preview: Arc::new(Mutex::new(None)),
+            moniker_resolvers: Arc::new(MonikerResolvers::default()),
+            inline_values: Arc::new(Mutex::new(HashMap::new())),
+            workspace_symbols: Arc::new(Mutex::new(Vec::new())),
+            call_hierarchy_items: Arc::new(Mutex::new(HashMap::new())),
+            code_lens_refreshes: HashMap::new(),
         }
     }
 
     fn respond_rpc(&self, id: RequestId, result: Result<ProxyResponse, RpcError>) {
         self.proxy_rpc.handle_response(id, result);
     }
+
+    /// Fetch the code lenses of a saved document again, as their values, e.g.
+    /// reference counts, are likely outdated. Saving the same document again
+    /// within [`CODE_LENS_REFRESH_INTERVAL`] doesn't refresh them.
+    fn refresh_code_lens(&mut self, path: PathBuf) {
+        let now = Instant::now();
+        if self.code_lens_refreshes.get(&path).is_some_and(|last| {
+            now.duration_since(*last) < CODE_LENS_REFRESH_INTERVAL
+        }) {
+            return;
+        }
+        self.code_lens_refreshes.insert(path.clone(), now);
+
+        let core_rpc = self.core_rpc.clone();
+        self.catalog_rpc
+            .get_resolved_code_lens(&path.clone(), move |result| {
+                if let Ok((plugin_id, lenses)) = result {
+                    core_rpc.code_lens(path, plugin_id, lenses);
+                }
+            });
+    }
+
+    /// Move the buffers of the renamed file, or of the files in the renamed
+    /// directory, to their new paths. Returns the canonicalized new path.
+    fn rename_buffers(&mut self, from: &Path, to: PathBuf) -> PathBuf {
+        let to = to.canonicalize().unwrap_or(to);
+
+        let (is_dir, is_file) = to
+            .metadata()
+            .map(|metadata| (metadata.is_dir(), metadata.is_file()))
+            .unwrap_or((false, false));
+
+        if is_dir {
+            // Update all buffers in which a file the renamed directory is an
+            // ancestor of is open to use the file's new path.
+            // This could be written more nicely if `HashMap::extract_if` were
+            // stable.
+            let child_buffers: Vec<_> = self
+                .buffers
+                .keys()
+                .filter_map(|path| {
+                    path.strip_prefix(from)
+                        .ok()
+                        .map(|suffix| (path.clone(), suffix.to_owned()))
+                })
+                .collect();
+
+            for (path, suffix) in child_buffers {
+                if let Some(mut buffer) = self.buffers.remove(&path) {
+                    let new_path = to.join(suffix);
+                    buffer.path = new_path;
+
+                    self.buffers.insert(buffer.path.clone(), buffer);
+                }
+            }
+        } else if is_file {
+            // If the renamed file is open in a buffer, update it to use the new
+            // path.
+            let buffer = self.buffers.remove(from);
+
+            if let Some(mut buffer) = buffer {
+                buffer.path = to.clone();
+                self.buffers.insert(to.clone(), buffer);
+            }
+        }
+
+        to
+    }
+
+    /// Carry out the file creations, renames and deletions of the workspace
+    /// edit in order, and return its text edits as they apply after them. The
+    /// edits made before an operation follow the files they were made to when
+    /// they are renamed, and are dropped when their file is overwritten or
+    /// deleted. The operations after one that fails are skipped.
+    fn apply_resource_operations(&mut self, edit: WorkspaceEdit) -> ProxyResponse {
+        let operations = match edit.document_changes {
+            Some(DocumentChanges::Operations(operations)) => operations,
+            document_changes => {
+                return ProxyResponse::ApplyResourceOperations {
+                    edit: WorkspaceEdit {
+                        document_changes,
+                        ..edit
+                    },
+                    renamed: Vec::new(),
+                    failed_change: None,
+                    failure_reason: None,
+                };
+            }
+        };
+
+        let mut edits: Vec<TextDocumentEdit> = Vec::new();
+        let mut renamed = Vec::new();
+        let mut failure = None;
+        for (i, operation) in operations.into_iter().enumerate() {
+            let op = match operation {
+                DocumentChangeOperation::Edit(e) => {
+                    edits.push(e);
+                    continue;
+                }
+                DocumentChangeOperation::Op(op) => op,
+            };
+            match apply_resource_operation(&op) {
+                Ok(true) => {}
+                // Skipped because of its options
+                Ok(false) => continue,
+                Err(err) => {
+                    failure = Some((i as u32, err));
+                    break;
+                }
+            }
+            match op {
+                ResourceOp::Create(create) => {
+                    // An overwritten file starts out empty
+                    if let Ok(path) = uri_to_path(&create.uri) {
+                        remove_edits_in(&mut edits, &path);
+                    }
+                }
+                ResourceOp::Rename(rename) => {
+                    let (Ok(from), Ok(to)) =
+                        (uri_to_path(&rename.old_uri), uri_to_path(&rename.new_uri))
+                    else {
+                        continue;
+                    };
+                    // Whatever was at the new path was replaced
+                    remove_edits_in(&mut edits, &to);
+                    for e in edits.iter_mut() {
+                        let new_path = uri_to_path(&e.text_document.uri)
+                            .ok()
+                            .and_then(|path| renamed_path(&path, &from, &to));
+                        if let Some(new_path) = new_path {
+                            e.text_document.uri = path_to_uri(&new_path);
+                        }
+                    }
+                    let to = self.rename_buffers(&from, to);
+                    renamed.push((from, to));
+                }
+                ResourceOp::Delete(delete) => {
+                    if let Ok(path) = uri_to_path(&delete.uri) {
+                        remove_edits_in(&mut edits, &path);
+                    }
+                }
+            }
+        }
+
+        let (failed_change, failure_reason) = failure.unzip();
+        ProxyResponse::ApplyResourceOperations {
+            edit: WorkspaceEdit {
+                document_changes: Some(DocumentChanges::Edits(edits)),
+                ..edit
+            },
+            renamed,
+            failed_change,
+            failure_reason,
+        }
+    }
+
+    /// The `index`th call hierarchy item last prepared for `path`, with the
+    /// plugin that prepared it.
+    fn call_hierarchy_item(
+        &self,
+        path: &Path,
+        index: usize,
+    ) -> Option<(PluginId, CallHierarchyItem)> {
+        let call_hierarchy_items = self.call_hierarchy_items.lock();
+        call_hierarchy_items.get(path)?.get(index).cloned()
+    }
+}
+
+/// The semantic tokens that a server reported as partial results so far.
+#[derive(Default)]
+struct PartialSemanticTokens {
+    /// Only the partial results of the first server that reported any are used
+    plugin_id: Option<PluginId>,
+    tokens: Vec<SemanticToken>,
+    /// The line and start character of the last token
+    last_position: (u32, u32),
+}
+
+impl PartialSemanticTokens {
+    /// Add a batch of tokens, and return it with the first token made relative to
+    /// the start of the document instead of to the last token of the previous
+    /// batch, so that it can be decoded on its own.
+    fn add_batch(
+        &mut self,
+        plugin_id: PluginId,
+        mut batch: Vec<SemanticToken>,
+    ) -> Option<Vec<SemanticToken>> {
+        if *self.plugin_id.get_or_insert(plugin_id) != plugin_id {
+            return None;
+        }
+
+        let (line, start) = self.last_position;
+        self.tokens.extend(batch.iter().cloned());
+        for token in batch.iter() {
+            if token.delta_line > 0 {
+                self.last_position =
+                    (self.last_position.0 + token.delta_line, token.delta_start);
+            } else {
+                self.last_position.1 += token.delta_start;
+            }
+        }
+
+        if let Some(first) = batch.first_mut() {
+            if first.delta_line == 0 {
+                first.delta_start += start;
+            }
+            first.delta_line += line;
+        }
+        Some(batch)
+    }
 }
 
 struct FileWatchNotifier {
@@ -1556,3 +2602,881 @@ fn search_in_path(
 
     Ok(ProxyResponse::GlobalSearchResponse { matches })
 }
+
+/// How the lines of a language are wrapped to a maximum length.
+#[derive(Clone, Copy)]
+struct LineWrapSyntax {
+    /// The markers of line comments, longest first so that `///` isn't
+    /// mistaken for `//`.
+    comment_prefixes: &'static [&'static str],
+    /// How a string literal is continued on the next line, if it can be
+    /// without changing its value.
+    string_continuation: Option<StringContinuation>,
+    /// The prefix of preprocessor directives, whose lines are never wrapped as
+    /// their strings are paths, e.g. `#include "a b.h"`.
+    directive_prefix: Option<&'static str>,
+    /// The delimiter of raw string literals, which can span lines and whose
+    /// lines are never wrapped, e.g. the backquote of Go.
+    raw_string_delimiter: Option<char>,
+}
+
+/// The regions between the lines matching the start and end patterns of custom
+/// fold markers. Regions of the same marker can be nested.
+fn marker_folding_ranges(text: &str, markers: &[FoldMarker]) -> Vec<FoldingRange> {
+    let mut ranges = Vec::new();
+    for marker in markers {
+        let (start, end) = match (Regex::new(&marker.start), Regex::new(&marker.end))
+        {
+            (Ok(start), Ok(end)) => (start, end),
+            _ => continue,
+        };
+        let mut open = Vec::new();
+        for (line, content) in text.lines().enumerate() {
+            // The end is checked first, as the start pattern can match the end
+            // line too, e.g. `region` in `endregion`
+            if end.is_match(content) {
+                if let Some(start_line) = open.pop() {
+                    ranges.push(FoldingRange {
+                        start_line,
+                        end_line: line as u32,
+                        kind: Some(FoldingRangeKind::Region),
+                        ..Default::default()
+                    });
+                }
+            } else if start.is_match(content) {
+                open.push(line as u32);
+            }
+        }
+    }
+    ranges
+}
+
+/// How many lines before the cursor are searched for the call it's in.
+const SIGNATURE_SCAN_LINES: usize = 50;
+
+/// The index of the argument at the end of the text, by counting the commas
+/// after the unclosed `(` of the call. Brackets nested inside the call are
+/// skipped, but commas in strings are still counted.
+fn call_argument_index(text: &str) -> Option<u32> {
+    let mut depth = 0;
+    let mut commas = 0;
+    for c in text.chars().rev() {
+        match c {
+            ')' | ']' | '}' => depth += 1,
+            '(' | '[' | '{' if depth > 0 => depth -= 1,
+            '(' => return Some(commas),
+            '[' | '{' => return None,
+            ',' if depth == 0 => commas += 1,
+            _ => {}
+        }
+    }
+    None
+}
+
+/// Group the symbols by the file they are in, keeping the order of the files
+/// and of the symbols in each. Symbols outside of files are left out.
+fn group_symbols_by_file(
+    symbols: Vec<SymbolInformation>,
+) -> IndexMap<PathBuf, Vec<SymbolInformation>> {
+    let mut grouped: IndexMap<PathBuf, Vec<SymbolInformation>> = IndexMap::new();
+    for symbol in symbols {
+        if let Ok(path) = uri_to_path(&symbol.location.uri) {
+            grouped.entry(path).or_default().push(symbol);
+        }
+    }
+    grouped
+}
+
+fn call_hierarchy_item_missing() -> RpcError {
+    RpcError {
+        code: 0,
+        message: "call hierarchy item is no longer available".to_string(),
+    }
+}
+
+/// The ranges of a selection range and its parents, from the innermost to the
+/// outermost, which is the order selections are expanded in. A parent with the
+/// same range as its child is skipped.
+fn selection_range_levels(selection_range: &SelectionRange) -> Vec<Range> {
+    let mut levels: Vec<Range> = Vec::new();
+    let mut current = Some(selection_range);
+    while let Some(selection_range) = current {
+        if levels.last() != Some(&selection_range.range) {
+            levels.push(selection_range.range);
+        }
+        current = selection_range.parent.as_deref();
+    }
+    levels
+}
+
+/// Write a color in the css notation, as `rgba()` if it isn't opaque so that the
+/// alpha isn't lost.
+fn color_to_css(color: &Color) -> String {
+    let channel = |value: f32| (value.clamp(0.0, 1.0) * 255.0).round() as u8;
+    let (red, green, blue) = (
+        channel(color.red),
+        channel(color.green),
+        channel(color.blue),
+    );
+    if color.alpha >= 1.0 {
+        format!("rgb({red}, {green}, {blue})")
+    } else {
+        let alpha = (color.alpha.max(0.0) * 100.0).round() / 100.0;
+        format!("rgba({red}, {green}, {blue}, {alpha})")
+    }
+}
+
+/// Resolve the `.` and `..` components of a path without touching the file
+/// system, so that paths from servers and from the editor can be compared.
+fn normalize_path(path: &Path) -> PathBuf {
+    let mut normalized = PathBuf::new();
+    for component in path.components() {
+        match component {
+            Component::CurDir => {}
+            Component::ParentDir => {
+                normalized.pop();
+            }
+            component => normalized.push(component),
+        }
+    }
+    normalized
+}
+
+#[derive(Clone, Copy)]
+enum StringContinuation {
+    /// A `\` at the end of the line, which also skips the indentation of the
+    /// next one.
+    Escape,
+    /// The literal is closed and another one started on the next line, joined
+    /// by the operator. It's empty for languages that concatenate adjacent
+    /// literals.
+    Concat(&'static str),
+}
+
+fn line_wrap_syntax(language_id: &str) -> Option<LineWrapSyntax> {
+    use StringContinuation::*;
+
+    let (comment_prefixes, string_continuation): (&'static [&'static str], _) =
+        match language_id {
+            "rust" => (&["///", "//!", "//"], Some(Escape)),
+            "c" | "cpp" => (&["//"], Some(Concat(""))),
+            "csharp" | "dart" | "go" | "java" | "javascript" | "javascriptreact"
+            | "kotlin" | "typescript" | "typescriptreact" => {
+                (&["//"], Some(Concat(" +")))
+            }
+            "dlang" | "groovy" | "proto" | "scala" | "swift" | "zig" => {
+                (&["//"], None)
+            }
+            "dockerfile" | "elixir" | "julia" | "makefile" | "perl"
+            | "powershell" | "python" | "r" | "ruby" | "shellscript" | "toml"
+            | "yaml" => (&["#"], None),
+            "elm" | "lua" | "sql" => (&["--"], None),
+            _ => return None,
+        };
+    let directive_prefix =
+        matches!(language_id, "c" | "cpp" | "csharp").then_some("#");
+    let raw_string_delimiter = matches!(
+        language_id,
+        "go" | "javascript" | "javascriptreact" | "typescript" | "typescriptreact"
+    )
+    .then_some('`');
+    Some(LineWrapSyntax {
+        comment_prefixes,
+        string_continuation,
+        directive_prefix,
+        raw_string_delimiter,
+    })
+}
+
+/// Wrap the long comment and string literal lines that the formatting `edits`
+/// touched, for servers that don't enforce a line length themselves. When any
+/// line is wrapped, the edits are replaced by a single edit of the lines that
+/// changed.
+fn wrap_formatted_lines(
+    buffer: &Buffer,
+    edits: Vec<TextEdit>,
+    max_line_length: usize,
+) -> Vec<TextEdit> {
+    let Some(syntax) = line_wrap_syntax(buffer.language_id) else {
+        return edits;
+    };
+    let formatted = buffer
+        .text_edits_delta(&edits)
+        .apply(&buffer.rope)
+        .to_string();
+    let edited = edited_lines(&edits);
+    let wrapped = wrap_long_lines(&formatted, syntax, max_line_length, |line| {
+        edited.iter().any(|lines| lines.contains(&line))
+    });
+    if wrapped == formatted {
+        return edits;
+    }
+    vec![changed_lines_edit(&buffer.rope.to_string(), &wrapped)]
+}
+
+/// The lines of the document as the formatting `edits` leave it that they
+/// changed.
+fn edited_lines(edits: &[TextEdit]) -> Vec<RangeInclusive<usize>> {
+    let mut edits: Vec<&TextEdit> = edits.iter().collect();
+    edits.sort_by_key(|edit| edit.range.start);
+
+    // How many lines the edits before the current one added
+    let mut shift = 0isize;
+    edits
+        .into_iter()
+        .map(|edit| {
+            let start = (edit.range.start.line as isize + shift).max(0) as usize;
+            let added = edit.new_text.matches('\n').count();
+            let removed = (edit.range.end.line - edit.range.start.line) as usize;
+            shift += added as isize - removed as isize;
+            start..=start + added
+        })
+        .collect()
+}
+
+/// Wrap the comment and string literal lines of `text` that are longer than
+/// `max_line_length` at the last space before it, if `is_edited` is true for
+/// their line number. Comments continue on the next line with the same
+/// indentation and comment marker, and string literals the way the language
+/// allows without changing their value.
+fn wrap_long_lines(
+    text: &str,
+    syntax: LineWrapSyntax,
+    max_line_length: usize,
+    is_edited: impl Fn(usize) -> bool,
+) -> String {
+    let mut wrapped = String::with_capacity(text.len());
+    let mut in_raw_string = false;
+    for (i, line) in text.split('\n').enumerate() {
+        if i > 0 {
+            wrapped.push('\n');
+        }
+        let (line, cr) = match line.strip_suffix('\r') {
+            Some(line) => (line, "\r"),
+            None => (line, ""),
+        };
+
+        let content = line.trim_start();
+        let indent = &line[..line.len() - content.len()];
+        let comment_prefix = syntax
+            .comment_prefixes
+            .iter()
+            .find(|prefix| content.starts_with(**prefix));
+
+        // Lines that start, end or are inside a raw string that spans lines
+        let mut raw = in_raw_string;
+        if let Some(delimiter) = syntax.raw_string_delimiter {
+            if comment_prefix.is_none() && line.matches(delimiter).count() % 2 == 1 {
+                in_raw_string = !in_raw_string;
+                raw = true;
+            }
+        }
+        let directive = syntax
+            .directive_prefix
+            .is_some_and(|prefix| content.starts_with(prefix));
+        if raw || directive || !is_edited(i) {
+            wrapped.push_str(line);
+            wrapped.push_str(cr);
+            continue;
+        }
+
+        let mut rest = line.to_string();
+        while rest.chars().count() > max_line_length {
+            let next = match comment_prefix {
+                Some(prefix) => {
+                    wrap_comment_line(&rest, indent, prefix, max_line_length)
+                }
+                None => wrap_string_line(&rest, indent, syntax, max_line_length),
+            };
+            let Some((head, tail)) = next else {
+                break;
+            };
+            wrapped.push_str(&head);
+            wrapped.push_str(cr);
+            wrapped.push('\n');
+            rest = tail;
+        }
+        wrapped.push_str(&rest);
+        wrapped.push_str(cr);
+    }
+    wrapped
+}
+
+/// Carry out a file creation, rename or deletion. Returns whether it was
+/// carried out, or skipped because its options say so.
+fn apply_resource_operation(op: &ResourceOp) -> Result<bool, String> {
+    fn file_path(uri: &Url) -> Result<PathBuf, String> {
+        uri_to_path(uri).map_err(|e| e.to_string())
+    }
+
+    fn create_parent(path: &Path) -> Result<(), String> {
+        match path.parent() {
+            Some(parent) => fs::create_dir_all(parent).map_err(|e| e.to_string()),
+            None => Ok(()),
+        }
+    }
+
+    match op {
+        ResourceOp::Create(create) => {
+            let path = file_path(&create.uri)?;
+            let options = create.options.as_ref();
+            if path.exists() && !options.and_then(|o| o.overwrite).unwrap_or(false) {
+                return if options.and_then(|o| o.ignore_if_exists).unwrap_or(false) {
+                    Ok(false)
+                } else {
+                    Err(format!("{} already exists", path.display()))
+                };
+            }
+            create_parent(&path)?;
+            fs::write(&path, "").map_err(|e| e.to_string())?;
+        }
+        ResourceOp::Rename(rename) => {
+            let from = file_path(&rename.old_uri)?;
+            let to = file_path(&rename.new_uri)?;
+            let options = rename.options.as_ref();
+            if to.exists() && !options.and_then(|o| o.overwrite).unwrap_or(false) {
+                return if options.and_then(|o| o.ignore_if_exists).unwrap_or(false) {
+                    Ok(false)
+                } else {
+                    Err(format!("{} already exists", to.display()))
+                };
+            }
+            create_parent(&to)?;
+            fs::rename(&from, &to).map_err(|e| e.to_string())?;
+        }
+        ResourceOp::Delete(delete) => {
+            let path = file_path(&delete.uri)?;
+            let options = delete.options.as_ref();
+            if !path.exists() {
+                return if options
+                    .and_then(|o| o.ignore_if_not_exists)
+                    .unwrap_or(false)
+                {
+                    Ok(false)
+                } else {
+                    Err(format!("{} doesn't exist", path.display()))
+                };
+            }
+            let result = if !path.is_dir() {
+                fs::remove_file(&path)
+            } else if options.and_then(|o| o.recursive).unwrap_or(false) {
+                fs::remove_dir_all(&path)
+            } else {
+                fs::remove_dir(&path)
+            };
+            result.map_err(|e| e.to_string())?;
+        }
+    }
+    Ok(true)
+}
+
+/// The new path of `path` after `from` is renamed to `to`, if `path` is `from`
+/// or in it.
+fn renamed_path(path: &Path, from: &Path, to: &Path) -> Option<PathBuf> {
+    let suffix = path.strip_prefix(from).ok()?;
+    Some(if suffix.as_os_str().is_empty() {
+        to.to_path_buf()
+    } else {
+        to.join(suffix)
+    })
+}
+
+/// Drop the text edits of `path`, and of the files in it if it's a directory.
+fn remove_edits_in(edits: &mut Vec<TextDocumentEdit>, path: &Path) {
+    edits.retain(|e| {
+        !uri_to_path(&e.text_document.uri).is_ok_and(|p| p.starts_with(path))
+    });
+}
+
+/// Split a comment line at the last space before `max_line_length`, returning
+/// the line up to it and the rest continued as a comment.
+fn wrap_comment_line(
+    line: &str,
+    indent: &str,
+    prefix: &str,
+    max_line_length: usize,
+) -> Option<(String, String)> {
+    let end = byte_index_of_char(line, max_line_length);
+    let split = if line[end..].starts_with(' ') {
+        Some(end)
+    } else {
+        line[..end].rfind(' ')
+    };
+    // Never split inside the indentation or the comment marker itself
+    let split = split.filter(|i| *i > indent.len() + prefix.len())?;
+    Some((
+        line[..split].trim_end().to_string(),
+        format!("{indent}{prefix} {}", line[split..].trim_start()),
+    ))
+}
+
+/// Split a line at the last space before `max_line_length` that's inside a
+/// string literal closed on the same line, returning the line up to it and
+/// the rest of the string continued on the next line.
+fn wrap_string_line(
+    line: &str,
+    indent: &str,
+    syntax: LineWrapSyntax,
+    max_line_length: usize,
+) -> Option<(String, String)> {
+    let continuation = syntax.string_continuation?;
+    let extra = match continuation {
+        StringContinuation::Escape => 1,
+        StringContinuation::Concat(op) => 1 + op.len(),
+    };
+    let end = byte_index_of_char(line, max_line_length.checked_sub(extra)?);
+
+    // The spaces of the string literal that's open, and of the ones that were
+    // closed, which are the only ones it can be split at
+    let mut open: Option<Vec<usize>> = None;
+    let mut splits = Vec::new();
+    let mut chars = line.char_indices().peekable();
+    while let Some((i, c)) = chars.next() {
+        match open.as_mut() {
+            Some(spaces) => match c {
+                '\\' => {
+                    chars.next();
+                }
+                '"' => splits.append(&mut open.take().unwrap()),
+                ' ' if i >= indent.len() && i < end => {
+                    // The space before the next word, as the indentation of
+                    // the next line is skipped after an escaped newline
+                    if chars.peek().map(|(_, c)| *c != ' ') == Some(true) {
+                        spaces.push(i);
+                    }
+                }
+                _ => {}
+            },
+            None => {
+                if syntax
+                    .comment_prefixes
+                    .iter()
+                    .any(|prefix| line[i..].starts_with(prefix))
+                {
+                    break;
+                }
+                match c {
+                    // A quote as a character literal
+                    '\'' if line[i..].starts_with("'\"'") => {
+                        chars.next();
+                        chars.next();
+                    }
+                    '"' => {
+                        // Escapes mean something else in raw and verbatim
+                        // strings
+                        let raw = line[..i]
+                            .chars()
+                            .next_back()
+                            .is_some_and(|c| matches!(c, 'r' | 'R' | '#' | '@'));
+                        if !raw {
+                            open = Some(Vec::new());
+                        } else {
+                            // Skip to its end
+                            for (_, c) in chars.by_ref() {
+                                if c == '"' {
+                                    break;
+                                }
+                            }
+                        }
+                    }
+                    // A raw string closed on the same line
+                    c if Some(c) == syntax.raw_string_delimiter => {
+                        for (_, c) in chars.by_ref() {
+                            if Some(c) == syntax.raw_string_delimiter {
+                                break;
+                            }
+                        }
+                    }
+                    _ => {}
+                }
+            }
+        }
+    }
+
+    let split = splits.into_iter().max()?;
+    let (head, tail) = line.split_at(split + 1);
+    Some(match continuation {
+        StringContinuation::Escape => {
+            (format!("{head}\\"), format!("{indent}{tail}"))
+        }
+        StringContinuation::Concat(op) => {
+            (format!("{head}\"{op}"), format!("{indent}\"{tail}"))
+        }
+    })
+}
+
+/// The byte index of the `n`th character of `s`, or its length if it's shorter.
+fn byte_index_of_char(s: &str, n: usize) -> usize {
+    s.char_indices().nth(n).map(|(i, _)| i).unwrap_or(s.len())
+}
+
+/// A single edit that turns `old` into `new`, replacing only the lines from the
+/// first to the last one that differ.
+fn changed_lines_edit(old: &str, new: &str) -> TextEdit {
+    let old_lines: Vec<&str> = old.split('\n').collect();
+    let new_lines: Vec<&str> = new.split('\n').collect();
+    let shortest = old_lines.len().min(new_lines.len());
+    // At least the last line is replaced, so the edit has a line to start at
+    let prefix = old_lines
+        .iter()
+        .zip(new_lines.iter())
+        .take(shortest - 1)
+        .take_while(|(a, b)| a == b)
+        .count();
+    let suffix = old_lines
+        .iter()
+        .rev()
+        .zip(new_lines.iter().rev())
+        .take(shortest - prefix)
+        .take_while(|(a, b)| a == b)
+        .count();
+
+    let start = Position {
+        line: prefix as u32,
+        character: 0,
+    };
+    let (end, new_text) = if suffix > 0 {
+        // Up to the start of the first line that stays the same
+        let end = Position {
+            line: (old_lines.len() - suffix) as u32,
+            character: 0,
+        };
+        let new_text = new_lines[prefix..new_lines.len() - suffix]
+            .iter()
+            .map(|line| format!("{line}\n"))
+            .collect();
+        (end, new_text)
+    } else {
+        let last = old_lines[old_lines.len() - 1];
+        let end = Position {
+            line: (old_lines.len() - 1) as u32,
+            character: last.encode_utf16().count() as u32,
+        };
+        (end, new_lines[prefix..].join("\n"))
+    };
+    TextEdit {
+        range: Range { start, end },
+        new_text,
+    }
+}
+#[cfg(test)]
+mod tests {
+    use std::path::{Path, PathBuf};
+
+    use lapce_rpc::proxy::{FoldMarker, ProxyResponse};
+    use lsp_types::{Color, ColorPresentation, Position, Range, SelectionRange};
+
+    use super::{
+        call_argument_index, changed_lines_edit, color_to_css,
+        group_symbols_by_file, line_wrap_syntax, marker_folding_ranges,
+        normalize_path, renamed_path, selection_range_levels, wrap_long_lines,
+    };
+
+    #[test]
+    fn test_group_symbols_by_file() {
+        #[allow(deprecated)]
+        let symbol = |name: &str, uri: &str| lsp_types::SymbolInformation {
+            name: name.to_string(),
+            kind: lsp_types::SymbolKind::FUNCTION,
+            tags: None,
+            deprecated: None,
+            location: lsp_types::Location {
+                uri: lsp_types::Url::parse(uri).unwrap(),
+                range: Range::default(),
+            },
+            container_name: None,
+        };
+        let grouped = group_symbols_by_file(vec![
+            symbol("b", "file:///src/b.rs"),
+            symbol("a", "file:///src/a.rs"),
+            symbol("b2", "file:///src/b.rs"),
+            symbol("remote", "https://example.com/c.rs"),
+        ]);
+        let grouped: Vec<(PathBuf, Vec<String>)> = grouped
+            .into_iter()
+            .map(|(path, symbols)| {
+                (path, symbols.into_iter().map(|s| s.name).collect())
+            })
+            .collect();
+        assert_eq!(
+            grouped,
+            vec![
+                (
+                    PathBuf::from("/src/b.rs"),
+                    vec!["b".to_string(), "b2".to_string()]
+                ),
+                (PathBuf::from("/src/a.rs"), vec!["a".to_string()]),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_renamed_path() {
+        let from = Path::new("/src/old");
+        let to = Path::new("/src/new");
+        assert_eq!(
+            renamed_path(Path::new("/src/old"), from, to),
+            Some(PathBuf::from("/src/new"))
+        );
+        assert_eq!(
+            renamed_path(Path::new("/src/old/mod.rs"), from, to),
+            Some(PathBuf::from("/src/new/mod.rs"))
+        );
+        assert_eq!(
+            renamed_path(Path::new("/src/old/mod.rs"), Path::new("/src/old/"), to),
+            Some(PathBuf::from("/src/new/mod.rs"))
+        );
+        assert_eq!(renamed_path(Path::new("/src/older.rs"), from, to), None);
+        assert_eq!(renamed_path(Path::new("/src/lib.rs"), from, to), None);
+    }
+
+    fn wrap(language_id: &str, text: &str, max_line_length: usize) -> String {
+        let syntax = line_wrap_syntax(language_id).unwrap();
+        wrap_long_lines(text, syntax, max_line_length, |_| true)
+    }
+
+    #[test]
+    fn test_marker_folding_ranges() {
+        let text = "// region outer
+fn a() {}
+// region inner
+fn b() {}
+// endregion
+// endregion
+// region unclosed
+";
+        let markers = vec![
+            FoldMarker {
+                start: r"^\s*// region".to_string(),
+                end: r"^\s*// endregion".to_string(),
+            },
+            FoldMarker {
+                start: "(".to_string(),
+                end: ")".to_string(),
+            },
+        ];
+        let ranges: Vec<(u32, u32)> = marker_folding_ranges(text, &markers)
+            .iter()
+            .map(|range| (range.start_line, range.end_line))
+            .collect();
+        assert_eq!(ranges, vec![(2, 4), (0, 5)]);
+    }
+
+    #[test]
+    fn test_call_argument_index() {
+        assert_eq!(call_argument_index("foo("), Some(0));
+        assert_eq!(call_argument_index("foo(a, b"), Some(1));
+        assert_eq!(call_argument_index("foo(a, bar(c, d), [e, f], "), Some(3));
+        assert_eq!(call_argument_index("foo(a, bar(c, "), Some(1));
+        assert_eq!(call_argument_index("let v = [a, "), None);
+        assert_eq!(call_argument_index("foo(a)"), None);
+    }
+
+    #[test]
+    fn test_selection_range_levels() {
+        let range =
+            |start, end| Range::new(Position::new(0, start), Position::new(0, end));
+        let selection_range = SelectionRange {
+            range: range(4, 7),
+            parent: Some(Box::new(SelectionRange {
+                range: range(4, 7),
+                parent: Some(Box::new(SelectionRange {
+                    range: range(0, 12),
+                    parent: None,
+                })),
+            })),
+        };
+        assert_eq!(
+            selection_range_levels(&selection_range),
+            vec![range(4, 7), range(0, 12)]
+        );
+    }
+
+    #[test]
+    fn test_color_to_css() {
+        let color = |alpha| Color {
+            red: 1.0,
+            green: 0.0,
+            blue: 0.5,
+            alpha,
+        };
+        assert_eq!(color_to_css(&color(1.0)), "rgb(255, 0, 128)");
+        assert_eq!(color_to_css(&color(0.5)), "rgba(255, 0, 128, 0.5)");
+        assert_eq!(color_to_css(&color(0.0)), "rgba(255, 0, 128, 0)");
+    }
+
+    #[test]
+    fn test_color_presentations_keep_alpha() {
+        let resp = ProxyResponse::GetColorPresentations {
+            presentations: vec![ColorPresentation {
+                label: "rgba(255, 0, 0, 0.5)".to_string(),
+                text_edit: None,
+                additional_text_edits: None,
+            }],
+        };
+        let value = serde_json::to_value(&resp).unwrap();
+        let ProxyResponse::GetColorPresentations { presentations } =
+            serde_json::from_value(value).unwrap()
+        else {
+            panic!("wrong response");
+        };
+        assert_eq!(presentations[0].label, "rgba(255, 0, 0, 0.5)");
+
+        let color = Color {
+            red: 1.0,
+            green: 0.0,
+            blue: 0.0,
+            alpha: 0.5,
+        };
+        let value = serde_json::to_value(color).unwrap();
+        assert_eq!(value["alpha"], 0.5);
+        assert_eq!(serde_json::from_value::<Color>(value).unwrap(), color);
+    }
+
+    #[test]
+    fn test_normalize_path() {
+        assert_eq!(
+            normalize_path(Path::new("/home/user/./project/src/../pkg/")),
+            PathBuf::from("/home/user/project/pkg")
+        );
+        assert!(normalize_path(Path::new("/home/user/project/pkg/a.go"))
+            .starts_with(normalize_path(Path::new("/home/user/project/./pkg"))));
+        assert!(!normalize_path(Path::new("/home/user/project/pkg2/a.go"))
+            .starts_with(normalize_path(Path::new("/home/user/project/pkg"))));
+    }
+
+    #[test]
+    fn test_wrap_long_comment_lines() {
+        assert_eq!(
+            wrap("rust", "    // aaa bbb ccc ddd eee fff\n    let s = 1;", 20),
+            "    // aaa bbb ccc\n    // ddd eee fff\n    let s = 1;"
+        );
+        assert_eq!(
+            wrap("python", "# a b c d e f g h", 7),
+            "# a b c\n# d e f\n# g h"
+        );
+        assert_eq!(wrap("rust", "/// a b c", 5), "/// a\n/// b\n/// c");
+        assert_eq!(
+            wrap("rust", "// a b c\r\nx", 5),
+            "// a\r\n// b\r\n// c\r\nx"
+        );
+        // Bullets and dereferences aren't comments
+        assert_eq!(
+            wrap("rust", "    * a b c d e f g h i", 10),
+            "    * a b c d e f g h i"
+        );
+        assert!(line_wrap_syntax("markdown").is_none());
+    }
+
+    #[test]
+    fn test_wrap_long_string_lines() {
+        assert_eq!(
+            wrap("rust", "    let s = \"aaa bbb ccc ddd\";", 24),
+            "    let s = \"aaa bbb \\\n    ccc ddd\";"
+        );
+        assert_eq!(
+            wrap("go", "\ts := \"aaa bbb ccc ddd\"", 18),
+            "\ts := \"aaa bbb \" +\n\t\"ccc ddd\""
+        );
+        assert_eq!(
+            wrap("c", "f(\"aaa bbb ccc\");", 12),
+            "f(\"aaa bbb \"\n\"ccc\");"
+        );
+        assert_eq!(
+            wrap("rust", "f('\"', \"aaa bbb ccc\");", 18),
+            "f('\"', \"aaa bbb \\\nccc\");"
+        );
+        // Strings that aren't closed on the line, raw strings, code, strings in
+        // comments and languages without a way to continue strings are kept
+        for (language_id, line) in [
+            ("rust", "let s = \"aaa bbb ccc ddd"),
+            ("rust", "let s = r\"aaa bbb ccc ddd\";"),
+            ("rust", "let sss = aaaa + bbbb + cccc;"),
+            ("rust", "f(); // \"aaa bbb ccc\""),
+            ("python", "s = \"aaa bbb ccc ddd\""),
+            ("go", "s := `aaa \"bbb ccc\" ddd`"),
+            ("c", "#include \"aaa bbb ccc.h\""),
+        ] {
+            assert_eq!(wrap(language_id, line, 15), line);
+        }
+        // Nor are the lines of raw strings that span lines
+        let text = "s := `aaa\n\"bbb ccc ddd\"\nddd`";
+        assert_eq!(wrap("go", text, 15), text);
+    }
+
+    #[test]
+    fn test_wrap_edited_lines_only() {
+        let syntax = line_wrap_syntax("rust").unwrap();
+        assert_eq!(
+            wrap_long_lines("// a b c\n// d e f", syntax, 5, |line| line == 1),
+            "// a b c\n// d\n// e\n// f"
+        );
+    }
+
+    #[test]
+    fn test_edited_lines() {
+        let edit = |start: u32, end: u32, new_text: &str| TextEdit {
+            range: Range {
+                start: Position {
+                    line: start,
+                    character: 0,
+                },
+                end: Position {
+                    line: end,
+                    character: 0,
+                },
+            },
+            new_text: new_text.to_string(),
+        };
+        // The second edit is moved down by the line the first one added, and
+        // the third one up by the two lines the second one removed
+        assert_eq!(
+            edited_lines(&[edit(5, 7, "x"), edit(1, 1, "a\nb"), edit(9, 9, "y")]),
+            vec![1..=2, 6..=6, 8..=8]
+        );
+    }
+
+    #[test]
+    fn test_changed_lines_edit() {
+        let edit = changed_lines_edit("a\nb\nc", "a\nB\nB2\nc");
+        assert_eq!(
+            edit.range,
+            Range {
+                start: Position {
+                    line: 1,
+                    character: 0
+                },
+                end: Position {
+                    line: 2,
+                    character: 0
+                },
+            }
+        );
+        assert_eq!(edit.new_text, "B\nB2\n");
+
+        // Changes at the end replace up to the end of the last line
+        let edit = changed_lines_edit("a\nbb", "a\nb\nb");
+        assert_eq!(
+            edit.range,
+            Range {
+                start: Position {
+                    line: 1,
+                    character: 0
+                },
+                end: Position {
+                    line: 1,
+                    character: 2
+                },
+            }
+        );
+        assert_eq!(edit.new_text, "b\nb");
+    }
+
+    #[test]
+    fn test_wrap_long_lines_without_space() {
+        assert_eq!(
+            wrap("rust", "// aaaaaaaaaaaaaaaaaaaaaaa", 10),
+            "// aaaaaaaaaaaaaaaaaaaaaaa"
+        );
+    }
+}
@@ -2,14 +2,17 @@
 
 pub mod buffer;
 pub mod cli;
+pub mod content;
 pub mod dispatch;
+pub mod metrics;
+pub mod moniker;
 pub mod plugin;
 pub mod terminal;
 pub mod watcher;
 
 use std::{
     io::{stdin, stdout, BufReader},
-    path::PathBuf,
+    path::{Path, PathBuf},
     process::exit,
     sync::Arc,
     thread,
@@ -35,6 +38,12 @@ struct Cli {
     #[clap(short, long, action, hide = true)]
     proxy: bool,
 
+    /// Replay a language server trace log, written with the `lsp-trace`
+    /// setting, against the server and print the answers that changed
+    #[clap(long, value_name = "TRACE_FILE")]
+    #[clap(value_hint = clap::ValueHint::FilePath)]
+    replay_trace: Option<PathBuf>,
+
     /// Paths to file(s) and/or folder(s) to open.
     /// When path is a file (that exists or not),
     /// it accepts `path:line:column` syntax
@@ -46,6 +55,9 @@ struct Cli {
 
 pub fn mainloop() {
     let cli = Cli::parse();
+    if let Some(path) = cli.replay_trace {
+        exit(replay_trace(&path));
+    }
     if !cli.proxy {
         if let Err(e) = cli::try_open_in_existing_process(&cli.paths) {
             error!("failed to open path(s): {e}");
@@ -117,6 +129,37 @@ pub fn mainloop() {
     proxy_rpc.mainloop(&mut dispatcher);
 }
 
+/// Replay a language server trace log and print the requests whose answers
+/// changed, returning the exit code.
+fn replay_trace(path: &Path) -> i32 {
+    let mismatches = plugin::trace::read_trace(path)
+        .and_then(|entries| plugin::trace::replay(&entries));
+    let mismatches = match mismatches {
+        Ok(mismatches) => mismatches,
+        Err(e) => {
+            eprintln!("failed to replay {}: {e}", path.display());
+            return 1;
+        }
+    };
+    for mismatch in &mismatches {
+        let actual = mismatch
+            .actual
+            .as_ref()
+            .map(|actual| actual.to_string())
+            .unwrap_or_else(|| "no answer".to_string());
+        println!(
+            "{} {}: expected {}, got {actual}",
+            mismatch.method, mismatch.id, mismatch.expected
+        );
+    }
+    println!("{} answers changed", mismatches.len());
+    if mismatches.is_empty() {
+        0
+    } else {
+        1
+    }
+}
+
 pub fn register_lapce_path() -> Result<()> {
     let path = std::env::current_exe()?;
 
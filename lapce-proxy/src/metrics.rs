@@ -0,0 +1,274 @@
+use std::{
+    collections::{BTreeMap, HashMap},
+    fmt::Write as _,
+    io::{BufRead, BufReader, ErrorKind, Write},
+    net::{TcpListener, TcpStream},
+    thread,
+    time::Duration,
+};
+
+use anyhow::Result;
+use lsp_types::{Diagnostic, DiagnosticSeverity};
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+
+/// The upper bounds of the request duration histogram buckets, in seconds
+const DURATION_BUCKETS: [f64; 10] =
+    [0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0];
+
+static METRICS: Lazy<Mutex<Metrics>> = Lazy::new(|| Mutex::new(Metrics::default()));
+
+/// The port the metrics are served on, once they are
+static SERVED_PORT: Lazy<Mutex<Option<u16>>> = Lazy::new(|| Mutex::new(None));
+
+#[derive(Default)]
+struct Histogram {
+    /// The number of observations in each bucket, not cumulative
+    buckets: [u64; DURATION_BUCKETS.len()],
+    sum: f64,
+    count: u64,
+}
+
+impl Histogram {
+    fn observe(&mut self, value: f64) {
+        if let Some(i) = DURATION_BUCKETS.iter().position(|bound| value <= *bound) {
+            self.buckets[i] += 1;
+        }
+        self.sum += value;
+        self.count += 1;
+    }
+}
+
+/// Metrics of the language servers, keyed by their labels. They are kept in
+/// sorted maps so that the output is stable.
+#[derive(Default)]
+struct Metrics {
+    /// Request durations by method and syntax
+    request_durations: BTreeMap<(String, String), Histogram>,
+    active_clients: i64,
+    /// Published diagnostics by severity and syntax
+    diagnostics: BTreeMap<(String, String), u64>,
+    /// The language server features that are turned on or off, by method
+    features: BTreeMap<String, bool>,
+}
+
+impl Metrics {
+    /// Render the metrics in the Prometheus text exposition format.
+    fn render(&self) -> String {
+        let mut out = String::new();
+
+        let _ = writeln!(
+            out,
+            "# HELP lapce_lsp_request_duration_seconds Duration of language server requests."
+        );
+        let _ = writeln!(out, "# TYPE lapce_lsp_request_duration_seconds histogram");
+        for ((method, syntax), histogram) in self.request_durations.iter() {
+            let labels = format!(
+                "method=\"{}\",syntax=\"{}\"",
+                escape_label(method),
+                escape_label(syntax)
+            );
+            let mut cumulative = 0;
+            for (bound, count) in DURATION_BUCKETS.iter().zip(histogram.buckets) {
+                cumulative += count;
+                let _ = writeln!(
+                    out,
+                    "lapce_lsp_request_duration_seconds_bucket{{{labels},le=\"{bound}\"}} {cumulative}"
+                );
+            }
+            let _ = writeln!(
+                out,
+                "lapce_lsp_request_duration_seconds_bucket{{{labels},le=\"+Inf\"}} {}",
+                histogram.count
+            );
+            let _ = writeln!(
+                out,
+                "lapce_lsp_request_duration_seconds_sum{{{labels}}} {}",
+                histogram.sum
+            );
+            let _ = writeln!(
+                out,
+                "lapce_lsp_request_duration_seconds_count{{{labels}}} {}",
+                histogram.count
+            );
+        }
+
+        let _ = writeln!(
+            out,
+            "# HELP lapce_lsp_active_clients Number of running language servers."
+        );
+        let _ = writeln!(out, "# TYPE lapce_lsp_active_clients gauge");
+        let _ = writeln!(out, "lapce_lsp_active_clients {}", self.active_clients);
+
+        let _ = writeln!(
+            out,
+            "# HELP lapce_lsp_diagnostics_total Number of diagnostics published by language servers."
+        );
+        let _ = writeln!(out, "# TYPE lapce_lsp_diagnostics_total counter");
+        for ((severity, syntax), count) in self.diagnostics.iter() {
+            let _ = writeln!(
+                out,
+                "lapce_lsp_diagnostics_total{{severity=\"{}\",syntax=\"{}\"}} {count}",
+                escape_label(severity),
+                escape_label(syntax)
+            );
+        }
+
+        let _ = writeln!(
+            out,
+            "# HELP lapce_lsp_feature_enabled Whether a language server feature is turned on."
+        );
+        let _ = writeln!(out, "# TYPE lapce_lsp_feature_enabled gauge");
+        for (method, enabled) in self.features.iter() {
+            let _ = writeln!(
+                out,
+                "lapce_lsp_feature_enabled{{method=\"{}\"}} {}",
+                escape_label(method),
+                u8::from(*enabled)
+            );
+        }
+
+        out
+    }
+}
+
+fn escape_label(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+/// Record the duration of a language server request.
+pub fn observe_request(method: &str, syntax: &str, duration: Duration) {
+    METRICS
+        .lock()
+        .request_durations
+        .entry((method.to_string(), syntax.to_string()))
+        .or_default()
+        .observe(duration.as_secs_f64());
+}
+
+pub fn client_started() {
+    METRICS.lock().active_clients += 1;
+}
+
+pub fn client_stopped() {
+    METRICS.lock().active_clients -= 1;
+}
+
+/// Count the diagnostics a language server published for a document.
+pub fn count_diagnostics(syntax: &str, diagnostics: &[Diagnostic]) {
+    let mut metrics = METRICS.lock();
+    for diagnostic in diagnostics {
+        let severity = match diagnostic.severity {
+            Some(DiagnosticSeverity::ERROR) => "error",
+            Some(DiagnosticSeverity::WARNING) => "warning",
+            Some(DiagnosticSeverity::INFORMATION) => "information",
+            Some(DiagnosticSeverity::HINT) => "hint",
+            _ => "unknown",
+        };
+        *metrics
+            .diagnostics
+            .entry((severity.to_string(), syntax.to_string()))
+            .or_default() += 1;
+    }
+}
+
+/// Record which language server features are turned on or off.
+pub fn set_features(features: &HashMap<String, bool>) {
+    METRICS.lock().features = features
+        .iter()
+        .map(|(method, enabled)| (method.clone(), *enabled))
+        .collect();
+}
+
+/// Serve the metrics over http on the local port, in a background thread, and
+/// return the port they are served on. If the port is taken, e.g. by the proxy
+/// of another Lapce instance, any free port is used instead. The metrics are
+/// shared by the proxies of a process, so they are only served once.
+pub fn serve(port: u16) -> Result<u16> {
+    let mut served_port = SERVED_PORT.lock();
+    if let Some(port) = *served_port {
+        return Ok(port);
+    }
+    let listener = match TcpListener::bind(("127.0.0.1", port)) {
+        Ok(listener) => listener,
+        Err(e) if e.kind() == ErrorKind::AddrInUse => {
+            TcpListener::bind(("127.0.0.1", 0))?
+        }
+        Err(e) => return Err(e.into()),
+    };
+    let port = listener.local_addr()?.port();
+    thread::spawn(move || {
+        for stream in listener.incoming().flatten() {
+            let _ = respond(stream);
+        }
+    });
+    *served_port = Some(port);
+    Ok(port)
+}
+
+fn respond(mut stream: TcpStream) -> Result<()> {
+    // Every request gets the metrics, so only the headers have to be read
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut line = String::new();
+    while reader.read_line(&mut line)? > 0 && line != "\r\n" {
+        line.clear();
+    }
+
+    let body = METRICS.lock().render();
+    write!(
+        stream,
+        "HTTP/1.1 200 OK\r\nContent-Type: text/plain; version=0.0.4\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{body}",
+        body.len()
+    )?;
+    stream.flush()?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use super::Metrics;
+
+    #[test]
+    fn test_render() {
+        let mut metrics = Metrics::default();
+        metrics
+            .request_durations
+            .entry(("textDocument/hover".to_string(), "rust".to_string()))
+            .or_default()
+            .observe(Duration::from_millis(30).as_secs_f64());
+        metrics.active_clients = 2;
+        metrics
+            .diagnostics
+            .insert(("error".to_string(), "go".to_string()), 3);
+        metrics
+            .features
+            .insert("textDocument/inlayHint".to_string(), false);
+
+        let out = metrics.render();
+        let labels = r#"method="textDocument/hover",syntax="rust""#;
+        assert!(out.contains(&format!(
+            "lapce_lsp_request_duration_seconds_bucket{{{labels},le=\"0.025\"}} 0\n"
+        )));
+        assert!(out.contains(&format!(
+            "lapce_lsp_request_duration_seconds_bucket{{{labels},le=\"0.05\"}} 1\n"
+        )));
+        assert!(out.contains(&format!(
+            "lapce_lsp_request_duration_seconds_bucket{{{labels},le=\"+Inf\"}} 1\n"
+        )));
+        assert!(out.contains(&format!(
+            "lapce_lsp_request_duration_seconds_count{{{labels}}} 1\n"
+        )));
+        assert!(out.contains("lapce_lsp_active_clients 2\n"));
+        assert!(out.contains(
+            "lapce_lsp_diagnostics_total{severity=\"error\",syntax=\"go\"} 3\n"
+        ));
+        assert!(out.contains(
+            "lapce_lsp_feature_enabled{method=\"textDocument/inlayHint\"} 0\n"
+        ));
+    }
+}
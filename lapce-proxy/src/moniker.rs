@@ -0,0 +1,236 @@
+use std::{
+    collections::HashMap,
+    fs,
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+use anyhow::{anyhow, Result};
+use lapce_rpc::file::path_to_uri;
+use lsp_types::{Location, Moniker, Position, Range};
+
+/// Resolves the monikers of one scheme to a location on the local disk, so
+/// that symbols of dependencies can be navigated to.
+pub trait MonikerResolver: Send + Sync {
+    fn resolve(&self, moniker: &Moniker) -> Result<Location>;
+}
+
+/// The moniker resolvers, by the scheme of the monikers they resolve.
+pub struct MonikerResolvers {
+    resolvers: HashMap<String, Box<dyn MonikerResolver>>,
+}
+
+impl Default for MonikerResolvers {
+    fn default() -> Self {
+        let mut resolvers = Self {
+            resolvers: HashMap::new(),
+        };
+        resolvers.register("gomod", GoModResolver);
+        resolvers
+    }
+}
+
+impl MonikerResolvers {
+    pub fn register(
+        &mut self,
+        scheme: &str,
+        resolver: impl MonikerResolver + 'static,
+    ) {
+        self.resolvers
+            .insert(scheme.to_string(), Box::new(resolver));
+    }
+
+    pub fn resolve(&self, moniker: &Moniker) -> Result<Location> {
+        let resolver = self.resolvers.get(&moniker.scheme).ok_or_else(|| {
+            anyhow!("no resolver for moniker scheme {}", moniker.scheme)
+        })?;
+        resolver.resolve(moniker)
+    }
+}
+
+/// Resolves `gomod` monikers, whose identifier is `<import path>:<symbol>`,
+/// to the package in the module cache or the source tree of the `GOPATH`.
+pub struct GoModResolver;
+
+impl MonikerResolver for GoModResolver {
+    fn resolve(&self, moniker: &Moniker) -> Result<Location> {
+        let (import_path, symbol) =
+            moniker.identifier.rsplit_once(':').ok_or_else(|| {
+                anyhow!("invalid gomod moniker {}", moniker.identifier)
+            })?;
+
+        let output = Command::new("go").args(["env", "GOPATH"]).output()?;
+        let gopath = String::from_utf8(output.stdout)?;
+        let dir = std::env::split_paths(gopath.trim())
+            .find_map(|gopath| find_go_package(&gopath, import_path))
+            .ok_or_else(|| anyhow!("package {import_path} not found in GOPATH"))?;
+
+        let mut files: Vec<PathBuf> = fs::read_dir(&dir)?
+            .flatten()
+            .map(|entry| entry.path())
+            .filter(|path| {
+                path.extension().and_then(|e| e.to_str()) == Some("go")
+                    && !path.to_string_lossy().ends_with("_test.go")
+            })
+            .collect();
+        files.sort();
+
+        for path in files.iter() {
+            let Ok(text) = fs::read_to_string(path) else {
+                continue;
+            };
+            if let Some(position) = find_go_symbol(&text, symbol) {
+                return Ok(Location {
+                    uri: path_to_uri(path),
+                    range: Range::new(position, position),
+                });
+            }
+        }
+
+        // The symbol couldn't be found, so at least go to the package
+        let path = files
+            .first()
+            .ok_or_else(|| anyhow!("package {import_path} has no go files"))?;
+        Ok(Location {
+            uri: path_to_uri(path),
+            range: Range::default(),
+        })
+    }
+}
+
+/// Find the directory of the package with the import path in a `GOPATH`,
+/// either in the module cache or in the source tree.
+fn find_go_package(gopath: &Path, import_path: &str) -> Option<PathBuf> {
+    let src = gopath.join("src").join(import_path);
+    if src.is_dir() {
+        return Some(src);
+    }
+
+    // The module is a prefix of the import path, and its folder in the module
+    // cache has the version appended, e.g. `github.com/foo/bar@v1.2.3/pkg`.
+    let components: Vec<&str> = import_path.split('/').collect();
+    for i in (1..=components.len()).rev() {
+        let module = escape_module_path(&components[..i].join("/"));
+        let (parent, name) = match module.rsplit_once('/') {
+            Some((parent, name)) => (gopath.join("pkg/mod").join(parent), name),
+            None => (gopath.join("pkg/mod"), module.as_str()),
+        };
+        let Ok(entries) = fs::read_dir(&parent) else {
+            continue;
+        };
+        let prefix = format!("{name}@");
+        let mut versions: Vec<PathBuf> = entries
+            .flatten()
+            .filter(|entry| entry.file_name().to_string_lossy().starts_with(&prefix))
+            .map(|entry| entry.path())
+            .collect();
+        versions.sort();
+        if let Some(module_dir) = versions.pop() {
+            let dir = components[i..]
+                .iter()
+                .fold(module_dir, |dir, component| dir.join(component));
+            if dir.is_dir() {
+                return Some(dir);
+            }
+        }
+    }
+
+    None
+}
+
+/// The module cache replaces upper case letters with `!` followed by the lower
+/// case letter, so that it works on case insensitive file systems.
+fn escape_module_path(module: &str) -> String {
+    let mut escaped = String::with_capacity(module.len());
+    for c in module.chars() {
+        if c.is_ascii_uppercase() {
+            escaped.push('!');
+            escaped.push(c.to_ascii_lowercase());
+        } else {
+            escaped.push(c);
+        }
+    }
+    escaped
+}
+
+/// Find the declaration of a top level symbol in go source. Methods are given as
+/// `Type.Method`.
+fn find_go_symbol(text: &str, symbol: &str) -> Option<Position> {
+    let (receiver, name) = match symbol.rsplit_once('.') {
+        Some((receiver, name)) => (Some(receiver.trim_start_matches('*')), name),
+        None => (None, symbol),
+    };
+
+    for (line, content) in text.lines().enumerate() {
+        let declared = match receiver {
+            Some(receiver) => content
+                .strip_prefix("func (")
+                .and_then(|rest| rest.split_once(')'))
+                .filter(|(recv, _)| {
+                    recv.split_whitespace()
+                        .last()
+                        .map(|ty| ty.trim_start_matches('*'))
+                        .map(|ty| ty.split('[').next() == Some(receiver))
+                        .unwrap_or(false)
+                })
+                .map(|(_, rest)| rest.trim_start()),
+            None => ["func ", "type ", "var ", "const "]
+                .iter()
+                .find_map(|keyword| content.strip_prefix(keyword)),
+        };
+        let Some(declared) = declared else {
+            continue;
+        };
+        let is_symbol = declared.strip_prefix(name).is_some_and(|rest| {
+            !rest.starts_with(|c: char| c.is_alphanumeric() || c == '_')
+        });
+        if is_symbol {
+            let character = content.len() - declared.len();
+            return Some(Position::new(line as u32, character as u32));
+        }
+    }
+
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use lsp_types::Position;
+
+    use super::{escape_module_path, find_go_symbol};
+
+    #[test]
+    fn test_escape_module_path() {
+        assert_eq!(
+            escape_module_path("github.com/BurntSushi/toml"),
+            "github.com/!burnt!sushi/toml"
+        );
+        assert_eq!(escape_module_path("golang.org/x/sync"), "golang.org/x/sync");
+    }
+
+    #[test]
+    fn test_find_go_symbol() {
+        let text = r#"package errors
+
+func Newer() {}
+
+func New(text string) error {
+}
+
+type fundamental struct{}
+
+func (f *fundamental) Error() string {
+}
+"#;
+        assert_eq!(find_go_symbol(text, "New"), Some(Position::new(4, 5)));
+        assert_eq!(
+            find_go_symbol(text, "fundamental"),
+            Some(Position::new(7, 5))
+        );
+        assert_eq!(
+            find_go_symbol(text, "fundamental.Error"),
+            Some(Position::new(9, 22))
+        );
+        assert_eq!(find_go_symbol(text, "Wrap"), None);
+    }
+}
@@ -1,7 +1,7 @@
 use std::{
     borrow::Cow,
     collections::HashMap,
-    path::PathBuf,
+    path::{Path, PathBuf},
     sync::{
         atomic::{AtomicUsize, Ordering},
         Arc,
@@ -9,6 +9,7 @@
     thread,
 };
 
+use lapce_core::language::LapceLanguage;
 use lapce_rpc::plugin::VoltInfo;
 use lapce_rpc::{
     dap_types::{self, DapId, DapServer, SetBreakpointsResponse},
@@ -18,10 +19,12 @@
     RpcError,
 };
 use lapce_xi_rope::{Rope, RopeDelta};
-use lsp_types::request::Request;
+use lsp_types::request::{Request, WorkspaceSymbolRequest};
 use lsp_types::{
-    notification::DidOpenTextDocument, DidOpenTextDocumentParams, SemanticTokens,
+    notification::{DidChangeConfiguration, DidOpenTextDocument},
+    DidChangeConfigurationParams, DidOpenTextDocumentParams, SemanticTokens,
     TextDocumentIdentifier, TextDocumentItem, VersionedTextDocumentIdentifier,
+    WorkspaceSymbolParams, WorkspaceSymbolResponse,
 };
 use parking_lot::Mutex;
 use psp_types::Notification;
@@ -29,8 +32,9 @@
 
 use super::{
     dap::{DapClient, DapRpcHandler, DebuggerData},
+    flatten_workspace_symbols,
     psp::{ClonableCallback, PluginServerRpc, PluginServerRpcHandler, RpcCallback},
-    wasi::{load_all_volts, start_volt},
+    wasi::{load_all_volts, start_volt, unflatten_map},
     PluginCatalogNotification, PluginCatalogRpcHandler,
 };
 use crate::plugin::{
@@ -46,6 +50,9 @@ pub struct PluginCatalog {
     plugin_configurations: HashMap<String, HashMap<String, serde_json::Value>>,
     unactivated_volts: HashMap<VoltID, VoltMetadata>,
     open_files: HashMap<PathBuf, String>,
+    /// The servers that documents asked for with an `lsp:` modeline, which are
+    /// then the only ones that serve them.
+    lsp_overrides: HashMap<PathBuf, String>,
 }
 
 impl PluginCatalog {
@@ -64,6 +71,7 @@ pub fn new(
             debuggers: HashMap::new(),
             unactivated_volts: HashMap::new(),
             open_files: HashMap::new(),
+            lsp_overrides: HashMap::new(),
         };
 
         thread::spawn(move || {
@@ -73,6 +81,30 @@ pub fn new(
         plugin
     }
 
+    /// The language of an opened document was decided when it was opened,
+    /// possibly from its shebang, so prefer it over the one guessed from the path.
+    fn document_language_id(
+        &self,
+        path: Option<&Path>,
+        language_id: Option<String>,
+    ) -> Option<String> {
+        path.and_then(|path| self.open_files.get(path))
+            .cloned()
+            .or(language_id)
+    }
+
+    /// Whether the plugin should serve the document, which is only not the case
+    /// if the document's modeline asked for another server.
+    fn serves_document(
+        &self,
+        plugin: &PluginServerRpcHandler,
+        path: Option<&Path>,
+    ) -> bool {
+        path.and_then(|path| self.lsp_overrides.get(path))
+            .map(|server| volt_matches_server(&plugin.volt_id, server))
+            .unwrap_or(true)
+    }
+
     #[allow(clippy::too_many_arguments)]
     pub fn handle_server_request(
         &mut self,
@@ -85,6 +117,7 @@ pub fn handle_server_request(
         check: bool,
         f: Box<dyn ClonableCallback<Value, RpcError>>,
     ) {
+        let language_id = self.document_language_id(path.as_deref(), language_id);
         if let Some(plugin_id) = plugin_id {
             if let Some(plugin) = self.plugins.get(&plugin_id) {
                 plugin.server_request_async(
@@ -132,6 +165,18 @@ pub fn handle_server_request(
         for (plugin_id, plugin) in self.plugins.iter() {
             let f = dyn_clone::clone_box(&*f);
             let plugin_id = *plugin_id;
+            if !self.serves_document(plugin, path.as_deref()) {
+                // Still answer, as the number of requests sent was counted
+                f(
+                    plugin_id,
+                    Err(RpcError {
+                        code: 0,
+                        message: "another server was chosen by the modeline"
+                            .to_string(),
+                    }),
+                );
+                continue;
+            }
             plugin.server_request_async(
                 method.clone(),
                 params.clone(),
@@ -155,6 +200,7 @@ pub fn handle_server_notification(
         path: Option<PathBuf>,
         check: bool,
     ) {
+        let language_id = self.document_language_id(path.as_deref(), language_id);
         if let Some(plugin_id) = plugin_id {
             if let Some(plugin) = self.plugins.get(&plugin_id) {
                 plugin.server_notification(method, params, language_id, path, check);
@@ -166,6 +212,9 @@ pub fn handle_server_notification(
         // Otherwise send it to all plugins
         let method = method.into();
         for (_, plugin) in self.plugins.iter() {
+            if !self.serves_document(plugin, path.as_deref()) {
+                continue;
+            }
             plugin.server_notification(
                 method.clone(),
                 params.clone(),
@@ -197,6 +246,7 @@ pub fn shutdown_volt(
                     },
                 );
                 plugin.shutdown();
+                self.plugin_rpc.remove_diagnostics(plugin_id);
             }
         }
     }
@@ -269,6 +319,15 @@ fn check_unactivated_volts(&mut self) {
 
     pub fn handle_did_open_text_document(&mut self, document: TextDocumentItem) {
         if let Ok(path) = document.uri.to_file_path() {
+            let comment_token = LapceLanguage::from_path(&path).comment_token();
+            match parse_lsp_modeline(&document.text, comment_token) {
+                Some(server) => {
+                    self.lsp_overrides.insert(path.clone(), server);
+                }
+                None => {
+                    self.lsp_overrides.remove(&path);
+                }
+            }
             self.open_files.insert(path, document.language_id.clone());
         }
 
@@ -292,6 +351,9 @@ pub fn handle_did_open_text_document(&mut self, document: TextDocumentItem) {
 
         let path = document.uri.to_file_path().ok();
         for (_, plugin) in self.plugins.iter() {
+            if !self.serves_document(plugin, path.as_deref()) {
+                continue;
+            }
             plugin.server_notification(
                 DidOpenTextDocument::METHOD,
                 DidOpenTextDocumentParams {
@@ -311,7 +373,13 @@ pub fn handle_did_save_text_document(
         text_document: TextDocumentIdentifier,
         text: Rope,
     ) {
+        let language_id = self
+            .document_language_id(Some(&path), Some(language_id))
+            .unwrap_or_default();
         for (_, plugin) in self.plugins.iter() {
+            if !self.serves_document(plugin, Some(&path)) {
+                continue;
+            }
             plugin.handle_rpc(PluginServerRpc::DidSaveTextDocument {
                 language_id: language_id.clone(),
                 path: path.clone(),
@@ -329,8 +397,15 @@ pub fn handle_did_change_text_document(
         text: Rope,
         new_text: Rope,
     ) {
+        let path = document.uri.to_file_path().ok();
+        let language_id = self
+            .document_language_id(path.as_deref(), Some(language_id))
+            .unwrap_or_default();
         let change = Arc::new(Mutex::new((None, None)));
         for (_, plugin) in self.plugins.iter() {
+            if !self.serves_document(plugin, path.as_deref()) {
+                continue;
+            }
             plugin.handle_rpc(PluginServerRpc::DidChangeTextDocument {
                 language_id: language_id.clone(),
                 document: document.clone(),
@@ -468,7 +543,28 @@ pub fn handle_notification(&mut self, notification: PluginCatalogNotification) {
                 self.check_unactivated_volts();
             }
             UpdatePluginConfigs(configs) => {
+                let changed = changed_plugin_configurations(
+                    &self.plugin_configurations,
+                    &configs,
+                );
                 self.plugin_configurations = configs;
+                for plugin in self.plugins.values() {
+                    if !changed.contains(&plugin.volt_id.name) {
+                        continue;
+                    }
+                    let settings = self
+                        .plugin_configurations
+                        .get(&plugin.volt_id.name)
+                        .map(unflatten_map)
+                        .unwrap_or(Value::Null);
+                    plugin.server_notification(
+                        DidChangeConfiguration::METHOD,
+                        DidChangeConfigurationParams { settings },
+                        None,
+                        None,
+                        false,
+                    );
+                }
             }
             PluginServerLoaded(plugin) => {
                 // TODO: check if the server has did open registered
@@ -478,6 +574,9 @@ pub fn handle_notification(&mut self, notification: PluginCatalogNotification) {
                     for item in items {
                         let language_id = Some(item.language_id.clone());
                         let path = item.uri.to_file_path().ok();
+                        if !self.serves_document(&plugin, path.as_deref()) {
+                            continue;
+                        }
                         plugin.server_notification(
                             DidOpenTextDocument::METHOD,
                             DidOpenTextDocumentParams {
@@ -493,6 +592,31 @@ pub fn handle_notification(&mut self, notification: PluginCatalogNotification) {
                 let plugin_id = plugin.plugin_id;
                 let spawned_by = plugin.spawned_by;
 
+                // Servers like gopls index the workspace lazily, so ask for all
+                // symbols up front to warm the index, and keep the result
+                // around as completion candidates.
+                let plugin_rpc = self.plugin_rpc.clone();
+                plugin.server_request_async(
+                    WorkspaceSymbolRequest::METHOD,
+                    WorkspaceSymbolParams {
+                        query: String::new(),
+                        work_done_progress_params: Default::default(),
+                        partial_result_params: Default::default(),
+                    },
+                    None,
+                    None,
+                    true,
+                    move |result: Result<Value, RpcError>| {
+                        if let Some(resp) = result.ok().and_then(|value| {
+                            serde_json::from_value::<WorkspaceSymbolResponse>(value)
+                                .ok()
+                        }) {
+                            let (symbols, _) = flatten_workspace_symbols(resp);
+                            plugin_rpc.cache_workspace_symbols(plugin_id, symbols);
+                        }
+                    },
+                );
+
                 self.plugins.insert(plugin.plugin_id, plugin);
 
                 if let Some(spawned_by) = spawned_by {
@@ -523,6 +647,7 @@ pub fn handle_notification(&mut self, notification: PluginCatalogNotification) {
                     if self.plugins.get(&id).unwrap().volt_id == volt_id {
                         let plugin = self.plugins.remove(&id).unwrap();
                         plugin.shutdown();
+                        self.plugin_rpc.remove_diagnostics(id);
                     }
                 }
                 let _ = self.plugin_rpc.unactivated_volts(vec![volt]);
@@ -534,6 +659,7 @@ pub fn handle_notification(&mut self, notification: PluginCatalogNotification) {
                     if self.plugins.get(&id).unwrap().volt_id == volt_id {
                         let plugin = self.plugins.remove(&id).unwrap();
                         plugin.shutdown();
+                        self.plugin_rpc.remove_diagnostics(id);
                     }
                 }
             }
@@ -689,3 +815,107 @@ pub fn handle_notification(&mut self, notification: PluginCatalogNotification) {
         }
     }
 }
+
+/// Find a modeline like `// lsp: pyright` in the first two lines of a document,
+/// which asks for the document to be served by that server only. The comment has
+/// to use the line comment token of the document's language.
+fn parse_lsp_modeline(text: &str, comment_token: &str) -> Option<String> {
+    if comment_token.is_empty() {
+        return None;
+    }
+    text.lines().take(2).find_map(|line| {
+        let server = line
+            .trim_start()
+            .strip_prefix(comment_token)?
+            .trim_start()
+            .strip_prefix("lsp:")?
+            .trim();
+        (!server.is_empty() && !server.contains(char::is_whitespace))
+            .then(|| server.to_string())
+    })
+}
+
+/// The names of the plugins whose configuration differs between `old` and `new`.
+fn changed_plugin_configurations(
+    old: &HashMap<String, HashMap<String, Value>>,
+    new: &HashMap<String, HashMap<String, Value>>,
+) -> Vec<String> {
+    let mut changed: Vec<String> = old
+        .keys()
+        .chain(new.keys().filter(|name| !old.contains_key(*name)))
+        .filter(|name| old.get(*name) != new.get(*name))
+        .cloned()
+        .collect();
+    changed.sort();
+    changed
+}
+
+/// Whether the volt provides the server named in a modeline. Volts are often
+/// named after their server with a `lapce-` prefix, so that is optional.
+fn volt_matches_server(volt_id: &VoltID, server: &str) -> bool {
+    let name = volt_id.name.to_lowercase();
+    let server = server.to_lowercase();
+    name == server || name.strip_prefix("lapce-") == Some(server.as_str())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+
+    use lapce_rpc::plugin::VoltID;
+    use serde_json::json;
+
+    use super::{
+        changed_plugin_configurations, parse_lsp_modeline, volt_matches_server,
+    };
+
+    #[test]
+    fn test_changed_plugin_configurations() {
+        let config = |value: serde_json::Value| {
+            HashMap::from([("server.option".to_string(), value)])
+        };
+        let old = HashMap::from([
+            ("lapce-rust".to_string(), config(json!(true))),
+            ("lapce-go".to_string(), config(json!("a"))),
+            ("lapce-python".to_string(), config(json!(1))),
+        ]);
+        let new = HashMap::from([
+            ("lapce-rust".to_string(), config(json!(true))),
+            ("lapce-go".to_string(), config(json!("b"))),
+            ("lapce-cpp".to_string(), config(json!(false))),
+        ]);
+        assert_eq!(
+            changed_plugin_configurations(&old, &new),
+            vec!["lapce-cpp", "lapce-go", "lapce-python"]
+        );
+    }
+
+    #[test]
+    fn test_parse_lsp_modeline() {
+        assert_eq!(
+            parse_lsp_modeline("#!/usr/bin/env python\n# lsp: pyright\n", "#"),
+            Some("pyright".to_string())
+        );
+        assert_eq!(
+            parse_lsp_modeline("// lsp:gopls\npackage main\n", "//"),
+            Some("gopls".to_string())
+        );
+        assert_eq!(
+            parse_lsp_modeline("package main\n\n// lsp: gopls\n", "//"),
+            None
+        );
+        assert_eq!(parse_lsp_modeline("# lsp: pyright\n", "//"), None);
+        assert_eq!(parse_lsp_modeline("// lsp:\n", "//"), None);
+    }
+
+    #[test]
+    fn test_volt_matches_server() {
+        let volt_id = VoltID {
+            author: "lapce".to_string(),
+            name: "lapce-pyright".to_string(),
+        };
+        assert!(volt_matches_server(&volt_id, "pyright"));
+        assert!(volt_matches_server(&volt_id, "Lapce-Pyright"));
+        assert!(!volt_matches_server(&volt_id, "pylsp"));
+    }
+}
@@ -1,18 +1,27 @@
+#[cfg(test)]
+mod tests;
+
 #[cfg(target_os = "windows")]
 use std::os::windows::process::CommandExt;
 use std::{
     io::{BufRead, BufReader, BufWriter, Write},
     path::{Path, PathBuf},
     process::{self, Child, Command, Stdio},
-    sync::Arc,
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc,
+    },
     thread,
+    time::{Duration, Instant},
 };
 
 use anyhow::{anyhow, Result};
-use jsonrpc_lite::{Id, Params};
+use jsonrpc_lite::{Id, JsonRpc, Params};
 use lapce_core::meta;
 use lapce_rpc::{
+    file::uri_to_path,
     plugin::{PluginId, VoltID},
+    proxy::ProxyResponse,
     style::LineStyle,
     RpcError,
 };
@@ -32,11 +41,27 @@
         PluginServerHandler, PluginServerRpcHandler, ResponseSender, RpcCallback,
     },
 };
-use crate::{buffer::Buffer, plugin::PluginCatalogRpcHandler};
+use crate::{
+    buffer::Buffer,
+    metrics,
+    plugin::{trace::TraceLog, PluginCatalogRpcHandler},
+};
 
 const HEADER_CONTENT_LENGTH: &str = "content-length";
 const HEADER_CONTENT_TYPE: &str = "content-type";
 
+/// The request sent to check that a server is still responsive. Servers have to
+/// answer `$/` requests they don't support with an error, which is enough. It
+/// can't be a notification, as those aren't answered.
+const HEARTBEAT_METHOD: &str = "$/ping";
+/// How long a server has to answer a heartbeat before it counts as missed
+const HEARTBEAT_TIMEOUT: Duration = Duration::from_secs(5);
+/// How many heartbeats in a row a server may miss before it's restarted
+const HEARTBEAT_MAX_MISSES: usize = 3;
+
+/// How long a server may take to print its version
+const VERSION_PROBE_TIMEOUT: Duration = Duration::from_secs(2);
+
 pub enum LspRpc {
     Request {
         id: u64,
@@ -61,9 +86,13 @@ pub struct LspClient {
     plugin_rpc: PluginCatalogRpcHandler,
     server_rpc: PluginServerRpcHandler,
     process: Child,
+    /// The path or name of the server binary
+    server: String,
     workspace: Option<PathBuf>,
     host: PluginHostHandler,
     options: Option<Value>,
+    /// Set once the server stopped writing to stdout, which is when it exited
+    stopped: Arc<AtomicBool>,
 }
 
 impl PluginServerHandler for LspClient {
@@ -89,7 +118,7 @@ fn handle_handler_notification(
                 self.initialize();
             }
             InitializeResult(result) => {
-                self.host.server_capabilities = result.capabilities;
+                self.host.set_server_capabilities(result.capabilities);
             }
             Shutdown => {
                 self.shutdown();
@@ -112,6 +141,10 @@ fn handle_host_notification(&mut self, method: String, params: Params) {
         let _ = self.host.handle_notification(method, params);
     }
 
+    fn handle_panic(&mut self, method: &str, params: &Params, message: &str) {
+        self.host.report_panic(method, params, message);
+    }
+
     fn handle_did_save_text_document(
         &self,
         language_id: String,
@@ -137,7 +170,7 @@ fn handle_did_change_text_document(
         change: Arc<
             Mutex<(
                 Option<TextDocumentContentChangeEvent>,
-                Option<TextDocumentContentChangeEvent>,
+                Option<Vec<TextDocumentContentChangeEvent>>,
             )>,
         >,
     ) {
@@ -196,6 +229,39 @@ fn new(
         let stderr = process.stderr.take().unwrap();
 
         let mut writer = Box::new(BufWriter::new(stdin));
+        let languages: Vec<&str> = document_selector
+            .iter()
+            .filter_map(|filter| filter.language.as_deref())
+            .collect();
+        let wrapper = ServerWrapper {
+            auth_token: plugin_rpc.auth_token(&languages),
+        };
+        let trace = if plugin_rpc.lsp_trace() {
+            match TraceLog::create(
+                &volt_id.name,
+                &server,
+                &args,
+                workspace.as_deref(),
+            ) {
+                Ok((trace, path)) => {
+                    plugin_rpc.core_rpc.log(
+                        tracing::Level::INFO,
+                        format!("tracing lsp server {server} to {}", path.display()),
+                    );
+                    Some(Arc::new(trace))
+                }
+                Err(e) => {
+                    plugin_rpc.core_rpc.log(
+                        tracing::Level::ERROR,
+                        format!("can't trace lsp server {server}: {e}"),
+                    );
+                    None
+                }
+            }
+        } else {
+            None
+        };
+
         let (io_tx, io_rx) = crossbeam_channel::unbounded();
         let server_rpc = PluginServerRpcHandler::new(
             volt_id.clone(),
@@ -203,6 +269,7 @@ fn new(
             plugin_id,
             io_tx.clone(),
         );
+        let local_trace = trace.clone();
         thread::spawn(move || {
             for msg in io_rx {
                 if msg
@@ -212,22 +279,29 @@ fn new(
                 {
                     break;
                 }
-                if let Ok(msg) = serde_json::to_string(&msg) {
-                    let msg =
-                        format!("Content-Length: {}\r\n\r\n{}", msg.len(), msg);
-                    let _ = writer.write(msg.as_bytes());
-                    let _ = writer.flush();
+                // Before the auth token is added, so that it isn't logged
+                if let Some(trace) = &local_trace {
+                    trace.sent(&msg);
                 }
+                let msg = wrapper.wrap(msg);
+                let _ = write_message(&mut writer, &msg);
             }
         });
 
         let local_server_rpc = server_rpc.clone();
+        let local_server = server.clone();
         let core_rpc = plugin_rpc.core_rpc.clone();
+        let stopped = Arc::new(AtomicBool::new(false));
+        let local_stopped = stopped.clone();
         thread::spawn(move || {
+            metrics::client_started();
             let mut reader = Box::new(BufReader::new(stdout));
             loop {
                 match read_message(&mut reader) {
                     Ok(message_str) => {
+                        if let Some(trace) = &trace {
+                            trace.received(&message_str);
+                        }
                         if let Some(resp) = handle_plugin_server_message(
                             &local_server_rpc,
                             &message_str,
@@ -238,8 +312,10 @@ fn new(
                     Err(_err) => {
                         core_rpc.log(
                             tracing::Level::ERROR,
-                            format!("lsp server {server} stopped!"),
+                            format!("lsp server {local_server} stopped!"),
                         );
+                        metrics::client_stopped();
+                        local_stopped.store(true, Ordering::Relaxed);
                         return;
                     }
                 };
@@ -283,9 +359,11 @@ fn new(
             plugin_rpc,
             server_rpc,
             process,
+            server,
             workspace,
             host,
             options,
+            stopped,
         })
     }
 
@@ -304,20 +382,54 @@ pub fn start(
         options: Option<Value>,
     ) -> Result<PluginId> {
         let mut lsp = Self::new(
-            plugin_rpc,
-            document_selector,
-            workspace,
-            volt_id,
-            volt_display_name,
+            plugin_rpc.clone(),
+            document_selector.clone(),
+            workspace.clone(),
+            volt_id.clone(),
+            volt_display_name.clone(),
             spawned_by,
             plugin_id,
-            pwd,
-            server_uri,
-            args,
-            options,
+            pwd.clone(),
+            server_uri.clone(),
+            args.clone(),
+            options.clone(),
         )?;
         let plugin_id = lsp.server_rpc.plugin_id;
 
+        if let Some(interval) = plugin_rpc.heartbeat_interval() {
+            let rpc = lsp.server_rpc.clone();
+            let stopped = lsp.stopped.clone();
+            thread::spawn(move || {
+                if !heartbeat(&rpc, &stopped, interval) {
+                    return;
+                }
+
+                plugin_rpc.core_rpc.log(
+                    tracing::Level::WARN,
+                    format!(
+                        "lsp server {server_uri} stopped responding, restarting it"
+                    ),
+                );
+                rpc.shutdown();
+                // The restarted server keeps the plugin id, so that it replaces
+                // this one in the catalog once it's loaded, which also opens the
+                // open documents in it again
+                let _ = Self::start(
+                    plugin_rpc,
+                    document_selector,
+                    workspace,
+                    volt_id,
+                    volt_display_name,
+                    spawned_by,
+                    Some(plugin_id),
+                    pwd,
+                    server_uri,
+                    args,
+                    options,
+                );
+            });
+        }
+
         let rpc = lsp.server_rpc.clone();
         thread::spawn(move || {
             rpc.mainloop(&mut lsp);
@@ -327,8 +439,8 @@ pub fn start(
 
     fn initialize(&mut self) {
         let root_uri = self
-            .workspace
-            .clone()
+            .workspace_root()
+            .or_else(|| self.workspace.clone())
             .map(|p| Url::from_directory_path(p).unwrap());
         #[allow(deprecated)]
         let params = InitializeParams {
@@ -351,30 +463,63 @@ fn initialize(&mut self) {
             root_path: None,
             work_done_progress_params: WorkDoneProgressParams::default(),
         };
-        if let Ok(value) = self.server_rpc.server_request(
+        // Servers like the ones for Java can take a while to start. The
+        // documents opened meanwhile are sent to them once they're loaded.
+        let timeout = self.plugin_rpc.startup_timeout(&self.host.languages());
+        let (tx, rx) = crossbeam_channel::bounded(1);
+        self.server_rpc.server_request_async(
             Initialize::METHOD,
             params,
             None,
             None,
             false,
-        ) {
-            let result: InitializeResult = serde_json::from_value(value).unwrap();
-            self.host.server_capabilities = result.capabilities;
-            self.server_rpc.server_notification(
-                Initialized::METHOD,
-                InitializedParams {},
-                None,
-                None,
-                false,
-            );
-            if self
-                .plugin_rpc
-                .plugin_server_loaded(self.server_rpc.clone())
-                .is_err()
-            {
+            move |result: Result<Value, RpcError>| {
+                let _ = tx.send(result);
+            },
+        );
+        let result = rx.recv_timeout(timeout).unwrap_or_else(|_| {
+            Err(RpcError {
+                code: 0,
+                message: format!(
+                    "it didn't answer within {} seconds",
+                    timeout.as_secs()
+                ),
+            })
+        });
+        let result = result.and_then(|value| {
+            serde_json::from_value::<InitializeResult>(value).map_err(|err| {
+                RpcError {
+                    code: 0,
+                    message: format!("invalid initialize result: {err}"),
+                }
+            })
+        });
+        let result = match result {
+            Ok(result) => result,
+            Err(err) => {
+                // The server can't be used, so don't leave its process behind
+                self.host.show_initialize_error(&err);
                 self.server_rpc.shutdown();
                 self.shutdown();
+                return;
             }
+        };
+        self.check_server_version(result.server_info.as_ref());
+        self.host.set_server_capabilities(result.capabilities);
+        self.server_rpc.server_notification(
+            Initialized::METHOD,
+            InitializedParams {},
+            None,
+            None,
+            false,
+        );
+        if self
+            .plugin_rpc
+            .plugin_server_loaded(self.server_rpc.clone())
+            .is_err()
+        {
+            self.server_rpc.shutdown();
+            self.shutdown();
         }
         //     move |result| {
         //         if let Ok(value) = result {
@@ -388,6 +533,77 @@ fn initialize(&mut self) {
         // );
     }
 
+    /// Warn the user if the version of the server is older than the minimum
+    /// configured for its languages. Servers that don't report their version
+    /// when initialized are run with their version flag to print it.
+    fn check_server_version(&self, server_info: Option<&ServerInfo>) {
+        let languages = self.host.languages();
+        let min_versions = self.plugin_rpc.min_versions(&languages);
+        if min_versions.is_empty() {
+            return;
+        }
+        let version = match server_info.and_then(|info| info.version.clone()) {
+            Some(version) => version,
+            None => {
+                let flag = self.plugin_rpc.version_flag(&languages);
+                let Some(version) = probe_server_version(&self.server, &flag) else {
+                    return;
+                };
+                version
+            }
+        };
+        let name =
+            server_info.map_or(self.server.as_str(), |info| info.name.as_str());
+        if let Some(min_version) = min_versions
+            .iter()
+            .find(|min_version| version_older_than(&version, min_version))
+        {
+            self.host.show_version_warning(name, &version, min_version);
+        }
+    }
+
+    /// The root folder of the project the server serves, which is the closest
+    /// folder with one of the root markers of the server's languages.
+    ///
+    /// It's looked up from the workspace first, so a workspace inside a
+    /// monorepo uses the monorepo's root. When no parent of the workspace has
+    /// a marker, e.g. a folder holding several projects, the outermost root of
+    /// the open documents the server serves is used, so the root doesn't
+    /// depend on the order they were opened in.
+    fn workspace_root(&self) -> Option<PathBuf> {
+        let markers = self.plugin_rpc.root_markers(&self.host.languages());
+        if markers.is_empty() {
+            return None;
+        }
+
+        if let Some(root) = self
+            .workspace
+            .as_deref()
+            .and_then(|workspace| find_workspace_root(workspace, &markers))
+        {
+            return Some(root);
+        }
+
+        let Ok(ProxyResponse::GetOpenFilesContentResponse { items }) =
+            self.plugin_rpc.proxy_rpc.get_open_files_content()
+        else {
+            return None;
+        };
+        items
+            .into_iter()
+            .filter_map(|item| {
+                let path = uri_to_path(&item.uri).ok()?;
+                if !self
+                    .host
+                    .document_supported(Some(&item.language_id), Some(&path))
+                {
+                    return None;
+                }
+                find_workspace_root(path.parent()?, &markers)
+            })
+            .min_by_key(|root| (root.components().count(), root.clone()))
+    }
+
     fn shutdown(&mut self) {
         let _ = self.process.kill();
         let _ = self.process.wait();
@@ -416,6 +632,175 @@ fn process(
     }
 }
 
+/// Ping the server every `interval` until it exits or stops answering. Returns
+/// `true` if it missed [`HEARTBEAT_MAX_MISSES`] pings in a row, and so should
+/// be restarted.
+///
+/// A server that never answered a ping may still be starting or ignore them,
+/// so it's only restarted after it answered one.
+fn heartbeat(
+    rpc: &PluginServerRpcHandler,
+    stopped: &AtomicBool,
+    interval: Duration,
+) -> bool {
+    let mut answered = false;
+    let mut misses = 0;
+    loop {
+        thread::sleep(interval);
+        if stopped.load(Ordering::Relaxed) {
+            return false;
+        }
+
+        let (tx, rx) = crossbeam_channel::bounded(1);
+        rpc.server_request_async(
+            HEARTBEAT_METHOD,
+            Value::Null,
+            None,
+            None,
+            false,
+            move |_result: Result<Value, RpcError>| {
+                let _ = tx.send(());
+            },
+        );
+        if rx.recv_timeout(HEARTBEAT_TIMEOUT).is_ok() {
+            answered = true;
+            misses = 0;
+            continue;
+        }
+
+        // The server may have been shut down while waiting for the answer
+        if stopped.load(Ordering::Relaxed) {
+            return false;
+        }
+        misses += 1;
+        if answered && misses >= HEARTBEAT_MAX_MISSES {
+            return true;
+        }
+    }
+}
+
+/// Find the closest directory to `path`, including `path` itself, that contains
+/// one of the `markers`.
+fn find_workspace_root(path: &Path, markers: &[String]) -> Option<PathBuf> {
+    path.ancestors()
+        .find(|dir| markers.iter().any(|marker| dir.join(marker).exists()))
+        .map(Path::to_path_buf)
+}
+
+/// Whether `version` is older than `other`, comparing their dot separated
+/// numbers. Anything after the numbers, like `-nightly` or a commit hash, is
+/// ignored, and so are versions without a number.
+fn version_older_than(version: &str, other: &str) -> bool {
+    fn numbers(version: &str) -> Vec<u64> {
+        let version = version.trim_start_matches(['v', 'V']);
+        let mut numbers = Vec::new();
+        for part in version.split('.') {
+            let digits: String =
+                part.chars().take_while(|c| c.is_ascii_digit()).collect();
+            let Ok(number) = digits.parse() else {
+                break;
+            };
+            numbers.push(number);
+            if digits.len() < part.len() {
+                break;
+            }
+        }
+        numbers
+    }
+
+    let (version, other) = (numbers(version), numbers(other));
+    if version.is_empty() || other.is_empty() {
+        return false;
+    }
+    let len = version.len().max(other.len());
+    let padded = |numbers: Vec<u64>| {
+        numbers.into_iter().chain(std::iter::repeat(0)).take(len)
+    };
+    padded(version).lt(padded(other))
+}
+
+/// Run the server binary with the flag that makes it print its version, and
+/// find the version in what it printed. Servers that don't know the flag may
+/// start serving instead, so they are stopped after [`VERSION_PROBE_TIMEOUT`].
+fn probe_server_version(server: &str, flag: &str) -> Option<String> {
+    let mut child = Command::new(server)
+        .arg(flag)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .ok()?;
+    let start = Instant::now();
+    while child.try_wait().ok()?.is_none() {
+        if start.elapsed() > VERSION_PROBE_TIMEOUT {
+            let _ = child.kill();
+            let _ = child.wait();
+            return None;
+        }
+        thread::sleep(Duration::from_millis(20));
+    }
+    let output = child.wait_with_output().ok()?;
+    // Some servers print their version to stderr
+    parse_version_output(&String::from_utf8_lossy(&output.stdout))
+        .or_else(|| parse_version_output(&String::from_utf8_lossy(&output.stderr)))
+        .map(|version| version.to_string())
+}
+
+/// The first word of the output of a version flag that looks like a version,
+/// e.g. `0.3.1800` in `rust-analyzer 0.3.1800-standalone (4f09ee6 2024-01-21)`.
+fn parse_version_output(output: &str) -> Option<&str> {
+    output.split_whitespace().find(|word| {
+        let word = word.trim_start_matches(['v', 'V']);
+        word.starts_with(|c: char| c.is_ascii_digit()) && word.contains('.')
+    })
+}
+
+/// Sits between the client and the server process, for servers run behind a
+/// wrapper that expects an authentication token in the initialization options.
+/// It adds the token to the `initialize` request and passes all other messages
+/// through unchanged.
+struct ServerWrapper {
+    /// The token read from the environment variable configured for the
+    /// server's languages
+    auth_token: Option<String>,
+}
+
+impl ServerWrapper {
+    fn wrap(&self, msg: JsonRpc) -> JsonRpc {
+        if self.auth_token.is_none() || msg.get_method() != Some(Initialize::METHOD)
+        {
+            return msg;
+        }
+        let (Some(id), Some(Params::Map(mut params))) =
+            (msg.get_id(), msg.get_params())
+        else {
+            return msg;
+        };
+        let options = params.remove("initializationOptions");
+        if let Some(options) = with_auth_token(options, self.auth_token.clone()) {
+            params.insert("initializationOptions".to_string(), options);
+        }
+        JsonRpc::request_with_params(id, Initialize::METHOD, Params::Map(params))
+    }
+}
+
+/// Add the authentication token to the initialization options as `authToken`,
+/// for servers run behind a wrapper that expects it there. Options that aren't
+/// an object are left as they are.
+fn with_auth_token(options: Option<Value>, token: Option<String>) -> Option<Value> {
+    let Some(token) = token else {
+        return options;
+    };
+    match options {
+        None | Some(Value::Null) => Some(serde_json::json!({ "authToken": token })),
+        Some(Value::Object(mut options)) => {
+            options.insert("authToken".to_string(), Value::String(token));
+            Some(Value::Object(options))
+        }
+        options => options,
+    }
+}
+
 pub struct DocumentFilter {
     /// The document must have this language id, if it exists
     pub language_id: Option<String>,
@@ -491,6 +876,14 @@ pub fn read_message<T: BufRead>(reader: &mut T) -> Result<String> {
     Ok(body)
 }
 
+pub fn write_message<T: Write>(writer: &mut T, msg: &JsonRpc) -> Result<()> {
+    let msg = serde_json::to_string(msg)?;
+    let msg = format!("Content-Length: {}\r\n\r\n{}", msg.len(), msg);
+    writer.write_all(msg.as_bytes())?;
+    writer.flush()?;
+    Ok(())
+}
+
 pub fn get_change_for_sync_kind(
     sync_kind: TextDocumentSyncKind,
     buffer: &Buffer,
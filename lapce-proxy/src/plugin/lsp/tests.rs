@@ -0,0 +1,271 @@
+use std::io::{BufReader, Cursor};
+
+use jsonrpc_lite::{Id, JsonRpc};
+use lapce_rpc::{plugin::VoltID, RpcError};
+use lsp_types::{
+    notification::{DidOpenTextDocument, Initialized, Notification},
+    request::{HoverRequest, Request},
+    DidOpenTextDocumentParams, HoverParams, InitializedParams, Position,
+    TextDocumentIdentifier, TextDocumentItem, TextDocumentPositionParams, Url,
+    WorkDoneProgressParams,
+};
+use serde_json::{json, Value};
+
+use super::{
+    find_workspace_root, parse_version_output, read_message, version_older_than,
+    with_auth_token, write_message, ServerWrapper,
+};
+use crate::plugin::psp::{handle_plugin_server_message, PluginServerRpcHandler};
+
+fn server_rpc() -> (PluginServerRpcHandler, crossbeam_channel::Receiver<JsonRpc>) {
+    let (io_tx, io_rx) = crossbeam_channel::unbounded();
+    let volt_id = VoltID {
+        author: "lapce".to_string(),
+        name: "test".to_string(),
+    };
+    (
+        PluginServerRpcHandler::new(volt_id, None, None, io_tx),
+        io_rx,
+    )
+}
+
+/// Frame every message the client sent, and parse them back the way a server
+/// would read them from its stdin.
+fn sent_messages(io_rx: &crossbeam_channel::Receiver<JsonRpc>) -> Vec<Value> {
+    let mut stream = Vec::new();
+    for msg in io_rx.try_iter() {
+        write_message(&mut stream, &msg).unwrap();
+    }
+
+    let mut reader = BufReader::new(Cursor::new(stream));
+    let mut messages = Vec::new();
+    while let Ok(message) = read_message(&mut reader) {
+        messages.push(serde_json::from_str(&message).unwrap());
+    }
+    messages
+}
+
+fn hover_params() -> HoverParams {
+    HoverParams {
+        text_document_position_params: TextDocumentPositionParams {
+            text_document: TextDocumentIdentifier {
+                uri: Url::parse("file:///tmp/main.rs").unwrap(),
+            },
+            position: Position::new(1, 2),
+        },
+        work_done_progress_params: WorkDoneProgressParams::default(),
+    }
+}
+
+#[test]
+fn test_content_length_framing() {
+    let mut stream = Vec::new();
+    let msg =
+        JsonRpc::notification_with_params("test", json!({ "text": "héllo wörld" }));
+    write_message(&mut stream, &msg).unwrap();
+
+    let stream = String::from_utf8(stream).unwrap();
+    let (header, body) = stream.split_once("\r\n\r\n").unwrap();
+    // The length is counted in bytes, not in chars
+    assert_eq!(header, format!("Content-Length: {}", body.len()));
+    assert_ne!(body.len(), body.chars().count());
+}
+
+#[test]
+fn test_read_message_headers() {
+    let body = r#"{"jsonrpc":"2.0","method":"initialized","params":{}}"#;
+    let stream = format!(
+        "content-length: {}\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n{body}{body}",
+        body.len()
+    );
+    let mut reader = BufReader::new(Cursor::new(stream));
+    assert_eq!(read_message(&mut reader).unwrap(), body);
+
+    // A message without a Content-Length header can't be read
+    assert!(read_message(&mut reader).is_err());
+}
+
+#[test]
+fn test_notification_sequence() {
+    let (server_rpc, io_rx) = server_rpc();
+    server_rpc.server_notification(
+        Initialized::METHOD,
+        InitializedParams {},
+        None,
+        None,
+        false,
+    );
+    server_rpc.server_notification(
+        DidOpenTextDocument::METHOD,
+        DidOpenTextDocumentParams {
+            text_document: TextDocumentItem::new(
+                Url::parse("file:///tmp/main.rs").unwrap(),
+                "rust".to_string(),
+                3,
+                "fn main() {}".to_string(),
+            ),
+        },
+        None,
+        None,
+        false,
+    );
+
+    let messages = sent_messages(&io_rx);
+    assert_eq!(messages.len(), 2);
+    for message in messages.iter() {
+        assert_eq!(message["jsonrpc"], "2.0");
+        assert!(message.get("id").is_none());
+    }
+    assert_eq!(messages[0]["method"], Initialized::METHOD);
+    assert_eq!(messages[1]["method"], DidOpenTextDocument::METHOD);
+    assert_eq!(messages[1]["params"]["textDocument"]["version"], 3);
+    assert_eq!(messages[1]["params"]["textDocument"]["languageId"], "rust");
+}
+
+#[test]
+fn test_request_ids_and_responses() {
+    let (server_rpc, io_rx) = server_rpc();
+    let (result_tx, result_rx) = crossbeam_channel::unbounded();
+    for _ in 0..2 {
+        let result_tx = result_tx.clone();
+        server_rpc.server_request_async(
+            HoverRequest::METHOD,
+            hover_params(),
+            None,
+            None,
+            false,
+            move |result: Result<Value, RpcError>| {
+                let _ = result_tx.send(result);
+            },
+        );
+    }
+
+    let messages = sent_messages(&io_rx);
+    assert_eq!(messages.len(), 2);
+    for message in messages.iter() {
+        assert_eq!(message["jsonrpc"], "2.0");
+        assert_eq!(message["method"], HoverRequest::METHOD);
+        assert_eq!(
+            message["params"]["position"],
+            json!({"line": 1, "character": 2})
+        );
+    }
+    // Every request gets its own id
+    assert_eq!(messages[0]["id"], 0);
+    assert_eq!(messages[1]["id"], 1);
+
+    // Responses are routed to the request with the same id, in any order
+    handle_plugin_server_message(
+        &server_rpc,
+        r#"{"jsonrpc":"2.0","id":1,"result":{"contents":"second"}}"#,
+    );
+    handle_plugin_server_message(
+        &server_rpc,
+        r#"{"jsonrpc":"2.0","id":0,"error":{"code":-32601,"message":"first"}}"#,
+    );
+    let second = result_rx.try_recv().unwrap().unwrap();
+    assert_eq!(second["contents"], "second");
+    let first = result_rx.try_recv().unwrap().unwrap_err();
+    assert_eq!(first.code, -32601);
+    assert_eq!(first.message, "first");
+}
+
+#[test]
+fn test_with_auth_token() {
+    assert_eq!(with_auth_token(None, None), None);
+    assert_eq!(
+        with_auth_token(Some(json!({ "a": 1 })), None),
+        Some(json!({ "a": 1 }))
+    );
+    assert_eq!(
+        with_auth_token(None, Some("secret".to_string())),
+        Some(json!({ "authToken": "secret" }))
+    );
+    assert_eq!(
+        with_auth_token(Some(json!({ "a": 1 })), Some("secret".to_string())),
+        Some(json!({ "a": 1, "authToken": "secret" }))
+    );
+    assert_eq!(
+        with_auth_token(Some(json!([1])), Some("secret".to_string())),
+        Some(json!([1]))
+    );
+}
+
+#[test]
+fn test_find_workspace_root() {
+    let dir = std::env::temp_dir()
+        .join(format!("lapce-workspace-root-{}", std::process::id()));
+    let package = dir.join("crates").join("a").join("src");
+    std::fs::create_dir_all(&package).unwrap();
+    std::fs::write(dir.join("go.work"), "").unwrap();
+    std::fs::write(dir.join("crates").join("a").join("go.mod"), "").unwrap();
+
+    let markers = vec!["go.work".to_string()];
+    assert_eq!(find_workspace_root(&package, &markers), Some(dir.clone()));
+    let markers = vec!["go.mod".to_string(), "go.work".to_string()];
+    assert_eq!(
+        find_workspace_root(&package, &markers),
+        Some(dir.join("crates").join("a"))
+    );
+    assert_eq!(find_workspace_root(&package, &["none".to_string()]), None);
+
+    std::fs::remove_dir_all(&dir).unwrap();
+}
+
+#[test]
+fn test_server_wrapper() {
+    let wrapper = ServerWrapper {
+        auth_token: Some("secret".to_string()),
+    };
+    let initialize = JsonRpc::request_with_params(
+        Id::Num(0),
+        "initialize",
+        json!({ "processId": 1, "initializationOptions": { "a": 1 } }),
+    );
+    let params =
+        serde_json::to_value(wrapper.wrap(initialize).get_params()).unwrap();
+    assert_eq!(
+        params,
+        json!({
+            "processId": 1,
+            "initializationOptions": { "a": 1, "authToken": "secret" }
+        })
+    );
+
+    // Other messages are passed through unchanged
+    let hover = JsonRpc::request_with_params(
+        Id::Num(1),
+        "textDocument/hover",
+        json!({ "initializationOptions": {} }),
+    );
+    let params = serde_json::to_value(wrapper.wrap(hover).get_params()).unwrap();
+    assert_eq!(params, json!({ "initializationOptions": {} }));
+}
+
+#[test]
+fn test_version_older_than() {
+    assert!(version_older_than("0.3.1700", "0.3.1800"));
+    assert!(version_older_than("1.9", "1.10"));
+    assert!(version_older_than("v1.2", "1.2.1"));
+    assert!(version_older_than("0.3.1700-standalone", "0.3.1800"));
+    assert!(!version_older_than("1.2.0", "1.2"));
+    assert!(!version_older_than("2.0.0 (abc123 2024-01-01)", "1.10"));
+    // Versions that aren't numbers can't be compared
+    assert!(!version_older_than("nightly", "1.0"));
+}
+
+#[test]
+fn test_parse_version_output() {
+    assert_eq!(
+        parse_version_output(
+            "rust-analyzer 0.3.1800-standalone (4f09ee6 2024-01-21)\n"
+        ),
+        Some("0.3.1800-standalone")
+    );
+    assert_eq!(parse_version_output("gopls v0.14.2\n"), Some("v0.14.2"));
+    assert_eq!(
+        parse_version_output("clangd version 17.0.6"),
+        Some("17.0.6")
+    );
+    assert_eq!(parse_version_output("usage: server [options]"), None);
+}
@@ -2,6 +2,7 @@
 pub mod dap;
 pub mod lsp;
 pub mod psp;
+pub mod trace;
 pub mod wasi;
 
 use std::time::Duration;
@@ -24,6 +25,7 @@
 use lapce_rpc::{
     core::CoreRpcHandler,
     dap_types::{self, DapId, RunDebugConfig, SourceBreakpoint, ThreadId},
+    file::{path_to_uri, uri_to_path},
     plugin::{PluginId, VoltInfo, VoltMetadata},
     proxy::ProxyRpcHandler,
     style::LineStyle,
@@ -33,37 +35,70 @@
 use lapce_xi_rope::{Rope, RopeDelta};
 use lsp_types::{
     request::{
-        CodeActionRequest, CodeActionResolveRequest, Completion,
-        DocumentSymbolRequest, Formatting, GotoDefinition, GotoTypeDefinition,
-        GotoTypeDefinitionParams, GotoTypeDefinitionResponse, HoverRequest,
-        InlayHintRequest, InlineCompletionRequest, PrepareRenameRequest, References,
-        Rename, Request, ResolveCompletionItem, SelectionRangeRequest,
-        SemanticTokensFullRequest, SignatureHelpRequest, WorkspaceSymbolRequest,
+        CallHierarchyIncomingCalls, CallHierarchyOutgoingCalls,
+        CallHierarchyPrepare, CodeActionRequest, CodeActionResolveRequest,
+        CodeLensRequest, CodeLensResolve, ColorPresentationRequest, Completion,
+        DocumentColor, DocumentHighlightRequest, DocumentSymbolRequest,
+        ExecuteCommand, FoldingRangeRequest, Formatting, GotoDeclaration,
+        GotoDeclarationParams, GotoDeclarationResponse, GotoDefinition,
+        GotoImplementation, GotoImplementationParams, GotoImplementationResponse,
+        GotoTypeDefinition, GotoTypeDefinitionParams, GotoTypeDefinitionResponse,
+        HoverRequest, InlayHintRequest, InlineCompletionRequest, InlineValueRequest,
+        MonikerRequest, OnTypeFormatting, PrepareRenameRequest, RangeFormatting,
+        References, Rename, Request, ResolveCompletionItem, SelectionRangeRequest,
+        SemanticTokensFullDeltaRequest, SemanticTokensFullRequest,
+        SemanticTokensRangeRequest, SignatureHelpRequest, WorkspaceSymbolRequest,
+        WorkspaceSymbolResolve,
     },
-    ClientCapabilities, CodeAction, CodeActionCapabilityResolveSupport,
-    CodeActionClientCapabilities, CodeActionContext, CodeActionKind,
-    CodeActionKindLiteralSupport, CodeActionLiteralSupport, CodeActionParams,
-    CodeActionResponse, CompletionClientCapabilities, CompletionItem,
-    CompletionItemCapability, CompletionItemCapabilityResolveSupport,
-    CompletionParams, CompletionResponse, Diagnostic, DocumentFormattingParams,
-    DocumentSymbolParams, DocumentSymbolResponse, FormattingOptions, GotoCapability,
-    GotoDefinitionParams, GotoDefinitionResponse, Hover, HoverClientCapabilities,
-    HoverParams, InlayHint, InlayHintClientCapabilities, InlayHintParams,
+    ApplyWorkspaceEditResponse, CallHierarchyClientCapabilities,
+    CallHierarchyIncomingCall, CallHierarchyIncomingCallsParams, CallHierarchyItem,
+    CallHierarchyOutgoingCall, CallHierarchyOutgoingCallsParams,
+    CallHierarchyPrepareParams, ClientCapabilities, CodeAction,
+    CodeActionCapabilityResolveSupport, CodeActionClientCapabilities,
+    CodeActionContext, CodeActionKind, CodeActionKindLiteralSupport,
+    CodeActionLiteralSupport, CodeActionOrCommand, CodeActionParams,
+    CodeActionResponse, CodeLens, CodeLensClientCapabilities, CodeLensParams,
+    CodeLensWorkspaceClientCapabilities, Color, ColorInformation, ColorPresentation,
+    ColorPresentationParams, Command, CompletionClientCapabilities,
+    CompletionContext, CompletionItem, CompletionItemCapability,
+    CompletionItemCapabilityResolveSupport, CompletionItemKind, CompletionItemTag,
+    CompletionParams, CompletionResponse, Diagnostic, DiagnosticClientCapabilities,
+    DiagnosticSeverity, DocumentColorClientCapabilities, DocumentColorParams,
+    DocumentFormattingParams, DocumentHighlight,
+    DocumentHighlightClientCapabilities, DocumentHighlightParams,
+    DocumentOnTypeFormattingClientCapabilities, DocumentOnTypeFormattingOptions,
+    DocumentOnTypeFormattingParams, DocumentRangeFormattingClientCapabilities,
+    DocumentRangeFormattingParams, DocumentSymbolClientCapabilities,
+    DocumentSymbolParams, DocumentSymbolResponse, ExecuteCommandParams,
+    FailureHandlingKind, FoldingRange, FoldingRangeClientCapabilities,
+    FoldingRangeParams, FormattingOptions, GotoCapability, GotoDefinitionParams,
+    GotoDefinitionResponse, Hover, HoverClientCapabilities, HoverParams, InlayHint,
+    InlayHintClientCapabilities, InlayHintParams,
     InlineCompletionClientCapabilities, InlineCompletionParams,
-    InlineCompletionResponse, InlineCompletionTriggerKind, Location, MarkupKind,
-    MessageActionItemCapabilities, ParameterInformationSettings,
-    PartialResultParams, Position, PrepareRenameResponse,
-    PublishDiagnosticsClientCapabilities, Range, ReferenceContext, ReferenceParams,
-    RenameParams, SelectionRange, SelectionRangeParams, SemanticTokens,
-    SemanticTokensClientCapabilities, SemanticTokensParams,
-    ShowMessageRequestClientCapabilities, SignatureHelp,
-    SignatureHelpClientCapabilities, SignatureHelpParams,
-    SignatureInformationSettings, SymbolInformation, TextDocumentClientCapabilities,
-    TextDocumentIdentifier, TextDocumentItem, TextDocumentPositionParams,
-    TextDocumentSyncClientCapabilities, TextEdit, Url,
+    InlineCompletionResponse, InlineCompletionTriggerKind, InlineValue,
+    InlineValueClientCapabilities, InlineValueContext, InlineValueParams, Location,
+    MarkupKind, MessageActionItem, MessageActionItemCapabilities, Moniker,
+    MonikerClientCapabilities, MonikerParams, NumberOrString, OneOf,
+    ParameterInformationSettings, PartialResultParams, Position,
+    PrepareRenameResponse, PublishDiagnosticsClientCapabilities,
+    PublishDiagnosticsParams, Range, ReferenceContext, ReferenceParams,
+    RenameClientCapabilities, RenameParams, ResourceOperationKind, SelectionRange,
+    SelectionRangeParams, SemanticToken, SemanticTokens,
+    SemanticTokensClientCapabilities, SemanticTokensClientCapabilitiesRequests,
+    SemanticTokensDeltaParams, SemanticTokensEdit, SemanticTokensFullDeltaResult,
+    SemanticTokensFullOptions, SemanticTokensParams, SemanticTokensPartialResult,
+    SemanticTokensRangeParams, SemanticTokensRangeResult,
+    ShowDocumentClientCapabilities, ShowMessageRequestClientCapabilities,
+    SignatureHelp, SignatureHelpClientCapabilities, SignatureHelpContext,
+    SignatureHelpOptions, SignatureHelpParams, SignatureHelpTriggerKind,
+    SignatureInformationSettings, SymbolInformation, SymbolKind, TagSupport,
+    TextDocumentClientCapabilities, TextDocumentIdentifier, TextDocumentItem,
+    TextDocumentPositionParams, TextDocumentSyncClientCapabilities, TextEdit, Url,
     VersionedTextDocumentIdentifier, WindowClientCapabilities,
     WorkDoneProgressParams, WorkspaceClientCapabilities, WorkspaceEdit,
+    WorkspaceEditClientCapabilities, WorkspaceSymbol,
     WorkspaceSymbolClientCapabilities, WorkspaceSymbolParams,
+    WorkspaceSymbolResolveSupportCapability, WorkspaceSymbolResponse,
 };
 use parking_lot::Mutex;
 use serde::{de::DeserializeOwned, Deserialize, Serialize};
@@ -74,13 +109,41 @@
 use self::{
     catalog::PluginCatalog,
     dap::DapRpcHandler,
-    psp::{ClonableCallback, PluginServerRpcHandler, RpcCallback},
+    psp::{
+        ClonableCallback, PluginServerRpcHandler, ResponseSender, RpcCallback,
+        SERVER_NOT_CAPABLE,
+    },
     wasi::{load_volt, start_volt},
 };
 use crate::buffer::language_id_from_path;
 
 pub type PluginName = String;
 
+/// The most cached workspace symbols added to a single completion response.
+const MAX_CACHED_SYMBOL_COMPLETIONS: usize = 50;
+
+/// How long workspace symbol queries wait for the next one before they are
+/// sent, so that typing a query only searches the workspace once.
+const WORKSPACE_SYMBOL_DEBOUNCE: Duration = Duration::from_millis(150);
+
+/// How long a language server may take to start, unless configured otherwise
+/// for its languages.
+const DEFAULT_STARTUP_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// The files that mark the root folder of a project, for the languages whose
+/// markers aren't configured.
+const DEFAULT_ROOT_MARKERS: &[(&str, &[&str])] = &[
+    ("go", &["go.work"]),
+    ("python", &["pyproject.toml"]),
+    ("rust", &["Cargo.toml"]),
+];
+
+/// Provides the content of documents that don't live on disk, keyed by the uri
+/// scheme they are registered for (e.g. `git` or `output`).
+pub trait TextDocumentContentProvider: Send + Sync {
+    fn provide_content(&self, uri: &Url) -> Result<String>;
+}
+
 #[allow(clippy::large_enum_variant)]
 pub enum PluginCatalogRpc {
     ServerRequest {
@@ -219,8 +282,69 @@ pub struct PluginCatalogRpcHandler {
     id: Arc<AtomicU64>,
     #[allow(dead_code, clippy::type_complexity)]
     pending: Arc<Mutex<HashMap<u64, Sender<Result<Value, RpcError>>>>>,
+    #[allow(clippy::type_complexity)]
+    content_providers:
+        Arc<Mutex<HashMap<String, Arc<dyn TextDocumentContentProvider>>>>,
+    /// Workspace symbols fetched from each server right after it was loaded,
+    /// offered as low priority completion candidates.
+    symbol_cache: Arc<Mutex<HashMap<PluginId, Vec<SymbolInformation>>>>,
+    /// Handlers of the partial results of pending requests, by their partial
+    /// result token.
+    partial_results: Arc<Mutex<HashMap<String, PartialResultHandler>>>,
+    /// The interval in seconds of pinging language servers, `0` if they
+    /// shouldn't be pinged.
+    heartbeat_interval: Arc<AtomicU64>,
+    /// Whether the messages exchanged with language servers are logged to
+    /// trace files.
+    lsp_trace: Arc<AtomicBool>,
+    /// How many seconds the servers of a language may take to start, by
+    /// language id.
+    startup_timeouts: Arc<Mutex<HashMap<String, u64>>>,
+    /// The language server features that are turned on or off, by their
+    /// method. Features that aren't listed are on.
+    lsp_features: Arc<Mutex<HashMap<String, bool>>>,
+    /// The environment variables holding the authentication tokens of the
+    /// servers of a language, by language id.
+    auth_token_envs: Arc<Mutex<HashMap<String, String>>>,
+    /// The settings given to the servers of a language when they ask for
+    /// their configuration, by language id.
+    configurations: Arc<Mutex<HashMap<String, Value>>>,
+    /// The oldest version of the servers of a language that's known to work,
+    /// by language id.
+    min_versions: Arc<Mutex<HashMap<String, String>>>,
+    /// The flag the servers of a language print their version with, by
+    /// language id.
+    version_flags: Arc<Mutex<HashMap<String, String>>>,
+    /// The latest diagnostics of each document from each server, which are
+    /// published together.
+    diagnostics: Arc<Mutex<HashMap<Url, HashMap<PluginId, Vec<Diagnostic>>>>>,
+    /// The last semantic tokens of each document with the server that sent
+    /// them, which later requests only ask that server for the changes to.
+    semantic_tokens: Arc<Mutex<HashMap<PathBuf, (PluginId, SemanticTokens)>>>,
+    /// The characters that trigger and retrigger signature help, by the
+    /// server that reported them.
+    signature_help_triggers:
+        Arc<Mutex<HashMap<PluginId, (Vec<String>, Vec<String>)>>>,
+    /// The `window/showMessageRequest` requests that wait for the user to
+    /// pick an action, by the id they were shown with.
+    message_requests: Arc<Mutex<HashMap<u64, ResponseSender>>>,
+    /// The files that mark the root folder of a project, by language id.
+    root_markers: Arc<Mutex<HashMap<String, Vec<String>>>>,
+    /// The `workspace/applyEdit` requests that wait for the editor to apply
+    /// their text edits, with the failure of their resource operations, by
+    /// the id they were sent with.
+    workspace_edit_requests:
+        Arc<Mutex<HashMap<u64, (ResponseSender, Option<u32>, Option<String>)>>>,
+    /// The characters that trigger on type formatting, by the server that
+    /// reported them.
+    on_type_formatting_triggers: Arc<Mutex<HashMap<PluginId, Vec<String>>>>,
+    /// The symbols of the last workspace symbol query that came without a
+    /// range, with the server that found them, to be resolved when picked.
+    unresolved_symbols: Arc<Mutex<Vec<(PluginId, WorkspaceSymbol)>>>,
 }
 
+type PartialResultHandler = Box<dyn FnMut(PluginId, Value) + Send>;
+
 impl PluginCatalogRpcHandler {
     pub fn new(core_rpc: CoreRpcHandler, proxy_rpc: ProxyRpcHandler) -> Self {
         let (plugin_tx, plugin_rx) = crossbeam_channel::unbounded();
@@ -231,7 +355,438 @@ pub fn new(core_rpc: CoreRpcHandler, proxy_rpc: ProxyRpcHandler) -> Self {
             plugin_rx: Arc::new(Mutex::new(Some(plugin_rx))),
             id: Arc::new(AtomicU64::new(0)),
             pending: Arc::new(Mutex::new(HashMap::new())),
+            content_providers: Arc::new(Mutex::new(HashMap::new())),
+            symbol_cache: Arc::new(Mutex::new(HashMap::new())),
+            partial_results: Arc::new(Mutex::new(HashMap::new())),
+            heartbeat_interval: Arc::new(AtomicU64::new(0)),
+            lsp_trace: Arc::new(AtomicBool::new(false)),
+            startup_timeouts: Arc::new(Mutex::new(HashMap::new())),
+            lsp_features: Arc::new(Mutex::new(HashMap::new())),
+            auth_token_envs: Arc::new(Mutex::new(HashMap::new())),
+            configurations: Arc::new(Mutex::new(HashMap::new())),
+            min_versions: Arc::new(Mutex::new(HashMap::new())),
+            version_flags: Arc::new(Mutex::new(HashMap::new())),
+            diagnostics: Arc::new(Mutex::new(HashMap::new())),
+            semantic_tokens: Arc::new(Mutex::new(HashMap::new())),
+            signature_help_triggers: Arc::new(Mutex::new(HashMap::new())),
+            message_requests: Arc::new(Mutex::new(HashMap::new())),
+            root_markers: Arc::new(Mutex::new(HashMap::new())),
+            workspace_edit_requests: Arc::new(Mutex::new(HashMap::new())),
+            on_type_formatting_triggers: Arc::new(Mutex::new(HashMap::new())),
+            unresolved_symbols: Arc::new(Mutex::new(Vec::new())),
+        }
+    }
+
+    pub fn set_heartbeat_interval(&self, secs: u64) {
+        self.heartbeat_interval.store(secs, Ordering::Relaxed);
+    }
+
+    pub fn set_lsp_trace(&self, trace: bool) {
+        self.lsp_trace.store(trace, Ordering::Relaxed);
+    }
+
+    /// Whether the messages exchanged with language servers that are started
+    /// from now on are logged to trace files.
+    pub fn lsp_trace(&self) -> bool {
+        self.lsp_trace.load(Ordering::Relaxed)
+    }
+
+    pub fn set_startup_timeouts(&self, timeouts: HashMap<String, u64>) {
+        *self.startup_timeouts.lock() = timeouts;
+    }
+
+    pub fn set_lsp_features(&self, features: HashMap<String, bool>) {
+        *self.lsp_features.lock() = features;
+    }
+
+    pub fn set_auth_token_envs(&self, envs: HashMap<String, String>) {
+        *self.auth_token_envs.lock() = envs;
+    }
+
+    /// The authentication token of the servers of the given languages, read
+    /// from the environment variable configured for the first of them that
+    /// has one.
+    pub fn auth_token(&self, languages: &[&str]) -> Option<String> {
+        let envs = self.auth_token_envs.lock();
+        languages
+            .iter()
+            .find_map(|language| envs.get(*language))
+            .and_then(|env| std::env::var(env).ok())
+    }
+
+    pub fn set_configurations(&self, configurations: HashMap<String, Value>) {
+        *self.configurations.lock() = configurations;
+    }
+
+    /// The settings of the servers of the given languages, from the first of
+    /// them that has any.
+    pub fn configuration(&self, languages: &[&str]) -> Value {
+        let configurations = self.configurations.lock();
+        languages
+            .iter()
+            .find_map(|language| configurations.get(*language))
+            .cloned()
+            .unwrap_or(Value::Null)
+    }
+
+    /// Keeps the response of a `window/showMessageRequest` until the user
+    /// picked an action, returning the id to show the message with.
+    pub fn add_message_request(&self, resp: ResponseSender) -> u64 {
+        let id = self.id.fetch_add(1, Ordering::Relaxed);
+        self.message_requests.lock().insert(id, resp);
+        id
+    }
+
+    /// Answers the server that showed the message with the action the user
+    /// picked, or `null` if there's none.
+    pub fn message_request_response(
+        &self,
+        request_id: u64,
+        action: Option<MessageActionItem>,
+    ) {
+        if let Some(resp) = self.message_requests.lock().remove(&request_id) {
+            resp.send(action);
+        }
+    }
+
+    /// Whether the feature of the LSP method wasn't turned off.
+    pub fn lsp_feature_enabled(&self, method: &str) -> bool {
+        self.lsp_features
+            .lock()
+            .get(method)
+            .copied()
+            .unwrap_or(true)
+    }
+
+    pub fn set_signature_help_triggers(
+        &self,
+        plugin_id: PluginId,
+        options: Option<&SignatureHelpOptions>,
+    ) {
+        let mut triggers = self.signature_help_triggers.lock();
+        match options {
+            Some(options) => {
+                triggers.insert(
+                    plugin_id,
+                    (
+                        options.trigger_characters.clone().unwrap_or_default(),
+                        options.retrigger_characters.clone().unwrap_or_default(),
+                    ),
+                );
+            }
+            None => {
+                triggers.remove(&plugin_id);
+            }
+        }
+        // The editor only asks for signature help after typing one of them,
+        // or while it shows one
+        let mut all_triggers: Vec<String> = triggers
+            .values()
+            .flat_map(|(trigger, retrigger)| trigger.iter().chain(retrigger))
+            .cloned()
+            .collect();
+        drop(triggers);
+        all_triggers.sort();
+        all_triggers.dedup();
+        self.core_rpc.signature_help_triggers(all_triggers);
+    }
+
+    /// The context of a signature help request made after typing the
+    /// character, which is only a trigger if a server reported it as one.
+    fn signature_help_context(
+        &self,
+        character: Option<String>,
+    ) -> SignatureHelpContext {
+        let triggers = self.signature_help_triggers.lock();
+        let is_trigger =
+            |c: &String| triggers.values().any(|(trigger, _)| trigger.contains(c));
+        let is_retrigger = |c: &String| {
+            triggers
+                .values()
+                .any(|(_, retrigger)| retrigger.contains(c))
+        };
+        match character {
+            Some(c) if is_trigger(&c) => SignatureHelpContext {
+                trigger_kind: SignatureHelpTriggerKind::TRIGGER_CHARACTER,
+                trigger_character: Some(c),
+                is_retrigger: false,
+                active_signature_help: None,
+            },
+            Some(c) if is_retrigger(&c) => SignatureHelpContext {
+                trigger_kind: SignatureHelpTriggerKind::TRIGGER_CHARACTER,
+                trigger_character: Some(c),
+                is_retrigger: true,
+                active_signature_help: None,
+            },
+            _ => SignatureHelpContext {
+                trigger_kind: SignatureHelpTriggerKind::INVOKED,
+                trigger_character: None,
+                is_retrigger: false,
+                active_signature_help: None,
+            },
+        }
+    }
+
+    /// Replace the diagnostics of a document from one server, returning them
+    /// merged with the ones of the other servers.
+    pub fn merge_diagnostics(
+        &self,
+        plugin_id: PluginId,
+        params: PublishDiagnosticsParams,
+    ) -> PublishDiagnosticsParams {
+        let mut diagnostics = self.diagnostics.lock();
+        let by_server = diagnostics.entry(params.uri.clone()).or_default();
+        if params.diagnostics.is_empty() {
+            by_server.remove(&plugin_id);
+        } else {
+            by_server.insert(plugin_id, params.diagnostics);
+        }
+        let merged = merge_diagnostics(by_server);
+        if by_server.is_empty() {
+            diagnostics.remove(&params.uri);
+        }
+        PublishDiagnosticsParams {
+            uri: params.uri,
+            diagnostics: merged,
+            version: params.version,
+        }
+    }
+
+    /// Drop the diagnostics of a server that was stopped, and publish what's
+    /// left of the diagnostics of each document it had some for.
+    pub fn remove_diagnostics(&self, plugin_id: PluginId) {
+        let mut published = Vec::new();
+        self.diagnostics.lock().retain(|uri, by_server| {
+            if by_server.remove(&plugin_id).is_some() {
+                published.push(PublishDiagnosticsParams {
+                    uri: uri.clone(),
+                    diagnostics: merge_diagnostics(by_server),
+                    version: None,
+                });
+            }
+            !by_server.is_empty()
+        });
+        for params in published {
+            self.core_rpc.publish_diagnostics(params);
+        }
+    }
+
+    /// How long a server of the languages may take to start, which is the
+    /// longest timeout of any of them.
+    pub fn startup_timeout(&self, languages: &[&str]) -> Duration {
+        let timeouts = self.startup_timeouts.lock();
+        languages
+            .iter()
+            .filter_map(|language| timeouts.get(*language))
+            .max()
+            .map(|secs| Duration::from_secs(*secs))
+            .unwrap_or(DEFAULT_STARTUP_TIMEOUT)
+    }
+
+    /// The interval of pinging language servers to check that they are still
+    /// responsive, if they should be pinged at all.
+    pub fn heartbeat_interval(&self) -> Option<Duration> {
+        let secs = self.heartbeat_interval.load(Ordering::Relaxed);
+        (secs > 0).then(|| Duration::from_secs(secs))
+    }
+
+    /// Keeps the response of a `workspace/applyEdit` until the editor applied
+    /// its text edits, returning the id to send them with.
+    pub fn add_workspace_edit_request(
+        &self,
+        resp: ResponseSender,
+        failed_change: Option<u32>,
+        failure_reason: Option<String>,
+    ) -> u64 {
+        let id = self.id.fetch_add(1, Ordering::Relaxed);
+        self.workspace_edit_requests
+            .lock()
+            .insert(id, (resp, failed_change, failure_reason));
+        id
+    }
+
+    /// Answers the server that asked for the workspace edit whether all of it
+    /// was applied.
+    pub fn workspace_edit_response(&self, request_id: u64, applied: bool) {
+        let Some((resp, failed_change, failure_reason)) =
+            self.workspace_edit_requests.lock().remove(&request_id)
+        else {
+            return;
+        };
+        let failure_reason = failure_reason.or_else(|| {
+            (!applied).then(|| "failed to apply the text edits".to_string())
+        });
+        resp.send(ApplyWorkspaceEditResponse {
+            applied: applied && failed_change.is_none(),
+            failure_reason,
+            failed_change,
+        });
+    }
+
+    /// Pass a partial result reported with `$/progress` to the request it
+    /// belongs to. Returns `false` if the token isn't one of a pending request.
+    pub fn handle_partial_result(
+        &self,
+        plugin_id: PluginId,
+        token: &str,
+        value: Value,
+    ) -> bool {
+        if let Some(handler) = self.partial_results.lock().get_mut(token) {
+            handler(plugin_id, value);
+            true
+        } else {
+            false
+        }
+    }
+
+    /// Register the provider used to answer content requests for documents
+    /// with the given uri scheme, replacing any previous one.
+    pub fn register_text_document_content_provider(
+        &self,
+        scheme: impl Into<String>,
+        provider: Arc<dyn TextDocumentContentProvider>,
+    ) {
+        self.content_providers
+            .lock()
+            .insert(scheme.into(), provider);
+    }
+
+    pub fn provide_text_document_content(&self, uri: &Url) -> Result<String> {
+        let provider = self
+            .content_providers
+            .lock()
+            .get(uri.scheme())
+            .cloned()
+            .ok_or_else(|| {
+                anyhow!("no content provider for scheme {}", uri.scheme())
+            })?;
+        provider.provide_content(uri)
+    }
+
+    pub fn cache_workspace_symbols(
+        &self,
+        plugin_id: PluginId,
+        symbols: Vec<SymbolInformation>,
+    ) {
+        self.symbol_cache.lock().insert(plugin_id, symbols);
+    }
+
+    /// Append the cached workspace symbols of the plugin that start with `input`
+    /// to its completion response, sorted after everything the server returned.
+    fn add_cached_symbols(
+        &self,
+        plugin_id: PluginId,
+        input: &str,
+        resp: &mut CompletionResponse,
+    ) {
+        if input.is_empty() {
+            return;
         }
+        let cache = self.symbol_cache.lock();
+        let Some(symbols) = cache.get(&plugin_id) else {
+            return;
+        };
+
+        let items = match resp {
+            CompletionResponse::Array(items) => items,
+            CompletionResponse::List(list) => &mut list.items,
+        };
+        let input = input.to_lowercase();
+        let candidates = symbols
+            .iter()
+            .filter(|symbol| symbol.name.to_lowercase().starts_with(&input))
+            .filter(|symbol| !items.iter().any(|item| item.label == symbol.name))
+            .take(MAX_CACHED_SYMBOL_COMPLETIONS)
+            .map(|symbol| CompletionItem {
+                label: symbol.name.clone(),
+                kind: symbol_completion_kind(symbol.kind),
+                detail: symbol.container_name.clone(),
+                sort_text: Some(format!("~{}", symbol.name)),
+                ..Default::default()
+            })
+            .collect::<Vec<_>>();
+        items.extend(candidates);
+    }
+
+    pub fn set_root_markers(&self, markers: HashMap<String, Vec<String>>) {
+        *self.root_markers.lock() = markers;
+    }
+
+    /// The files that mark the root folder of a project for the servers of
+    /// the given languages, from all of them. Languages without configured
+    /// markers use the [`DEFAULT_ROOT_MARKERS`].
+    pub fn root_markers(&self, languages: &[&str]) -> Vec<String> {
+        let markers = self.root_markers.lock();
+        languages
+            .iter()
+            .flat_map(|language| match markers.get(*language) {
+                Some(markers) => markers.clone(),
+                None => DEFAULT_ROOT_MARKERS
+                    .iter()
+                    .find(|(name, _)| name == language)
+                    .map(|(_, markers)| {
+                        markers.iter().map(|marker| marker.to_string()).collect()
+                    })
+                    .unwrap_or_default(),
+            })
+            .collect()
+    }
+
+    pub fn set_min_versions(&self, versions: HashMap<String, String>) {
+        *self.min_versions.lock() = versions;
+    }
+
+    /// The oldest versions of the servers of the given languages that are
+    /// known to work, from all of them.
+    pub fn min_versions(&self, languages: &[&str]) -> Vec<String> {
+        let versions = self.min_versions.lock();
+        languages
+            .iter()
+            .filter_map(|language| versions.get(*language))
+            .cloned()
+            .collect()
+    }
+
+    pub fn set_version_flags(&self, flags: HashMap<String, String>) {
+        *self.version_flags.lock() = flags;
+    }
+
+    /// The flag the servers of the given languages print their version with,
+    /// which is `--version` unless one of them has another.
+    pub fn version_flag(&self, languages: &[&str]) -> String {
+        let flags = self.version_flags.lock();
+        languages
+            .iter()
+            .find_map(|language| flags.get(*language))
+            .cloned()
+            .unwrap_or_else(|| "--version".to_string())
+    }
+
+    pub fn set_on_type_formatting_triggers(
+        &self,
+        plugin_id: PluginId,
+        options: Option<&DocumentOnTypeFormattingOptions>,
+    ) {
+        let mut triggers = self.on_type_formatting_triggers.lock();
+        match options {
+            Some(options) => {
+                let mut characters = vec![options.first_trigger_character.clone()];
+                characters.extend(
+                    options.more_trigger_character.iter().flatten().cloned(),
+                );
+                triggers.insert(plugin_id, characters);
+            }
+            None => {
+                triggers.remove(&plugin_id);
+            }
+        }
+        // The editor only asks for on type formatting after typing one of them
+        let mut all_triggers: Vec<String> =
+            triggers.values().flatten().cloned().collect();
+        drop(triggers);
+        all_triggers.sort();
+        all_triggers.dedup();
+        self.core_rpc.on_type_formatting_triggers(all_triggers);
     }
 
     #[allow(dead_code)]
@@ -416,6 +971,50 @@ fn send_request_to_all_plugins<P, Resp>(
         );
     }
 
+    /// Sends the request to every server, and calls back once all of them
+    /// answered with the successful responses of each.
+    fn send_request_to_each_plugin<P, Resp>(
+        &self,
+        method: &'static str,
+        params: P,
+        language_id: Option<String>,
+        path: Option<PathBuf>,
+        cb: impl FnOnce(Vec<(PluginId, Resp)>) + Send + 'static,
+    ) where
+        P: Serialize,
+        Resp: DeserializeOwned + Send + 'static,
+    {
+        let request_sent = Arc::new(AtomicUsize::new(0));
+        let state = Arc::new(Mutex::new((Vec::new(), 0, Some(cb))));
+        self.send_request(
+            None,
+            Some(request_sent.clone()),
+            method,
+            params,
+            language_id,
+            path,
+            true,
+            move |plugin_id, result| {
+                let mut state = state.lock();
+                let (responses, received, cb) = &mut *state;
+                if let Some(resp) = result
+                    .ok()
+                    .and_then(|value| serde_json::from_value::<Resp>(value).ok())
+                {
+                    responses.push((plugin_id, resp));
+                }
+                *received += 1;
+                if *received == request_sent.load(Ordering::Acquire) {
+                    if let Some(cb) = cb.take() {
+                        let responses = std::mem::take(responses);
+                        drop(state);
+                        cb(responses);
+                    }
+                }
+            },
+        );
+    }
+
     #[allow(clippy::too_many_arguments)]
     pub(crate) fn send_request<P: Serialize>(
         &self,
@@ -480,8 +1079,7 @@ pub fn format_semantic_tokens(
     }
 
     pub fn did_save_text_document(&self, path: &Path, text: Rope) {
-        let text_document =
-            TextDocumentIdentifier::new(Url::from_file_path(path).unwrap());
+        let text_document = TextDocumentIdentifier::new(path_to_uri(path));
         let language_id = language_id_from_path(path).unwrap_or("").to_string();
         let _ = self.plugin_tx.send(PluginCatalogRpc::DidSaveTextDocument {
             language_id,
@@ -499,10 +1097,8 @@ pub fn did_change_text_document(
         text: Rope,
         new_text: Rope,
     ) {
-        let document = VersionedTextDocumentIdentifier::new(
-            Url::from_file_path(path).unwrap(),
-            rev as i32,
-        );
+        let document =
+            VersionedTextDocumentIdentifier::new(path_to_uri(path), rev as i32);
         let language_id = language_id_from_path(path).unwrap_or("").to_string();
         let _ = self
             .plugin_tx
@@ -524,7 +1120,7 @@ pub fn get_definition(
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
+        let uri = path_to_uri(path);
         let method = GotoDefinition::METHOD;
         let params = GotoDefinitionParams {
             text_document_position_params: TextDocumentPositionParams {
@@ -555,7 +1151,7 @@ pub fn get_type_definition(
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
+        let uri = path_to_uri(path);
         let method = GotoTypeDefinition::METHOD;
         let params = GotoTypeDefinitionParams {
             text_document_position_params: TextDocumentPositionParams {
@@ -577,27 +1173,24 @@ pub fn get_type_definition(
         );
     }
 
-    pub fn get_references(
+    pub fn get_document_highlights(
         &self,
         path: &Path,
         position: Position,
-        cb: impl FnOnce(PluginId, Result<Vec<Location>, RpcError>)
+        cb: impl FnOnce(PluginId, Result<Option<Vec<DocumentHighlight>>, RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = References::METHOD;
-        let params = ReferenceParams {
-            text_document_position: TextDocumentPositionParams {
+        let uri = path_to_uri(path);
+        let method = DocumentHighlightRequest::METHOD;
+        let params = DocumentHighlightParams {
+            text_document_position_params: TextDocumentPositionParams {
                 text_document: TextDocumentIdentifier { uri },
                 position,
             },
             work_done_progress_params: WorkDoneProgressParams::default(),
             partial_result_params: PartialResultParams::default(),
-            context: ReferenceContext {
-                include_declaration: false,
-            },
         };
 
         let language_id =
@@ -611,32 +1204,26 @@ pub fn get_references(
         );
     }
 
-    pub fn get_code_actions(
+    pub fn get_implementation(
         &self,
         path: &Path,
         position: Position,
-        diagnostics: Vec<Diagnostic>,
-        cb: impl FnOnce(PluginId, Result<CodeActionResponse, RpcError>)
+        cb: impl FnOnce(PluginId, Result<GotoImplementationResponse, RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = CodeActionRequest::METHOD;
-        let params = CodeActionParams {
-            text_document: TextDocumentIdentifier { uri },
-            range: Range {
-                start: position,
-                end: position,
-            },
-            context: CodeActionContext {
-                diagnostics,
-                only: None,
-                trigger_kind: None,
+        let uri = path_to_uri(path);
+        let method = GotoImplementation::METHOD;
+        let params = GotoImplementationParams {
+            text_document_position_params: TextDocumentPositionParams {
+                text_document: TextDocumentIdentifier { uri },
+                position,
             },
             work_done_progress_params: WorkDoneProgressParams::default(),
             partial_result_params: PartialResultParams::default(),
         };
+
         let language_id =
             Some(language_id_from_path(path).unwrap_or("").to_string());
         self.send_request_to_all_plugins(
@@ -648,22 +1235,26 @@ pub fn get_code_actions(
         );
     }
 
-    pub fn get_inlay_hints(
+    pub fn get_declaration(
         &self,
         path: &Path,
-        range: Range,
-        cb: impl FnOnce(PluginId, Result<Vec<InlayHint>, RpcError>)
+        position: Position,
+        cb: impl FnOnce(PluginId, Result<GotoDeclarationResponse, RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = InlayHintRequest::METHOD;
-        let params = InlayHintParams {
-            text_document: TextDocumentIdentifier { uri },
+        let uri = path_to_uri(path);
+        let method = GotoDeclaration::METHOD;
+        let params = GotoDeclarationParams {
+            text_document_position_params: TextDocumentPositionParams {
+                text_document: TextDocumentIdentifier { uri },
+                position,
+            },
             work_done_progress_params: WorkDoneProgressParams::default(),
-            range,
+            partial_result_params: PartialResultParams::default(),
         };
+
         let language_id =
             Some(language_id_from_path(path).unwrap_or("").to_string());
         self.send_request_to_all_plugins(
@@ -675,28 +1266,758 @@ pub fn get_inlay_hints(
         );
     }
 
-    pub fn get_inline_completions(
+    pub fn get_references(
         &self,
         path: &Path,
         position: Position,
-        trigger_kind: InlineCompletionTriggerKind,
-        cb: impl FnOnce(PluginId, Result<InlineCompletionResponse, RpcError>)
+        include_declaration: bool,
+        cb: impl FnOnce(PluginId, Result<Vec<Location>, RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = InlineCompletionRequest::METHOD;
-        let params = InlineCompletionParams {
+        let uri = path_to_uri(path);
+        let method = References::METHOD;
+        let params = ReferenceParams {
             text_document_position: TextDocumentPositionParams {
                 text_document: TextDocumentIdentifier { uri },
                 position,
             },
-            context: lsp_types::InlineCompletionContext {
-                trigger_kind,
-                selected_completion_info: None,
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+            context: ReferenceContext {
+                include_declaration,
+            },
+        };
+
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            cb,
+        );
+    }
+
+    pub fn get_code_actions(
+        &self,
+        path: &Path,
+        position: Position,
+        diagnostics: Vec<Diagnostic>,
+        only: Option<Vec<CodeActionKind>>,
+        cb: impl FnOnce(PluginId, Result<CodeActionResponse, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let method = CodeActionRequest::METHOD;
+        let params = code_action_params(path, position, diagnostics, only);
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            move |plugin_id, result: Result<CodeActionResponse, RpcError>| {
+                cb(plugin_id, result.map(normalize_code_actions))
+            },
+        );
+    }
+
+    /// The quick fixes at the position from all the servers together, so that
+    /// it can be decided once whether there's only one to run.
+    pub fn get_quick_fixes(
+        &self,
+        path: &Path,
+        position: Position,
+        diagnostics: Vec<Diagnostic>,
+        cb: impl FnOnce(Vec<(PluginId, CodeActionResponse)>) + Send + 'static,
+    ) {
+        let method = CodeActionRequest::METHOD;
+        let params = code_action_params(
+            path,
+            position,
+            diagnostics,
+            Some(vec![CodeActionKind::QUICKFIX]),
+        );
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_each_plugin(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            move |responses: Vec<(PluginId, CodeActionResponse)>| {
+                cb(responses
+                    .into_iter()
+                    .map(|(plugin_id, actions)| {
+                        (plugin_id, normalize_code_actions(actions))
+                    })
+                    .collect())
             },
+        );
+    }
+
+    /// The actions that fix all the `diagnostics` at once, from servers like
+    /// ESLint that offer `source.fixAll` or `quickfix.all` actions.
+    pub fn get_fix_all_actions(
+        &self,
+        path: &Path,
+        diagnostics: Vec<Diagnostic>,
+        cb: impl FnOnce(Vec<(PluginId, CodeActionResponse)>) + Send + 'static,
+    ) {
+        let method = CodeActionRequest::METHOD;
+        // The range spanning all the diagnostics
+        let range = Range {
+            start: diagnostics
+                .iter()
+                .map(|d| d.range.start)
+                .min()
+                .unwrap_or_default(),
+            end: diagnostics
+                .iter()
+                .map(|d| d.range.end)
+                .max()
+                .unwrap_or_default(),
+        };
+        let params = CodeActionParams {
+            text_document: TextDocumentIdentifier {
+                uri: path_to_uri(path),
+            },
+            range,
+            context: CodeActionContext {
+                diagnostics,
+                only: Some(vec![
+                    CodeActionKind::SOURCE_FIX_ALL,
+                    CodeActionKind::from("quickfix.all"),
+                ]),
+                trigger_kind: None,
+            },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_each_plugin(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            move |responses: Vec<(PluginId, CodeActionResponse)>| {
+                cb(responses
+                    .into_iter()
+                    .map(|(plugin_id, actions)| {
+                        (plugin_id, normalize_code_actions(actions))
+                    })
+                    .collect())
+            },
+        );
+    }
+
+    pub fn get_inlay_hints(
+        &self,
+        path: &Path,
+        range: Range,
+        cb: impl FnOnce(PluginId, Result<Vec<InlayHint>, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = InlayHintRequest::METHOD;
+        let params = InlayHintParams {
+            text_document: TextDocumentIdentifier { uri },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            range,
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            cb,
+        );
+    }
+
+    pub fn get_inline_values(
+        &self,
+        path: &Path,
+        range: Range,
+        context: InlineValueContext,
+        cb: impl FnOnce(PluginId, Result<Vec<InlineValue>, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = InlineValueRequest::METHOD;
+        let params = InlineValueParams {
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            text_document: TextDocumentIdentifier { uri },
+            range,
+            context,
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            cb,
+        );
+    }
+
+    pub fn get_inline_completions(
+        &self,
+        path: &Path,
+        position: Position,
+        trigger_kind: InlineCompletionTriggerKind,
+        cb: impl FnOnce(PluginId, Result<InlineCompletionResponse, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = InlineCompletionRequest::METHOD;
+        let params = InlineCompletionParams {
+            text_document_position: TextDocumentPositionParams {
+                text_document: TextDocumentIdentifier { uri },
+                position,
+            },
+            context: lsp_types::InlineCompletionContext {
+                trigger_kind,
+                selected_completion_info: None,
+            },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            cb,
+        );
+    }
+
+    pub fn get_document_symbols(
+        &self,
+        path: &Path,
+        cb: impl FnOnce(PluginId, Result<DocumentSymbolResponse, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = DocumentSymbolRequest::METHOD;
+        let params = DocumentSymbolParams {
+            text_document: TextDocumentIdentifier { uri },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            cb,
+        );
+    }
+
+    /// Search the symbols of the workspace once no other query came in for a
+    /// moment. Queries replaced by a newer one fail without being sent.
+    pub fn get_workspace_symbols(
+        &self,
+        query: String,
+        cb: impl FnOnce(Result<Vec<SymbolInformation>, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        static QUERY_ID: AtomicU64 = AtomicU64::new(0);
+        let our_id = QUERY_ID.fetch_add(1, Ordering::SeqCst) + 1;
+
+        let catalog = self.clone();
+        std::thread::spawn(move || {
+            std::thread::sleep(WORKSPACE_SYMBOL_DEBOUNCE);
+            if QUERY_ID.load(Ordering::SeqCst) != our_id {
+                cb(Err(RpcError {
+                    code: 0,
+                    message: "expired workspace symbol query".to_string(),
+                }));
+                return;
+            }
+
+            let method = WorkspaceSymbolRequest::METHOD;
+            let params = WorkspaceSymbolParams {
+                query,
+                work_done_progress_params: WorkDoneProgressParams::default(),
+                partial_result_params: PartialResultParams::default(),
+            };
+            let unresolved_symbols = catalog.unresolved_symbols.clone();
+            catalog.send_request_to_all_plugins(
+                method,
+                params,
+                None,
+                None,
+                move |plugin_id, result: Result<WorkspaceSymbolResponse, _>| {
+                    cb(result.map(|resp| {
+                        let (symbols, unresolved) = flatten_workspace_symbols(resp);
+                        *unresolved_symbols.lock() = unresolved
+                            .into_iter()
+                            .map(|symbol| (plugin_id, symbol))
+                            .collect();
+                        symbols
+                    }))
+                },
+            );
+        });
+    }
+
+    /// The location of a symbol of the last workspace symbol query that came
+    /// without a range, asking the server that found it. There is none if it
+    /// came with one, or the server couldn't resolve it.
+    pub fn resolve_workspace_symbol(
+        &self,
+        name: &str,
+        kind: SymbolKind,
+        path: &Path,
+        cb: impl FnOnce(Option<Location>) + Clone + Send + 'static,
+    ) {
+        let symbol = self
+            .unresolved_symbols
+            .lock()
+            .iter()
+            .find(|(_, symbol)| {
+                let uri = match &symbol.location {
+                    OneOf::Left(location) => &location.uri,
+                    OneOf::Right(location) => &location.uri,
+                };
+                symbol.name == name
+                    && symbol.kind == kind
+                    && uri_to_path(uri).ok().as_deref() == Some(path)
+            })
+            .cloned();
+        let Some((plugin_id, symbol)) = symbol else {
+            cb(None);
+            return;
+        };
+
+        let method = WorkspaceSymbolResolve::METHOD;
+        self.send_request(
+            Some(plugin_id),
+            None,
+            method,
+            symbol,
+            None,
+            None,
+            true,
+            move |_, result| {
+                let location = result
+                    .ok()
+                    .and_then(|value| {
+                        serde_json::from_value::<WorkspaceSymbol>(value).ok()
+                    })
+                    .and_then(|symbol| match symbol.location {
+                        OneOf::Left(location) => Some(location),
+                        OneOf::Right(_) => None,
+                    });
+                cb(location)
+            },
+        );
+    }
+
+    pub fn get_document_formatting(
+        &self,
+        path: &Path,
+        tab_size: u32,
+        insert_spaces: bool,
+        cb: impl FnOnce(PluginId, Result<Vec<TextEdit>, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = Formatting::METHOD;
+        let params = DocumentFormattingParams {
+            text_document: TextDocumentIdentifier { uri },
+            options: FormattingOptions {
+                tab_size,
+                insert_spaces,
+                ..Default::default()
+            },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            cb,
+        );
+    }
+
+    /// Format only `range`, or the whole document if no server can format
+    /// ranges.
+    pub fn get_range_formatting(
+        &self,
+        path: &Path,
+        range: Range,
+        tab_size: u32,
+        insert_spaces: bool,
+        cb: impl FnOnce(PluginId, Result<Vec<TextEdit>, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = RangeFormatting::METHOD;
+        let params = DocumentRangeFormattingParams {
+            text_document: TextDocumentIdentifier { uri },
+            range,
+            options: FormattingOptions {
+                tab_size,
+                insert_spaces,
+                ..Default::default()
+            },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        let catalog = self.clone();
+        let local_path = path.to_path_buf();
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            move |plugin_id, result| match result {
+                Err(e) if e.message == SERVER_NOT_CAPABLE => catalog
+                    .get_document_formatting(
+                        &local_path,
+                        tab_size,
+                        insert_spaces,
+                        cb,
+                    ),
+                result => cb(plugin_id, result),
+            },
+        );
+    }
+
+    /// Ask the servers that reported `ch` as an on type formatting trigger for
+    /// the edits after it was typed before `position`. There are none if no
+    /// server did, and then no request is sent.
+    pub fn get_on_type_formatting(
+        &self,
+        path: &Path,
+        position: Position,
+        ch: String,
+        tab_size: u32,
+        insert_spaces: bool,
+        cb: impl FnOnce(Result<Vec<TextEdit>, RpcError>) + Clone + Send + 'static,
+    ) {
+        let plugin_ids: Vec<PluginId> = self
+            .on_type_formatting_triggers
+            .lock()
+            .iter()
+            .filter(|(_, triggers)| triggers.contains(&ch))
+            .map(|(plugin_id, _)| *plugin_id)
+            .collect();
+        if plugin_ids.is_empty() {
+            cb(Ok(Vec::new()));
+            return;
+        }
+
+        let uri = path_to_uri(path);
+        let method = OnTypeFormatting::METHOD;
+        let params = DocumentOnTypeFormattingParams {
+            text_document_position: TextDocumentPositionParams {
+                text_document: TextDocumentIdentifier { uri },
+                position,
+            },
+            ch,
+            options: FormattingOptions {
+                tab_size,
+                insert_spaces,
+                ..Default::default()
+            },
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        // Each server with the trigger is asked, as only those serving the
+        // document answer, and the first edits that aren't empty are used
+        let pending = Arc::new(Mutex::new((plugin_ids.len(), Some(cb))));
+        for plugin_id in plugin_ids {
+            let pending = pending.clone();
+            self.send_request(
+                Some(plugin_id),
+                None,
+                method,
+                &params,
+                language_id.clone(),
+                Some(path.to_path_buf()),
+                true,
+                move |_, result| {
+                    let edits = result
+                        .ok()
+                        .and_then(|value| {
+                            serde_json::from_value::<Option<Vec<TextEdit>>>(value)
+                                .ok()
+                        })
+                        .flatten()
+                        .unwrap_or_default();
+                    let mut pending = pending.lock();
+                    let (remaining, cb) = &mut *pending;
+                    *remaining -= 1;
+                    if !edits.is_empty() || *remaining == 0 {
+                        if let Some(cb) = cb.take() {
+                            drop(pending);
+                            cb(Ok(edits));
+                        }
+                    }
+                },
+            );
+        }
+    }
+
+    pub fn prepare_rename(
+        &self,
+        path: &Path,
+        position: Position,
+        cb: impl FnOnce(PluginId, Result<PrepareRenameResponse, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = PrepareRenameRequest::METHOD;
+        let params = TextDocumentPositionParams {
+            text_document: TextDocumentIdentifier { uri },
+            position,
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            move |plugin_id, result: Result<Option<PrepareRenameResponse>, _>| {
+                let result = match result {
+                    Ok(Some(resp)) => Ok(resp),
+                    Ok(None) => Err(RpcError {
+                        code: 0,
+                        message: "the symbol can't be renamed".to_string(),
+                    }),
+                    // Servers that can rename without preparing it rename the
+                    // word under the cursor
+                    Err(e) if e.message == SERVER_NOT_CAPABLE => {
+                        Ok(PrepareRenameResponse::DefaultBehavior {
+                            default_behavior: true,
+                        })
+                    }
+                    Err(e) => Err(e),
+                };
+                cb(plugin_id, result)
+            },
+        );
+    }
+
+    pub fn prepare_call_hierarchy(
+        &self,
+        path: &Path,
+        position: Position,
+        cb: impl FnOnce(Vec<(PluginId, CallHierarchyItem)>) + Send + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = CallHierarchyPrepare::METHOD;
+        let params = CallHierarchyPrepareParams {
+            text_document_position_params: TextDocumentPositionParams {
+                text_document: TextDocumentIdentifier { uri },
+                position,
+            },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_each_plugin(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            move |responses: Vec<(PluginId, Option<Vec<CallHierarchyItem>>)>| {
+                cb(responses
+                    .into_iter()
+                    .flat_map(|(plugin_id, items)| {
+                        items
+                            .unwrap_or_default()
+                            .into_iter()
+                            .map(move |item| (plugin_id, item))
+                    })
+                    .collect())
+            },
+        );
+    }
+
+    /// Ask the plugin which prepared `item` for the calls made to it.
+    pub fn call_hierarchy_incoming(
+        &self,
+        plugin_id: PluginId,
+        item: CallHierarchyItem,
+        cb: impl FnOnce(Result<Vec<CallHierarchyIncomingCall>, RpcError>)
+            + Send
+            + Clone
+            + 'static,
+    ) {
+        let method = CallHierarchyIncomingCalls::METHOD;
+        let params = CallHierarchyIncomingCallsParams {
+            item,
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+        };
+        self.send_request(
+            Some(plugin_id),
+            None,
+            method,
+            params,
+            None,
+            None,
+            true,
+            move |_, result| {
+                cb(result.and_then(|value| {
+                    serde_json::from_value::<Option<Vec<CallHierarchyIncomingCall>>>(
+                        value,
+                    )
+                    .map(Option::unwrap_or_default)
+                    .map_err(|_| RpcError {
+                        code: 0,
+                        message: "incoming calls deserialize error".to_string(),
+                    })
+                }))
+            },
+        );
+    }
+
+    /// Ask the plugin which prepared `item` for the calls made from it.
+    pub fn call_hierarchy_outgoing(
+        &self,
+        plugin_id: PluginId,
+        item: CallHierarchyItem,
+        cb: impl FnOnce(Result<Vec<CallHierarchyOutgoingCall>, RpcError>)
+            + Send
+            + Clone
+            + 'static,
+    ) {
+        let method = CallHierarchyOutgoingCalls::METHOD;
+        let params = CallHierarchyOutgoingCallsParams {
+            item,
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+        };
+        self.send_request(
+            Some(plugin_id),
+            None,
+            method,
+            params,
+            None,
+            None,
+            true,
+            move |_, result| {
+                cb(result.and_then(|value| {
+                    serde_json::from_value::<Option<Vec<CallHierarchyOutgoingCall>>>(
+                        value,
+                    )
+                    .map(Option::unwrap_or_default)
+                    .map_err(|_| RpcError {
+                        code: 0,
+                        message: "outgoing calls deserialize error".to_string(),
+                    })
+                }))
+            },
+        );
+    }
+
+    pub fn get_monikers(
+        &self,
+        path: &Path,
+        position: Position,
+        cb: impl FnOnce(PluginId, Result<Option<Vec<Moniker>>, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = MonikerRequest::METHOD;
+        let params = MonikerParams {
+            text_document_position_params: TextDocumentPositionParams {
+                text_document: TextDocumentIdentifier { uri },
+                position,
+            },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            cb,
+        );
+    }
+
+    pub fn get_document_colors(
+        &self,
+        path: &Path,
+        cb: impl FnOnce(PluginId, Result<Vec<ColorInformation>, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = DocumentColor::METHOD;
+        let params = DocumentColorParams {
+            text_document: TextDocumentIdentifier { uri },
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request_to_all_plugins(
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            cb,
+        );
+    }
+
+    pub fn get_folding_ranges(
+        &self,
+        path: &Path,
+        cb: impl FnOnce(PluginId, Result<Option<Vec<FoldingRange>>, RpcError>)
+            + Clone
+            + Send
+            + 'static,
+    ) {
+        let uri = path_to_uri(path);
+        let method = FoldingRangeRequest::METHOD;
+        let params = FoldingRangeParams {
+            text_document: TextDocumentIdentifier { uri },
             work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
         };
         let language_id =
             Some(language_id_from_path(path).unwrap_or("").to_string());
@@ -709,17 +2030,17 @@ pub fn get_inline_completions(
         );
     }
 
-    pub fn get_document_symbols(
+    pub fn get_code_lens(
         &self,
         path: &Path,
-        cb: impl FnOnce(PluginId, Result<DocumentSymbolResponse, RpcError>)
+        cb: impl FnOnce(PluginId, Result<Option<Vec<CodeLens>>, RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = DocumentSymbolRequest::METHOD;
-        let params = DocumentSymbolParams {
+        let uri = path_to_uri(path);
+        let method = CodeLensRequest::METHOD;
+        let params = CodeLensParams {
             text_document: TextDocumentIdentifier { uri },
             work_done_progress_params: WorkDoneProgressParams::default(),
             partial_result_params: PartialResultParams::default(),
@@ -735,41 +2056,104 @@ pub fn get_document_symbols(
         );
     }
 
-    pub fn get_workspace_symbols(
+    /// The code lenses of the document, with the ones that came without a
+    /// command resolved by the server that sent them.
+    pub fn get_resolved_code_lens(
         &self,
-        query: String,
-        cb: impl FnOnce(PluginId, Result<Vec<SymbolInformation>, RpcError>)
+        path: &Path,
+        cb: impl FnOnce(Result<(PluginId, Vec<CodeLens>), RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let method = WorkspaceSymbolRequest::METHOD;
-        let params = WorkspaceSymbolParams {
-            query,
-            work_done_progress_params: WorkDoneProgressParams::default(),
-            partial_result_params: PartialResultParams::default(),
-        };
-        self.send_request_to_all_plugins(method, params, None, None, cb);
+        let catalog_rpc = self.clone();
+        self.get_code_lens(path, move |plugin_id, result| {
+            let lenses = match result {
+                Ok(lenses) => lenses.unwrap_or_default(),
+                Err(err) => {
+                    cb(Err(err));
+                    return;
+                }
+            };
+            let unresolved: Vec<usize> = lenses
+                .iter()
+                .enumerate()
+                .filter(|(_, lens)| lens.command.is_none())
+                .map(|(i, _)| i)
+                .collect();
+            if unresolved.is_empty() {
+                cb(Ok((plugin_id, lenses)));
+                return;
+            }
+
+            // The lenses are resolved concurrently, and sent once all of them
+            // have answered. Lenses that failed to resolve are kept as they are.
+            let remaining = Arc::new(AtomicUsize::new(unresolved.len()));
+            let lenses = Arc::new(Mutex::new(lenses));
+            let cb = Arc::new(Mutex::new(Some(cb)));
+            for i in unresolved {
+                let lens = lenses.lock()[i].clone();
+                let remaining = remaining.clone();
+                let lenses = lenses.clone();
+                let cb = cb.clone();
+                catalog_rpc.code_lens_resolve(plugin_id, lens, move |result| {
+                    if let Ok(lens) = result {
+                        lenses.lock()[i] = lens;
+                    }
+                    if remaining.fetch_sub(1, Ordering::AcqRel) == 1 {
+                        if let Some(cb) = cb.lock().take() {
+                            cb(Ok((plugin_id, std::mem::take(&mut *lenses.lock()))));
+                        }
+                    }
+                });
+            }
+        });
     }
 
-    pub fn get_document_formatting(
+    pub fn code_lens_resolve(
+        &self,
+        plugin_id: PluginId,
+        lens: CodeLens,
+        cb: impl FnOnce(Result<CodeLens, RpcError>) + Send + Clone + 'static,
+    ) {
+        let method = CodeLensResolve::METHOD;
+        self.send_request(
+            Some(plugin_id),
+            None,
+            method,
+            lens,
+            None,
+            None,
+            true,
+            move |_, result| {
+                cb(result.and_then(|value| {
+                    serde_json::from_value::<CodeLens>(value).map_err(|_| RpcError {
+                        code: 0,
+                        message: "code lens deserialize error".to_string(),
+                    })
+                }))
+            },
+        );
+    }
+
+    pub fn get_color_presentations(
         &self,
         path: &Path,
-        cb: impl FnOnce(PluginId, Result<Vec<TextEdit>, RpcError>)
+        color: Color,
+        range: Range,
+        cb: impl FnOnce(PluginId, Result<Vec<ColorPresentation>, RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = Formatting::METHOD;
-        let params = DocumentFormattingParams {
+        let uri = path_to_uri(path);
+        let method = ColorPresentationRequest::METHOD;
+        let params = ColorPresentationParams {
             text_document: TextDocumentIdentifier { uri },
-            options: FormattingOptions {
-                tab_size: 4,
-                insert_spaces: true,
-                ..Default::default()
-            },
+            color,
+            range,
             work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
         };
         let language_id =
             Some(language_id_from_path(path).unwrap_or("").to_string());
@@ -782,20 +2166,25 @@ pub fn get_document_formatting(
         );
     }
 
-    pub fn prepare_rename(
+    pub fn rename(
         &self,
         path: &Path,
         position: Position,
-        cb: impl FnOnce(PluginId, Result<PrepareRenameResponse, RpcError>)
+        new_name: String,
+        cb: impl FnOnce(PluginId, Result<WorkspaceEdit, RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = PrepareRenameRequest::METHOD;
-        let params = TextDocumentPositionParams {
-            text_document: TextDocumentIdentifier { uri },
-            position,
+        let uri = path_to_uri(path);
+        let method = Rename::METHOD;
+        let params = RenameParams {
+            text_document_position: TextDocumentPositionParams {
+                text_document: TextDocumentIdentifier { uri },
+                position,
+            },
+            new_name,
+            work_done_progress_params: WorkDoneProgressParams::default(),
         };
         let language_id =
             Some(language_id_from_path(path).unwrap_or("").to_string());
@@ -808,29 +2197,172 @@ pub fn prepare_rename(
         );
     }
 
-    pub fn rename(
+    /// Request the semantic tokens of the document. If the server that sent the
+    /// last tokens of the document supports it, only the changes to them are
+    /// requested. Otherwise servers that support partial results report
+    /// batches of tokens to `partial` before the response, which then only has
+    /// the remaining tokens. When several servers answer, the response is the
+    /// one of the first server that reported partial results, if any did.
+    pub fn get_semantic_tokens(
         &self,
         path: &Path,
-        position: Position,
-        new_name: String,
-        cb: impl FnOnce(PluginId, Result<WorkspaceEdit, RpcError>)
+        partial: impl FnMut(PluginId, Vec<SemanticToken>) + Clone + Send + 'static,
+        cb: impl FnOnce(Result<(PluginId, SemanticTokens), RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = Rename::METHOD;
-        let params = RenameParams {
-            text_document_position: TextDocumentPositionParams {
-                text_document: TextDocumentIdentifier { uri },
-                position,
+        let previous = self
+            .semantic_tokens
+            .lock()
+            .get(path)
+            .filter(|(_, tokens)| tokens.result_id.is_some())
+            .cloned();
+        let Some((plugin_id, previous)) = previous else {
+            self.get_full_semantic_tokens(path, partial, cb);
+            return;
+        };
+
+        let rpc = self.clone();
+        let local_path = path.to_path_buf();
+        let uri = path_to_uri(path);
+        let method = SemanticTokensFullDeltaRequest::METHOD;
+        let params = SemanticTokensDeltaParams {
+            text_document: TextDocumentIdentifier { uri },
+            previous_result_id: previous.result_id.clone().unwrap_or_default(),
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+        };
+        let language_id =
+            Some(language_id_from_path(path).unwrap_or("").to_string());
+        self.send_request(
+            Some(plugin_id),
+            None,
+            method,
+            params,
+            language_id,
+            Some(path.to_path_buf()),
+            true,
+            move |plugin_id, result| {
+                let tokens = result
+                    .ok()
+                    .and_then(|value| {
+                        serde_json::from_value::<SemanticTokensFullDeltaResult>(
+                            value,
+                        )
+                        .ok()
+                    })
+                    .map(|result| match result {
+                        SemanticTokensFullDeltaResult::Tokens(tokens) => tokens,
+                        SemanticTokensFullDeltaResult::TokensDelta(delta) => {
+                            SemanticTokens {
+                                result_id: delta.result_id,
+                                data: apply_semantic_tokens_delta(
+                                    &previous.data,
+                                    delta.edits,
+                                ),
+                            }
+                        }
+                        SemanticTokensFullDeltaResult::PartialTokensDelta {
+                            edits,
+                        } => SemanticTokens {
+                            result_id: None,
+                            data: apply_semantic_tokens_delta(&previous.data, edits),
+                        },
+                    });
+                match tokens {
+                    Some(tokens) => {
+                        rpc.semantic_tokens
+                            .lock()
+                            .insert(local_path, (plugin_id, tokens.clone()));
+                        cb(Ok((plugin_id, tokens)));
+                    }
+                    // The server doesn't support deltas or doesn't know the
+                    // previous tokens anymore
+                    None => rpc.get_full_semantic_tokens(&local_path, partial, cb),
+                }
             },
-            new_name,
+        );
+    }
+
+    fn get_full_semantic_tokens(
+        &self,
+        path: &Path,
+        mut partial: impl FnMut(PluginId, Vec<SemanticToken>) + Send + 'static,
+        cb: impl FnOnce(Result<(PluginId, SemanticTokens), RpcError>) + Send + 'static,
+    ) {
+        let token = format!(
+            "semantic-tokens-{}",
+            self.id.fetch_add(1, Ordering::Relaxed)
+        );
+        // The servers that reported partial results, in the order they started
+        let partial_plugins = Arc::new(Mutex::new(Vec::new()));
+        {
+            let partial_plugins = partial_plugins.clone();
+            self.partial_results.lock().insert(
+                token.clone(),
+                Box::new(move |plugin_id, value| {
+                    if let Ok(result) =
+                        serde_json::from_value::<SemanticTokensPartialResult>(value)
+                    {
+                        {
+                            let mut partial_plugins = partial_plugins.lock();
+                            if !partial_plugins.contains(&plugin_id) {
+                                partial_plugins.push(plugin_id);
+                            }
+                        }
+                        partial(plugin_id, result.data);
+                    }
+                }),
+            );
+        }
+        let partial_results = self.partial_results.clone();
+        let partial_token = token.clone();
+        let semantic_tokens = self.semantic_tokens.clone();
+        let local_path = path.to_path_buf();
+        let cb = move |responses: Vec<(PluginId, SemanticTokens)>| {
+            // Servers may report partial results until they answered
+            partial_results.lock().remove(&partial_token);
+            let partial_plugins = partial_plugins.lock();
+            // Only the partial results of the first server that reported any
+            // are used, so its response has the rest of the tokens
+            let index = partial_plugins
+                .first()
+                .and_then(|plugin_id| {
+                    responses.iter().position(|(id, _)| id == plugin_id)
+                })
+                .unwrap_or(0);
+            let Some((plugin_id, tokens)) = responses.into_iter().nth(index) else {
+                cb(Err(RpcError {
+                    code: 0,
+                    message: "no semantic tokens".to_string(),
+                }));
+                return;
+            };
+            // The tokens that were reported as partial results aren't in the
+            // response, so it can't be the base of later changes
+            if partial_plugins.contains(&plugin_id) {
+                semantic_tokens.lock().remove(&local_path);
+            } else {
+                semantic_tokens
+                    .lock()
+                    .insert(local_path, (plugin_id, tokens.clone()));
+            }
+            cb(Ok((plugin_id, tokens)));
+        };
+
+        let uri = path_to_uri(path);
+        let method = SemanticTokensFullRequest::METHOD;
+        let params = SemanticTokensParams {
+            text_document: TextDocumentIdentifier { uri },
             work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams {
+                partial_result_token: Some(NumberOrString::String(token)),
+            },
         };
         let language_id =
             Some(language_id_from_path(path).unwrap_or("").to_string());
-        self.send_request_to_all_plugins(
+        self.send_request_to_each_plugin(
             method,
             params,
             language_id,
@@ -839,18 +2371,20 @@ pub fn rename(
         );
     }
 
-    pub fn get_semantic_tokens(
+    pub fn get_semantic_tokens_range(
         &self,
         path: &Path,
+        range: Range,
         cb: impl FnOnce(PluginId, Result<SemanticTokens, RpcError>)
             + Clone
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
-        let method = SemanticTokensFullRequest::METHOD;
-        let params = SemanticTokensParams {
+        let uri = path_to_uri(path);
+        let method = SemanticTokensRangeRequest::METHOD;
+        let params = SemanticTokensRangeParams {
             text_document: TextDocumentIdentifier { uri },
+            range,
             work_done_progress_params: WorkDoneProgressParams::default(),
             partial_result_params: PartialResultParams::default(),
         };
@@ -861,7 +2395,16 @@ pub fn get_semantic_tokens(
             params,
             language_id,
             Some(path.to_path_buf()),
-            cb,
+            move |plugin_id, result: Result<SemanticTokensRangeResult, RpcError>| {
+                let result = result.map(|result| match result {
+                    SemanticTokensRangeResult::Tokens(tokens) => tokens,
+                    SemanticTokensRangeResult::Partial(partial) => SemanticTokens {
+                        result_id: None,
+                        data: partial.data,
+                    },
+                });
+                cb(plugin_id, result);
+            },
         );
     }
 
@@ -874,7 +2417,7 @@ pub fn get_selection_range(
             + Send
             + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
+        let uri = path_to_uri(path);
         let method = SelectionRangeRequest::METHOD;
         let params = SelectionRangeParams {
             text_document: TextDocumentIdentifier { uri },
@@ -899,7 +2442,7 @@ pub fn hover(
         position: Position,
         cb: impl FnOnce(PluginId, Result<Hover, RpcError>) + Clone + Send + 'static,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
+        let uri = path_to_uri(path);
         let method = HoverRequest::METHOD;
         let params = HoverParams {
             text_document_position_params: TextDocumentPositionParams {
@@ -926,8 +2469,9 @@ pub fn completion(
         path: &Path,
         input: String,
         position: Position,
+        context: CompletionContext,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
+        let uri = path_to_uri(path);
         let method = Completion::METHOD;
         let params = CompletionParams {
             text_document_position: TextDocumentPositionParams {
@@ -936,10 +2480,11 @@ pub fn completion(
             },
             work_done_progress_params: WorkDoneProgressParams::default(),
             partial_result_params: PartialResultParams::default(),
-            context: None,
+            context: Some(context),
         };
 
         let core_rpc = self.core_rpc.clone();
+        let catalog_rpc = self.clone();
         let language_id =
             Some(language_id_from_path(path).unwrap_or("").to_string());
 
@@ -950,9 +2495,10 @@ pub fn completion(
             Some(path.to_path_buf()),
             move |plugin_id, result| {
                 if let Ok(value) = result {
-                    if let Ok(resp) =
+                    if let Ok(mut resp) =
                         serde_json::from_value::<CompletionResponse>(value)
                     {
+                        catalog_rpc.add_cached_symbols(plugin_id, &input, &mut resp);
                         core_rpc
                             .completion_response(request_id, input, resp, plugin_id);
                     }
@@ -1003,12 +2549,13 @@ pub fn signature_help(
         request_id: usize,
         path: &Path,
         position: Position,
+        trigger_character: Option<String>,
+        active_parameter: Option<u32>,
     ) {
-        let uri = Url::from_file_path(path).unwrap();
+        let uri = path_to_uri(path);
         let method = SignatureHelpRequest::METHOD;
         let params = SignatureHelpParams {
-            // TODO: We could provide more information about the signature for the LSP to work with
-            context: None,
+            context: Some(self.signature_help_context(trigger_character)),
             text_document_position_params: TextDocumentPositionParams {
                 text_document: TextDocumentIdentifier { uri },
                 position,
@@ -1029,8 +2576,19 @@ pub fn signature_help(
             true,
             move |plugin_id, result| {
                 if let Ok(value) = result {
-                    if let Ok(resp) = serde_json::from_value::<SignatureHelp>(value)
+                    // No signature, e.g. once the cursor left the call, is
+                    // sent as an empty one so that the editor hides it
+                    if let Ok(resp) =
+                        serde_json::from_value::<Option<SignatureHelp>>(value)
                     {
+                        let mut resp = resp.unwrap_or(SignatureHelp {
+                            signatures: Vec::new(),
+                            active_signature: None,
+                            active_parameter: None,
+                        });
+                        if resp.active_parameter.is_none() {
+                            resp.active_parameter = active_parameter;
+                        }
                         core_rpc
                             .signature_help_response(request_id, resp, plugin_id);
                     }
@@ -1075,6 +2633,30 @@ pub fn action_resolve(
         );
     }
 
+    pub fn execute_command(
+        &self,
+        command: Command,
+        plugin_id: PluginId,
+        cb: impl FnOnce(Result<Value, RpcError>) + Send + Clone + 'static,
+    ) {
+        let method = ExecuteCommand::METHOD;
+        let params = ExecuteCommandParams {
+            command: command.command,
+            arguments: command.arguments.unwrap_or_default(),
+            work_done_progress_params: WorkDoneProgressParams::default(),
+        };
+        self.send_request(
+            Some(plugin_id),
+            None,
+            method,
+            params,
+            None,
+            None,
+            true,
+            move |_, result| cb(result),
+        );
+    }
+
     pub fn did_open_document(
         &self,
         path: &Path,
@@ -1084,7 +2666,7 @@ pub fn did_open_document(
     ) {
         let _ = self.plugin_tx.send(PluginCatalogRpc::DidOpenTextDocument {
             document: TextDocumentItem::new(
-                Url::from_file_path(path).unwrap(),
+                path_to_uri(path),
                 language_id,
                 version,
                 text,
@@ -1435,6 +3017,49 @@ pub fn remove_volt(
     Ok(())
 }
 
+/// Turn the bare commands that older servers answer code action requests with
+/// into code actions that only run them, so that all of the actions are
+/// handled the same way.
+fn normalize_code_actions(actions: CodeActionResponse) -> CodeActionResponse {
+    actions
+        .into_iter()
+        .map(|action| match action {
+            CodeActionOrCommand::Command(command) => {
+                CodeActionOrCommand::CodeAction(CodeAction {
+                    title: command.title.clone(),
+                    command: Some(command),
+                    ..Default::default()
+                })
+            }
+            action => action,
+        })
+        .collect()
+}
+
+fn code_action_params(
+    path: &Path,
+    position: Position,
+    diagnostics: Vec<Diagnostic>,
+    only: Option<Vec<CodeActionKind>>,
+) -> CodeActionParams {
+    CodeActionParams {
+        text_document: TextDocumentIdentifier {
+            uri: path_to_uri(path),
+        },
+        range: Range {
+            start: position,
+            end: position,
+        },
+        context: CodeActionContext {
+            diagnostics,
+            only,
+            trigger_kind: None,
+        },
+        work_done_progress_params: WorkDoneProgressParams::default(),
+        partial_result_params: PartialResultParams::default(),
+    }
+}
+
 fn client_capabilities() -> ClientCapabilities {
     ClientCapabilities {
         text_document: Some(TextDocumentClientCapabilities {
@@ -1443,11 +3068,23 @@ fn client_capabilities() -> ClientCapabilities {
                 dynamic_registration: Some(true),
                 ..Default::default()
             }),
+            document_symbol: Some(DocumentSymbolClientCapabilities {
+                hierarchical_document_symbol_support: Some(true),
+                ..Default::default()
+            }),
             completion: Some(CompletionClientCapabilities {
                 completion_item: Some(CompletionItemCapability {
                     snippet_support: Some(true),
                     resolve_support: Some(CompletionItemCapabilityResolveSupport {
-                        properties: vec!["additionalTextEdits".to_string()],
+                        properties: vec![
+                            "additionalTextEdits".to_string(),
+                            "documentation".to_string(),
+                            "detail".to_string(),
+                        ],
+                    }),
+                    deprecated_support: Some(true),
+                    tag_support: Some(TagSupport {
+                        value_set: vec![CompletionItemTag::DEPRECATED],
                     }),
                     ..Default::default()
                 }),
@@ -1464,6 +3101,7 @@ fn client_capabilities() -> ClientCapabilities {
                     }),
                     active_parameter_support: Some(true),
                 }),
+                context_support: Some(true),
                 ..Default::default()
             }),
             hover: Some(HoverClientCapabilities {
@@ -1476,10 +3114,14 @@ fn client_capabilities() -> ClientCapabilities {
             inlay_hint: Some(InlayHintClientCapabilities {
                 ..Default::default()
             }),
+            rename: Some(RenameClientCapabilities {
+                prepare_support: Some(true),
+                ..Default::default()
+            }),
             code_action: Some(CodeActionClientCapabilities {
                 data_support: Some(true),
                 resolve_support: Some(CodeActionCapabilityResolveSupport {
-                    properties: vec!["edit".to_string()],
+                    properties: vec!["edit".to_string(), "command".to_string()],
                 }),
                 code_action_literal_support: Some(CodeActionLiteralSupport {
                     code_action_kind: CodeActionKindLiteralSupport {
@@ -1496,12 +3138,20 @@ fn client_capabilities() -> ClientCapabilities {
                                 .to_string(),
                             "quickassist".to_string(),
                             "source.fixAll".to_string(),
+                            "quickfix.all".to_string(),
                         ],
                     },
                 }),
                 ..Default::default()
             }),
             semantic_tokens: Some(SemanticTokensClientCapabilities {
+                multiline_token_support: Some(true),
+                requests: SemanticTokensClientCapabilitiesRequests {
+                    full: Some(SemanticTokensFullOptions::Delta {
+                        delta: Some(true),
+                    }),
+                    range: Some(true),
+                },
                 ..Default::default()
             }),
             type_definition: Some(GotoCapability {
@@ -1513,12 +3163,53 @@ fn client_capabilities() -> ClientCapabilities {
             definition: Some(GotoCapability {
                 ..Default::default()
             }),
+            implementation: Some(GotoCapability {
+                ..Default::default()
+            }),
+            document_highlight: Some(DocumentHighlightClientCapabilities {
+                ..Default::default()
+            }),
+            declaration: Some(GotoCapability {
+                ..Default::default()
+            }),
+            diagnostic: Some(DiagnosticClientCapabilities {
+                ..Default::default()
+            }),
             publish_diagnostics: Some(PublishDiagnosticsClientCapabilities {
+                // Related information is listed under the diagnostic in the
+                // problem panel, and can be jumped to from there
+                related_information: Some(true),
                 ..Default::default()
             }),
             inline_completion: Some(InlineCompletionClientCapabilities {
                 ..Default::default()
             }),
+            inline_value: Some(InlineValueClientCapabilities {
+                ..Default::default()
+            }),
+            call_hierarchy: Some(CallHierarchyClientCapabilities {
+                ..Default::default()
+            }),
+            moniker: Some(MonikerClientCapabilities {
+                ..Default::default()
+            }),
+            color_provider: Some(DocumentColorClientCapabilities {
+                ..Default::default()
+            }),
+            folding_range: Some(FoldingRangeClientCapabilities {
+                line_folding_only: Some(true),
+                ..Default::default()
+            }),
+            code_lens: Some(CodeLensClientCapabilities {
+                ..Default::default()
+            }),
+            range_formatting: Some(
+                DocumentRangeFormattingClientCapabilities::default(),
+            ),
+            // The trigger characters can change through dynamic registration
+            on_type_formatting: Some(DocumentOnTypeFormattingClientCapabilities {
+                dynamic_registration: Some(true),
+            }),
 
             ..Default::default()
         }),
@@ -1529,15 +3220,374 @@ fn client_capabilities() -> ClientCapabilities {
                     additional_properties_support: Some(true),
                 }),
             }),
+            show_document: Some(ShowDocumentClientCapabilities { support: true }),
             ..Default::default()
         }),
         workspace: Some(WorkspaceClientCapabilities {
             symbol: Some(WorkspaceSymbolClientCapabilities {
+                // The range of a symbol is only needed once it's picked
+                resolve_support: Some(WorkspaceSymbolResolveSupportCapability {
+                    properties: vec!["location.range".to_string()],
+                }),
+                ..Default::default()
+            }),
+            configuration: Some(true),
+            apply_edit: Some(true),
+            workspace_edit: Some(WorkspaceEditClientCapabilities {
+                document_changes: Some(true),
+                resource_operations: Some(vec![
+                    ResourceOperationKind::Create,
+                    ResourceOperationKind::Rename,
+                    ResourceOperationKind::Delete,
+                ]),
+                failure_handling: Some(FailureHandlingKind::Abort),
                 ..Default::default()
             }),
-            configuration: Some(false),
+            code_lens: Some(CodeLensWorkspaceClientCapabilities {
+                refresh_support: Some(true),
+            }),
             ..Default::default()
         }),
         ..Default::default()
     }
 }
+
+/// The diagnostics of all the servers, in an order that doesn't depend on
+/// which server published last.
+fn merge_diagnostics(
+    by_server: &HashMap<PluginId, Vec<Diagnostic>>,
+) -> Vec<Diagnostic> {
+    fn severity_rank(severity: Option<DiagnosticSeverity>) -> u8 {
+        match severity {
+            Some(DiagnosticSeverity::ERROR) => 0,
+            Some(DiagnosticSeverity::WARNING) => 1,
+            Some(DiagnosticSeverity::INFORMATION) => 2,
+            Some(DiagnosticSeverity::HINT) => 3,
+            _ => 4,
+        }
+    }
+
+    let mut diagnostics: Vec<(PluginId, &Diagnostic)> = by_server
+        .iter()
+        .flat_map(|(plugin_id, diagnostics)| {
+            diagnostics
+                .iter()
+                .map(move |diagnostic| (*plugin_id, diagnostic))
+        })
+        .collect();
+    // The server and the message break the remaining ties, so that the order
+    // doesn't depend on the order of the map
+    diagnostics.sort_by(|(a_id, a), (b_id, b)| {
+        a.source
+            .cmp(&b.source)
+            .then_with(|| a.range.start.line.cmp(&b.range.start.line))
+            .then_with(|| a.range.start.character.cmp(&b.range.start.character))
+            .then_with(|| severity_rank(a.severity).cmp(&severity_rank(b.severity)))
+            .then_with(|| a_id.0.cmp(&b_id.0))
+            .then_with(|| a.message.cmp(&b.message))
+    });
+    diagnostics
+        .into_iter()
+        .map(|(_, diagnostic)| diagnostic.clone())
+        .collect()
+}
+
+/// Apply the edits of a semantic tokens delta to the previous tokens. The edits
+/// index into the integers that the tokens are encoded as, five per token.
+fn apply_semantic_tokens_delta(
+    previous: &[SemanticToken],
+    mut edits: Vec<SemanticTokensEdit>,
+) -> Vec<SemanticToken> {
+    let mut data: Vec<u32> = previous
+        .iter()
+        .flat_map(|token| {
+            [
+                token.delta_line,
+                token.delta_start,
+                token.length,
+                token.token_type,
+                token.token_modifiers_bitset,
+            ]
+        })
+        .collect();
+    // The edits are applied from the end, so that the indexes of the ones
+    // before them stay valid
+    edits.sort_by_key(|edit| std::cmp::Reverse(edit.start));
+    for edit in edits {
+        let start = (edit.start as usize).min(data.len());
+        let end = (start + edit.delete_count as usize).min(data.len());
+        let inserted = edit.data.unwrap_or_default().into_iter().flat_map(|token| {
+            [
+                token.delta_line,
+                token.delta_start,
+                token.length,
+                token.token_type,
+                token.token_modifiers_bitset,
+            ]
+        });
+        data.splice(start..end, inserted);
+    }
+    data.chunks_exact(5)
+        .map(|token| SemanticToken {
+            delta_line: token[0],
+            delta_start: token[1],
+            length: token[2],
+            token_type: token[3],
+            token_modifiers_bitset: token[4],
+        })
+        .collect()
+}
+
+fn symbol_completion_kind(kind: SymbolKind) -> Option<CompletionItemKind> {
+    let kind = match kind {
+        SymbolKind::FILE => CompletionItemKind::FILE,
+        SymbolKind::MODULE | SymbolKind::NAMESPACE | SymbolKind::PACKAGE => {
+            CompletionItemKind::MODULE
+        }
+        SymbolKind::CLASS => CompletionItemKind::CLASS,
+        SymbolKind::METHOD => CompletionItemKind::METHOD,
+        SymbolKind::PROPERTY => CompletionItemKind::PROPERTY,
+        SymbolKind::FIELD => CompletionItemKind::FIELD,
+        SymbolKind::CONSTRUCTOR => CompletionItemKind::CONSTRUCTOR,
+        SymbolKind::ENUM => CompletionItemKind::ENUM,
+        SymbolKind::INTERFACE => CompletionItemKind::INTERFACE,
+        SymbolKind::FUNCTION => CompletionItemKind::FUNCTION,
+        SymbolKind::VARIABLE => CompletionItemKind::VARIABLE,
+        SymbolKind::CONSTANT => CompletionItemKind::CONSTANT,
+        SymbolKind::ENUM_MEMBER => CompletionItemKind::ENUM_MEMBER,
+        SymbolKind::STRUCT => CompletionItemKind::STRUCT,
+        SymbolKind::EVENT => CompletionItemKind::EVENT,
+        SymbolKind::OPERATOR => CompletionItemKind::OPERATOR,
+        SymbolKind::TYPE_PARAMETER => CompletionItemKind::TYPE_PARAMETER,
+        _ => return None,
+    };
+    Some(kind)
+}
+
+/// The symbols of a workspace symbol response as symbol informations, with the
+/// ones that came without a range, which are located at the start of their
+/// file until they are resolved.
+fn flatten_workspace_symbols(
+    resp: WorkspaceSymbolResponse,
+) -> (Vec<SymbolInformation>, Vec<WorkspaceSymbol>) {
+    let symbols = match resp {
+        WorkspaceSymbolResponse::Flat(symbols) => return (symbols, Vec::new()),
+        WorkspaceSymbolResponse::Nested(symbols) => symbols,
+    };
+    let mut unresolved = Vec::new();
+    let symbols = symbols
+        .into_iter()
+        .map(|symbol| {
+            let location = match &symbol.location {
+                OneOf::Left(location) => location.clone(),
+                OneOf::Right(location) => {
+                    unresolved.push(symbol.clone());
+                    Location {
+                        uri: location.uri.clone(),
+                        range: Range::default(),
+                    }
+                }
+            };
+            #[allow(deprecated)]
+            SymbolInformation {
+                name: symbol.name,
+                kind: symbol.kind,
+                tags: symbol.tags,
+                deprecated: None,
+                location,
+                container_name: symbol.container_name,
+            }
+        })
+        .collect();
+    (symbols, unresolved)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+
+    use lapce_rpc::plugin::PluginId;
+    use lsp_types::{
+        CodeAction, CodeActionKind, CodeActionOrCommand, Command, Diagnostic,
+        DiagnosticSeverity, Location, OneOf, Position, Range, SemanticToken,
+        SemanticTokensEdit, SymbolKind, Url, WorkspaceLocation, WorkspaceSymbol,
+        WorkspaceSymbolResponse,
+    };
+
+    use super::{
+        apply_semantic_tokens_delta, flatten_workspace_symbols, merge_diagnostics,
+        normalize_code_actions,
+    };
+
+    fn diagnostic(
+        source: &str,
+        line: u32,
+        severity: DiagnosticSeverity,
+    ) -> Diagnostic {
+        Diagnostic {
+            range: Range::new(Position::new(line, 0), Position::new(line, 1)),
+            severity: Some(severity),
+            source: Some(source.to_string()),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_merge_diagnostics() {
+        let by_server = HashMap::from([
+            (
+                PluginId(1),
+                vec![
+                    diagnostic("rustc", 3, DiagnosticSeverity::WARNING),
+                    diagnostic("rustc", 1, DiagnosticSeverity::ERROR),
+                ],
+            ),
+            (
+                PluginId(2),
+                vec![
+                    diagnostic("clippy", 5, DiagnosticSeverity::HINT),
+                    diagnostic("rustc", 3, DiagnosticSeverity::ERROR),
+                ],
+            ),
+        ]);
+        assert_eq!(
+            merge_diagnostics(&by_server),
+            vec![
+                diagnostic("clippy", 5, DiagnosticSeverity::HINT),
+                diagnostic("rustc", 1, DiagnosticSeverity::ERROR),
+                diagnostic("rustc", 3, DiagnosticSeverity::ERROR),
+                diagnostic("rustc", 3, DiagnosticSeverity::WARNING),
+            ]
+        );
+
+        // Ties are ordered by server and then by message
+        let message = |message: &str| Diagnostic {
+            message: message.to_string(),
+            ..diagnostic("rustc", 1, DiagnosticSeverity::ERROR)
+        };
+        let by_server = HashMap::from([
+            (PluginId(2), vec![message("a")]),
+            (PluginId(1), vec![message("c"), message("b")]),
+        ]);
+        assert_eq!(
+            merge_diagnostics(&by_server),
+            vec![message("b"), message("c"), message("a")]
+        );
+
+        // Ties are ordered by server and then by message
+        let message = |message: &str| Diagnostic {
+            message: message.to_string(),
+            ..diagnostic("rustc", 1, DiagnosticSeverity::ERROR)
+        };
+        let by_server = HashMap::from([
+            (PluginId(2), vec![message("a")]),
+            (PluginId(1), vec![message("c"), message("b")]),
+        ]);
+        assert_eq!(
+            merge_diagnostics(&by_server),
+            vec![message("b"), message("c"), message("a")]
+        );
+    }
+
+    #[test]
+    fn test_normalize_code_actions() {
+        let command = Command {
+            title: "Organize imports".to_string(),
+            command: "organize".to_string(),
+            arguments: None,
+        };
+        let action = CodeAction {
+            title: "Remove unused variable".to_string(),
+            kind: Some(CodeActionKind::QUICKFIX),
+            ..Default::default()
+        };
+        assert_eq!(
+            normalize_code_actions(vec![
+                CodeActionOrCommand::Command(command.clone()),
+                CodeActionOrCommand::CodeAction(action.clone()),
+            ]),
+            vec![
+                CodeActionOrCommand::CodeAction(CodeAction {
+                    title: "Organize imports".to_string(),
+                    command: Some(command),
+                    ..Default::default()
+                }),
+                CodeActionOrCommand::CodeAction(action),
+            ]
+        );
+    }
+
+    fn token(delta_line: u32, delta_start: u32, length: u32) -> SemanticToken {
+        SemanticToken {
+            delta_line,
+            delta_start,
+            length,
+            token_type: 0,
+            token_modifiers_bitset: 0,
+        }
+    }
+
+    #[test]
+    fn test_apply_semantic_tokens_delta() {
+        let previous = vec![token(0, 0, 3), token(1, 4, 2), token(2, 0, 5)];
+        let edits = vec![
+            // Remove the first token
+            SemanticTokensEdit {
+                start: 0,
+                delete_count: 5,
+                data: None,
+            },
+            // Add a token before the last one, at its index in the previous
+            // tokens
+            SemanticTokensEdit {
+                start: 10,
+                delete_count: 0,
+                data: Some(vec![token(1, 0, 1)]),
+            },
+        ];
+        assert_eq!(
+            apply_semantic_tokens_delta(&previous, edits),
+            vec![token(1, 4, 2), token(1, 0, 1), token(2, 0, 5)]
+        );
+    }
+
+    #[test]
+    fn test_flatten_workspace_symbols() {
+        let uri = Url::parse("file:///src/lib.rs").unwrap();
+        let range = Range::new(Position::new(3, 4), Position::new(3, 8));
+        let symbol = |name: &str, location| WorkspaceSymbol {
+            name: name.to_string(),
+            kind: SymbolKind::FUNCTION,
+            tags: None,
+            container_name: None,
+            location,
+            data: None,
+        };
+        let resolved = symbol(
+            "resolved",
+            OneOf::Left(Location {
+                uri: uri.clone(),
+                range,
+            }),
+        );
+        let unresolved = symbol(
+            "unresolved",
+            OneOf::Right(WorkspaceLocation { uri: uri.clone() }),
+        );
+
+        let (symbols, to_resolve) =
+            flatten_workspace_symbols(WorkspaceSymbolResponse::Nested(vec![
+                resolved,
+                unresolved.clone(),
+            ]));
+        let locations: Vec<_> = symbols
+            .iter()
+            .map(|symbol| (symbol.name.as_str(), symbol.location.range))
+            .collect();
+        assert_eq!(
+            locations,
+            vec![("resolved", range), ("unresolved", Range::default())]
+        );
+        assert_eq!(to_resolve, vec![unresolved]);
+    }
+}
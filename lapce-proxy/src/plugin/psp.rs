@@ -1,12 +1,16 @@
 use std::{
+    any::Any,
     borrow::Cow,
     collections::HashMap,
+    io::Write,
+    panic::{self, AssertUnwindSafe},
     path::{Path, PathBuf},
     sync::{
         atomic::{AtomicU64, Ordering},
         Arc,
     },
     thread,
+    time::{Duration, Instant},
 };
 
 use anyhow::{anyhow, Result};
@@ -14,14 +18,19 @@
 use dyn_clone::DynClone;
 use floem_editor_core::buffer::rope_text::{RopeText, RopeTextRef};
 use jsonrpc_lite::{Id, JsonRpc, Params};
-use lapce_core::{encoding::offset_utf16_to_utf8, rope_text_pos::RopeTextPosition};
+use lapce_core::{
+    directory::Directory, encoding::offset_utf16_to_utf8,
+    rope_text_pos::RopeTextPosition,
+};
 use lapce_rpc::{
     core::CoreRpcHandler,
+    file::uri_to_path,
     plugin::{PluginId, VoltID},
+    proxy::ProxyResponse,
     style::{LineStyle, Style},
     RpcError,
 };
-use lapce_xi_rope::{Rope, RopeDelta};
+use lapce_xi_rope::{DeltaElement, Rope, RopeDelta};
 use lsp_types::{
     notification::{
         DidChangeTextDocument, DidOpenTextDocument, DidSaveTextDocument,
@@ -29,22 +38,36 @@
         ShowMessage,
     },
     request::{
-        CodeActionRequest, CodeActionResolveRequest, Completion,
-        DocumentSymbolRequest, Formatting, GotoDefinition, GotoTypeDefinition,
-        HoverRequest, Initialize, InlayHintRequest, InlineCompletionRequest,
-        PrepareRenameRequest, References, RegisterCapability, Rename,
-        ResolveCompletionItem, SelectionRangeRequest, SemanticTokensFullRequest,
-        SignatureHelpRequest, WorkDoneProgressCreate, WorkspaceSymbolRequest,
+        ApplyWorkspaceEdit, CallHierarchyIncomingCalls, CallHierarchyOutgoingCalls,
+        CallHierarchyPrepare, CodeActionRequest, CodeActionResolveRequest,
+        CodeLensRefresh, CodeLensRequest, CodeLensResolve, ColorPresentationRequest,
+        Completion, DocumentColor, DocumentDiagnosticRequest,
+        DocumentHighlightRequest, DocumentSymbolRequest, ExecuteCommand,
+        FoldingRangeRequest, Formatting, GotoDeclaration, GotoDefinition,
+        GotoImplementation, GotoTypeDefinition, HoverRequest, Initialize,
+        InlayHintRequest, InlineCompletionRequest, InlineValueRequest,
+        MonikerRequest, OnTypeFormatting, PrepareRenameRequest, RangeFormatting,
+        References, RegisterCapability, Rename, ResolveCompletionItem,
+        SelectionRangeRequest, SemanticTokensFullDeltaRequest,
+        SemanticTokensFullRequest, SemanticTokensRangeRequest, ShowDocument,
+        ShowMessageRequest, SignatureHelpRequest, WorkDoneProgressCreate,
+        WorkspaceConfiguration, WorkspaceSymbolRequest, WorkspaceSymbolResolve,
     },
-    CodeActionProviderCapability, DidChangeTextDocumentParams,
-    DidSaveTextDocumentParams, DocumentSelector, HoverProviderCapability,
-    InitializeResult, LogMessageParams, OneOf, ProgressParams,
-    PublishDiagnosticsParams, Range, Registration, RegistrationParams,
-    SemanticTokens, SemanticTokensLegend, SemanticTokensServerCapabilities,
-    ServerCapabilities, ShowMessageParams, TextDocumentContentChangeEvent,
-    TextDocumentIdentifier, TextDocumentSaveRegistrationOptions,
-    TextDocumentSyncCapability, TextDocumentSyncKind, TextDocumentSyncSaveOptions,
-    VersionedTextDocumentIdentifier,
+    ApplyWorkspaceEditParams, CodeActionProviderCapability, ConfigurationParams,
+    DeclarationCapability, Diagnostic, DidChangeTextDocumentParams,
+    DidSaveTextDocumentParams, DocumentDiagnosticParams, DocumentDiagnosticReport,
+    DocumentDiagnosticReportResult, DocumentOnTypeFormattingOptions,
+    DocumentOnTypeFormattingRegistrationOptions, DocumentSelector,
+    HoverProviderCapability, InitializeResult, LogMessageParams, MessageType, OneOf,
+    PartialResultParams, ProgressParams, PublishDiagnosticsParams, Range,
+    Registration, RegistrationParams, SemanticTokens, SemanticTokensFullOptions,
+    SemanticTokensLegend, SemanticTokensRegistrationOptions,
+    SemanticTokensServerCapabilities, ServerCapabilities, ShowDocumentParams,
+    ShowDocumentResult, ShowMessageParams, ShowMessageRequestParams,
+    TextDocumentContentChangeEvent, TextDocumentIdentifier,
+    TextDocumentSaveRegistrationOptions, TextDocumentSyncCapability,
+    TextDocumentSyncKind, TextDocumentSyncSaveOptions, Url,
+    VersionedTextDocumentIdentifier, WorkDoneProgressParams,
 };
 use parking_lot::Mutex;
 use psp_types::{
@@ -54,13 +77,37 @@
     SendLspRequestResult, StartLspServer, StartLspServerParams,
     StartLspServerResult,
 };
-use serde::Serialize;
+use serde::{Deserialize, Serialize};
 use serde_json::Value;
 
 use super::{
     lsp::{DocumentFilter, LspClient},
     PluginCatalogRpcHandler,
 };
+use crate::{buffer::language_id_from_path, metrics};
+
+/// Request for the content of a virtual document, answered by the
+/// [`TextDocumentContentProvider`](super::TextDocumentContentProvider)
+/// registered for the uri's scheme.
+const TEXT_DOCUMENT_CONTENT_METHOD: &str = "workspace/textDocumentContent";
+
+/// The JSON-RPC error code of requests that failed inside the client.
+const INTERNAL_ERROR_CODE: i64 = -32603;
+
+/// The error of requests sent to a server that doesn't support the method.
+pub const SERVER_NOT_CAPABLE: &str = "server not capable";
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct TextDocumentContentParams {
+    uri: Url,
+}
+
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+struct TextDocumentContentResult {
+    text: String,
+}
 
 pub enum ResponseHandler<Resp, Error> {
     Chan(Sender<Result<Resp, Error>>),
@@ -150,7 +197,7 @@ pub enum PluginServerRpc {
         change: Arc<
             Mutex<(
                 Option<TextDocumentContentChangeEvent>,
-                Option<TextDocumentContentChangeEvent>,
+                Option<Vec<TextDocumentContentChangeEvent>>,
             )>,
         >,
     },
@@ -210,6 +257,9 @@ fn document_supported(
     ) -> bool;
     fn method_registered(&mut self, method: &str) -> bool;
     fn handle_host_notification(&mut self, method: String, params: Params);
+    /// Called when handling a message from the server panicked, instead of
+    /// letting the panic end the plugin's thread.
+    fn handle_panic(&mut self, method: &str, params: &Params, message: &str);
     fn handle_host_request(
         &mut self,
         id: Id,
@@ -238,7 +288,7 @@ fn handle_did_change_text_document(
         change: Arc<
             Mutex<(
                 Option<TextDocumentContentChangeEvent>,
-                Option<TextDocumentContentChangeEvent>,
+                Option<Vec<TextDocumentContentChangeEvent>>,
             )>,
         >,
     );
@@ -441,11 +491,24 @@ pub fn mainloop<H>(&self, handler: &mut H)
                         .document_supported(language_id.as_deref(), path.as_deref())
                         && handler.method_registered(&method)
                     {
+                        let start = Instant::now();
+                        let syntax = language_id.unwrap_or_default();
+                        let request_method = method.clone();
+                        let rh = ResponseHandler::Callback(Box::new(
+                            move |result: Result<Value, RpcError>| {
+                                metrics::observe_request(
+                                    &request_method,
+                                    &syntax,
+                                    start.elapsed(),
+                                );
+                                rh.invoke(result);
+                            },
+                        ));
                         self.send_server_request(id, &method, params, rh);
                     } else {
                         rh.invoke(Err(RpcError {
                             code: 0,
-                            message: "server not capable".to_string(),
+                            message: SERVER_NOT_CAPABLE.to_string(),
                         }));
                     }
                 }
@@ -468,10 +531,37 @@ pub fn mainloop<H>(&self, handler: &mut H)
                     params,
                     resp,
                 } => {
-                    handler.handle_host_request(id, method, params, resp);
+                    // The server waits for an answer even if handling its
+                    // request panicked
+                    let panic_resp = resp.clone();
+                    let result = panic::catch_unwind(AssertUnwindSafe(|| {
+                        handler.handle_host_request(
+                            id,
+                            method.clone(),
+                            params.clone(),
+                            resp,
+                        );
+                    }));
+                    if let Err(payload) = result {
+                        let message = panic_message(payload.as_ref());
+                        panic_resp.send_err(INTERNAL_ERROR_CODE, message);
+                        handler.handle_panic(&method, &params, message);
+                    }
                 }
                 PluginServerRpc::HostNotification { method, params } => {
-                    handler.handle_host_notification(method, params);
+                    let result = panic::catch_unwind(AssertUnwindSafe(|| {
+                        handler.handle_host_notification(
+                            method.clone(),
+                            params.clone(),
+                        );
+                    }));
+                    if let Err(payload) = result {
+                        handler.handle_panic(
+                            &method,
+                            &params,
+                            panic_message(payload.as_ref()),
+                        );
+                    }
                 }
                 PluginServerRpc::DidSaveTextDocument {
                     language_id,
@@ -587,6 +677,84 @@ struct ServerRegistrations {
     save: Option<SaveRegistration>,
 }
 
+/// The diagnostics last published by a server, keyed by workspace and then by
+/// document, so they can be shown while the server is still starting up.
+type DiagnosticsCache = HashMap<PathBuf, HashMap<Url, Vec<Diagnostic>>>;
+
+/// The message a panic was raised with.
+fn panic_message(payload: &(dyn Any + Send)) -> &str {
+    if let Some(message) = payload.downcast_ref::<&str>() {
+        message
+    } else if let Some(message) = payload.downcast_ref::<String>() {
+        message
+    } else {
+        "<unknown>"
+    }
+}
+
+/// How long a server has to stop publishing diagnostics before they're written
+/// to the cache.
+const PERSIST_DIAGNOSTICS_DELAY: Duration = Duration::from_secs(2);
+
+fn diagnostics_cache_path(volt_id: &VoltID) -> Option<PathBuf> {
+    let dir = Directory::cache_directory()?.join("diagnostics");
+    if !dir.exists() {
+        let _ = std::fs::create_dir(&dir);
+    }
+    Some(dir.join(format!("{volt_id}.json")))
+}
+
+fn read_diagnostics_cache(volt_id: &VoltID) -> DiagnosticsCache {
+    diagnostics_cache_path(volt_id)
+        .and_then(|path| std::fs::read_to_string(path).ok())
+        .and_then(|content| serde_json::from_str(&content).ok())
+        .unwrap_or_default()
+}
+
+fn write_diagnostics_cache(
+    volt_id: &VoltID,
+    workspace: PathBuf,
+    diagnostics: HashMap<Url, Vec<Diagnostic>>,
+) {
+    let Some(path) = diagnostics_cache_path(volt_id) else {
+        return;
+    };
+    let mut cache = read_diagnostics_cache(volt_id);
+    cache.insert(workspace, diagnostics);
+    if let Ok(content) = serde_json::to_string(&cache) {
+        if let Err(err) = std::fs::write(&path, content) {
+            tracing::error!("failed to persist diagnostics to {path:?}: {err}");
+        }
+    }
+}
+
+/// Starts a thread that writes the diagnostics it's sent to the cache, once
+/// no newer ones came for a while, so a server publishing a lot doesn't keep
+/// the plugin thread busy with file I/O. The last ones are written when the
+/// sender is dropped.
+fn spawn_diagnostics_writer(
+    volt_id: VoltID,
+    workspace: PathBuf,
+) -> Sender<HashMap<Url, Vec<Diagnostic>>> {
+    let (tx, rx) = crossbeam_channel::unbounded();
+    thread::spawn(move || {
+        while let Ok(mut diagnostics) = rx.recv() {
+            loop {
+                match rx.recv_timeout(PERSIST_DIAGNOSTICS_DELAY) {
+                    Ok(newer) => diagnostics = newer,
+                    Err(crossbeam_channel::RecvTimeoutError::Timeout) => break,
+                    Err(crossbeam_channel::RecvTimeoutError::Disconnected) => {
+                        write_diagnostics_cache(&volt_id, workspace, diagnostics);
+                        return;
+                    }
+                }
+            }
+            write_diagnostics_cache(&volt_id, workspace.clone(), diagnostics);
+        }
+    });
+    tx
+}
+
 pub struct PluginHostHandler {
     volt_id: VoltID,
     volt_display_name: String,
@@ -598,6 +766,14 @@ pub struct PluginHostHandler {
     pub server_rpc: PluginServerRpcHandler,
     pub server_capabilities: ServerCapabilities,
     server_registrations: ServerRegistrations,
+    /// The legend the server decodes the types of its semantic tokens with,
+    /// reported once when it's initialized or registers semantic tokens.
+    semantic_tokens_legend: Option<SemanticTokensLegend>,
+    /// The diagnostics the server currently has published for each document.
+    diagnostics: HashMap<Url, Vec<Diagnostic>>,
+    /// Where the diagnostics are sent to be persisted, if there's a workspace
+    /// to persist them for.
+    diagnostics_writer: Option<Sender<HashMap<Url, Vec<Diagnostic>>>>,
 
     /// Language servers that this plugin has spawned.  
     /// Note that these plugin ids could be 'dead' if the LSP died/exited.  
@@ -620,6 +796,29 @@ pub fn new(
             .iter()
             .map(DocumentFilter::from_lsp_filter_loose)
             .collect();
+
+        // Show what the server reported last time straight away, the server
+        // will replace them with fresh diagnostics as it publishes them. They
+        // are merged like published ones, so the other servers keep them.
+        let diagnostics = workspace
+            .as_ref()
+            .and_then(|workspace| read_diagnostics_cache(&volt_id).remove(workspace))
+            .unwrap_or_default();
+        for (uri, diagnostics) in diagnostics.iter() {
+            let diagnostics = catalog_rpc.merge_diagnostics(
+                server_rpc.plugin_id,
+                PublishDiagnosticsParams {
+                    uri: uri.clone(),
+                    diagnostics: diagnostics.clone(),
+                    version: None,
+                },
+            );
+            core_rpc.publish_stale_diagnostics(diagnostics);
+        }
+        let diagnostics_writer = workspace
+            .clone()
+            .map(|workspace| spawn_diagnostics_writer(volt_id.clone(), workspace));
+
         Self {
             pwd,
             workspace,
@@ -631,10 +830,19 @@ pub fn new(
             server_rpc,
             server_capabilities: ServerCapabilities::default(),
             server_registrations: ServerRegistrations::default(),
+            semantic_tokens_legend: None,
+            diagnostics,
+            diagnostics_writer,
             spawned_lsp: HashMap::new(),
         }
     }
 
+    fn persist_diagnostics(&self) {
+        if let Some(writer) = self.diagnostics_writer.as_ref() {
+            let _ = writer.send(self.diagnostics.clone());
+        }
+    }
+
     pub fn document_supported(
         &self,
         language_id: Option<&str>,
@@ -662,7 +870,18 @@ pub fn document_supported(
         }
     }
 
+    /// The languages the server was started for
+    pub fn languages(&self) -> Vec<&str> {
+        self.document_selector
+            .iter()
+            .filter_map(|filter| filter.language_id.as_deref())
+            .collect()
+    }
+
     pub fn method_registered(&mut self, method: &str) -> bool {
+        if !self.catalog_rpc.lsp_feature_enabled(method) {
+            return false;
+        }
         match method {
             Initialize::METHOD => true,
             Initialized::METHOD => true,
@@ -727,6 +946,50 @@ pub fn method_registered(&mut self, method: &str) -> bool {
             GotoTypeDefinition::METHOD => {
                 self.server_capabilities.type_definition_provider.is_some()
             }
+            GotoImplementation::METHOD => {
+                self.server_capabilities.implementation_provider.is_some()
+            }
+            MonikerRequest::METHOD => {
+                self.server_capabilities.moniker_provider.is_some()
+            }
+            ColorPresentationRequest::METHOD | DocumentColor::METHOD => {
+                self.server_capabilities.color_provider.is_some()
+            }
+            CodeLensRequest::METHOD => {
+                self.server_capabilities.code_lens_provider.is_some()
+            }
+            CodeLensResolve::METHOD => self
+                .server_capabilities
+                .code_lens_provider
+                .as_ref()
+                .and_then(|c| c.resolve_provider)
+                .unwrap_or(false),
+            FoldingRangeRequest::METHOD => {
+                self.server_capabilities.folding_range_provider.is_some()
+            }
+            CallHierarchyPrepare::METHOD
+            | CallHierarchyIncomingCalls::METHOD
+            | CallHierarchyOutgoingCalls::METHOD => {
+                self.server_capabilities.call_hierarchy_provider.is_some()
+            }
+            GotoDeclaration::METHOD => self
+                .server_capabilities
+                .declaration_provider
+                .as_ref()
+                .map(|d| match d {
+                    DeclarationCapability::Simple(is_capable) => *is_capable,
+                    _ => true,
+                })
+                .unwrap_or(false),
+            DocumentHighlightRequest::METHOD => self
+                .server_capabilities
+                .document_highlight_provider
+                .as_ref()
+                .map(|d| match d {
+                    OneOf::Left(is_capable) => *is_capable,
+                    OneOf::Right(_) => true,
+                })
+                .unwrap_or(false),
             References::METHOD => self
                 .server_capabilities
                 .references_provider
@@ -754,9 +1017,57 @@ pub fn method_registered(&mut self, method: &str) -> bool {
                     OneOf::Right(_) => true,
                 })
                 .unwrap_or(false),
+            RangeFormatting::METHOD => self
+                .server_capabilities
+                .document_range_formatting_provider
+                .as_ref()
+                .map(|f| match f {
+                    OneOf::Left(is_capable) => *is_capable,
+                    OneOf::Right(_) => true,
+                })
+                .unwrap_or(false),
+            OnTypeFormatting::METHOD => self
+                .server_capabilities
+                .document_on_type_formatting_provider
+                .is_some(),
             SemanticTokensFullRequest::METHOD => {
                 self.server_capabilities.semantic_tokens_provider.is_some()
             }
+            SemanticTokensFullDeltaRequest::METHOD => self
+                .server_capabilities
+                .semantic_tokens_provider
+                .as_ref()
+                .map(|provider| {
+                    let full = match provider {
+                        SemanticTokensServerCapabilities::SemanticTokensOptions(
+                            options,
+                        ) => options.full.as_ref(),
+                        SemanticTokensServerCapabilities::SemanticTokensRegistrationOptions(
+                            options,
+                        ) => options.semantic_tokens_options.full.as_ref(),
+                    };
+                    matches!(
+                        full,
+                        Some(SemanticTokensFullOptions::Delta { delta: Some(true) })
+                    )
+                })
+                .unwrap_or(false),
+            SemanticTokensRangeRequest::METHOD => self
+                .server_capabilities
+                .semantic_tokens_provider
+                .as_ref()
+                .map(|provider| {
+                    let range = match provider {
+                        SemanticTokensServerCapabilities::SemanticTokensOptions(
+                            options,
+                        ) => options.range,
+                        SemanticTokensServerCapabilities::SemanticTokensRegistrationOptions(
+                            options,
+                        ) => options.semantic_tokens_options.range,
+                    };
+                    range == Some(true)
+                })
+                .unwrap_or(false),
             InlayHintRequest::METHOD => {
                 self.server_capabilities.inlay_hint_provider.is_some()
             }
@@ -764,21 +1075,56 @@ pub fn method_registered(&mut self, method: &str) -> bool {
                 .server_capabilities
                 .inline_completion_provider
                 .is_some(),
+            InlineValueRequest::METHOD => self
+                .server_capabilities
+                .inline_value_provider
+                .as_ref()
+                .map(|p| match p {
+                    OneOf::Left(is_capable) => *is_capable,
+                    OneOf::Right(_) => true,
+                })
+                .unwrap_or(false),
             DocumentSymbolRequest::METHOD => {
                 self.server_capabilities.document_symbol_provider.is_some()
             }
             WorkspaceSymbolRequest::METHOD => {
                 self.server_capabilities.workspace_symbol_provider.is_some()
             }
-            PrepareRenameRequest::METHOD => {
-                self.server_capabilities.rename_provider.is_some()
-            }
+            WorkspaceSymbolResolve::METHOD => self
+                .server_capabilities
+                .workspace_symbol_provider
+                .as_ref()
+                .map(|p| match p {
+                    OneOf::Left(_) => false,
+                    OneOf::Right(options) => options.resolve_provider == Some(true),
+                })
+                .unwrap_or(false),
+            PrepareRenameRequest::METHOD => self
+                .server_capabilities
+                .rename_provider
+                .as_ref()
+                .map(|p| match p {
+                    OneOf::Left(_) => false,
+                    OneOf::Right(options) => options.prepare_provider == Some(true),
+                })
+                .unwrap_or(false),
             Rename::METHOD => self.server_capabilities.rename_provider.is_some(),
             SelectionRangeRequest::METHOD => {
                 self.server_capabilities.selection_range_provider.is_some()
             }
-            CodeActionResolveRequest::METHOD => {
-                self.server_capabilities.code_action_provider.is_some()
+            CodeActionResolveRequest::METHOD => self
+                .server_capabilities
+                .code_action_provider
+                .as_ref()
+                .map(|c| match c {
+                    CodeActionProviderCapability::Simple(_) => false,
+                    CodeActionProviderCapability::Options(options) => {
+                        options.resolve_provider == Some(true)
+                    }
+                })
+                .unwrap_or(false),
+            ExecuteCommand::METHOD => {
+                self.server_capabilities.execute_command_provider.is_some()
             }
             _ => false,
         }
@@ -849,6 +1195,39 @@ fn register_capability(&mut self, registration: Registration) -> Result<()> {
                         .unwrap_or_default(),
                 });
             }
+            // Semantic tokens are registered as a whole rather than by request
+            "textDocument/semanticTokens" => {
+                let options = registration
+                    .register_options
+                    .ok_or_else(|| anyhow!("don't have options"))?;
+                let options: SemanticTokensRegistrationOptions =
+                    serde_json::from_value(options)?;
+                self.semantic_tokens_legend =
+                    Some(options.semantic_tokens_options.legend.clone());
+                self.server_capabilities.semantic_tokens_provider = Some(
+                    SemanticTokensServerCapabilities::SemanticTokensRegistrationOptions(
+                        options,
+                    ),
+                );
+            }
+            // The trigger characters replace the ones the server started with
+            OnTypeFormatting::METHOD => {
+                let options = registration
+                    .register_options
+                    .ok_or_else(|| anyhow!("don't have options"))?;
+                let options: DocumentOnTypeFormattingRegistrationOptions =
+                    serde_json::from_value(options)?;
+                let options = DocumentOnTypeFormattingOptions {
+                    first_trigger_character: options.first_trigger_character,
+                    more_trigger_character: options.more_trigger_character,
+                };
+                self.catalog_rpc.set_on_type_formatting_triggers(
+                    self.server_rpc.plugin_id,
+                    Some(&options),
+                );
+                self.server_capabilities
+                    .document_on_type_formatting_provider = Some(options);
+            }
             _ => {
                 eprintln!(
                     "don't handle register capability for {}",
@@ -887,6 +1266,81 @@ pub fn process_request(
                 self.register_capabilities(params.registrations);
                 resp.send_null();
             }
+            WorkspaceConfiguration::METHOD => {
+                let params: ConfigurationParams =
+                    serde_json::from_value(serde_json::to_value(params)?)?;
+                let configuration =
+                    self.catalog_rpc.configuration(&self.languages());
+                let settings: Vec<Value> = params
+                    .items
+                    .iter()
+                    .map(|item| {
+                        configuration_section(
+                            &configuration,
+                            item.section.as_deref(),
+                        )
+                    })
+                    .collect();
+                resp.send(settings);
+            }
+            CodeLensRefresh::METHOD => {
+                self.core_rpc.code_lens_refresh();
+                resp.send_null();
+            }
+            ShowDocument::METHOD => {
+                let params: ShowDocumentParams =
+                    serde_json::from_value(serde_json::to_value(params)?)?;
+                self.core_rpc.show_document(params);
+                resp.send(ShowDocumentResult { success: true });
+            }
+            ShowMessageRequest::METHOD => {
+                let params: ShowMessageRequestParams =
+                    serde_json::from_value(serde_json::to_value(params)?)?;
+                let title = format!("Plugin: {}", self.volt_display_name);
+                if params.actions.as_ref().map_or(true, |a| a.is_empty()) {
+                    // Nothing to pick, so it's just a message
+                    self.core_rpc.show_message(
+                        title,
+                        ShowMessageParams {
+                            typ: params.typ,
+                            message: params.message,
+                        },
+                    );
+                    resp.send_null();
+                } else {
+                    let id = self.catalog_rpc.add_message_request(resp);
+                    self.core_rpc.show_message_request(title, id, params);
+                }
+            }
+            ApplyWorkspaceEdit::METHOD => {
+                let params: ApplyWorkspaceEditParams =
+                    serde_json::from_value(serde_json::to_value(params)?)?;
+                // The files are created, renamed and deleted first, and then the
+                // text edits are applied by the editor, which reports back
+                // whether they could be
+                let core_rpc = self.core_rpc.clone();
+                let catalog_rpc = self.catalog_rpc.clone();
+                self.catalog_rpc.proxy_rpc.apply_resource_operations(
+                    params.edit,
+                    move |result| match result {
+                        Ok(ProxyResponse::ApplyResourceOperations {
+                            edit,
+                            renamed,
+                            failed_change,
+                            failure_reason,
+                        }) => {
+                            let request_id = catalog_rpc.add_workspace_edit_request(
+                                resp,
+                                failed_change,
+                                failure_reason,
+                            );
+                            core_rpc.apply_workspace_edit(request_id, edit, renamed);
+                        }
+                        Ok(_) => resp.send_null(),
+                        Err(err) => resp.send_err(err.code, err.message),
+                    },
+                );
+            }
             ExecuteProcess::METHOD => {
                 let params: ExecuteProcessParams =
                     serde_json::from_value(serde_json::to_value(params)?)?;
@@ -999,6 +1453,14 @@ pub fn process_request(
                     },
                 )
             }
+            TEXT_DOCUMENT_CONTENT_METHOD => {
+                let params: TextDocumentContentParams =
+                    serde_json::from_value(serde_json::to_value(params)?)?;
+                let text = self
+                    .catalog_rpc
+                    .provide_text_document_content(&params.uri)?;
+                resp.send(TextDocumentContentResult { text });
+            }
             _ => return Err(anyhow!("request not supported")),
         }
 
@@ -1047,11 +1509,38 @@ pub fn handle_notification(
             PublishDiagnostics::METHOD => {
                 let diagnostics: PublishDiagnosticsParams =
                     serde_json::from_value(serde_json::to_value(params)?)?;
+                let syntax = uri_to_path(&diagnostics.uri)
+                    .ok()
+                    .and_then(|path| language_id_from_path(&path))
+                    .unwrap_or_default();
+                metrics::count_diagnostics(syntax, &diagnostics.diagnostics);
+                if diagnostics.diagnostics.is_empty() {
+                    self.diagnostics.remove(&diagnostics.uri);
+                } else {
+                    self.diagnostics.insert(
+                        diagnostics.uri.clone(),
+                        diagnostics.diagnostics.clone(),
+                    );
+                }
+                self.persist_diagnostics();
+                let diagnostics = self
+                    .catalog_rpc
+                    .merge_diagnostics(self.server_rpc.plugin_id, diagnostics);
                 self.catalog_rpc.core_rpc.publish_diagnostics(diagnostics);
             }
             Progress::METHOD => {
-                let progress: ProgressParams =
-                    serde_json::from_value(serde_json::to_value(params)?)?;
+                let params = serde_json::to_value(params)?;
+                // Partial results of requests are reported with progress too
+                if let Some(token) = params["token"].as_str() {
+                    if self.catalog_rpc.handle_partial_result(
+                        self.server_rpc.plugin_id,
+                        token,
+                        params["value"].clone(),
+                    ) {
+                        return Ok(());
+                    }
+                }
+                let progress: ProgressParams = serde_json::from_value(params)?;
                 self.catalog_rpc.core_rpc.work_done_progress(progress);
             }
             ShowMessage::METHOD => {
@@ -1092,6 +1581,7 @@ pub fn handle_did_save_text_document(
                 None
             },
         };
+        let uri = params.text_document.uri.clone();
         self.server_rpc.server_notification(
             DidSaveTextDocument::METHOD,
             params,
@@ -1099,6 +1589,53 @@ pub fn handle_did_save_text_document(
             Some(path),
             false,
         );
+        self.pull_diagnostics(uri);
+    }
+
+    /// Ask a server that supports pull diagnostics for the diagnostics of a
+    /// document. They are only pulled once the document is saved, so that the
+    /// errors of unfinished edits aren't reported.
+    fn pull_diagnostics(&self, uri: Url) {
+        if self.server_capabilities.diagnostic_provider.is_none() {
+            return;
+        }
+
+        let params = DocumentDiagnosticParams {
+            text_document: TextDocumentIdentifier { uri: uri.clone() },
+            identifier: None,
+            previous_result_id: None,
+            work_done_progress_params: WorkDoneProgressParams::default(),
+            partial_result_params: PartialResultParams::default(),
+        };
+        let server_rpc = self.server_rpc.clone();
+        self.server_rpc.server_request_async(
+            DocumentDiagnosticRequest::METHOD,
+            params,
+            None,
+            None,
+            false,
+            move |result: Result<Value, RpcError>| {
+                let Some(DocumentDiagnosticReportResult::Report(
+                    DocumentDiagnosticReport::Full(report),
+                )) = result
+                    .ok()
+                    .and_then(|value| serde_json::from_value(value).ok())
+                else {
+                    return;
+                };
+                // Handled like pushed diagnostics, so that they're tracked the
+                // same way
+                let diagnostics = PublishDiagnosticsParams {
+                    uri,
+                    diagnostics: report.full_document_diagnostic_report.items,
+                    version: None,
+                };
+                server_rpc.handle_rpc(PluginServerRpc::HostNotification {
+                    method: PublishDiagnostics::METHOD.to_string(),
+                    params: Params::from(serde_json::to_value(diagnostics).unwrap()),
+                });
+            },
+        );
     }
 
     pub fn handle_did_change_text_document(
@@ -1111,7 +1648,7 @@ pub fn handle_did_change_text_document(
         change: Arc<
             Mutex<(
                 Option<TextDocumentContentChangeEvent>,
-                Option<TextDocumentContentChangeEvent>,
+                Option<Vec<TextDocumentContentChangeEvent>>,
             )>,
         >,
     ) {
@@ -1124,10 +1661,10 @@ pub fn handle_did_change_text_document(
         };
 
         let mut existing = change.lock();
-        let change = match kind {
+        let changes = match kind {
             TextDocumentSyncKind::FULL => {
                 if let Some(c) = existing.0.as_ref() {
-                    c.clone()
+                    vec![c.clone()]
                 } else {
                     let change = TextDocumentContentChangeEvent {
                         range: None,
@@ -1135,21 +1672,23 @@ pub fn handle_did_change_text_document(
                         text: new_text.to_string(),
                     };
                     existing.0 = Some(change.clone());
-                    change
+                    vec![change]
                 }
             }
             TextDocumentSyncKind::INCREMENTAL => {
                 if let Some(c) = existing.1.as_ref() {
                     c.clone()
                 } else {
-                    let change = get_document_content_change(&text, &delta)
-                        .unwrap_or_else(|| TextDocumentContentChangeEvent {
-                            range: None,
-                            range_length: None,
-                            text: new_text.to_string(),
+                    let changes = get_document_content_changes(&text, &delta)
+                        .unwrap_or_else(|| {
+                            vec![TextDocumentContentChangeEvent {
+                                range: None,
+                                range_length: None,
+                                text: new_text.to_string(),
+                            }]
                         });
-                    existing.1 = Some(change.clone());
-                    change
+                    existing.1 = Some(changes.clone());
+                    changes
                 }
             }
             TextDocumentSyncKind::NONE => return,
@@ -1160,7 +1699,7 @@ pub fn handle_did_change_text_document(
 
         let params = DidChangeTextDocumentParams {
             text_document: document,
-            content_changes: vec![change],
+            content_changes: changes,
         };
 
         self.server_rpc.server_notification(
@@ -1178,18 +1717,113 @@ pub fn format_semantic_tokens(
         text: Rope,
         f: Box<dyn RpcCallback<Vec<LineStyle>, RpcError>>,
     ) {
-        let result = format_semantic_styles(
-            &text,
-            self.server_capabilities.semantic_tokens_provider.as_ref(),
-            &tokens,
-        )
-        .ok_or_else(|| RpcError {
-            code: 0,
-            message: "can't get styles".to_string(),
-        });
+        let result =
+            format_semantic_styles(&text, self.semantic_tokens_legend(), &tokens)
+                .ok_or_else(|| RpcError {
+                    code: 0,
+                    message: "can't get styles".to_string(),
+                });
         f.call(result);
     }
 
+    pub fn set_server_capabilities(&mut self, capabilities: ServerCapabilities) {
+        self.catalog_rpc.set_signature_help_triggers(
+            self.server_rpc.plugin_id,
+            capabilities.signature_help_provider.as_ref(),
+        );
+        self.semantic_tokens_legend = capabilities
+            .semantic_tokens_provider
+            .as_ref()
+            .map(|provider| semantic_tokens_legend(provider).clone());
+        self.catalog_rpc.set_on_type_formatting_triggers(
+            self.server_rpc.plugin_id,
+            capabilities.document_on_type_formatting_provider.as_ref(),
+        );
+        self.server_capabilities = capabilities;
+    }
+
+    pub fn semantic_tokens_legend(&self) -> Option<&SemanticTokensLegend> {
+        self.semantic_tokens_legend.as_ref()
+    }
+
+    /// Tell the user that the server couldn't be initialized, as otherwise the
+    /// languages it serves would silently lack any language features.
+    pub fn show_initialize_error(&self, error: &RpcError) {
+        let languages = self.languages();
+        let message = if languages.is_empty() {
+            format!("The language server failed to start: {}", error.message)
+        } else {
+            format!(
+                "The language server for {} failed to start: {}",
+                languages.join(", "),
+                error.message
+            )
+        };
+        self.core_rpc.show_message(
+            format!("Plugin: {}", self.volt_display_name),
+            ShowMessageParams {
+                typ: MessageType::ERROR,
+                message,
+            },
+        );
+    }
+
+    /// Tell the user that the server is older than the version known to work
+    /// for its languages, as the features it lacks would silently be missing.
+    pub fn show_version_warning(
+        &self,
+        server_name: &str,
+        version: &str,
+        min_version: &str,
+    ) {
+        self.core_rpc.show_message(
+            format!("Plugin: {}", self.volt_display_name),
+            ShowMessageParams {
+                typ: MessageType::WARNING,
+                message: format!(
+                    "{server_name} {version} is older than {min_version}, the oldest version known to work. Some language features may not work until it's updated."
+                ),
+            },
+        );
+    }
+
+    /// Append the message that made the plugin panic, with the state it was
+    /// handled in, to the plugin panic log, and tell the user about it.
+    pub fn report_panic(&self, method: &str, params: &Params, message: &str) {
+        let params = serde_json::to_string(params).unwrap_or_default();
+        let dump = format!(
+            "{} ({}) panicked handling {method}: {message}\n\
+             params: {params}\n\
+             workspace: {:?}\n\
+             documents with diagnostics: {}\n\n",
+            self.volt_id,
+            self.server_rpc.plugin_id.0,
+            self.workspace,
+            self.diagnostics.len(),
+        );
+        if let Some(path) =
+            Directory::logs_directory().map(|dir| dir.join("plugin-panics.log"))
+        {
+            if let Ok(mut file) = std::fs::OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(path)
+            {
+                let _ = file.write_all(dump.as_bytes());
+            }
+        }
+
+        self.core_rpc.show_message(
+            format!("Plugin: {}", self.volt_display_name),
+            ShowMessageParams {
+                typ: MessageType::ERROR,
+                message: format!(
+                    "The plugin failed to handle {method} from its server: {message}"
+                ),
+            },
+        );
+    }
+
     pub fn handle_spawned_plugin_loaded(&mut self, plugin_id: PluginId) {
         if let Some(info) = self.spawned_lsp.get_mut(&plugin_id) {
             let Some(resp) = info.resp.take() else {
@@ -1211,59 +1845,92 @@ struct SpawnedLspInfo {
     resp: Option<ResponseSender>,
 }
 
-fn get_document_content_change(
+/// The changes of a delta, in the order they have to be applied in. A delta can
+/// change several regions at once, e.g. when editing with multiple cursors,
+/// which are sent as one change each rather than as the full document.
+fn get_document_content_changes(
     text: &Rope,
     delta: &RopeDelta,
-) -> Option<TextDocumentContentChangeEvent> {
-    let (interval, _) = delta.summary();
-    let (start, end) = interval.start_end();
-
+) -> Option<Vec<TextDocumentContentChangeEvent>> {
     let text = RopeTextRef::new(text);
-
-    // TODO: Handle more trivial cases like typing when there's a selection or transpose
-    if let Some(node) = delta.as_simple_insert() {
-        let (start, end) = interval.start_end();
-        let start = text.offset_to_position(start);
-
-        let end = text.offset_to_position(end);
-
-        let text = String::from(node);
-        let text_document_content_change_event = TextDocumentContentChangeEvent {
-            range: Some(Range { start, end }),
-            range_length: None,
-            text,
-        };
-
-        return Some(text_document_content_change_event);
-    }
-    // Or a simple delete
-    else if delta.is_simple_delete() {
-        let end_position = text.offset_to_position(end);
-
-        let start = text.offset_to_position(start);
-
-        let text_document_content_change_event = TextDocumentContentChangeEvent {
+    let changes: Vec<TextDocumentContentChangeEvent> = delta_replacements(delta)
+        .into_iter()
+        // Later regions go first, so that the positions of the earlier ones stay
+        // valid as the changes are applied one after another.
+        .rev()
+        .map(|(start, end, new_text)| TextDocumentContentChangeEvent {
             range: Some(Range {
-                start,
-                end: end_position,
+                start: text.offset_to_position(start),
+                end: text.offset_to_position(end),
             }),
             range_length: None,
-            text: String::new(),
-        };
+            text: new_text,
+        })
+        .collect();
 
-        return Some(text_document_content_change_event);
+    if changes.is_empty() {
+        None
+    } else {
+        Some(changes)
     }
+}
 
-    None
+/// The regions of the original text that a delta replaces, with their new text,
+/// in the order of the regions.
+fn delta_replacements(delta: &RopeDelta) -> Vec<(usize, usize, String)> {
+    let mut replacements = Vec::new();
+    // The end of the last copied region, which is where the next replacement
+    // starts
+    let mut offset = 0;
+    let mut inserted: Option<String> = None;
+    for element in delta.els.iter() {
+        match element {
+            DeltaElement::Copy(start, end) => {
+                if *start > offset || inserted.is_some() {
+                    replacements.push((
+                        offset,
+                        *start,
+                        inserted.take().unwrap_or_default(),
+                    ));
+                }
+                offset = *end;
+            }
+            DeltaElement::Insert(node) => {
+                inserted
+                    .get_or_insert_with(String::new)
+                    .push_str(&String::from(node));
+            }
+        }
+    }
+    if delta.base_len > offset || inserted.is_some() {
+        replacements.push((
+            offset,
+            delta.base_len,
+            inserted.take().unwrap_or_default(),
+        ));
+    }
+    replacements
+}
+
+/// The part of the settings under the dotted `section`, or all of them without
+/// a section. Sections that aren't set are null.
+fn configuration_section(settings: &Value, section: Option<&str>) -> Value {
+    let Some(section) = section.filter(|section| !section.is_empty()) else {
+        return settings.clone();
+    };
+    section
+        .split('.')
+        .try_fold(settings, |settings, part| settings.get(part))
+        .cloned()
+        .unwrap_or(Value::Null)
 }
 
 fn format_semantic_styles(
     text: &Rope,
-    semantic_tokens_provider: Option<&SemanticTokensServerCapabilities>,
+    legend: Option<&SemanticTokensLegend>,
     tokens: &SemanticTokens,
 ) -> Option<Vec<LineStyle>> {
-    let semantic_tokens_provider = semantic_tokens_provider?;
-    let semantic_legends = semantic_tokens_legend(semantic_tokens_provider);
+    let legend = legend?;
 
     let text = RopeTextRef::new(text);
     let mut highlights = Vec::new();
@@ -1283,9 +1950,11 @@ fn format_semantic_styles(
         let end =
             start + offset_utf16_to_utf8(sub_text, semantic_token.length as usize);
 
-        let kind = semantic_legends.token_types[semantic_token.token_type as usize]
-            .as_str()
-            .to_string();
+        // A type that isn't in the legend can't be styled
+        let Some(kind) = legend.token_types.get(semantic_token.token_type as usize)
+        else {
+            continue;
+        };
         if start < last_start {
             continue;
         }
@@ -1294,7 +1963,7 @@ fn format_semantic_styles(
             start,
             end,
             style: Style {
-                fg_color: Some(kind),
+                fg_color: Some(kind.as_str().to_string()),
             },
         });
     }
@@ -1314,3 +1983,140 @@ fn semantic_tokens_legend(
         ) => &options.semantic_tokens_options.legend,
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use lapce_xi_rope::{DeltaBuilder, Rope};
+
+    use lsp_types::{Position, SemanticTokens, SemanticTokensServerCapabilities};
+    use serde_json::json;
+
+    use super::{
+        configuration_section, delta_replacements, format_semantic_styles,
+        get_document_content_changes, panic_message, semantic_tokens_legend,
+    };
+
+    #[test]
+    fn test_configuration_section() {
+        let settings = json!({
+            "rust-analyzer": { "check": { "command": "clippy" } },
+        });
+        assert_eq!(configuration_section(&settings, None), settings);
+        assert_eq!(configuration_section(&settings, Some("")), settings);
+        assert_eq!(
+            configuration_section(&settings, Some("rust-analyzer")),
+            json!({ "check": { "command": "clippy" } })
+        );
+        assert_eq!(
+            configuration_section(&settings, Some("rust-analyzer.check.command")),
+            json!("clippy")
+        );
+        assert_eq!(
+            configuration_section(&settings, Some("rust-analyzer.cargo")),
+            serde_json::Value::Null
+        );
+        assert_eq!(
+            configuration_section(&serde_json::Value::Null, Some("rust-analyzer")),
+            serde_json::Value::Null
+        );
+    }
+
+    #[test]
+    fn test_panic_message() {
+        let payload = std::panic::catch_unwind(|| panic!("static")).unwrap_err();
+        assert_eq!(panic_message(payload.as_ref()), "static");
+        let payload =
+            std::panic::catch_unwind(|| panic!("formatted {}", 1)).unwrap_err();
+        assert_eq!(panic_message(payload.as_ref()), "formatted 1");
+        let payload =
+            std::panic::catch_unwind(|| std::panic::panic_any(1)).unwrap_err();
+        assert_eq!(panic_message(payload.as_ref()), "<unknown>");
+    }
+
+    #[test]
+    fn test_delta_replacements() {
+        let mut builder = DeltaBuilder::new(11);
+        builder.replace(0..0, Rope::from("// "));
+        builder.replace(4..5, Rope::from(""));
+        builder.replace(11..11, Rope::from("!"));
+        let delta = builder.build();
+        assert_eq!(
+            delta_replacements(&delta),
+            vec![
+                (0, 0, "// ".to_string()),
+                (4, 5, "".to_string()),
+                (11, 11, "!".to_string())
+            ]
+        );
+    }
+
+    #[test]
+    fn test_multi_cursor_content_changes() {
+        // An insert at the start of each line, as typed with a cursor on each line
+        let text = Rope::from("a\nb\nc\n");
+        let mut builder = DeltaBuilder::new(text.len());
+        builder.replace(0..0, Rope::from("x"));
+        builder.replace(2..2, Rope::from("x"));
+        builder.replace(4..4, Rope::from("x"));
+        let delta = builder.build();
+
+        let changes = get_document_content_changes(&text, &delta).unwrap();
+        let starts: Vec<Position> = changes
+            .iter()
+            .map(|change| change.range.unwrap().start)
+            .collect();
+        assert_eq!(
+            starts,
+            vec![
+                Position::new(2, 0),
+                Position::new(1, 0),
+                Position::new(0, 0)
+            ]
+        );
+        assert!(changes.iter().all(|change| change.text == "x"));
+    }
+    #[test]
+    fn test_format_semantic_styles() {
+        let text = Rope::from("let a = \"one\ntwo\";\n\nlet b = a;");
+        let provider: SemanticTokensServerCapabilities =
+            serde_json::from_value(json!({
+                "legend": {
+                    "tokenTypes": ["string", "variable"],
+                    "tokenModifiers": []
+                }
+            }))
+            .unwrap();
+        let legend = semantic_tokens_legend(&provider);
+        // Each token is `[deltaLine, deltaStart, length, tokenType, modifiers]`
+        let tokens: SemanticTokens = serde_json::from_value(json!({
+            "data": [
+                0, 4, 1, 1, 0,
+                // On the same line, so the start is relative to the `a`, and
+                // the string goes on to the next line
+                0, 4, 9, 0, 0,
+                // Skips the line of the string's end and an empty line
+                3, 4, 1, 1, 0,
+                // A type the legend doesn't have is left out
+                0, 2, 1, 7, 0,
+                0, 2, 1, 1, 0
+            ]
+        }))
+        .unwrap();
+
+        let styles: Vec<(usize, usize, String)> =
+            format_semantic_styles(&text, Some(legend), &tokens)
+                .unwrap()
+                .into_iter()
+                .map(|style| (style.start, style.end, style.style.fg_color.unwrap()))
+                .collect();
+        assert_eq!(
+            styles,
+            vec![
+                (4, 5, "variable".to_string()),
+                (8, 17, "string".to_string()),
+                (24, 25, "variable".to_string()),
+                (28, 29, "variable".to_string()),
+            ]
+        );
+    }
+}
@@ -0,0 +1,294 @@
+use std::{
+    collections::{HashMap, HashSet},
+    fs::File,
+    io::{BufRead, BufReader, BufWriter, Write},
+    path::{Path, PathBuf},
+    process::{self, Command, Stdio},
+    thread,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+use anyhow::{anyhow, Result};
+use jsonrpc_lite::JsonRpc;
+use lapce_core::directory::Directory;
+use parking_lot::Mutex;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use super::lsp::{read_message, write_message};
+
+/// How long a replayed request may take to be answered
+const REPLAY_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// A line of a trace log, which holds one JSON entry per line.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "kind", rename_all = "camelCase")]
+pub enum TraceEntry {
+    /// The server the log is of, which is the first entry.
+    Server {
+        server: String,
+        args: Vec<String>,
+        workspace: Option<PathBuf>,
+    },
+    /// A message the client sent to the server.
+    Sent { message: Value },
+    /// A message the server sent to the client.
+    Received { message: Value },
+}
+
+/// Logs every message exchanged with a language server, so that the session
+/// can be replayed against another version of the server.
+pub struct TraceLog {
+    writer: Mutex<BufWriter<File>>,
+}
+
+impl TraceLog {
+    /// Start the trace log of a server in the logs folder, returning it with
+    /// the path of its file.
+    pub fn create(
+        name: &str,
+        server: &str,
+        args: &[String],
+        workspace: Option<&Path>,
+    ) -> Result<(TraceLog, PathBuf)> {
+        let dir = Directory::logs_directory()
+            .ok_or_else(|| anyhow!("can't find the logs folder"))?;
+        let time = SystemTime::now().duration_since(UNIX_EPOCH)?.as_millis();
+        let path =
+            dir.join(format!("lsp-trace-{name}-{}-{time}.jsonl", process::id()));
+        let trace = TraceLog {
+            writer: Mutex::new(BufWriter::new(File::create(&path)?)),
+        };
+        trace.write(&TraceEntry::Server {
+            server: server.to_string(),
+            args: args.to_vec(),
+            workspace: workspace.map(Path::to_path_buf),
+        });
+        Ok((trace, path))
+    }
+
+    pub fn sent(&self, msg: &JsonRpc) {
+        if let Ok(message) = serde_json::to_value(msg) {
+            self.write(&TraceEntry::Sent { message });
+        }
+    }
+
+    pub fn received(&self, msg: &str) {
+        if let Ok(message) = serde_json::from_str(msg) {
+            self.write(&TraceEntry::Received { message });
+        }
+    }
+
+    fn write(&self, entry: &TraceEntry) {
+        let mut writer = self.writer.lock();
+        if serde_json::to_writer(&mut *writer, entry).is_ok() {
+            let _ = writer.write_all(b"\n");
+            let _ = writer.flush();
+        }
+    }
+}
+
+/// A request whose answer in a replay differs from the one in the trace log.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ReplayMismatch {
+    pub method: String,
+    pub id: Value,
+    /// The `result` or `error` of the answer in the trace log
+    pub expected: Value,
+    /// The `result` or `error` of the answer in the replay, `None` if the
+    /// server didn't answer in time
+    pub actual: Option<Value>,
+}
+
+/// Read a trace log written with the `lsp-trace` setting.
+pub fn read_trace(path: &Path) -> Result<Vec<TraceEntry>> {
+    let reader = BufReader::new(File::open(path)?);
+    let mut entries = Vec::new();
+    for line in reader.lines() {
+        let line = line?;
+        if !line.trim().is_empty() {
+            entries.push(serde_json::from_str(&line)?);
+        }
+    }
+    Ok(entries)
+}
+
+/// Send the messages the client sent in a trace log to a new process of the
+/// server, in the same order, and compare the answers to its requests with the
+/// ones in the log. Requests of the server are answered with the answers the
+/// client gave when the log was written.
+pub fn replay(entries: &[TraceEntry]) -> Result<Vec<ReplayMismatch>> {
+    let Some(TraceEntry::Server {
+        server,
+        args,
+        workspace,
+    }) = entries.first()
+    else {
+        return Err(anyhow!("the trace log doesn't start with its server"));
+    };
+
+    let mut command = Command::new(server);
+    if let Some(workspace) = workspace {
+        command.current_dir(workspace);
+    }
+    let mut child = command
+        .args(args)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()?;
+    let mut writer = BufWriter::new(child.stdin.take().unwrap());
+    let stdout = child.stdout.take().unwrap();
+    let (tx, rx) = crossbeam_channel::unbounded();
+    thread::spawn(move || {
+        let mut reader = BufReader::new(stdout);
+        while let Ok(msg) = read_message(&mut reader) {
+            if let Ok(msg) = serde_json::from_str::<Value>(&msg) {
+                if tx.send(msg).is_err() {
+                    return;
+                }
+            }
+        }
+    });
+
+    let expected = expected_answers(entries);
+    // The answers of the client to the requests of the server, sent as soon as
+    // the server makes them, as it can wait for them before it answers
+    let mut client_answers: HashMap<String, &Value> = entries
+        .iter()
+        .filter_map(|entry| match entry {
+            TraceEntry::Sent { message } => {
+                let (id, _) = answer(message)?;
+                Some((id.to_string(), message))
+            }
+            _ => None,
+        })
+        .collect();
+    let mut answered = HashSet::new();
+
+    let mut mismatches = Vec::new();
+    for entry in entries {
+        let TraceEntry::Sent { message } = entry else {
+            continue;
+        };
+        if let Some((id, _)) = answer(message) {
+            if !answered.insert(id.to_string()) {
+                continue;
+            }
+            client_answers.remove(&id.to_string());
+        }
+        send_message(&mut writer, message)?;
+
+        let (Some(method), Some(id)) = (
+            message.get("method").and_then(Value::as_str),
+            message.get("id"),
+        ) else {
+            continue;
+        };
+        let actual = loop {
+            let Ok(msg) = rx.recv_timeout(REPLAY_TIMEOUT) else {
+                break None;
+            };
+            if let Some((answer_id, result)) = answer(&msg) {
+                if answer_id == id {
+                    break Some(result.clone());
+                }
+            } else if let Some(server_id) = msg.get("id") {
+                let key = server_id.to_string();
+                if let Some(client_answer) = client_answers.remove(&key) {
+                    answered.insert(key);
+                    send_message(&mut writer, client_answer)?;
+                }
+            }
+        };
+        if let Some(expected) = expected.get(&id.to_string()) {
+            if actual.as_ref() != Some(expected) {
+                mismatches.push(ReplayMismatch {
+                    method: method.to_string(),
+                    id: id.clone(),
+                    expected: expected.clone(),
+                    actual,
+                });
+            }
+        }
+    }
+
+    let _ = child.kill();
+    let _ = child.wait();
+    Ok(mismatches)
+}
+
+fn send_message<W: Write>(writer: &mut W, message: &Value) -> Result<()> {
+    let msg: JsonRpc = serde_json::from_value(message.clone())?;
+    write_message(writer, &msg)
+}
+
+/// The answers of the server to the requests of the client in a trace log, by
+/// the id of the request.
+fn expected_answers(entries: &[TraceEntry]) -> HashMap<String, Value> {
+    entries
+        .iter()
+        .filter_map(|entry| match entry {
+            TraceEntry::Received { message } => {
+                let (id, result) = answer(message)?;
+                Some((id.to_string(), result.clone()))
+            }
+            _ => None,
+        })
+        .collect()
+}
+
+/// The id and the `result` or `error` of a message that answers a request.
+fn answer(message: &Value) -> Option<(&Value, &Value)> {
+    if message.get("method").is_some() {
+        return None;
+    }
+    let id = message.get("id")?;
+    let result = message.get("result").or_else(|| message.get("error"))?;
+    Some((id, result))
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::{answer, expected_answers, TraceEntry};
+
+    #[test]
+    fn test_expected_answers() {
+        let entries = vec![
+            TraceEntry::Server {
+                server: "server".to_string(),
+                args: Vec::new(),
+                workspace: None,
+            },
+            TraceEntry::Sent {
+                message: json!({"jsonrpc": "2.0", "id": 1, "method": "a"}),
+            },
+            TraceEntry::Received {
+                message: json!({"jsonrpc": "2.0", "id": 1, "result": [1]}),
+            },
+            // A request of the server isn't an answer
+            TraceEntry::Received {
+                message: json!({"jsonrpc": "2.0", "id": 2, "method": "b"}),
+            },
+            TraceEntry::Received {
+                message: json!({"jsonrpc": "2.0", "id": "c", "error": {"code": 1}}),
+            },
+        ];
+        let answers = expected_answers(&entries);
+        assert_eq!(answers.len(), 2);
+        assert_eq!(answers["1"], json!([1]));
+        assert_eq!(answers["\"c\""], json!({"code": 1}));
+        assert_eq!(answer(&json!({"jsonrpc": "2.0", "method": "d"})), None);
+
+        // Entries are written one per line
+        let line = serde_json::to_string(&entries[1]).unwrap();
+        assert!(!line.contains('\n'));
+        assert!(line.starts_with(r#"{"kind":"sent","#));
+        assert_eq!(
+            serde_json::from_str::<TraceEntry>(&line).unwrap(),
+            entries[1]
+        );
+    }
+}
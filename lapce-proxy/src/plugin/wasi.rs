@@ -112,7 +112,7 @@ fn handle_handler_notification(
                 self.initialize();
             }
             InitializeResult(result) => {
-                self.host.server_capabilities = result.capabilities;
+                self.host.set_server_capabilities(result.capabilities);
             }
             Shutdown => {
                 self.shutdown();
@@ -127,6 +127,10 @@ fn handle_host_notification(&mut self, method: String, params: Params) {
         let _ = self.host.handle_notification(method, params);
     }
 
+    fn handle_panic(&mut self, method: &str, params: &Params, message: &str) {
+        self.host.report_panic(method, params, message);
+    }
+
     fn handle_host_request(
         &mut self,
         id: Id,
@@ -162,7 +166,7 @@ fn handle_did_change_text_document(
         change: Arc<
             Mutex<(
                 Option<TextDocumentContentChangeEvent>,
-                Option<TextDocumentContentChangeEvent>,
+                Option<Vec<TextDocumentContentChangeEvent>>,
             )>,
         >,
     ) {
@@ -545,7 +549,7 @@ fn wasi_read_string(stdout: &Arc<RwLock<WasiPipe>>) -> Result<String> {
     Ok(buf)
 }
 
-fn unflatten_map(map: &HashMap<String, serde_json::Value>) -> serde_json::Value {
+pub fn unflatten_map(map: &HashMap<String, serde_json::Value>) -> serde_json::Value {
     let mut new = serde_json::json!({});
     for (key, value) in map.iter() {
         let mut current = new.as_object_mut().unwrap();
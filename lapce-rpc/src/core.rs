@@ -9,8 +9,9 @@
 
 use crossbeam_channel::{Receiver, Sender};
 use lsp_types::{
-    CompletionResponse, LogMessageParams, ProgressParams, PublishDiagnosticsParams,
-    ShowMessageParams, SignatureHelp,
+    CodeLens, CompletionResponse, LogMessageParams, ProgressParams,
+    PublishDiagnosticsParams, ShowDocumentParams, ShowMessageParams,
+    ShowMessageRequestParams, SignatureHelp, WorkspaceEdit,
 };
 use parking_lot::Mutex;
 use serde::{Deserialize, Serialize};
@@ -23,6 +24,7 @@
     plugin::{PluginId, VoltInfo, VoltMetadata},
     proxy::ProxyStatus,
     source_control::DiffInfo,
+    style::SemanticStyles,
     terminal::TermId,
     RequestId, RpcError, RpcMessage,
 };
@@ -61,14 +63,62 @@ pub enum CoreNotification {
     WorkspaceFileChange,
     PublishDiagnostics {
         diagnostics: PublishDiagnosticsParams,
+        /// Diagnostics restored from a previous session, that the server
+        /// hasn't confirmed yet.
+        #[serde(default)]
+        stale: bool,
     },
     WorkDoneProgress {
         progress: ProgressParams,
     },
+    /// Semantic styles of a batch of tokens that the server reported before the
+    /// full response of a semantic tokens request.
+    PartialSemanticStyles {
+        styles: SemanticStyles,
+    },
     ShowMessage {
         title: String,
         message: ShowMessageParams,
     },
+    /// A server asked the user to pick one of the actions of a message, which
+    /// is answered with the request id.
+    ShowMessageRequest {
+        title: String,
+        request_id: u64,
+        message: ShowMessageRequestParams,
+    },
+    /// A server asked to show a document, either in the editor or, if it's
+    /// external, in the default application.
+    ShowDocument {
+        params: ShowDocumentParams,
+    },
+    /// The code lenses of a document, fetched again after it was saved.
+    CodeLens {
+        path: PathBuf,
+        plugin_id: PluginId,
+        lenses: Vec<CodeLens>,
+    },
+    /// A server asked for the code lenses of all documents to be fetched
+    /// again.
+    CodeLensRefresh,
+    /// A server asked to apply an edit, e.g. while running a command. The
+    /// editor answers whether all of its text edits could be applied. Its
+    /// files were already created, renamed and deleted, and the editors of
+    /// the renamed files have to follow them.
+    ApplyWorkspaceEdit {
+        request_id: u64,
+        edit: WorkspaceEdit,
+        renamed: Vec<(PathBuf, PathBuf)>,
+    },
+    /// The characters that trigger on type formatting on any of the servers.
+    OnTypeFormattingTriggers {
+        triggers: Vec<String>,
+    },
+    /// The characters that trigger or retrigger signature help on any of the
+    /// servers.
+    SignatureHelpTriggers {
+        triggers: Vec<String>,
+    },
     LogMessage {
         message: LogMessageParams,
     },
@@ -296,17 +346,86 @@ pub fn log(&self, level: tracing::Level, message: String) {
     }
 
     pub fn publish_diagnostics(&self, diagnostics: PublishDiagnosticsParams) {
-        self.notification(CoreNotification::PublishDiagnostics { diagnostics });
+        self.notification(CoreNotification::PublishDiagnostics {
+            diagnostics,
+            stale: false,
+        });
+    }
+
+    pub fn publish_stale_diagnostics(&self, diagnostics: PublishDiagnosticsParams) {
+        self.notification(CoreNotification::PublishDiagnostics {
+            diagnostics,
+            stale: true,
+        });
     }
 
     pub fn work_done_progress(&self, progress: ProgressParams) {
         self.notification(CoreNotification::WorkDoneProgress { progress });
     }
 
+    pub fn partial_semantic_styles(&self, styles: SemanticStyles) {
+        self.notification(CoreNotification::PartialSemanticStyles { styles });
+    }
+
     pub fn show_message(&self, title: String, message: ShowMessageParams) {
         self.notification(CoreNotification::ShowMessage { title, message });
     }
 
+    pub fn show_message_request(
+        &self,
+        title: String,
+        request_id: u64,
+        message: ShowMessageRequestParams,
+    ) {
+        self.notification(CoreNotification::ShowMessageRequest {
+            title,
+            request_id,
+            message,
+        });
+    }
+
+    pub fn code_lens(
+        &self,
+        path: PathBuf,
+        plugin_id: PluginId,
+        lenses: Vec<CodeLens>,
+    ) {
+        self.notification(CoreNotification::CodeLens {
+            path,
+            plugin_id,
+            lenses,
+        });
+    }
+
+    pub fn code_lens_refresh(&self) {
+        self.notification(CoreNotification::CodeLensRefresh);
+    }
+
+    pub fn show_document(&self, params: ShowDocumentParams) {
+        self.notification(CoreNotification::ShowDocument { params });
+    }
+
+    pub fn apply_workspace_edit(
+        &self,
+        request_id: u64,
+        edit: WorkspaceEdit,
+        renamed: Vec<(PathBuf, PathBuf)>,
+    ) {
+        self.notification(CoreNotification::ApplyWorkspaceEdit {
+            request_id,
+            edit,
+            renamed,
+        });
+    }
+
+    pub fn on_type_formatting_triggers(&self, triggers: Vec<String>) {
+        self.notification(CoreNotification::OnTypeFormattingTriggers { triggers });
+    }
+
+    pub fn signature_help_triggers(&self, triggers: Vec<String>) {
+        self.notification(CoreNotification::SignatureHelpTriggers { triggers });
+    }
+
     pub fn log_message(&self, message: LogMessageParams) {
         self.notification(CoreNotification::LogMessage { message });
     }
@@ -5,7 +5,9 @@
     path::{Path, PathBuf},
 };
 
+use anyhow::{anyhow, Result};
 use serde::{Deserialize, Serialize};
+use url::Url;
 
 /// UTF8 line and column-offset
 #[derive(
@@ -48,6 +50,64 @@ pub fn from_path(path: PathBuf, is_dir: bool) -> PathObject {
     }
 }
 
+/// Converts a local path into a `file://` uri, percent-encoding any characters
+/// (spaces, `#`, `%`, ...) that aren't allowed to appear verbatim in a uri.
+///
+/// Relative paths can't be represented by [`Url::from_file_path`], so they are
+/// encoded as-is rather than panicking.
+#[cfg(not(windows))]
+pub fn path_to_uri(path: &Path) -> Url {
+    Url::from_file_path(path).unwrap_or_else(|_| {
+        let mut uri = Url::parse("file:///").unwrap();
+        uri.set_path(&path.to_string_lossy());
+        uri
+    })
+}
+
+/// Converts a local path into a `file://` uri, percent-encoding any characters
+/// (spaces, `#`, `%`, ...) that aren't allowed to appear verbatim in a uri.
+#[cfg(windows)]
+pub fn path_to_uri(path: &Path) -> Url {
+    windows_path_to_uri(&path.to_string_lossy())
+}
+
+/// Builds the uri for a Windows path, producing `file:///C:/...` for drive
+/// paths and `file://server/share/...` for UNC paths. Backslashes become
+/// forward slashes and the drive letter is capitalized, since language servers
+/// tend to compare uris as plain strings.
+#[cfg_attr(not(windows), allow(dead_code))]
+fn windows_path_to_uri(path: &str) -> Url {
+    let path = path.replace('\\', "/");
+    let mut uri = Url::parse("file:///").unwrap();
+
+    if let Some(unc) = path.strip_prefix("//") {
+        let (host, rest) = unc.split_once('/').unwrap_or((unc, ""));
+        if uri.set_host(Some(host)).is_ok() {
+            uri.set_path(rest);
+            return uri;
+        }
+    }
+
+    let path = match path.as_bytes() {
+        [drive, b':', ..] if drive.is_ascii_alphabetic() => {
+            format!("/{}{}", drive.to_ascii_uppercase() as char, &path[1..])
+        }
+        _ => path,
+    };
+    uri.set_path(&path);
+    uri
+}
+
+/// Converts a `file://` uri back into a local path, decoding any
+/// percent-encoded characters.
+pub fn uri_to_path(uri: &Url) -> Result<PathBuf> {
+    if uri.scheme() != "file" {
+        return Err(anyhow!("uri {uri} doesn't use the file scheme"));
+    }
+    uri.to_file_path()
+        .map_err(|_| anyhow!("uri {uri} isn't a valid file path"))
+}
+
 /// Stores the state of any in progress rename of a path.
 ///
 /// The `editor_needs_reset` field is `true` if the rename editor should have its contents reset
@@ -440,3 +500,40 @@ pub fn append_view_slice(
         i
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::windows_path_to_uri;
+
+    #[test]
+    fn test_windows_drive_path_to_uri() {
+        assert_eq!(
+            windows_path_to_uri(r"C:\Users\foo\bar.go").as_str(),
+            "file:///C:/Users/foo/bar.go"
+        );
+        assert_eq!(
+            windows_path_to_uri(r"c:\Users\foo\bar.go").as_str(),
+            "file:///C:/Users/foo/bar.go"
+        );
+        assert_eq!(
+            windows_path_to_uri("C:/Users/foo/bar.go").as_str(),
+            "file:///C:/Users/foo/bar.go"
+        );
+    }
+
+    #[test]
+    fn test_windows_unc_path_to_uri() {
+        assert_eq!(
+            windows_path_to_uri(r"\\server\share\foo\bar.go").as_str(),
+            "file://server/share/foo/bar.go"
+        );
+    }
+
+    #[test]
+    fn test_windows_path_with_spaces_to_uri() {
+        assert_eq!(
+            windows_path_to_uri(r"C:\Program Files\my project\main.go").as_str(),
+            "file:///C:/Program%20Files/my%20project/main.go"
+        );
+    }
+}
@@ -11,11 +11,16 @@
 use indexmap::IndexMap;
 use lapce_xi_rope::RopeDelta;
 use lsp_types::{
-    request::GotoTypeDefinitionResponse, CodeAction, CodeActionResponse,
-    CompletionItem, Diagnostic, DocumentSymbolResponse, GotoDefinitionResponse,
-    Hover, InlayHint, InlineCompletionResponse, InlineCompletionTriggerKind,
-    Location, Position, PrepareRenameResponse, SelectionRange, SymbolInformation,
-    TextDocumentItem, TextEdit, WorkspaceEdit,
+    request::{GotoDeclarationResponse, GotoTypeDefinitionResponse},
+    CallHierarchyIncomingCall, CallHierarchyItem, CallHierarchyOutgoingCall,
+    CodeAction, CodeActionOrCommand, CodeActionResponse, CodeLens, Color,
+    ColorInformation, ColorPresentation, Command, CompletionContext, CompletionItem,
+    Diagnostic, DocumentHighlight, DocumentSymbolResponse, FoldingRange,
+    GotoDefinitionResponse, Hover, InlayHint, InlineCompletionResponse,
+    InlineCompletionTriggerKind, InlineValue, InlineValueContext, Location,
+    MessageActionItem, Moniker, Position, PrepareRenameResponse, Range,
+    SelectionRange, SymbolInformation, SymbolKind, TextDocumentItem, TextEdit,
+    WorkspaceEdit,
 };
 use parking_lot::Mutex;
 use serde::{Deserialize, Serialize};
@@ -23,6 +28,7 @@
 use super::plugin::VoltID;
 use crate::{
     buffer::BufferId,
+    counter::Counter,
     dap_types::{self, DapId, RunDebugConfig, SourceBreakpoint, ThreadId},
     file::{FileNodeItem, PathObject},
     plugin::{PluginId, VoltInfo, VoltMetadata},
@@ -54,6 +60,33 @@ pub struct SearchMatch {
     pub line_content: String,
 }
 
+#[derive(Eq, PartialEq, Hash, Copy, Clone, Debug, Serialize, Deserialize)]
+pub struct RenamePreviewId(pub u64);
+
+impl RenamePreviewId {
+    pub fn next() -> Self {
+        static RENAME_PREVIEW_ID_COUNTER: Counter = Counter::new();
+        Self(RENAME_PREVIEW_ID_COUNTER.next())
+    }
+}
+
+/// A pair of patterns of the lines that start and end a custom folding region,
+/// e.g. `// region` and `// endregion`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct FoldMarker {
+    /// Regex of the line that starts the region
+    pub start: String,
+    /// Regex of the line that ends the region
+    pub end: String,
+}
+
+/// The hover for a single position of a [`ProxyRequest::GetHoverMulti`] request.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct HoverResult {
+    pub position: Position,
+    pub hover: Hover,
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(rename_all = "snake_case")]
 #[serde(tag = "method", content = "params")]
@@ -79,11 +112,22 @@ pub enum ProxyRequest {
         plugin_id: PluginId,
         action_item: Box<CodeAction>,
     },
+    /// Run a command of a code action on the server that offered it. Answered
+    /// with [`ProxyResponse::Success`].
+    ExecuteCommand {
+        plugin_id: PluginId,
+        command: Command,
+    },
     GetHover {
         request_id: usize,
         path: PathBuf,
         position: Position,
     },
+    GetHoverMulti {
+        request_id: usize,
+        path: PathBuf,
+        positions: Vec<Position>,
+    },
     GetSignature {
         buffer_id: BufferId,
         position: Position,
@@ -98,6 +142,7 @@ pub enum ProxyRequest {
     GetReferences {
         path: PathBuf,
         position: Position,
+        include_declaration: bool,
     },
     GetDefinition {
         request_id: usize,
@@ -109,8 +154,32 @@ pub enum ProxyRequest {
         path: PathBuf,
         position: Position,
     },
+    /// The implementations of the interface or method at the position. Servers
+    /// that can't find implementations answer with none rather than an error.
+    GetImplementation {
+        path: PathBuf,
+        position: Position,
+    },
+    /// The occurrences in the document of the symbol at `position`
+    GetDocumentHighlights {
+        path: PathBuf,
+        position: Position,
+    },
+    GetDeclaration {
+        request_id: usize,
+        path: PathBuf,
+        position: Position,
+    },
+    /// The inlay hints in `range`, or in the whole document without one
     GetInlayHints {
         path: PathBuf,
+        #[serde(default)]
+        range: Option<Range>,
+    },
+    GetInlineValues {
+        path: PathBuf,
+        range: Range,
+        context: InlineValueContext,
     },
     GetInlineCompletions {
         path: PathBuf,
@@ -120,20 +189,95 @@ pub enum ProxyRequest {
     GetSemanticTokens {
         path: PathBuf,
     },
+    /// Semantic tokens of only the range, e.g. the visible part of a large
+    /// file. Answered with [`ProxyResponse::GetSemanticTokens`].
+    GetSemanticTokensRange {
+        path: PathBuf,
+        range: Range,
+    },
     PrepareRename {
         path: PathBuf,
         position: Position,
     },
+    PrepareCallHierarchy {
+        path: PathBuf,
+        position: Position,
+    },
+    /// The callers of the `index`th item of the last call hierarchy prepared
+    /// for `path`
+    CallHierarchyIncoming {
+        path: PathBuf,
+        index: usize,
+    },
+    /// The callees of the `index`th item of the last call hierarchy prepared
+    /// for `path`
+    CallHierarchyOutgoing {
+        path: PathBuf,
+        index: usize,
+    },
+    GetMonikers {
+        path: PathBuf,
+        position: Position,
+    },
+    /// The colors written in the document, with their ranges
+    GetDocumentColors {
+        path: PathBuf,
+    },
+    /// The ways the color at `range` can be written, e.g. to pick another
+    /// notation for it
+    GetColorPresentations {
+        path: PathBuf,
+        color: Color,
+        range: Range,
+    },
+    /// The folding ranges of the server, with the regions between the custom
+    /// markers added
+    GetFoldingRanges {
+        path: PathBuf,
+        #[serde(default)]
+        markers: Vec<FoldMarker>,
+    },
+    GetCodeLens {
+        path: PathBuf,
+    },
+    GoToMoniker {
+        request_id: usize,
+        moniker: Moniker,
+    },
     Rename {
         path: PathBuf,
         position: Position,
         new_name: String,
     },
+    /// Compute the edit of a rename without applying it, so that it can be
+    /// shown to the user first. The edit is kept until the next preview.
+    RenamePreview {
+        path: PathBuf,
+        position: Position,
+        new_name: String,
+    },
+    /// Apply the edit of the last rename preview, answered with a
+    /// [`ProxyResponse::Rename`].
+    ConfirmRename {
+        preview_id: RenamePreviewId,
+    },
     GetCodeActions {
         path: PathBuf,
         position: Position,
         diagnostics: Vec<Diagnostic>,
     },
+    GetQuickFixes {
+        path: PathBuf,
+        position: Position,
+        diagnostics: Vec<Diagnostic>,
+    },
+    /// The actions that fix all the `diagnostics` of the document at once,
+    /// which share their source and code. Answered with
+    /// [`ProxyResponse::GetQuickFixesResponse`].
+    GetFixAllActions {
+        path: PathBuf,
+        diagnostics: Vec<Diagnostic>,
+    },
     GetDocumentSymbols {
         path: PathBuf,
     },
@@ -141,8 +285,78 @@ pub enum ProxyRequest {
         /// The search query
         query: String,
     },
+    /// Workspace symbols of the files under `path` only, e.g. for the symbols of
+    /// the current folder. Answered with [`ProxyResponse::GetWorkspaceSymbols`].
+    GetWorkspaceSymbolsInPath {
+        /// The search query
+        query: String,
+        path: PathBuf,
+    },
+    /// Workspace symbols of the given kinds only, e.g. for the functions named
+    /// `query`. Answered with [`ProxyResponse::GetWorkspaceSymbols`].
+    GetWorkspaceSymbolsByKind {
+        /// The search query
+        query: String,
+        kinds: Vec<SymbolKind>,
+    },
+    /// Workspace symbols grouped by the file they are in, e.g. for a tree of the
+    /// symbols of each file. Answered with
+    /// [`ProxyResponse::GetWorkspaceSymbolsGrouped`].
+    GetWorkspaceSymbolsGrouped {
+        /// The search query
+        query: String,
+    },
+    /// A page of the symbols of the last workspace symbol query, for servers
+    /// that find too many of them to show at once.
+    GetWorkspaceSymbolsPage {
+        offset: usize,
+        limit: usize,
+    },
+    /// The location of a symbol of the last workspace symbol query that the
+    /// server left out the range of until it's picked. Answered with
+    /// [`ProxyResponse::ResolveWorkspaceSymbol`].
+    ResolveWorkspaceSymbol {
+        name: String,
+        kind: SymbolKind,
+        path: PathBuf,
+    },
+    /// Apply text edits to the buffer on the proxy side, to get them trimmed
+    /// down to the text that they change
+    ApplyTextEdits {
+        path: PathBuf,
+        edits: Vec<TextEdit>,
+    },
     GetDocumentFormatting {
         path: PathBuf,
+        /// The size of a tab in spaces
+        tab_size: u32,
+        /// Whether to indent with spaces instead of tabs
+        insert_spaces: bool,
+        /// Comment lines longer than this are wrapped after formatting, `0`
+        /// leaves the edits as the server returned them.
+        max_line_length: usize,
+    },
+    /// The edits formatting only `range`, or the whole document on servers
+    /// that can't format ranges. Answered with
+    /// [`ProxyResponse::GetDocumentFormatting`].
+    GetRangeFormatting {
+        path: PathBuf,
+        range: Range,
+        /// The size of a tab in spaces
+        tab_size: u32,
+        /// Whether to indent with spaces instead of tabs
+        insert_spaces: bool,
+    },
+    /// The edits of the server that reported `ch` as an on type formatting
+    /// trigger, after it was typed before `position`
+    GetOnTypeFormatting {
+        path: PathBuf,
+        position: Position,
+        ch: String,
+        /// The size of a tab in spaces
+        tab_size: u32,
+        /// Whether to indent with spaces instead of tabs
+        insert_spaces: bool,
     },
     GetOpenFilesContent {},
     GetFiles {
@@ -182,6 +396,11 @@ pub enum ProxyRequest {
         from: PathBuf,
         to: PathBuf,
     },
+    /// Create, rename and delete the files of the resource operations of a
+    /// workspace edit
+    ApplyResourceOperations {
+        edit: WorkspaceEdit,
+    },
     TestCreateAtPath {
         path: PathBuf,
     },
@@ -205,6 +424,45 @@ pub enum ProxyNotification {
         plugin_configurations: HashMap<String, HashMap<String, serde_json::Value>>,
         window_id: usize,
         tab_id: usize,
+        /// The local port to serve language server metrics on, `0` if they
+        /// shouldn't be served
+        #[serde(default)]
+        metrics_port: u16,
+        /// The interval in seconds of pinging language servers, `0` if they
+        /// shouldn't be pinged
+        #[serde(default)]
+        lsp_heartbeat_interval: u64,
+        /// Whether the messages exchanged with language servers are logged
+        /// to trace files
+        #[serde(default)]
+        lsp_trace: bool,
+        /// How many seconds the servers of a language may take to start, by
+        /// language id
+        #[serde(default)]
+        lsp_startup_timeouts: HashMap<String, u64>,
+        /// The language server features that are turned on or off, by their
+        /// method
+        #[serde(default)]
+        lsp_features: HashMap<String, bool>,
+        /// The environment variables holding the authentication tokens of the
+        /// servers of a language, by language id
+        #[serde(default)]
+        lsp_auth_token_envs: HashMap<String, String>,
+        /// The settings given to the servers of a language when they ask for
+        /// their configuration, by language id
+        #[serde(default)]
+        lsp_configurations: HashMap<String, serde_json::Value>,
+        /// The files that mark the root folder of a project, by language id
+        #[serde(default)]
+        lsp_root_markers: HashMap<String, Vec<String>>,
+        /// The oldest version of the language servers of a language that's
+        /// known to work, by language id
+        #[serde(default)]
+        lsp_min_versions: HashMap<String, String>,
+        /// The flag the servers of a language print their version with, by
+        /// language id
+        #[serde(default)]
+        lsp_version_flags: HashMap<String, String>,
     },
     OpenFileChanged {
         path: PathBuf,
@@ -218,6 +476,7 @@ pub enum ProxyNotification {
         path: PathBuf,
         input: String,
         position: Position,
+        context: CompletionContext,
     },
     SignatureHelp {
         request_id: usize,
@@ -263,6 +522,18 @@ pub enum ProxyNotification {
     },
     GitDiscardWorkspaceChanges {},
     GitInit {},
+    /// The action the user picked for a message a server showed, `None` if the
+    /// message was dismissed.
+    ShowMessageRequestResponse {
+        request_id: u64,
+        action: Option<MessageActionItem>,
+    },
+    /// Whether all the text edits of a workspace edit a server asked for
+    /// could be applied.
+    ApplyWorkspaceEditResponse {
+        request_id: u64,
+        applied: bool,
+    },
     TerminalWrite {
         term_id: TermId,
         content: String,
@@ -349,6 +620,10 @@ pub enum ProxyResponse {
         request_id: usize,
         hover: Hover,
     },
+    HoverMultiResponse {
+        request_id: usize,
+        results: Vec<HoverResult>,
+    },
     GetDefinitionResponse {
         request_id: usize,
         definition: GotoDefinitionResponse,
@@ -357,6 +632,19 @@ pub enum ProxyResponse {
         request_id: usize,
         definition: GotoTypeDefinitionResponse,
     },
+    GetImplementation {
+        locations: Vec<Location>,
+    },
+    GetDocumentHighlights {
+        highlights: Vec<DocumentHighlight>,
+    },
+    /// `fallback` is set when the server had no declaration, and `declaration`
+    /// holds the definition instead.
+    GetDeclaration {
+        request_id: usize,
+        declaration: GotoDeclarationResponse,
+        fallback: bool,
+    },
     GetReferencesResponse {
         references: Vec<Location>,
     },
@@ -364,24 +652,52 @@ pub enum ProxyResponse {
         plugin_id: PluginId,
         resp: CodeActionResponse,
     },
+    /// The quick fixes of all the servers, with the server that offered each.
+    GetQuickFixesResponse {
+        actions: Vec<(PluginId, CodeActionOrCommand)>,
+    },
     GetFilesResponse {
         items: Vec<PathBuf>,
     },
     GetDocumentFormatting {
         edits: Vec<TextEdit>,
     },
+    GetOnTypeFormatting {
+        edits: Vec<TextEdit>,
+    },
     GetDocumentSymbols {
         resp: DocumentSymbolResponse,
     },
     GetWorkspaceSymbols {
         symbols: Vec<SymbolInformation>,
     },
+    GetWorkspaceSymbolsGrouped {
+        /// The symbols of each file, with the files in the order the servers
+        /// first reported a symbol in them
+        symbols: IndexMap<PathBuf, Vec<SymbolInformation>>,
+    },
+    GetWorkspaceSymbolsPage {
+        symbols: Vec<SymbolInformation>,
+        /// How many symbols the last query found in total
+        total: usize,
+    },
+    ResolveWorkspaceSymbol {
+        /// `None` if the symbol already had a range or couldn't be resolved
+        location: Option<Location>,
+    },
     GetSelectionRange {
         ranges: Vec<SelectionRange>,
+        /// The ranges of each position, flattened from the innermost to the
+        /// outermost so that a selection can be expanded a level at a time
+        #[serde(default)]
+        levels: Vec<Vec<Range>>,
     },
     GetInlayHints {
         hints: Vec<InlayHint>,
     },
+    GetInlineValues {
+        values: Vec<InlineValue>,
+    },
     GetInlineCompletions {
         completions: InlineCompletionResponse,
     },
@@ -391,9 +707,42 @@ pub enum ProxyResponse {
     PrepareRename {
         resp: PrepareRenameResponse,
     },
+    PrepareCallHierarchy {
+        items: Vec<CallHierarchyItem>,
+    },
+    CallHierarchyIncoming {
+        calls: Vec<CallHierarchyIncomingCall>,
+    },
+    CallHierarchyOutgoing {
+        calls: Vec<CallHierarchyOutgoingCall>,
+    },
+    GetMonikers {
+        monikers: Vec<Moniker>,
+    },
+    GetDocumentColors {
+        colors: Vec<ColorInformation>,
+    },
+    GetColorPresentations {
+        presentations: Vec<ColorPresentation>,
+    },
+    GetFoldingRanges {
+        ranges: Vec<FoldingRange>,
+    },
+    GetCodeLens {
+        plugin_id: PluginId,
+        lenses: Vec<CodeLens>,
+    },
+    ApplyTextEdits {
+        rev: u64,
+        edits: Vec<TextEdit>,
+    },
     Rename {
         edit: WorkspaceEdit,
     },
+    RenamePreview {
+        preview_id: RenamePreviewId,
+        edit: WorkspaceEdit,
+    },
     GetOpenFilesContentResponse {
         items: Vec<TextDocumentItem>,
     },
@@ -409,6 +758,17 @@ pub enum ProxyResponse {
     CreatePathResponse {
         path: PathBuf,
     },
+    ApplyResourceOperations {
+        /// The text edits of the workspace edit, moved to the new paths of
+        /// the files renamed after them
+        edit: WorkspaceEdit,
+        /// The files and directories that were renamed, with their new paths
+        renamed: Vec<(PathBuf, PathBuf)>,
+        /// The index of the operation that failed, after which the rest were
+        /// skipped
+        failed_change: Option<u32>,
+        failure_reason: Option<String>,
+    },
     Success {},
     SaveResponse {},
 }
@@ -534,6 +894,24 @@ pub fn git_init(&self) {
         self.notification(ProxyNotification::GitInit {});
     }
 
+    pub fn show_message_request_response(
+        &self,
+        request_id: u64,
+        action: Option<MessageActionItem>,
+    ) {
+        self.notification(ProxyNotification::ShowMessageRequestResponse {
+            request_id,
+            action,
+        });
+    }
+
+    pub fn apply_workspace_edit_response(&self, request_id: u64, applied: bool) {
+        self.notification(ProxyNotification::ApplyWorkspaceEditResponse {
+            request_id,
+            applied,
+        });
+    }
+
     pub fn git_commit(&self, message: String, diffs: Vec<FileDiff>) {
         self.notification(ProxyNotification::GitCommit { message, diffs });
     }
@@ -567,6 +945,7 @@ pub fn shutdown(&self) {
         let _ = self.tx.send(ProxyRpc::Shutdown);
     }
 
+    #[allow(clippy::too_many_arguments)]
     pub fn initialize(
         &self,
         workspace: Option<PathBuf>,
@@ -574,6 +953,16 @@ pub fn initialize(
         plugin_configurations: HashMap<String, HashMap<String, serde_json::Value>>,
         window_id: usize,
         tab_id: usize,
+        metrics_port: u16,
+        lsp_heartbeat_interval: u64,
+        lsp_trace: bool,
+        lsp_startup_timeouts: HashMap<String, u64>,
+        lsp_features: HashMap<String, bool>,
+        lsp_auth_token_envs: HashMap<String, String>,
+        lsp_configurations: HashMap<String, serde_json::Value>,
+        lsp_root_markers: HashMap<String, Vec<String>>,
+        lsp_min_versions: HashMap<String, String>,
+        lsp_version_flags: HashMap<String, String>,
     ) {
         self.notification(ProxyNotification::Initialize {
             workspace,
@@ -581,6 +970,16 @@ pub fn initialize(
             plugin_configurations,
             window_id,
             tab_id,
+            metrics_port,
+            lsp_heartbeat_interval,
+            lsp_trace,
+            lsp_startup_timeouts,
+            lsp_features,
+            lsp_auth_token_envs,
+            lsp_configurations,
+            lsp_root_markers,
+            lsp_min_versions,
+            lsp_version_flags,
         });
     }
 
@@ -590,12 +989,14 @@ pub fn completion(
         path: PathBuf,
         input: String,
         position: Position,
+        context: CompletionContext,
     ) {
         self.notification(ProxyNotification::Completion {
             request_id,
             path,
             input,
             position,
+            context,
         });
     }
 
@@ -681,6 +1082,14 @@ pub fn rename_path(
         self.request_async(ProxyRequest::RenamePath { from, to }, f);
     }
 
+    pub fn apply_resource_operations(
+        &self,
+        edit: WorkspaceEdit,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::ApplyResourceOperations { edit }, f);
+    }
+
     pub fn test_create_at_path(
         &self,
         path: PathBuf,
@@ -793,6 +1202,15 @@ pub fn code_action_resolve(
         );
     }
 
+    pub fn execute_command(
+        &self,
+        command: Command,
+        plugin_id: PluginId,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::ExecuteCommand { plugin_id, command }, f);
+    }
+
     pub fn get_hover(
         &self,
         request_id: usize,
@@ -810,6 +1228,23 @@ pub fn get_hover(
         );
     }
 
+    pub fn get_hover_multi(
+        &self,
+        request_id: usize,
+        path: PathBuf,
+        positions: Vec<Position>,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetHoverMulti {
+                request_id,
+                path,
+                positions,
+            },
+            f,
+        );
+    }
+
     pub fn get_definition(
         &self,
         request_id: usize,
@@ -844,13 +1279,59 @@ pub fn get_type_definition(
         );
     }
 
+    pub fn get_implementation(
+        &self,
+        path: PathBuf,
+        position: Position,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::GetImplementation { path, position }, f);
+    }
+
+    pub fn get_document_highlights(
+        &self,
+        path: PathBuf,
+        position: Position,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetDocumentHighlights { path, position },
+            f,
+        );
+    }
+
+    pub fn get_declaration(
+        &self,
+        request_id: usize,
+        path: PathBuf,
+        position: Position,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetDeclaration {
+                request_id,
+                path,
+                position,
+            },
+            f,
+        );
+    }
+
     pub fn get_references(
         &self,
         path: PathBuf,
         position: Position,
+        include_declaration: bool,
         f: impl ProxyCallback + 'static,
     ) {
-        self.request_async(ProxyRequest::GetReferences { path, position }, f);
+        self.request_async(
+            ProxyRequest::GetReferences {
+                path,
+                position,
+                include_declaration,
+            },
+            f,
+        );
     }
 
     pub fn get_code_actions(
@@ -870,12 +1351,89 @@ pub fn get_code_actions(
         );
     }
 
+    pub fn get_quick_fixes(
+        &self,
+        path: PathBuf,
+        position: Position,
+        diagnostics: Vec<Diagnostic>,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetQuickFixes {
+                path,
+                position,
+                diagnostics,
+            },
+            f,
+        );
+    }
+
+    pub fn get_fix_all_actions(
+        &self,
+        path: PathBuf,
+        diagnostics: Vec<Diagnostic>,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::GetFixAllActions { path, diagnostics }, f);
+    }
+
     pub fn get_document_formatting(
         &self,
         path: PathBuf,
+        tab_size: u32,
+        insert_spaces: bool,
+        max_line_length: usize,
         f: impl ProxyCallback + 'static,
     ) {
-        self.request_async(ProxyRequest::GetDocumentFormatting { path }, f);
+        self.request_async(
+            ProxyRequest::GetDocumentFormatting {
+                path,
+                tab_size,
+                insert_spaces,
+                max_line_length,
+            },
+            f,
+        );
+    }
+
+    pub fn get_range_formatting(
+        &self,
+        path: PathBuf,
+        range: Range,
+        tab_size: u32,
+        insert_spaces: bool,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetRangeFormatting {
+                path,
+                range,
+                tab_size,
+                insert_spaces,
+            },
+            f,
+        );
+    }
+
+    pub fn get_on_type_formatting(
+        &self,
+        path: PathBuf,
+        position: Position,
+        ch: String,
+        tab_size: u32,
+        insert_spaces: bool,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetOnTypeFormatting {
+                path,
+                position,
+                ch,
+                tab_size,
+                insert_spaces,
+            },
+            f,
+        );
     }
 
     pub fn get_semantic_tokens(
@@ -886,6 +1444,15 @@ pub fn get_semantic_tokens(
         self.request_async(ProxyRequest::GetSemanticTokens { path }, f);
     }
 
+    pub fn get_semantic_tokens_range(
+        &self,
+        path: PathBuf,
+        range: Range,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::GetSemanticTokensRange { path, range }, f);
+    }
+
     pub fn get_document_symbols(
         &self,
         path: PathBuf,
@@ -902,6 +1469,63 @@ pub fn get_workspace_symbols(
         self.request_async(ProxyRequest::GetWorkspaceSymbols { query }, f);
     }
 
+    pub fn get_workspace_symbols_in_path(
+        &self,
+        query: String,
+        path: PathBuf,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetWorkspaceSymbolsInPath { query, path },
+            f,
+        );
+    }
+
+    pub fn get_workspace_symbols_by_kind(
+        &self,
+        query: String,
+        kinds: Vec<SymbolKind>,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetWorkspaceSymbolsByKind { query, kinds },
+            f,
+        );
+    }
+
+    pub fn get_workspace_symbols_grouped(
+        &self,
+        query: String,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::GetWorkspaceSymbolsGrouped { query }, f);
+    }
+
+    pub fn get_workspace_symbols_page(
+        &self,
+        offset: usize,
+        limit: usize,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetWorkspaceSymbolsPage { offset, limit },
+            f,
+        );
+    }
+
+    pub fn resolve_workspace_symbol(
+        &self,
+        name: String,
+        kind: SymbolKind,
+        path: PathBuf,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::ResolveWorkspaceSymbol { name, kind, path },
+            f,
+        );
+    }
+
     pub fn prepare_rename(
         &self,
         path: PathBuf,
@@ -911,6 +1535,100 @@ pub fn prepare_rename(
         self.request_async(ProxyRequest::PrepareRename { path, position }, f);
     }
 
+    pub fn prepare_call_hierarchy(
+        &self,
+        path: PathBuf,
+        position: Position,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::PrepareCallHierarchy { path, position }, f);
+    }
+
+    pub fn call_hierarchy_incoming(
+        &self,
+        path: PathBuf,
+        index: usize,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::CallHierarchyIncoming { path, index }, f);
+    }
+
+    pub fn call_hierarchy_outgoing(
+        &self,
+        path: PathBuf,
+        index: usize,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::CallHierarchyOutgoing { path, index }, f);
+    }
+
+    pub fn apply_text_edits(
+        &self,
+        path: PathBuf,
+        edits: Vec<TextEdit>,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::ApplyTextEdits { path, edits }, f);
+    }
+
+    pub fn get_monikers(
+        &self,
+        path: PathBuf,
+        position: Position,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::GetMonikers { path, position }, f);
+    }
+
+    pub fn get_folding_ranges(
+        &self,
+        path: PathBuf,
+        markers: Vec<FoldMarker>,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::GetFoldingRanges { path, markers }, f);
+    }
+
+    pub fn get_document_colors(
+        &self,
+        path: PathBuf,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::GetDocumentColors { path }, f);
+    }
+
+    pub fn get_code_lens(&self, path: PathBuf, f: impl ProxyCallback + 'static) {
+        self.request_async(ProxyRequest::GetCodeLens { path }, f);
+    }
+
+    pub fn get_color_presentations(
+        &self,
+        path: PathBuf,
+        color: Color,
+        range: Range,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetColorPresentations { path, color, range },
+            f,
+        );
+    }
+
+    pub fn go_to_moniker(
+        &self,
+        request_id: usize,
+        moniker: Moniker,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GoToMoniker {
+                request_id,
+                moniker,
+            },
+            f,
+        );
+    }
+
     pub fn git_get_remote_file_url(
         &self,
         file: PathBuf,
@@ -936,8 +1654,55 @@ pub fn rename(
         );
     }
 
-    pub fn get_inlay_hints(&self, path: PathBuf, f: impl ProxyCallback + 'static) {
-        self.request_async(ProxyRequest::GetInlayHints { path }, f);
+    pub fn rename_preview(
+        &self,
+        path: PathBuf,
+        position: Position,
+        new_name: String,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::RenamePreview {
+                path,
+                position,
+                new_name,
+            },
+            f,
+        );
+    }
+
+    pub fn confirm_rename(
+        &self,
+        preview_id: RenamePreviewId,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::ConfirmRename { preview_id }, f);
+    }
+
+    pub fn get_inlay_hints(
+        &self,
+        path: PathBuf,
+        range: Option<Range>,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(ProxyRequest::GetInlayHints { path, range }, f);
+    }
+
+    pub fn get_inline_values(
+        &self,
+        path: PathBuf,
+        range: Range,
+        context: InlineValueContext,
+        f: impl ProxyCallback + 'static,
+    ) {
+        self.request_async(
+            ProxyRequest::GetInlineValues {
+                path,
+                range,
+                context,
+            },
+            f,
+        );
     }
 
     pub fn get_inline_completions(